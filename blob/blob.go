@@ -0,0 +1,238 @@
+// Package blob stores large values in the DHT.  A blob is split into chunks,
+// each stored under the SHA-256 hash of its content, and a manifest that lists
+// them is stored under its own hash, which is the ID of the blob.  Chunks are
+// put and fetched in parallel, and every one is checked against its hash.
+// Blobs with chunks in common, such as versions of a file cut by a
+// ContentDefined chunker, store those once.
+package blob
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/anteater2/bitmesh/dht"
+	"github.com/anteater2/bitmesh/metrics"
+)
+
+// ErrCorrupt is returned for a chunk or a manifest that does not match its hash.
+var ErrCorrupt = errors.New("blob: content does not match its hash")
+
+// Manifest lists the chunks of a blob, in order.
+type Manifest struct {
+	Size   int64
+	Chunks []Chunk
+}
+
+// Chunk is a chunk of a blob.  Hash is the hex SHA-256 hash of its content.
+type Chunk struct {
+	Hash string
+	Size int
+}
+
+// Config holds the optional settings of a store.
+type Config struct {
+	// Chunker splits blobs into chunks.  Defaults to chunks of 256 KiB.
+	Chunker Chunker
+	// Parallelism is the number of chunks put or fetched at once.  Defaults to 8.
+	Parallelism int
+	// Prefix is put before the keys of chunks and manifests.  Defaults to "blob/".
+	Prefix string
+	// Metrics defaults to metrics.Discard.
+	Metrics metrics.Metrics
+}
+
+// Store stores blobs in a DHT.
+type Store struct {
+	dht    *dht.DHT
+	config Config
+}
+
+// New creates a store of blobs in d.
+func New(d *dht.DHT) *Store {
+	return NewWith(d, Config{})
+}
+
+// NewWith creates a store of blobs in d with the given config.
+func NewWith(d *dht.DHT, config Config) *Store {
+	if config.Chunker == nil {
+		config.Chunker = FixedSize(256 << 10)
+	}
+	if config.Parallelism <= 0 {
+		config.Parallelism = 8
+	}
+	if config.Prefix == "" {
+		config.Prefix = "blob/"
+	}
+	config.Metrics = metrics.Or(config.Metrics)
+	return &Store{dht: d, config: config}
+}
+
+// Put stores the content of r, and returns the ID of the blob.
+func (s *Store) Put(r io.Reader) (string, error) {
+	var manifest Manifest
+	var errs []error
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, s.config.Parallelism)
+	err := s.config.Chunker.Split(r, func(data []byte) error {
+		mutex.Lock()
+		failed := len(errs) > 0
+		mutex.Unlock()
+		if failed {
+			return errors.New("blob: a chunk could not be put")
+		}
+		c := Chunk{Hash: hash(data), Size: len(data)}
+		manifest.Chunks = append(manifest.Chunks, c)
+		manifest.Size += int64(c.Size)
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := s.dht.PutBytes(s.chunkKey(c.Hash), data); err != nil {
+				mutex.Lock()
+				errs = append(errs, fmt.Errorf("blob: put chunk %s: %w", c.Hash, err))
+				mutex.Unlock()
+				return
+			}
+			s.config.Metrics.Add("bitmesh_blob_chunks_total", 1, metrics.Label{Name: "op", Value: "put"})
+			s.config.Metrics.Add("bitmesh_blob_bytes_total", float64(c.Size), metrics.Label{Name: "op", Value: "put"})
+		}()
+		return nil
+	})
+	wg.Wait()
+	if len(errs) > 0 {
+		return "", errs[0]
+	}
+	if err != nil {
+		return "", err
+	}
+	// The chunks are all stored before the manifest that points to them.
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	id := hash(data)
+	if err := s.dht.PutBytes(s.manifestKey(id), data); err != nil {
+		return "", fmt.Errorf("blob: put manifest: %w", err)
+	}
+	return id, nil
+}
+
+// Stat returns the manifest of the blob id, or dht.ErrNotFound if there is
+// no such blob.
+func (s *Store) Stat(id string) (Manifest, error) {
+	var manifest Manifest
+	data, err := s.dht.GetBytes(s.manifestKey(id))
+	if err != nil {
+		return manifest, err
+	}
+	if hash(data) != id {
+		s.config.Metrics.Add("bitmesh_blob_corrupt_total", 1)
+		return manifest, fmt.Errorf("%w: manifest %s", ErrCorrupt, id)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("%w: manifest %s: %v", ErrCorrupt, id, err)
+	}
+	return manifest, nil
+}
+
+// Get returns the content of the blob id.
+func (s *Store) Get(id string) ([]byte, error) {
+	manifest, err := s.Stat(id)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Grow(int(manifest.Size))
+	if _, err := s.write(manifest, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteTo writes the content of the blob id to w, and returns the number of
+// bytes written.  At most Parallelism chunks are held in memory at once.
+func (s *Store) WriteTo(id string, w io.Writer) (int64, error) {
+	manifest, err := s.Stat(id)
+	if err != nil {
+		return 0, err
+	}
+	return s.write(manifest, w)
+}
+
+// write fetches the chunks of manifest, Parallelism at a time, and writes
+// them to w in order.
+func (s *Store) write(manifest Manifest, w io.Writer) (int64, error) {
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan struct{})
+	defer close(done)
+	// The fetches start in order, and each hands its result over through its
+	// own channel, so that w gets the chunks in order.
+	results := make(chan chan result, s.config.Parallelism-1)
+	go func() {
+		defer close(results)
+		for _, c := range manifest.Chunks {
+			ch := make(chan result, 1)
+			select {
+			case results <- ch:
+			case <-done:
+				return
+			}
+			go func() {
+				data, err := s.chunk(c)
+				ch <- result{data, err}
+			}()
+		}
+	}()
+	var written int64
+	for ch := range results {
+		r := <-ch
+		if r.err != nil {
+			return written, r.err
+		}
+		n, err := w.Write(r.data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// chunk fetches a chunk and checks it.
+func (s *Store) chunk(c Chunk) ([]byte, error) {
+	data, err := s.dht.GetBytes(s.chunkKey(c.Hash))
+	if err != nil {
+		return nil, fmt.Errorf("blob: get chunk %s: %w", c.Hash, err)
+	}
+	if len(data) != c.Size || hash(data) != c.Hash {
+		s.config.Metrics.Add("bitmesh_blob_corrupt_total", 1)
+		return nil, fmt.Errorf("%w: chunk %s", ErrCorrupt, c.Hash)
+	}
+	s.config.Metrics.Add("bitmesh_blob_chunks_total", 1, metrics.Label{Name: "op", Value: "get"})
+	s.config.Metrics.Add("bitmesh_blob_bytes_total", float64(c.Size), metrics.Label{Name: "op", Value: "get"})
+	return data, nil
+}
+
+func (s *Store) chunkKey(hash string) string {
+	return s.config.Prefix + "chunk/" + hash
+}
+
+func (s *Store) manifestKey(id string) string {
+	return s.config.Prefix + "manifest/" + id
+}
+
+func hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,123 @@
+package blob_test
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/anteater2/bitmesh/blob"
+	"github.com/anteater2/bitmesh/chord/chordtest"
+	"github.com/anteater2/bitmesh/dht"
+)
+
+func random(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// chunks returns the chunks of data cut by chunker.
+func chunks(t *testing.T, chunker blob.Chunker, data []byte) [][]byte {
+	t.Helper()
+	var chunks [][]byte
+	err := chunker.Split(bytes.NewReader(data), func(chunk []byte) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joined := bytes.Join(chunks, nil); !bytes.Equal(joined, data) {
+		t.Fatal("the chunks do not add up to the data")
+	}
+	return chunks
+}
+
+func TestContentDefined(t *testing.T) {
+	const min, avg, max = 1 << 10, 4 << 10, 16 << 10
+	chunker := blob.ContentDefined(min, avg, max)
+	data := random(1<<20, 1)
+	before := chunks(t, chunker, data)
+	for _, c := range before[:len(before)-1] {
+		if len(c) < min || len(c) > max {
+			t.Errorf("chunk of %d bytes", len(c))
+		}
+	}
+	// An insert in the middle only changes the chunks around it.
+	edited := append(append(append([]byte(nil), data[:len(data)/2]...), "inserted"...), data[len(data)/2:]...)
+	seen := make(map[string]bool)
+	for _, c := range before {
+		seen[string(c)] = true
+	}
+	changed := 0
+	for _, c := range chunks(t, chunker, edited) {
+		if !seen[string(c)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("%d of %d chunks changed", changed, len(before))
+	}
+}
+
+func TestPutGet(t *testing.T) {
+	ring, err := chordtest.NewRing(5, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.Stop()
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	d, err := dht.New(ring.Entry(), 0, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	store := blob.NewWith(d, blob.Config{Chunker: blob.FixedSize(64 << 10)})
+	data := random(3<<20+12345, 2)
+	id, err := store.Put(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := store.Stat(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Size != int64(len(data)) || len(manifest.Chunks) != 49 {
+		t.Errorf("manifest of %d bytes in %d chunks", manifest.Size, len(manifest.Chunks))
+	}
+	got, err := store.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("got other data")
+	}
+	var buf bytes.Buffer
+	if n, err := store.WriteTo(id, &buf); err != nil || n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("wrote %d bytes: %v", n, err)
+	}
+
+	// The same content is the same blob.
+	if again, err := store.Put(bytes.NewReader(data)); err != nil || again != id {
+		t.Errorf("put again: %s, %v", again, err)
+	}
+	if _, err := store.Get("missing"); err != dht.ErrNotFound {
+		t.Errorf("get a missing blob: %v", err)
+	}
+
+	// A chunk that does not match its hash is not returned.
+	if err := d.PutBytes("blob/chunk/"+manifest.Chunks[3].Hash, random(64<<10, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(id); !errors.Is(err, blob.ErrCorrupt) {
+		t.Errorf("got a corrupt blob: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package blob
+
+import (
+	"bufio"
+	"io"
+)
+
+// Chunker splits a stream into chunks.
+type Chunker interface {
+	// Split calls chunk with the successive chunks of r, which it may keep,
+	// and stops at the first error.
+	Split(r io.Reader, chunk func([]byte) error) error
+}
+
+type fixedSize int
+
+// FixedSize returns a Chunker that cuts chunks of size bytes, but for the
+// last one.  It panics if size is not positive.
+func FixedSize(size int) Chunker {
+	if size <= 0 {
+		panic("blob: chunk size is not positive")
+	}
+	return fixedSize(size)
+}
+
+func (size fixedSize) Split(r io.Reader, chunk func([]byte) error) error {
+	for {
+		buf := make([]byte, size)
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := chunk(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type contentDefined struct {
+	min, max int
+	mask     uint64
+}
+
+// ContentDefined returns a Chunker that cuts chunks where the content says
+// so, with a rolling hash, so that an insert or a delete only changes the
+// chunks around it and the others are stored once.  Chunks are between min
+// and max bytes long; past min, every byte ends a chunk with a chance of one
+// in avg, rounded down to a power of two.  It panics unless
+// 0 < min <= avg <= max.
+func ContentDefined(min int, avg int, max int) Chunker {
+	if min <= 0 || min > avg || avg > max {
+		panic("blob: chunk sizes out of order")
+	}
+	bits := 0
+	for 1<<(bits+1) <= avg {
+		bits++
+	}
+	// The top bits of the hash depend on the last 64 bytes, the low ones
+	// on fewer.
+	return contentDefined{min: min, max: max, mask: (1<<bits - 1) << (64 - bits)}
+}
+
+func (c contentDefined) Split(r io.Reader, chunk func([]byte) error) error {
+	br := bufio.NewReader(r)
+	buf := make([]byte, 0, c.max)
+	var h uint64
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			if len(buf) > 0 {
+				return chunk(buf)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		buf = append(buf, b)
+		// A gear hash: every byte shifts out of the hash after 64 more.
+		h = h<<1 + gear[b]
+		if (len(buf) >= c.min && h&c.mask == 0) || len(buf) >= c.max {
+			if err := chunk(buf); err != nil {
+				return err
+			}
+			buf = make([]byte, 0, c.max)
+			h = 0
+		}
+	}
+}
+
+// gear maps bytes to random numbers for the rolling hash.  It is fixed, so
+// that every client cuts the same content at the same places.
+var gear [256]uint64
+
+func init() {
+	// splitmix64
+	x := uint64(0x9e3779b97f4a7c15)
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		gear[i] = z ^ z>>31
+	}
+}
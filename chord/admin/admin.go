@@ -0,0 +1,163 @@
+// Package admin serves the HTTP admin API of a chord node.
+//
+//	GET  /status             key, address, neighbours, fingers, uptime and key count
+//	GET  /keys               the entries the node is responsible for
+//	POST /stabilize          runs a round of stabilize and refreshes the fingers
+//	POST /leave              leaves the ring gracefully and stops the node
+//	GET  /metrics            metrics, if a handler is given
+//	GET  /debug/pprof/       the profiles of net/http/pprof
+//
+// HostHandler serves a host of virtual nodes instead:
+//
+//	GET  /vnodes             the status of every virtual node
+//	POST /vnodes?count=N     adds or removes virtual nodes until there are N
+//	POST /move?vnode=I&id=K  moves virtual node I to the keyspace position K
+//	POST /leave              makes every virtual node leave and stops the host
+//	GET  /metrics            metrics, if a handler is given
+//	GET  /debug/pprof/       the profiles of net/http/pprof
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+
+	"github.com/anteater2/bitmesh/chord"
+)
+
+// Status is the JSON document served on /status.
+type Status struct {
+	chord.Status
+	// Uptime is formatted like "1h2m3s".
+	Uptime string
+}
+
+// Entry is an entry of the JSON list served on /keys.
+type Entry struct {
+	Key   string
+	Value []byte // base64 in JSON
+}
+
+// Handler returns the admin API of node.
+// metrics serves /metrics, such as a *metrics.Registry; it may be nil.
+func Handler(node *chord.Node, metrics http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/status", only("GET", func(w http.ResponseWriter, r *http.Request) {
+		status := node.Status()
+		writeJSON(w, http.StatusOK, Status{status, status.Uptime.String()})
+	}))
+	mux.Handle("/keys", only("GET", func(w http.ResponseWriter, r *http.Request) {
+		entries := []Entry{}
+		for _, e := range node.Entries() {
+			entries = append(entries, Entry{e.Key, e.Value})
+		}
+		writeJSON(w, http.StatusOK, entries)
+	}))
+	mux.Handle("/stabilize", only("POST", func(w http.ResponseWriter, r *http.Request) {
+		node.Stabilize()
+		status := node.Status()
+		writeJSON(w, http.StatusOK, Status{status, status.Uptime.String()})
+	}))
+	mux.Handle("/leave", only("POST", func(w http.ResponseWriter, r *http.Request) {
+		if err := node.Leave(); err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"Error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{})
+	}))
+	debug(mux, metrics)
+	return mux
+}
+
+// HostHandler returns the admin API of a host of virtual nodes.
+// metrics serves /metrics, such as a *metrics.Registry; it may be nil.
+func HostHandler(host *chord.Host, metrics http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	vnodes := func(w http.ResponseWriter, code int) {
+		statuses := []Status{}
+		for _, n := range host.Nodes() {
+			status := n.Status()
+			statuses = append(statuses, Status{status, status.Uptime.String()})
+		}
+		writeJSON(w, code, statuses)
+	}
+	mux.Handle("/vnodes", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			vnodes(w, http.StatusOK)
+		case "POST":
+			count, err := strconv.Atoi(r.URL.Query().Get("count"))
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"Error": "count must be a number"})
+				return
+			}
+			if err := host.SetVirtualNodes(count); err != nil {
+				writeJSON(w, http.StatusBadGateway, map[string]string{"Error": err.Error()})
+				return
+			}
+			vnodes(w, http.StatusOK)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"Error": "method not allowed"})
+		}
+	}))
+	mux.Handle("/move", only("POST", func(w http.ResponseWriter, r *http.Request) {
+		i, err := strconv.Atoi(r.URL.Query().Get("vnode"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"Error": "vnode must be a number"})
+			return
+		}
+		id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"Error": "id must be a number"})
+			return
+		}
+		if err := host.Move(i, chord.NewKey(id)); err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"Error": err.Error()})
+			return
+		}
+		vnodes(w, http.StatusOK)
+	}))
+	mux.Handle("/leave", only("POST", func(w http.ResponseWriter, r *http.Request) {
+		if err := host.Leave(); err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"Error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{})
+	}))
+	debug(mux, metrics)
+	return mux
+}
+
+// debug adds /metrics and /debug/pprof/ to mux.
+func debug(mux *http.ServeMux, metrics http.Handler) {
+	if metrics != nil {
+		mux.Handle("/metrics", metrics)
+	}
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// only rejects the requests that do not use method.
+func only(method string, f http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"Error": "method not allowed"})
+			return
+		}
+		f(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,174 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/chord/admin"
+	"github.com/anteater2/bitmesh/chord/chordtest"
+	"github.com/anteater2/bitmesh/dht"
+	"github.com/anteater2/bitmesh/metrics"
+)
+
+func do(t *testing.T, h http.Handler, method string, path string, v interface{}) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %v: %s", method, path, err, w.Body.String())
+		}
+	}
+	return w.Code
+}
+
+func TestAdmin(t *testing.T) {
+	ring, err := chordtest.NewRing(4, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.Stop()
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	entry := ring.Entry()
+	d, err := dht.New(entry, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+	const keys = 100
+	for i := 0; i < keys; i++ {
+		k := fmt.Sprint("key ", i)
+		if err := d.Put(k, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	total := 0
+	for i := 0; i < ring.Size(); i++ {
+		h := admin.Handler(ring.Node(i), nil)
+		var status admin.Status
+		if code := do(t, h, "GET", "/status", &status); code != http.StatusOK {
+			t.Fatalf("GET /status: %d", code)
+		}
+		if status.Key != ring.Node(i).Key() || status.Predecessor == nil || len(status.Successors) != 2 {
+			t.Errorf("node %d: bad status %+v", i, status)
+		}
+		var entries []admin.Entry
+		do(t, h, "GET", "/keys", &entries)
+		if len(entries) != status.Keys {
+			t.Errorf("node %d: %d entries in range, %d stored", i, len(entries), status.Keys)
+		}
+		total += len(entries)
+		if code := do(t, h, "POST", "/stabilize", &status); code != http.StatusOK {
+			t.Errorf("POST /stabilize: %d", code)
+		}
+		if code := do(t, h, "GET", "/metrics", nil); code != http.StatusNotFound {
+			t.Errorf("GET /metrics without metrics: %d", code)
+		}
+		if code := do(t, h, "GET", "/leave", nil); code != http.StatusMethodNotAllowed {
+			t.Errorf("GET /leave: %d", code)
+		}
+	}
+	if total != keys {
+		t.Errorf("%d keys in the ranges of the nodes, expecting %d", total, keys)
+	}
+
+	// Leaving through the API keeps the keys in the ring.
+	leaving := 0
+	if ring.Node(leaving).Address() == entry {
+		leaving = 1
+	}
+	if code := do(t, admin.Handler(ring.Node(leaving), nil), "POST", "/leave", &struct{}{}); code != http.StatusOK {
+		t.Fatalf("POST /leave: %d", code)
+	}
+	ring.Kill(leaving)
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < keys; i++ {
+		k := fmt.Sprint("key ", i)
+		if v, err := d.Get(k); err != nil || v != k {
+			t.Errorf("get %q after leave: %q, %v", k, v, err)
+		}
+	}
+}
+
+func TestMetricsAndPprof(t *testing.T) {
+	ring, err := chordtest.NewRing(1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.Stop()
+	registry := metrics.NewRegistry()
+	registry.Set("up", 1)
+	h := admin.Handler(ring.Node(0), registry)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "up 1") {
+		t.Errorf("GET /metrics: %d %q", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("GET /debug/pprof/: %d", w.Code)
+	}
+}
+
+func TestHostHandler(t *testing.T) {
+	host, err := chord.NewHost(chord.Config{Addr: "127.0.0.1", Bits: 10, VirtualNodes: 2, StabilizeInterval: chordtest.StabilizeInterval})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := host.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer host.Stop()
+	h := admin.HostHandler(host, nil)
+
+	var statuses []admin.Status
+	if code := do(t, h, "GET", "/vnodes", &statuses); code != http.StatusOK || len(statuses) != 2 {
+		t.Fatalf("GET /vnodes: %d, %d virtual nodes", code, len(statuses))
+	}
+	if code := do(t, h, "POST", "/vnodes?count=3", &statuses); code != http.StatusOK || len(statuses) != 3 {
+		t.Fatalf("POST /vnodes?count=3: %d, %d virtual nodes", code, len(statuses))
+	}
+	if len(host.Nodes()) != 3 {
+		t.Errorf("%d virtual nodes after POST /vnodes?count=3", len(host.Nodes()))
+	}
+	if code := do(t, h, "POST", "/vnodes?count=x", nil); code != http.StatusBadRequest {
+		t.Errorf("POST /vnodes?count=x: %d", code)
+	}
+	if code := do(t, h, "POST", "/vnodes?count=0", nil); code != http.StatusBadGateway {
+		t.Errorf("POST /vnodes?count=0: %d", code)
+	}
+	if code := do(t, h, "POST", "/move?vnode=1&id=7", &statuses); code != http.StatusOK || statuses[1].Key != 7 {
+		t.Errorf("POST /move?vnode=1&id=7: %d, %+v", code, statuses)
+	}
+	if code := do(t, h, "POST", "/move?vnode=1&id=x", nil); code != http.StatusBadRequest {
+		t.Errorf("POST /move?vnode=1&id=x: %d", code)
+	}
+	if code := do(t, h, "POST", "/move?vnode=9&id=8", nil); code != http.StatusBadGateway {
+		t.Errorf("POST /move?vnode=9&id=8: %d", code)
+	}
+	if code := do(t, h, "DELETE", "/vnodes", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE /vnodes: %d", code)
+	}
+	if code := do(t, h, "POST", "/leave", &struct{}{}); code != http.StatusOK {
+		t.Fatalf("POST /leave: %d", code)
+	}
+	if len(host.Nodes()) != 0 {
+		t.Errorf("%d virtual nodes after POST /leave", len(host.Nodes()))
+	}
+}
@@ -0,0 +1,163 @@
+// Package balance moves the virtual nodes of a host into the arcs of heavily
+// loaded nodes, like the item balancing of Karger and Ruhl.
+//
+// Every interval, a virtual node compares its load with that of the node
+// owning a random key.  If that node holds more than Threshold times as much,
+// the virtual node leaves the ring, handing its keys over to its successor,
+// and joins it again at the position that takes half of the keys of the
+// other node.  At most one virtual node of the host moves per round.
+package balance
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/logging"
+	"github.com/anteater2/bitmesh/metrics"
+	"github.com/anteater2/bitmesh/rpc"
+)
+
+// Config holds the optional settings of a balancer.
+type Config struct {
+	// Interval is the pause between two rounds.  Defaults to thirty seconds.
+	Interval time.Duration
+	// Threshold is how many times the load of a virtual node the load of
+	// another node must be for the virtual node to move.  Defaults to four.
+	Threshold float64
+	// Bytes compares the size of the values instead of the number of keys.
+	Bytes bool
+	// Metrics defaults to metrics.Discard.  It is shared with the rpc and message layers.
+	Metrics metrics.Metrics
+	// Logger defaults to slog.Default().  It is shared with the rpc and message layers.
+	Logger logging.Logger
+}
+
+// Balancer balances the load of the virtual nodes of a host.
+type Balancer struct {
+	host   *chord.Host
+	config Config
+	caller *chord.NodeCaller
+
+	quit     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// New creates a balancer of host, which receives its replies on port.
+func New(host *chord.Host, port uint16) (*Balancer, error) {
+	return NewWith(host, port, Config{})
+}
+
+// NewWith creates a balancer of host with the given config.
+func NewWith(host *chord.Host, port uint16, config Config) (*Balancer, error) {
+	if config.Interval == 0 {
+		config.Interval = 30 * time.Second
+	}
+	if config.Threshold == 0 {
+		config.Threshold = 4
+	}
+	config.Metrics = metrics.Or(config.Metrics)
+	config.Logger = logging.Or(config.Logger)
+	caller, err := chord.NewNodeCallerWith(port, rpc.Config{
+		Transport: host.Transport(),
+		Clock:     host.Clock(),
+		Metrics:   config.Metrics,
+		Logger:    config.Logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Balancer{host: host, config: config, caller: caller, quit: make(chan struct{})}, nil
+}
+
+// Start starts balancing every interval.
+func (b *Balancer) Start() error {
+	if err := b.caller.Start(); err != nil {
+		return err
+	}
+	b.wg.Add(1)
+	go b.loop()
+	return nil
+}
+
+// Stop stops the balancer.  The host keeps running.
+func (b *Balancer) Stop() {
+	b.stopOnce.Do(func() {
+		close(b.quit)
+		b.wg.Wait()
+		b.caller.Stop()
+	})
+}
+
+func (b *Balancer) loop() {
+	defer b.wg.Done()
+	for {
+		select {
+		case <-b.quit:
+			return
+		case <-b.host.Clock().After(b.config.Interval):
+		}
+		if _, err := b.Balance(); err != nil {
+			b.config.Logger.Warn("could not balance", "error", err)
+		}
+	}
+}
+
+// Balance runs a round: every virtual node probes the owner of a random key,
+// until one of them moves.  It returns true if one did.
+func (b *Balancer) Balance() (bool, error) {
+	nodes := b.host.Nodes()
+	local := make(map[string]bool)
+	for _, n := range nodes {
+		local[n.Address()] = true
+	}
+	for i, n := range nodes {
+		key := chord.NewKey(rand.Uint64() % n.MaxKey())
+		peer, err := b.caller.FindSuccessor(n.Address(), key)
+		if err != nil {
+			b.config.Metrics.Add("bitmesh_balance_probes_total", 1, outcome("failed"))
+			return false, err
+		}
+		if local[peer.Address] {
+			b.config.Metrics.Add("bitmesh_balance_probes_total", 1, outcome("local"))
+			continue
+		}
+		load, err := b.caller.GetLoad(peer.Address)
+		if err != nil {
+			b.config.Metrics.Add("bitmesh_balance_probes_total", 1, outcome("failed"))
+			return false, err
+		}
+		mine := n.Load()
+		split := load.Split
+		if b.config.Bytes {
+			split = load.SplitBytes
+		}
+		if b.weight(load) <= b.config.Threshold*b.weight(mine) || split == peer.Key {
+			b.config.Metrics.Add("bitmesh_balance_probes_total", 1, outcome("balanced"))
+			continue
+		}
+		b.config.Metrics.Add("bitmesh_balance_probes_total", 1, outcome("move"))
+		b.config.Logger.Info("moving into the arc of a loaded node",
+			"vnode", i, "node", n.Key(), "peer", peer.Address, "to", split, "keys", mine.Keys, "peer_keys", load.Keys)
+		if err := b.host.Move(i, split); err != nil {
+			return false, err
+		}
+		b.config.Metrics.Add("bitmesh_balance_moves_total", 1)
+		return true, nil
+	}
+	return false, nil
+}
+
+// weight returns the load the balancer compares.
+func (b *Balancer) weight(load chord.Load) float64 {
+	if b.config.Bytes {
+		return float64(load.KeyBytes)
+	}
+	return float64(load.Keys)
+}
+
+func outcome(o string) metrics.Label {
+	return metrics.Label{Name: "outcome", Value: o}
+}
@@ -0,0 +1,185 @@
+package balance_test
+
+import (
+	"fmt"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/chord/balance"
+	"github.com/anteater2/bitmesh/chord/chordtest"
+	"github.com/anteater2/bitmesh/chord/crawl"
+	"github.com/anteater2/bitmesh/dht"
+	"github.com/anteater2/bitmesh/rpc"
+	"github.com/anteater2/bitmesh/sim"
+)
+
+func TestBalance(t *testing.T) {
+	const bits = 10
+	newHost := func(id chord.Key) *chord.Host {
+		host, err := chord.NewHost(chord.Config{Addr: "127.0.0.1", Bits: bits, IDs: []chord.Key{id}, StabilizeInterval: chordtest.StabilizeInterval})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := host.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if key := host.Nodes()[0].Key(); key != id {
+			t.Fatalf("node at %d, expecting %d", key, id)
+		}
+		return host
+	}
+	// The light node owns (10, 20], the heavy one the rest of the ring.
+	heavy := newHost(10)
+	defer heavy.Stop()
+	light := newHost(20)
+	defer light.Stop()
+	if err := light.Join(heavy.Address()); err != nil {
+		t.Fatal(err)
+	}
+	caller, err := chord.NewNodeCaller(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := caller.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Stop()
+	waitConverged := func() {
+		t.Helper()
+		deadline := time.Now().Add(30 * time.Second)
+		for {
+			r, err := crawl.Crawl(caller, heavy.Address(), bits)
+			if err == nil && r.OK() && r.Closed && len(r.Nodes) == 2 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("ring did not converge: %v %+v", err, r)
+			}
+			time.Sleep(chordtest.StabilizeInterval)
+		}
+	}
+	waitConverged()
+
+	d, err := dht.New(heavy.Address(), 0, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+	const keys = 200
+	for i := 0; i < keys; i++ {
+		k := fmt.Sprint("key ", i)
+		if err := d.Put(k, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := light.Nodes()[0].Load()
+	if 4*before.Keys >= keys {
+		t.Fatalf("light node holds %d of %d keys", before.Keys, keys)
+	}
+
+	b, err := balance.New(light, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+	// The probes may land on the light node itself.
+	for moved := false; !moved; {
+		if moved, err = b.Balance(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitConverged()
+	after := light.Nodes()[0].Load()
+	if after.Keys < keys/2-1 || after.Keys > keys/2+1 {
+		t.Errorf("light node holds %d of %d keys after moving to %d", after.Keys, keys, light.Nodes()[0].Key())
+	}
+	for i := 0; i < 10; i++ {
+		if moved, err := b.Balance(); err != nil || moved {
+			t.Fatalf("moved again: %v, %v", moved, err)
+		}
+	}
+	for i := 0; i < keys; i++ {
+		k := fmt.Sprint("key ", i)
+		if v, err := d.Get(k); err != nil || v != k {
+			t.Errorf("get %q: %q, %v", k, v, err)
+		}
+	}
+	if err := light.Move(0, heavy.Nodes()[0].Key()); err == nil {
+		t.Error("moved onto a taken position")
+	}
+}
+
+func TestSim(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		network := sim.New(sim.Config{Seed: 1, MinLatency: time.Millisecond, MaxLatency: 10 * time.Millisecond})
+		defer network.Close()
+		const bits = 10
+		newHost := func(ip string, id chord.Key) *chord.Host {
+			host, err := chord.NewHost(chord.Config{
+				Addr:      ip,
+				Bits:      bits,
+				IDs:       []chord.Key{id},
+				Transport: network.Host(ip),
+				Clock:     network,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := host.Start(); err != nil {
+				t.Fatal(err)
+			}
+			return host
+		}
+		heavy := newHost("10.0.0.1", 10)
+		defer heavy.Stop()
+		light := newHost("10.0.0.2", 20)
+		defer light.Stop()
+		if err := light.Join(heavy.Address()); err != nil {
+			t.Fatal(err)
+		}
+		caller, err := chord.NewNodeCallerWith(0, rpc.Config{Transport: network.Host("10.0.0.9"), Clock: network})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := caller.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer caller.Stop()
+		<-network.After(10 * time.Second)
+		const keys = 100
+		for i := 0; i < keys; i++ {
+			k := fmt.Sprint("key ", i)
+			owner, err := caller.FindSuccessor(heavy.Address(), chord.Hash(k, 1<<bits))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := caller.Put(owner.Address, k, []byte(k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The balancer probes on the simulated network, every interval of its clock.
+		b, err := balance.NewWith(light, 0, balance.Config{Interval: time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer b.Stop()
+		for light.Nodes()[0].Key() == 20 {
+			if network.Now().After(sim.Epoch.Add(time.Hour)) {
+				t.Fatal("the light node did not move")
+			}
+			<-network.After(time.Second)
+		}
+	})
+}
@@ -0,0 +1,309 @@
+// Package chordtest runs whole chord rings inside a single process.
+// Nodes either listen on ephemeral ports and advertise loopback addresses,
+// or run on a simulated network (see package sim), so tests need neither
+// docker nor fixed ports.
+package chordtest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/clock"
+	"github.com/anteater2/bitmesh/sim"
+)
+
+// StabilizeInterval is the stabilize interval of the nodes of a Ring on loopback,
+// unless the config of the ring sets one.
+// It is much shorter than the default so rings converge quickly.
+// Simulated rings keep the default, since their time is virtual anyway.
+var StabilizeInterval = 10 * time.Millisecond
+
+// Ring is a set of chord nodes running in this process.
+// Nodes are numbered in the order they were added; a killed node keeps its number.
+type Ring struct {
+	bits    uint64
+	config  chord.Config // the settings of every node, but its address and ports
+	network *sim.Network // nil on loopback
+	clock   clock.Clock
+	hosts   int // number of simulated hosts handed out
+
+	nodes []*chord.Node // nil if the node has been killed
+	addrs []string      // so that killed nodes can restart at the same position
+	mutex sync.Mutex
+}
+
+// NewRing starts size nodes with a keyspace of 2^bits on loopback
+// and joins them into one ring.
+// The ring may not have converged yet when NewRing returns; see WaitConverged.
+func NewRing(size int, bits uint64) (*Ring, error) {
+	return NewRingWith(size, bits, chord.Config{})
+}
+
+// NewRingWith is like NewRing, with the other settings of the nodes, such as
+// Replicas, taken from config.
+func NewRingWith(size int, bits uint64, config chord.Config) (*Ring, error) {
+	return newRing(size, &Ring{bits: bits, config: config, clock: clock.Real})
+}
+
+// NewSimRing is like NewRing, but the nodes run on the simulated network
+// and its clock.  Every node gets a host of its own.
+func NewSimRing(size int, bits uint64, network *sim.Network) (*Ring, error) {
+	return NewSimRingWith(size, bits, network, chord.Config{})
+}
+
+// NewSimRingWith is like NewSimRing, with the other settings of the nodes
+// taken from config, as with NewRingWith.
+func NewSimRingWith(size int, bits uint64, network *sim.Network, config chord.Config) (*Ring, error) {
+	return newRing(size, &Ring{bits: bits, config: config, network: network, clock: network})
+}
+
+func newRing(size int, r *Ring) (*Ring, error) {
+	for i := 0; i < size; i++ {
+		_, err := r.Add()
+		if err != nil {
+			r.Stop()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Add starts a new node and joins it to the ring.  It returns the number of the node.
+func (r *Ring) Add() (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	// Addresses are picked blindly, so a node may land on a position
+	// that is already taken. Just try another one.
+	for attempt := 0; attempt < 10; attempt++ {
+		node, err := r.start(r.newAddr())
+		if err == errTaken {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.nodes = append(r.nodes, node)
+		r.addrs = append(r.addrs, node.Address())
+		return len(r.nodes) - 1, nil
+	}
+	return 0, errors.New("chordtest: no free keyspace position left")
+}
+
+var errTaken = errors.New("chordtest: keyspace position taken")
+
+// newAddr returns an address for a new node.
+// The caller must hold the mutex.
+func (r *Ring) newAddr() string {
+	if r.network == nil {
+		return "127.0.0.1:0"
+	}
+	r.hosts++
+	return fmt.Sprintf("10.0.%d.%d:2001", r.hosts/256, r.hosts%256)
+}
+
+// start starts a node at addr and joins it to any live node.
+// The caller must hold the mutex.
+func (r *Ring) start(addr string) (*chord.Node, error) {
+	ip, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	calleePort, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	config := r.config
+	config.Addr = ip
+	config.CalleePort = uint16(calleePort)
+	config.CallerPort = 0
+	config.Bits = r.bits
+	if r.network != nil {
+		config.Transport = r.network.Host(ip)
+		config.Clock = r.network
+	} else if config.StabilizeInterval == 0 {
+		config.StabilizeInterval = StabilizeInterval
+	}
+	node, err := chord.NewNode(config)
+	if err != nil {
+		return nil, err
+	}
+	err = node.Start()
+	if err != nil {
+		return nil, err
+	}
+	var entry *chord.Node
+	for _, n := range r.nodes {
+		if n == nil {
+			continue
+		}
+		if n.Key() == node.Key() {
+			node.Stop()
+			return nil, errTaken
+		}
+		entry = n
+	}
+	if entry != nil {
+		err = node.Join(entry.Address())
+		if err != nil {
+			node.Stop()
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// Kill stops node i without letting the rest of the ring know.
+func (r *Ring) Kill(i int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.nodes[i] != nil {
+		r.nodes[i].Stop()
+		r.nodes[i] = nil
+	}
+}
+
+// Leave makes node i leave the ring gracefully.  Like a killed node, it can be restarted.
+func (r *Ring) Leave(i int) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.nodes[i] == nil {
+		return fmt.Errorf("chordtest: node %d is not running", i)
+	}
+	if err := r.nodes[i].Leave(); err != nil {
+		return err
+	}
+	r.nodes[i] = nil
+	return nil
+}
+
+// Restart starts the killed node i again at its old address, and thus at its old position.
+// The data it held before it was killed is lost.
+func (r *Ring) Restart(i int) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.nodes[i] != nil {
+		return fmt.Errorf("chordtest: node %d is running", i)
+	}
+	node, err := r.start(r.addrs[i])
+	if err != nil {
+		return err
+	}
+	r.nodes[i] = node
+	return nil
+}
+
+// Node returns node i, or nil if it has been killed.
+func (r *Ring) Node(i int) *chord.Node {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.nodes[i]
+}
+
+// Size returns the number of nodes ever added to the ring, dead or alive.
+func (r *Ring) Size() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.nodes)
+}
+
+// Live returns the running nodes, sorted by key.
+func (r *Ring) Live() []*chord.Node {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	live := []*chord.Node{}
+	for _, n := range r.nodes {
+		if n != nil {
+			live = append(live, n)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].Key() < live[j].Key() })
+	return live
+}
+
+// Entry returns the address of a running node, to be used as an introducer
+// or by a client.  It returns "" if every node has been killed.
+func (r *Ring) Entry() string {
+	live := r.Live()
+	if len(live) == 0 {
+		return ""
+	}
+	return live[0].Address()
+}
+
+// Stop stops all the nodes.
+func (r *Ring) Stop() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, n := range r.nodes {
+		if n != nil {
+			n.Stop()
+			r.nodes[i] = nil
+		}
+	}
+}
+
+// Check verifies the invariants of a converged ring on the running nodes:
+// every node points to the next node on the ring as its successor and to the
+// previous one as its predecessor, and finger i of node n is successor(n+2^i).
+// It returns an error describing the first violation.
+func (r *Ring) Check() error {
+	live := r.Live()
+	if len(live) == 0 {
+		return errors.New("chordtest: no running node")
+	}
+	maxKey := uint64(1) << r.bits
+	for i, n := range live {
+		next := live[(i+1)%len(live)]
+		prev := live[(i+len(live)-1)%len(live)]
+		if succ := n.Successor(); succ.Address != next.Address() {
+			return fmt.Errorf("node %d: successor is %d, expecting %d", n.Key(), succ.Key, next.Key())
+		}
+		pred := n.Predecessor()
+		if pred == nil {
+			return fmt.Errorf("node %d: no predecessor, expecting %d", n.Key(), prev.Key())
+		}
+		if pred.Address != prev.Address() {
+			return fmt.Errorf("node %d: predecessor is %d, expecting %d", n.Key(), pred.Key, prev.Key())
+		}
+		for j, finger := range n.Fingers() {
+			target := chord.Key((uint64(n.Key()) + 1<<uint(j)) % maxKey)
+			if want := successor(live, target); finger.Address != want.Address() {
+				return fmt.Errorf("node %d: finger %d is %d, expecting %d", n.Key(), j, finger.Key, want.Key())
+			}
+		}
+	}
+	return nil
+}
+
+// WaitConverged polls Check until it passes or the timeout expires,
+// in which case it returns the last violation.
+// Simulated rings measure the timeout in virtual time.
+func (r *Ring) WaitConverged(timeout time.Duration) error {
+	deadline := r.clock.Now().Add(timeout)
+	for {
+		err := r.Check()
+		if err == nil {
+			return nil
+		}
+		if r.clock.Now().After(deadline) {
+			return fmt.Errorf("chordtest: ring did not converge in %v: %v", timeout, err)
+		}
+		<-r.clock.After(StabilizeInterval)
+	}
+}
+
+// successor returns the first node of live, which is sorted by key, at or after key.
+func successor(live []*chord.Node, key chord.Key) *chord.Node {
+	for _, n := range live {
+		if n.Key() >= key {
+			return n
+		}
+	}
+	return live[0]
+}
@@ -0,0 +1,367 @@
+package chordtest_test
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/chord/chordtest"
+	"github.com/anteater2/bitmesh/chord/crawl"
+	"github.com/anteater2/bitmesh/dht"
+	"github.com/anteater2/bitmesh/sim"
+)
+
+func TestKillRestart(t *testing.T) {
+	ring, err := chordtest.NewRing(5, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.Stop()
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	ring.Kill(2)
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatalf("after kill: %v", err)
+	}
+	if n := len(ring.Live()); n != 4 {
+		t.Fatalf("%d nodes alive, expecting 4", n)
+	}
+
+	if err := ring.Restart(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatalf("after restart: %v", err)
+	}
+}
+
+// simRing runs a ring of 5 nodes on a network made from seed, kills a node,
+// and returns the trace of the messages and of the successors of the nodes.
+func simRing(t *testing.T, seed int64) string {
+	var trace strings.Builder
+	synctest.Test(t, func(t *testing.T) {
+		network := sim.New(sim.Config{
+			Seed:          seed,
+			MinLatency:    time.Millisecond,
+			MaxLatency:    20 * time.Millisecond,
+			LossRate:      0.01,
+			DuplicateRate: 0.01,
+			ReorderRate:   0.05,
+			Trace: func(at time.Time, from string, to string, data []byte) {
+				fmt.Fprintf(&trace, "%v %s>%s %x\n", at.Sub(sim.Epoch), from, to, sha256.Sum256(data))
+			},
+		})
+		defer network.Close()
+		ring, err := chordtest.NewSimRingWith(5, 16, network, chord.Config{Replicas: 2})
+		if err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		defer ring.Stop()
+		if err := ring.WaitConverged(5 * time.Minute); err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+
+		ring.Kill(3)
+		if err := ring.WaitConverged(5 * time.Minute); err != nil {
+			t.Fatalf("seed %d: after kill: %v", seed, err)
+		}
+		fmt.Fprintf(&trace, "converged at %v\n", network.Now().Sub(sim.Epoch))
+		for _, n := range ring.Live() {
+			fmt.Fprintf(&trace, "%d -> %d\n", n.Key(), n.Successor().Key)
+		}
+	})
+	return trace.String()
+}
+
+func TestSimRing(t *testing.T) {
+	simRing(t, 1)
+	// The killed node is both the successor and the double successor of
+	// another one, which has to fall back to a finger.
+	simRing(t, 11)
+}
+
+func TestSimReplay(t *testing.T) {
+	first := simRing(t, 7)
+	if second := simRing(t, 7); first != second {
+		t.Fatalf("same seed, different traces:\n%s", diff(first, second))
+	}
+	if other := simRing(t, 8); first == other {
+		t.Fatal("different seeds, same trace")
+	}
+}
+
+// diff returns the first line where two traces differ, with its number.
+func diff(a string, b string) string {
+	as, bs := strings.Split(a, "\n"), strings.Split(b, "\n")
+	for i := range as {
+		if i >= len(bs) || as[i] != bs[i] {
+			other := ""
+			if i < len(bs) {
+				other = bs[i]
+			}
+			return fmt.Sprintf("line %d of %d: %q\nline %d of %d: %q", i, len(as), as[i], i, len(bs), other)
+		}
+	}
+	return fmt.Sprintf("%d lines, then %d", len(as), len(bs))
+}
+
+func TestJoinAny(t *testing.T) {
+	ring, err := chordtest.NewRing(2, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.Stop()
+	node, err := chord.NewNode(chord.Config{Addr: "127.0.0.1", Bits: 16, StabilizeInterval: chordtest.StabilizeInterval})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer node.Stop()
+
+	if err := node.JoinAny([]string{"127.0.0.1:1", "127.0.0.1:2"}); err == nil {
+		t.Fatal("joined through dead seeds")
+	}
+	if err := node.JoinAny([]string{"127.0.0.1:1", ring.Entry()}); err != nil {
+		t.Fatal(err)
+	}
+	if node.Successor().Address == node.Address() {
+		t.Error("still alone after joining")
+	}
+}
+
+func TestHost(t *testing.T) {
+	const bits = 16
+	newHost := func(vnodes int) *chord.Host {
+		host, err := chord.NewHost(chord.Config{Addr: "127.0.0.1", Bits: bits, VirtualNodes: vnodes, StabilizeInterval: chordtest.StabilizeInterval})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := host.Start(); err != nil {
+			t.Fatal(err)
+		}
+		return host
+	}
+	newClient := func(host *chord.Host) *dht.DHT {
+		d, err := dht.New(host.Address(), 0, bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Start(); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	const keys, early = 200, 50
+	// The virtual nodes of a host that just started are still finding each other.
+	put := func(d *dht.DHT, from int, to int) {
+		deadline := time.Now().Add(30 * time.Second)
+		for i := from; i < to; i++ {
+			k := fmt.Sprint("key ", i)
+			for err := d.Put(k, k); err != nil; err = d.Put(k, k) {
+				if time.Now().After(deadline) {
+					t.Fatal(err)
+				}
+				time.Sleep(chordtest.StabilizeInterval)
+			}
+		}
+	}
+	small := newHost(2)
+	defer small.Stop()
+	big := newHost(6)
+	defer big.Stop()
+	// The keys of a host on its own ring go along when it joins another.
+	alone := newClient(big)
+	put(alone, 0, early)
+	alone.Stop()
+	if err := big.Join(small.Address()); err != nil {
+		t.Fatal(err)
+	}
+
+	caller, err := chord.NewNodeCaller(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := caller.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Stop()
+	waitConverged := func(nodes int) {
+		t.Helper()
+		deadline := time.Now().Add(30 * time.Second)
+		for {
+			r, err := crawl.Crawl(caller, small.Address(), bits)
+			if err == nil && r.OK() && r.Closed && len(r.Nodes) == nodes {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("ring did not converge to %d nodes: %v %+v", nodes, err, r)
+			}
+			time.Sleep(chordtest.StabilizeInterval)
+		}
+	}
+	waitConverged(8)
+
+	d := newClient(small)
+	defer d.Stop()
+	put(d, early, keys)
+	check := func() {
+		t.Helper()
+		for i := 0; i < keys; i++ {
+			k := fmt.Sprint("key ", i)
+			if v, err := d.Get(k); err != nil || v != k {
+				t.Errorf("get %q: %q, %v", k, v, err)
+			}
+		}
+		stored := 0
+		for _, host := range []*chord.Host{small, big} {
+			for _, n := range host.Nodes() {
+				stored += len(n.Entries())
+			}
+		}
+		if stored != keys {
+			t.Errorf("%d keys stored, expecting %d", stored, keys)
+		}
+	}
+	check()
+
+	// The keys move to new virtual nodes and away from removed ones.
+	if err := small.SetVirtualNodes(4); err != nil {
+		t.Fatal(err)
+	}
+	// Leaving nodes hand their keys to their successor, which must be up to date.
+	waitConverged(10)
+	check()
+	if err := big.SetVirtualNodes(3); err != nil {
+		t.Fatal(err)
+	}
+	waitConverged(7)
+	if n := len(big.Nodes()); n != 3 {
+		t.Errorf("%d virtual nodes, expecting 3", n)
+	}
+	check()
+
+	if err := small.SetVirtualNodes(0); err == nil {
+		t.Error("removed every virtual node")
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	const bits, keys = 16, 100
+	ring, err := chordtest.NewRingWith(5, bits, chord.Config{Replicas: 3, AntiEntropyInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.Stop()
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	entry := ring.Entry()
+	d, err := dht.New(entry, 0, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+	for i := 0; i < keys; i++ {
+		k := fmt.Sprint("key ", i)
+		if err := d.Put(k, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	caller, err := chord.NewNodeCaller(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := caller.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Stop()
+	// copies returns the number of nodes that store k, not counting tombstones.
+	copies := func(k string) int {
+		count := 0
+		for _, n := range ring.Live() {
+			entries, err := caller.GetEntries(n.Address(), []string{k})
+			if err == nil && len(entries) == 1 && !entries[0].Deleted {
+				count++
+			}
+		}
+		return count
+	}
+	waitFor := func(what string, ok func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(30 * time.Second)
+		for !ok() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	waitFor("three copies of every key", func() bool {
+		for i := 0; i < keys; i++ {
+			if copies(fmt.Sprint("key ", i)) != 3 {
+				return false
+			}
+		}
+		return true
+	})
+
+	// A write that only reached a replica is pulled by the owner.
+	owner, err := caller.FindSuccessor(entry, chord.Hash("key 0", 1<<bits))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, err := caller.GetSuccessor(owner.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := caller.GetEntries(owner.Address, []string{"key 0"})
+	if err != nil || len(stored) != 1 {
+		t.Fatalf("entries of key 0 on its owner: %v, %v", stored, err)
+	}
+	stored[0].Value = []byte("missed")
+	stored[0].Version++
+	if err := caller.Repair(replica.Address, stored); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("the owner to pull a newer version", func() bool {
+		v, err := d.Get("key 0")
+		return err == nil && v == "missed"
+	})
+
+	// A delete reaches the replicas and is not undone by them.
+	if err := d.Delete("key 1"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("the delete to reach the replicas", func() bool { return copies("key 1") == 0 })
+	time.Sleep(200 * time.Millisecond)
+	if _, err := d.Get("key 1"); err != chord.ErrNotFound {
+		t.Errorf("get a deleted key: %v", err)
+	}
+
+	// The successor of a dead node has its keys.
+	victim := 0
+	if ring.Node(victim).Address() == entry {
+		victim = 1
+	}
+	ring.Kill(victim)
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i < keys; i++ {
+		k := fmt.Sprint("key ", i)
+		if v, err := d.Get(k); err != nil || v != k {
+			t.Errorf("get %q after a crash: %q, %v", k, v, err)
+		}
+	}
+}
@@ -2,46 +2,112 @@ package chord
 
 import (
 	"errors"
+	"fmt"
+	"time"
+
+	"github.com/anteater2/bitmesh/clock"
+	"github.com/anteater2/bitmesh/logging"
+	"github.com/anteater2/bitmesh/message"
+	"github.com/anteater2/bitmesh/metrics"
+	"github.com/anteater2/bitmesh/rpc"
 )
 
-var config struct {
-	addr       string
-	bits       uint64
-	callerPort uint16
-	calleePort uint16
-	introducer string
-	isCreator  bool
-	maxKey     uint64
-	numFingers uint64
+// Config holds the settings of a node.
+type Config struct {
+	// Addr is the IP address other nodes use to reach this node.
+	Addr string
+	// CalleePort is the port to receive calls on; 0 picks a free port.
+	CalleePort uint16
+	// CallerPort is the port to receive replies on; 0 picks a free port.
+	CallerPort uint16
+	// Bits is the size of the keyspace, which is [0, 2^Bits).
+	Bits uint64
+	// VirtualNodes is the number of virtual nodes of a Host; give bigger
+	// machines more, so that they take more of the keyspace.  Defaults to one.
+	VirtualNodes int
+	// IDs are the keyspace positions of the node, or of the virtual nodes of
+	// a Host in order.  A node without one takes the hash of its address.
+	IDs []Key
+	// StabilizeInterval is the pause between two rounds of stabilize,
+	// fixFingers and checkPredecessor. Defaults to one second.
+	StabilizeInterval time.Duration
+	// ExpireInterval is the pause between two sweeps of the expired keys.
+	// Defaults to ten seconds.
+	ExpireInterval time.Duration
+	// Replicas is the number of nodes that store every key: its owner and the
+	// successors of the owner.  Defaults to one, which keeps no copies.
+	Replicas int
+	// AntiEntropyInterval is the pause between two rounds of anti-entropy,
+	// which repair the copies of the keys of a node on its successors.
+	// Defaults to ten seconds.
+	AntiEntropyInterval time.Duration
+	// TombstoneTTL is how long the tombstones of deleted keys are kept when
+	// there are replicas, so that anti-entropy does not bring the keys back.
+	// A replica that is away for longer may.  Defaults to ten anti-entropy
+	// intervals.
+	TombstoneTTL time.Duration
+	// Transport defaults to message.TCP.
+	Transport message.Transport
+	// Clock defaults to clock.Real.
+	Clock clock.Clock
+	// Metrics defaults to metrics.Discard.  It is shared with the rpc and message layers.
+	Metrics metrics.Metrics
+	// Logger defaults to slog.Default().  It is shared with the rpc and message layers.
+	Logger logging.Logger
 }
 
-// Init initializes the configs
-func Init(addr string, calleePort uint16, callerPort uint16, bits uint64) error {
-	config.addr = addr
-	config.calleePort = calleePort
-	config.callerPort = callerPort
-	config.bits = bits
-
-	if config.bits > 63 {
+func (c *Config) check() error {
+	if c.Bits > 63 {
 		return errors.New("invalid keyspace; maximum keyspace size > 63")
 	}
-	config.isCreator = config.introducer == ""
-	config.maxKey = 1 << config.bits
-	config.numFingers = config.bits - 1
+	if c.Bits < 2 {
+		return errors.New("invalid keyspace; minimum keyspace size < 2")
+	}
+	if c.StabilizeInterval == 0 {
+		c.StabilizeInterval = time.Second
+	}
+	if c.VirtualNodes < 1 {
+		c.VirtualNodes = 1
+	}
+	for _, id := range c.IDs {
+		if !id.Valid(c.MaxKey()) {
+			return fmt.Errorf("invalid ID %d; outside of the keyspace", id)
+		}
+	}
+	if c.ExpireInterval == 0 {
+		c.ExpireInterval = 10 * time.Second
+	}
+	if c.Replicas < 1 {
+		c.Replicas = 1
+	}
+	if c.AntiEntropyInterval == 0 {
+		c.AntiEntropyInterval = 10 * time.Second
+	}
+	if c.TombstoneTTL == 0 {
+		c.TombstoneTTL = 10 * c.AntiEntropyInterval
+	}
+	if c.Clock == nil {
+		c.Clock = clock.Real
+	}
+	c.Metrics = metrics.Or(c.Metrics)
+	c.Logger = logging.Or(c.Logger)
 	return nil
 }
 
-// Introducer returns the introducing address
-func Introducer() string {
-	return config.introducer
+func (c Config) message() message.Config {
+	return message.Config{Transport: c.Transport, Metrics: c.Metrics, Logger: c.Logger}
+}
+
+func (c Config) rpc() rpc.Config {
+	return rpc.Config{Transport: c.Transport, Clock: c.Clock, Metrics: c.Metrics, Logger: c.Logger}
 }
 
 // MaxKey returns the size of the key space.
-func MaxKey() uint64 {
-	return config.maxKey
+func (c Config) MaxKey() uint64 {
+	return 1 << c.Bits
 }
 
 // NumFingers returns the size of a finger table
-func NumFingers() uint64 {
-	return config.numFingers
+func (c Config) NumFingers() uint64 {
+	return c.Bits - 1
 }
@@ -0,0 +1,221 @@
+// Package crawl walks a whole chord ring over RPC and checks its invariants.
+package crawl
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/anteater2/bitmesh/chord"
+)
+
+// Node is what the crawler learned about one node.
+type Node struct {
+	Address     string
+	Key         chord.Key
+	Predecessor *chord.RemoteNode  `json:",omitempty"`
+	Successor   *chord.RemoteNode  `json:",omitempty"`
+	Fingers     []chord.RemoteNode `json:",omitempty"`
+	// Owned is the number of positions in the arc the node is responsible for,
+	// that is from the previous node on the walk (exclusive) to itself (inclusive).
+	Owned uint64
+	// Share is Owned as a fraction of the keyspace.
+	Share float64
+	// Load is what the node stores, see chord.Load.
+	Load *chord.Load `json:",omitempty"`
+	// Error is set when the node did not answer GetSuccessor, so it was
+	// not crawled.
+	Error string `json:",omitempty"`
+	// Errors holds the errors of the other calls to a crawled node, by call.
+	Errors map[string]string `json:",omitempty"`
+}
+
+// Violation is a broken invariant.
+type Violation struct {
+	Address string
+	Key     chord.Key
+	Check   string
+	Message string
+}
+
+// Check names
+const (
+	CheckReachable   = "reachable"   // every node on the walk answers
+	CheckClosed      = "closed"      // following successors leads back to the seed
+	CheckOrdered     = "ordered"     // the walk goes around the keyspace exactly once
+	CheckUnique      = "unique"      // no two nodes share a key
+	CheckPredecessor = "predecessor" // pred(succ(n)) == n
+	CheckFingers     = "fingers"     // finger i of n is successor(n+2^i)
+)
+
+// Report is the result of a crawl.
+type Report struct {
+	Seed       string
+	Bits       uint64
+	Nodes      []Node // in the order of the walk, starting at the seed
+	Closed     bool
+	Violations []Violation
+}
+
+// OK returns true if no invariant is broken.
+func (r *Report) OK() bool {
+	return len(r.Violations) == 0
+}
+
+// Crawl asks seed for its key, follows GetSuccessor from seed until it comes back to the seed,
+// asks every node it meets for its predecessor, fingers and load,
+// then checks the invariants of the ring.
+// The error is only set if the seed itself cannot be crawled.
+func Crawl(caller *chord.NodeCaller, seed string, bits uint64) (*Report, error) {
+	r := &Report{Seed: seed, Bits: bits}
+	maxKey := uint64(1) << bits
+	seen := make(map[string]bool)
+	// The seed tells its own key, which is not the hash of its address when
+	// it was set or the seed is a virtual node.  The key of every other node
+	// is learned from whoever points at it.
+	self, err := caller.GetNode(seed)
+	if err != nil {
+		return nil, err
+	}
+	addr, key := seed, self.Key
+	for !seen[addr] && uint64(len(r.Nodes)) < maxKey {
+		seen[addr] = true
+		node := Node{Address: addr, Key: key}
+		succ, err := caller.GetSuccessor(addr)
+		if err != nil {
+			if addr == seed {
+				return nil, err
+			}
+			node.Error = err.Error()
+			r.Nodes = append(r.Nodes, node)
+			r.violate(node, CheckReachable, "no answer to GetSuccessor: %v", err)
+			break
+		}
+		node.Successor = &succ
+		failed := func(call string, err error) {
+			if node.Errors == nil {
+				node.Errors = make(map[string]string)
+			}
+			node.Errors[call] = err.Error()
+		}
+		if pred, err := caller.GetPredecessor(addr); err == nil {
+			node.Predecessor = &pred
+		} else {
+			failed("GetPredecessor", err)
+		}
+		if fingers, err := caller.GetFingers(addr); err == nil {
+			node.Fingers = fingers
+		} else {
+			failed("GetFingers", err)
+		}
+		if load, err := caller.GetLoad(addr); err == nil {
+			node.Load = &load
+		} else {
+			failed("GetLoad", err)
+		}
+		r.Nodes = append(r.Nodes, node)
+		addr, key = succ.Address, succ.Key
+	}
+	r.Closed = addr == seed
+	r.check()
+	return r, nil
+}
+
+func (r *Report) violate(node Node, check string, format string, args ...interface{}) {
+	r.Violations = append(r.Violations, Violation{
+		Address: node.Address,
+		Key:     node.Key,
+		Check:   check,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// check fills in the ownership of the nodes and looks for broken invariants.
+func (r *Report) check() {
+	maxKey := uint64(1) << r.Bits
+	// A walk that stopped at a node that did not answer is reported as such.
+	if last := r.Nodes[len(r.Nodes)-1]; !r.Closed && last.Error == "" {
+		r.violate(last, CheckClosed, "successor %s has been visited but is not the seed", last.Successor.Address)
+	}
+
+	for _, node := range r.Nodes {
+		calls := make([]string, 0, len(node.Errors))
+		for call := range node.Errors {
+			calls = append(calls, call)
+		}
+		sort.Strings(calls)
+		for _, call := range calls {
+			r.violate(node, CheckReachable, "no answer to %s: %s", call, node.Errors[call])
+		}
+	}
+
+	byAddress := make(map[string]*Node)
+	byKey := make(map[chord.Key]*Node)
+	for i := range r.Nodes {
+		node := &r.Nodes[i]
+		byAddress[node.Address] = node
+		if other, prs := byKey[node.Key]; prs {
+			r.violate(*node, CheckUnique, "key %d is also taken by %s", node.Key, other.Address)
+		}
+		byKey[node.Key] = node
+	}
+
+	// ownership, and how many times the walk wraps around
+	wraps := 0
+	for i := range r.Nodes {
+		node := &r.Nodes[i]
+		prev := r.Nodes[(i+len(r.Nodes)-1)%len(r.Nodes)]
+		node.Owned = (uint64(node.Key) + maxKey - uint64(prev.Key)) % maxKey
+		if node.Owned == 0 {
+			node.Owned = maxKey
+		}
+		node.Share = float64(node.Owned) / float64(maxKey)
+		if len(r.Nodes) > 1 && node.Key <= prev.Key {
+			wraps++
+		}
+	}
+	if r.Closed && len(r.Nodes) > 1 && wraps != 1 {
+		r.violate(r.Nodes[0], CheckOrdered, "the walk goes around the keyspace %d times", wraps)
+	}
+
+	// pred(succ(n)) == n
+	for _, node := range r.Nodes {
+		if node.Successor == nil {
+			continue
+		}
+		succ, prs := byAddress[node.Successor.Address]
+		if !prs || succ.Predecessor == nil {
+			continue
+		}
+		if succ.Predecessor.Address != node.Address {
+			r.violate(node, CheckPredecessor, "predecessor of successor %s is %s",
+				succ.Address, succ.Predecessor.Address)
+		}
+	}
+
+	// finger i of n is successor(n+2^i)
+	if !r.Closed {
+		return
+	}
+	sorted := make([]Node, len(r.Nodes))
+	copy(sorted, r.Nodes)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	for _, node := range r.Nodes {
+		for i, finger := range node.Fingers {
+			target := chord.Key((uint64(node.Key) + 1<<uint(i)) % maxKey)
+			if want := successor(sorted, target); finger.Address != want.Address {
+				r.violate(node, CheckFingers, "finger %d (key %d) is %s (key %d), expecting %s (key %d)",
+					i, target, finger.Address, finger.Key, want.Address, want.Key)
+			}
+		}
+	}
+}
+
+// successor returns the first node of sorted at or after key.
+func successor(sorted []Node, key chord.Key) Node {
+	for _, node := range sorted {
+		if node.Key >= key {
+			return node
+		}
+	}
+	return sorted[0]
+}
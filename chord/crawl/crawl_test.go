@@ -0,0 +1,152 @@
+package crawl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/chord/chordtest"
+)
+
+func TestCrawl(t *testing.T) {
+	ring, err := chordtest.NewRing(5, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.Stop()
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	caller, err := chord.NewNodeCaller(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := caller.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Stop()
+	owner, err := caller.FindSuccessor(ring.Entry(), chord.Hash("key", 1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := caller.Put(owner.Address, "key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Crawl(caller, ring.Entry(), 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.OK() || !r.Closed {
+		t.Fatalf("violations on a converged ring: %+v", r.Violations)
+	}
+	if len(r.Nodes) != 5 {
+		t.Fatalf("crawled %d nodes, expecting 5", len(r.Nodes))
+	}
+	if seed := ring.Live()[0]; r.Nodes[0].Key != seed.Key() {
+		t.Errorf("seed has key %d, expecting %d", r.Nodes[0].Key, seed.Key())
+	}
+	owned := uint64(0)
+	keys := 0
+	for _, node := range r.Nodes {
+		owned += node.Owned
+		if node.Load == nil {
+			t.Fatalf("no load for %s", node.Address)
+		}
+		keys += node.Load.Keys
+	}
+	if owned != 1<<16 {
+		t.Errorf("nodes own %d keys in total, expecting %d", owned, 1<<16)
+	}
+	if keys != 1 {
+		t.Errorf("nodes store %d keys in total, expecting 1", keys)
+	}
+}
+
+// TestSeedKey crawls from a virtual node with a set ID, whose key is not the
+// hash of its address.
+func TestSeedKey(t *testing.T) {
+	host, err := chord.NewHost(chord.Config{
+		Addr:              "127.0.0.1",
+		Bits:              16,
+		VirtualNodes:      3,
+		IDs:               []chord.Key{100, 30000, 50000},
+		StabilizeInterval: chordtest.StabilizeInterval,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := host.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer host.Stop()
+	caller, err := chord.NewNodeCaller(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := caller.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Stop()
+
+	seed := host.Nodes()[1].Address()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		r, err := Crawl(caller, seed, 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Nodes[0].Key != 30000 {
+			t.Fatalf("seed has key %d, expecting 30000", r.Nodes[0].Key)
+		}
+		if r.OK() && len(r.Nodes) == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("violations: %+v", r.Violations)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	node := func(addr string, key chord.Key, pred string, predKey chord.Key, succ string, succKey chord.Key) Node {
+		return Node{
+			Address:     addr,
+			Key:         key,
+			Predecessor: &chord.RemoteNode{Address: pred, Key: predKey},
+			Successor:   &chord.RemoteNode{Address: succ, Key: succKey},
+			Fingers:     []chord.RemoteNode{{Address: succ, Key: succKey}},
+		}
+	}
+	// a -> b -> c -> a, but c believes its predecessor is a,
+	// and b shares its key with a
+	r := &Report{
+		Bits:   4,
+		Closed: true,
+		Nodes: []Node{
+			node("a", 2, "c", 12, "b", 2),
+			node("b", 2, "a", 2, "c", 12),
+			node("c", 12, "a", 2, "a", 2),
+		},
+	}
+	// c answered GetSuccessor but not GetLoad.
+	r.Nodes[2].Errors = map[string]string{"GetLoad": "timeout"}
+	r.check()
+	checks := make(map[string]int)
+	for _, v := range r.Violations {
+		checks[v.Check]++
+	}
+	if checks[CheckUnique] != 1 {
+		t.Errorf("%d %s violations, expecting 1: %+v", checks[CheckUnique], CheckUnique, r.Violations)
+	}
+	if checks[CheckPredecessor] != 1 {
+		t.Errorf("%d %s violations, expecting 1: %+v", checks[CheckPredecessor], CheckPredecessor, r.Violations)
+	}
+	if checks[CheckOrdered] != 1 {
+		t.Errorf("%d %s violations, expecting 1: %+v", checks[CheckOrdered], CheckOrdered, r.Violations)
+	}
+	if checks[CheckReachable] != 1 {
+		t.Errorf("%d %s violations, expecting 1: %+v", checks[CheckReachable], CheckReachable, r.Violations)
+	}
+}
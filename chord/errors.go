@@ -0,0 +1,61 @@
+package chord
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/anteater2/bitmesh/crdt"
+)
+
+// Errors of the key operations.  They survive the trip through NodeCaller,
+// so they can be compared with ==, but for crdt.ErrType, which can be
+// wrapped and is matched with errors.Is.
+var (
+	ErrNotFound  = errors.New("no such key")
+	ErrWrongNode = errors.New("wrong node to get the key")
+	// ErrVersionMismatch is returned by a compare-and-swap that lost a race.
+	ErrVersionMismatch = errors.New("version mismatch")
+	// ErrSiblings is returned for a single value of a key that has concurrent
+	// values, put with vector clocks.
+	ErrSiblings = errors.New("key has concurrent values")
+)
+
+// Errors cannot be gob-encoded, so replies carry their message instead.
+
+func encodeError(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func decodeError(msg string) error {
+	switch msg {
+	case "":
+		return nil
+	case ErrNotFound.Error():
+		return ErrNotFound
+	case ErrWrongNode.Error():
+		return ErrWrongNode
+	case ErrVersionMismatch.Error():
+		return ErrVersionMismatch
+	case ErrSiblings.Error():
+		return ErrSiblings
+	case crdt.ErrType.Error():
+		return crdt.ErrType
+	}
+	// Errors of crdt.Apply wrap crdt.ErrType, and still do on this side.
+	if rest, ok := strings.CutPrefix(msg, crdt.ErrType.Error()+": "); ok {
+		return fmt.Errorf("%w: %s", crdt.ErrType, rest)
+	}
+	return errors.New(msg)
+}
+
+func decodeErrors(msgs []string) []error {
+	errs := make([]error, len(msgs))
+	for i, msg := range msgs {
+		errs[i] = decodeError(msg)
+	}
+	return errs
+}
@@ -0,0 +1,16 @@
+package chord
+
+import "testing"
+
+func TestDecodeError(t *testing.T) {
+	// Older nodes send these exact messages, so they must not change.
+	for msg, want := range map[string]error{
+		"":                          nil,
+		"no such key":               ErrNotFound,
+		"wrong node to get the key": ErrWrongNode,
+	} {
+		if err := decodeError(msg); err != want {
+			t.Errorf("decodeError(%q) = %v, want %v", msg, err, want)
+		}
+	}
+}
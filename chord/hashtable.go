@@ -3,14 +3,35 @@
 package chord
 
 import (
+	"bytes"
 	"errors"
 	"sync"
+	"time"
+
+	"github.com/anteater2/bitmesh/clock"
+	"github.com/anteater2/bitmesh/crdt"
 )
 
 type HashEntry struct {
 	Value []byte
 	Key   string
-	next  *HashEntry
+	// Expires is when the entry expires; the zero time means never.
+	// It is absolute, so an entry keeps its deadline when it moves to another node.
+	Expires time.Time
+	// Version counts the puts of the key since it was created, starting at 1.
+	Version uint64
+	// Deleted marks a tombstone, which stands for a deleted key until it
+	// expires, so that replicas learn about the delete; see HashTable.
+	Deleted bool
+	// Siblings are the concurrent values of a key put with vector clocks, in
+	// place of Value; see PutSibling.
+	Siblings []Sibling
+	// Type is the type of the CRDT whose state is Value, if any; see Apply.
+	Type crdt.Type
+	// TTL is how long an entry sent with MultiPut lives, from the clock of
+	// the node that stores it, which turns it into Expires; 0 means forever.
+	TTL  time.Duration
+	next *HashEntry
 }
 
 // HashTable is a hash table mapping strings to byte arrays.
@@ -18,54 +39,414 @@ type HashEntry struct {
 type HashTable struct {
 	hashEntries []HashEntry
 	maximum     uint64
-	rw          sync.RWMutex
+	count       int
+	size        int
+	clock       clock.Clock
+	// changed, if set, is called with the write lock held for every put,
+	// delete and expiry, but not for entries moving in with PutEntry.
+	changed func(entry HashEntry, event EventType)
+	// tombstones, if set, makes deletes leave tombstones that expire after it.
+	// Tombstones are not entries: the table only returns them to replicas.
+	tombstones time.Duration
+	// generation counts the changes to the table.
+	generation uint64
+	rw         sync.RWMutex
 }
 
 func NewTable(maxKeys uint64) *HashTable {
-	return &HashTable{maximum: maxKeys, hashEntries: make([]HashEntry, maxKeys)}
+	return &HashTable{maximum: maxKeys, hashEntries: make([]HashEntry, maxKeys), clock: clock.Real}
 }
 
+// GetRange returns the entries whose keys are in (start, end], leaving out
+// the expired ones.
 func (self *HashTable) GetRange(start Key, end Key) []HashEntry {
+	return self.getRange(start, end, false)
+}
+
+// getRange is GetRange, with the tombstones if asked for.
+func (self *HashTable) getRange(start Key, end Key, tombstones bool) []HashEntry {
 	self.rw.RLock()
+	now := self.clock.Now()
 	entries := []HashEntry{}
-	for i := start + 1; i <= end+1; i++ {
+	for i := (uint64(start) + 1) % self.maximum; ; i = (i + 1) % self.maximum {
 		hashEntry := &self.hashEntries[i]
 		if !hashEntry.IsNil() {
-			entries = append(entries, *hashEntry)
-			for hashEntry.next != nil {
-				hashEntry = hashEntry.next
-				entries = append(entries, *hashEntry)
+			for ; hashEntry != nil; hashEntry = hashEntry.next {
+				if !hashEntry.Expired(now) && (tombstones || !hashEntry.Deleted) {
+					entry := *hashEntry
+					entry.next = nil
+					entries = append(entries, entry)
+				}
 			}
 		}
+		if i == uint64(end)%self.maximum {
+			break
+		}
 	}
 	self.rw.RUnlock()
 	return entries
 }
 
 func (self *HashTable) Put(hashKey string, value []byte) {
+	self.PutWithExpiry(hashKey, value, time.Time{})
+}
+
+// PutWithExpiry puts an entry that expires at expires, or never if it is zero.
+// It returns the version of the entry, which is one more than the version it
+// replaces, or than the tombstone of the key.
+func (self *HashTable) PutWithExpiry(hashKey string, value []byte, expires time.Time) uint64 {
+	version, _ := self.put(HashEntry{Key: hashKey, Value: value, Expires: expires}, EventPut, func(old *HashEntry, _ *HashEntry) (uint64, error) {
+		if old == nil {
+			return 1, nil
+		}
+		return old.Version + 1, nil
+	})
+	return version
+}
+
+// PutEntry puts an entry as is, version included.  It is for entries moving
+// from another node.  An entry with siblings, or the state of a CRDT, is
+// joined with the one in the table instead, as both may have taken writes.
+func (self *HashTable) PutEntry(entry HashEntry) {
+	self.put(entry, 0, func(old *HashEntry, merged *HashEntry) (uint64, error) {
+		if old != nil && join(old, merged) {
+			if version, err := joinedVersion(old, entry, *merged); err == nil {
+				return version, nil
+			}
+			return old.Version, nil
+		}
+		return entry.Version, nil
+	})
+}
+
+// Merge puts an entry or tombstone from a replica as is, unless the table
+// has a newer version of the key.  It reports whether the entry was put.
+// The siblings of two entries of a key put with vector clocks, or two states
+// of a CRDT, are joined instead, and the result gets a new version if it
+// differs from both.
+func (self *HashTable) Merge(entry HashEntry) bool {
+	_, err := self.put(entry, 0, func(old *HashEntry, merged *HashEntry) (uint64, error) {
+		if old != nil && join(old, merged) {
+			return joinedVersion(old, entry, *merged)
+		}
+		if old != nil && old.Version > entry.Version {
+			return 0, errStale
+		}
+		return entry.Version, nil
+	})
+	return err == nil
+}
+
+// join merges old into entry if both hold siblings, or states of the same
+// CRDT, and reports whether it did.
+func join(old *HashEntry, entry *HashEntry) bool {
+	switch {
+	case old.Deleted || entry.Deleted:
+		return false
+	case len(old.Siblings) > 0 && len(entry.Siblings) > 0:
+		entry.Siblings = mergeSiblings(old.Siblings, entry.Siblings)
+		return true
+	case old.Type != "" && old.Type == entry.Type:
+		value, err := crdt.Merge(entry.Type, old.Value, entry.Value)
+		if err != nil {
+			return false
+		}
+		entry.Value = value
+		return true
+	}
+	return false
+}
+
+// joinedVersion returns the version of merged, the join of old and entry:
+// the newer of their versions, or one more if it differs from both.  It
+// returns errStale if merged is old.
+func joinedVersion(old *HashEntry, entry HashEntry, merged HashEntry) (uint64, error) {
+	newer := entry
+	if old.Version > entry.Version {
+		newer = *old
+	}
+	switch {
+	case !sameValue(merged, newer):
+		return newer.Version + 1, nil
+	case old.Version == newer.Version && sameValue(merged, *old):
+		return 0, errStale
+	}
+	return newer.Version, nil
+}
+
+// sameValue returns true if a and b hold the same value or siblings.
+func sameValue(a HashEntry, b HashEntry) bool {
+	return bytes.Equal(a.Value, b.Value) && sameSiblings(a.Siblings, b.Siblings)
+}
+
+// Apply does an operation on the CRDT stored at a key, as replica, and
+// returns its new state and version.  It returns crdt.ErrType if the key
+// holds something else.
+func (self *HashTable) Apply(hashKey string, op crdt.Op, replica string) ([]byte, uint64, error) {
+	var state []byte
+	version, err := self.put(HashEntry{Key: hashKey, Type: op.Type}, EventPut, func(old *HashEntry, entry *HashEntry) (uint64, error) {
+		var current []byte
+		version := uint64(1)
+		if old != nil {
+			version = old.Version + 1
+			if !old.Deleted {
+				if old.Type != op.Type {
+					return 0, crdt.ErrType
+				}
+				current = old.Value
+			}
+		}
+		var err error
+		if entry.Value, err = crdt.Apply(current, op, replica, self.clock.Now()); err != nil {
+			return 0, err
+		}
+		state = entry.Value
+		return version, nil
+	})
+	return state, version, err
+}
+
+var errStale = errors.New("chord: stale entry")
+
+// CompareAndSwap puts an entry if the current version of the key is version,
+// where 0 stands for a missing key.  It returns the new version, or
+// ErrVersionMismatch and leaves the table alone.
+func (self *HashTable) CompareAndSwap(hashKey string, version uint64, value []byte, expires time.Time) (uint64, error) {
+	return self.put(HashEntry{Key: hashKey, Value: value, Expires: expires}, EventPut, func(old *HashEntry, _ *HashEntry) (uint64, error) {
+		current := uint64(0)
+		if old != nil && !old.Deleted {
+			current = old.Version
+		}
+		if current != version {
+			return 0, ErrVersionMismatch
+		}
+		if old != nil {
+			return old.Version + 1, nil
+		}
+		return 1, nil
+	})
+}
+
+// SetExpiry sets a key to expire at expires, or never if it is zero, and
+// returns its new version.  It returns ErrNotFound for a missing key.
+func (self *HashTable) SetExpiry(hashKey string, expires time.Time) (uint64, error) {
+	return self.put(HashEntry{Key: hashKey, Expires: expires}, 0, func(old *HashEntry, entry *HashEntry) (uint64, error) {
+		if old == nil || old.Deleted {
+			return 0, ErrNotFound
+		}
+		entry.Value, entry.Siblings, entry.Type = old.Value, old.Siblings, old.Type
+		return old.Version + 1, nil
+	})
+}
+
+// PutSibling puts a value with the vector clock context it was read with,
+// as a write taken by node.  It replaces the siblings the context has seen
+// and keeps the others, so that concurrent writes are not lost.  It returns
+// the version of the entry.
+func (self *HashTable) PutSibling(hashKey string, value []byte, context VectorClock, node Key, expires time.Time) uint64 {
+	version, _ := self.put(HashEntry{Key: hashKey, Expires: expires}, EventPut, func(old *HashEntry, entry *HashEntry) (uint64, error) {
+		count := context[node]
+		if old != nil && !old.Deleted {
+			for _, s := range old.Siblings {
+				if !s.seenBy(context) {
+					entry.Siblings = append(entry.Siblings, s)
+				}
+				// The write must not have the count of an earlier one.
+				if c := Context([]Sibling{s})[node]; c > count {
+					count = c
+				}
+			}
+		}
+		entry.Siblings = append(entry.Siblings, Sibling{Value: value, Clock: context, Node: node, Count: count + 1})
+		if old != nil {
+			return old.Version + 1, nil
+		}
+		return 1, nil
+	})
+	return version
+}
+
+// put stores entry with the version returned by set, which is given the
+// current entry or tombstone of the key, or nil if there is none or it has
+// expired, and may change the entry.  If set fails, the table is left alone.
+// event is 0 for no event.
+func (self *HashTable) put(entry HashEntry, event EventType, set func(old *HashEntry, entry *HashEntry) (uint64, error)) (uint64, error) {
 	self.rw.Lock()
-	// TO DO: Replace if key is the same
+	defer self.rw.Unlock()
+	position := Hash(entry.Key, self.maximum)
+	head := &self.hashEntries[position]
+	var existing, tail *HashEntry
+	if !head.IsNil() {
+		for hashEntry := head; hashEntry != nil; hashEntry = hashEntry.next {
+			if hashEntry.Key == entry.Key {
+				existing = hashEntry
+				break
+			}
+			tail = hashEntry
+		}
+	}
+	current := existing
+	if current != nil && current.Expired(self.clock.Now()) {
+		current = nil
+	}
+	version, err := set(current, &entry)
+	if err != nil {
+		return 0, err
+	}
+	entry.Version = version
+	entry.next = nil
+	switch {
+	case existing != nil:
+		if !existing.Deleted {
+			self.count--
+			self.size -= existing.size()
+		}
+		entry.next = existing.next
+		*existing = entry
+	case tail == nil:
+		*head = entry
+	default:
+		tail.next = &entry
+	}
+	if !entry.Deleted {
+		self.count++
+		self.size += entry.size()
+	}
+	self.generation++
+	entry.next = nil
+	self.emit(entry, event)
+	return version, nil
+}
+
+func (self *HashTable) emit(entry HashEntry, event EventType) {
+	if event != 0 && self.changed != nil {
+		self.changed(entry, event)
+	}
+}
+
+// Delete removes an entry and reports whether it was there.
+func (self *HashTable) Delete(hashKey string) bool {
+	self.rw.Lock()
+	defer self.rw.Unlock()
+	return self.delete(hashKey, EventDelete, func(*HashEntry) bool { return true })
+}
+
+// Expire removes the expired entries and returns how many there were.
+func (self *HashTable) Expire() int {
+	self.rw.Lock()
+	defer self.rw.Unlock()
+	now := self.clock.Now()
+	var expired []string
+	for i := range self.hashEntries {
+		for hashEntry := &self.hashEntries[i]; hashEntry != nil && !hashEntry.IsNil(); hashEntry = hashEntry.next {
+			if hashEntry.Expired(now) {
+				expired = append(expired, hashEntry.Key)
+			}
+		}
+	}
+	count := 0
+	for _, hashKey := range expired {
+		if self.delete(hashKey, EventExpire, func(*HashEntry) bool { return true }) {
+			count++
+		}
+	}
+	return count
+}
+
+// delete removes an entry if ok accepts it.  With tombstones, a delete
+// leaves a tombstone in its place.  Tombstones are only removed when they
+// expire, silently, and do not count as entries.
+// The caller must hold the write lock.
+func (self *HashTable) delete(hashKey string, event EventType, ok func(*HashEntry) bool) bool {
 	position := Hash(hashKey, self.maximum)
-	newHashEntry := HashEntry{Key: hashKey, Value: value}
-	hashEntry := &self.hashEntries[position]
-	if hashEntry.IsNil() {
-		self.hashEntries[position] = newHashEntry
-	} else {
-		for hashEntry.next != nil {
-			hashEntry = hashEntry.next
+	head := &self.hashEntries[position]
+	if head.IsNil() {
+		return false
+	}
+	var prev *HashEntry
+	hashEntry := head
+	for hashEntry != nil && hashEntry.Key != hashKey {
+		prev, hashEntry = hashEntry, hashEntry.next
+	}
+	if hashEntry == nil || (hashEntry.Deleted && event != EventExpire) || !ok(hashEntry) {
+		return false
+	}
+	self.generation++
+	deleted := hashEntry.Deleted
+	if !deleted {
+		self.count--
+		self.size -= hashEntry.size()
+	}
+	switch {
+	case !deleted && event == EventDelete && self.tombstones > 0:
+		*hashEntry = HashEntry{
+			Key:     hashKey,
+			Version: hashEntry.Version + 1,
+			Deleted: true,
+			Expires: self.clock.Now().Add(self.tombstones),
+			next:    hashEntry.next,
 		}
-		hashEntry.next = &newHashEntry
+	case prev != nil:
+		prev.next = hashEntry.next
+	case hashEntry.next == nil:
+		*head = HashEntry{}
+	default:
+		*head = *hashEntry.next
 	}
-	self.rw.Unlock()
+	if deleted {
+		return false
+	}
+	self.emit(HashEntry{Key: hashKey}, event)
+	return true
+}
+
+// Len returns the number of entries in the table.
+func (self *HashTable) Len() int {
+	self.rw.RLock()
+	defer self.rw.RUnlock()
+	return self.count
+}
+
+// Generation returns a number that changes with every change to the table.
+func (self *HashTable) Generation() uint64 {
+	self.rw.RLock()
+	defer self.rw.RUnlock()
+	return self.generation
+}
+
+// Size returns the total length of the values in the table.
+func (self *HashTable) Size() int {
+	self.rw.RLock()
+	defer self.rw.RUnlock()
+	return self.size
 }
+
 func (self *HashTable) Get(hashKey string) ([]byte, error) {
+	entry, err := self.GetEntry(hashKey)
+	return entry.Value, err
+}
+
+// GetEntry returns the entry of a key.  Expired entries are removed on the way.
+func (self *HashTable) GetEntry(hashKey string) (HashEntry, error) {
 	self.rw.RLock()
 	position := Hash(hashKey, self.maximum)
 	hashEntry := self.hashEntries[position]
 	for !hashEntry.IsNil() {
 		if hashEntry.Key == hashKey {
 			self.rw.RUnlock()
-			return hashEntry.Value, nil
+			now := self.clock.Now()
+			if hashEntry.Deleted && !hashEntry.Expired(now) {
+				return HashEntry{}, ErrNotFound
+			}
+			if hashEntry.Expired(now) {
+				self.rw.Lock()
+				// The entry may have been put again in between.
+				self.delete(hashKey, EventExpire, func(e *HashEntry) bool { return e.Expired(now) })
+				self.rw.Unlock()
+				return HashEntry{}, ErrNotFound
+			}
+			hashEntry.next = nil
+			return hashEntry, nil
 		}
 		if hashEntry.next == nil {
 			break
@@ -73,8 +454,35 @@ func (self *HashTable) Get(hashKey string) ([]byte, error) {
 		hashEntry = *hashEntry.next
 	}
 	self.rw.RUnlock()
-	return []byte{0}, errors.New("No such key!")
+	return HashEntry{}, ErrNotFound
+}
+
+// Current returns the value of the entry, or of its only sibling.  It
+// returns ErrSiblings if the entry has concurrent values.
+func (self HashEntry) Current() ([]byte, error) {
+	switch len(self.Siblings) {
+	case 0:
+		return self.Value, nil
+	case 1:
+		return self.Siblings[0].Value, nil
+	}
+	return nil, ErrSiblings
 }
+
+// size returns the length of the values of the entry.
+func (self HashEntry) size() int {
+	size := len(self.Value)
+	for _, s := range self.Siblings {
+		size += len(s.Value)
+	}
+	return size
+}
+
 func (self HashEntry) IsNil() bool {
 	return self.Value == nil && self.Key == ""
 }
+
+// Expired returns true if the entry has a deadline that is not after now.
+func (self HashEntry) Expired(now time.Time) bool {
+	return !self.Expires.IsZero() && !now.Before(self.Expires)
+}
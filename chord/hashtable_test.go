@@ -0,0 +1,259 @@
+package chord
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anteater2/bitmesh/crdt"
+)
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return make(chan time.Time)
+}
+
+func TestExpiry(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	table := NewTable(16)
+	table.clock = clock
+	deadline := clock.now.Add(time.Minute)
+	table.PutWithExpiry("a", []byte("1"), deadline)
+	table.PutWithExpiry("b", []byte("2"), deadline)
+	table.Put("c", []byte("3"))
+
+	if v, err := table.Get("a"); err != nil || string(v) != "1" {
+		t.Fatalf("get a before the deadline: %q, %v", v, err)
+	}
+	if entries := table.GetRange(0, 0); len(entries) != 3 {
+		t.Fatalf("%d entries before the deadline, expecting 3", len(entries))
+	}
+
+	clock.now = deadline
+	if entries := table.GetRange(0, 0); len(entries) != 1 || entries[0].Key != "c" {
+		t.Errorf("entries after the deadline: %v", entries)
+	}
+	// lazily
+	if _, err := table.Get("a"); err != ErrNotFound {
+		t.Errorf("get a after the deadline: %v", err)
+	}
+	if table.Len() != 2 {
+		t.Errorf("%d entries after a lazy expiry, expecting 2", table.Len())
+	}
+	// in the background
+	if n := table.Expire(); n != 1 {
+		t.Errorf("%d entries expired, expecting 1", n)
+	}
+	if table.Len() != 1 || table.Size() != 1 {
+		t.Errorf("%d entries of %d bytes left, expecting 1 of 1", table.Len(), table.Size())
+	}
+
+	// Putting again without a TTL clears the deadline.
+	table.PutWithExpiry("c", []byte("3"), deadline)
+	table.Put("c", []byte("3"))
+	if _, err := table.Get("c"); err != nil {
+		t.Errorf("get c: %v", err)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	table := NewTable(16)
+	table.clock = clock
+
+	if v := table.PutWithExpiry("a", []byte("1"), time.Time{}); v != 1 {
+		t.Errorf("version %d after the first put", v)
+	}
+	if v := table.PutWithExpiry("a", []byte("2"), time.Time{}); v != 2 {
+		t.Errorf("version %d after the second put", v)
+	}
+	if _, err := table.CompareAndSwap("a", 1, []byte("3"), time.Time{}); err != ErrVersionMismatch {
+		t.Errorf("swap at an old version: %v", err)
+	}
+	if v, err := table.CompareAndSwap("a", 2, []byte("3"), time.Time{}); err != nil || v != 3 {
+		t.Errorf("swap at the current version: %d, %v", v, err)
+	}
+	if e, err := table.GetEntry("a"); err != nil || string(e.Value) != "3" || e.Version != 3 {
+		t.Errorf("get a: %+v, %v", e, err)
+	}
+
+	// An expired key counts as missing.
+	table.PutWithExpiry("b", []byte("1"), clock.now.Add(time.Second))
+	clock.now = clock.now.Add(time.Second)
+	if v, err := table.CompareAndSwap("b", 0, []byte("2"), time.Time{}); err != nil || v != 1 {
+		t.Errorf("swap an expired key: %d, %v", v, err)
+	}
+
+	// Moved entries keep their version.
+	table.PutEntry(HashEntry{Key: "c", Value: []byte("1"), Version: 7})
+	if e, _ := table.GetEntry("c"); e.Version != 7 {
+		t.Errorf("version %d after a move, expecting 7", e.Version)
+	}
+	if table.Len() != 3 || table.Size() != 3 {
+		t.Errorf("%d entries of %d bytes, expecting 3 of 3", table.Len(), table.Size())
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	table := NewTable(16)
+	table.clock = clock
+	table.tombstones = time.Minute
+
+	table.Put("a", []byte("1"))
+	table.Put("a", []byte("2"))
+	if !table.Delete("a") {
+		t.Fatal("delete a")
+	}
+	if _, err := table.Get("a"); err != ErrNotFound {
+		t.Errorf("get a deleted key: %v", err)
+	}
+	if table.Len() != 0 || len(table.GetRange(0, 0)) != 0 {
+		t.Errorf("%d entries left after the delete", table.Len())
+	}
+	if table.Delete("a") {
+		t.Error("deleted a tombstone")
+	}
+	tombstones := table.getRange(0, 0, true)
+	if len(tombstones) != 1 || !tombstones[0].Deleted || tombstones[0].Version != 3 {
+		t.Fatalf("tombstones: %+v", tombstones)
+	}
+
+	// An older copy does not bring the key back, a newer one does.
+	if table.Merge(HashEntry{Key: "a", Value: []byte("2"), Version: 2}) {
+		t.Error("merged an entry older than its tombstone")
+	}
+	if v, err := table.CompareAndSwap("a", 0, []byte("4"), time.Time{}); err != nil || v != 4 {
+		t.Errorf("swap a deleted key: %d, %v", v, err)
+	}
+	table.Delete("a")
+	if !table.Merge(HashEntry{Key: "a", Value: []byte("6"), Version: 6}) {
+		t.Error("did not merge an entry newer than its tombstone")
+	}
+	if e, err := table.GetEntry("a"); err != nil || e.Version != 6 {
+		t.Errorf("get a after a merge: %+v, %v", e, err)
+	}
+
+	// Tombstones expire silently.
+	table.Delete("a")
+	clock.now = clock.now.Add(time.Minute)
+	if n := table.Expire(); n != 0 {
+		t.Errorf("%d entries expired, expecting none", n)
+	}
+	if tombstones := table.getRange(0, 0, true); len(tombstones) != 0 {
+		t.Errorf("tombstones after they expired: %+v", tombstones)
+	}
+	if v := table.PutWithExpiry("a", []byte("1"), time.Time{}); v != 1 {
+		t.Errorf("version %d after the tombstone expired, expecting 1", v)
+	}
+}
+
+func TestSiblings(t *testing.T) {
+	const a, b = Key(1), Key(2)
+	values := func(entry HashEntry) string {
+		var vs []string
+		for _, s := range entry.Siblings {
+			vs = append(vs, string(s.Value))
+		}
+		sort.Strings(vs)
+		return strings.Join(vs, ",")
+	}
+	table := NewTable(16)
+	table.PutSibling("cart", []byte("milk"), nil, a, time.Time{})
+	entry, _ := table.GetEntry("cart")
+	context := Context(entry.Siblings)
+	if v, err := entry.Current(); err != nil || string(v) != "milk" {
+		t.Fatalf("current value: %q, %v", v, err)
+	}
+
+	// Two writes from the same context are concurrent.
+	table.PutSibling("cart", []byte("milk eggs"), context, a, time.Time{})
+	table.PutSibling("cart", []byte("milk bread"), context, a, time.Time{})
+	entry, _ = table.GetEntry("cart")
+	if v := values(entry); v != "milk bread,milk eggs" {
+		t.Fatalf("siblings: %s", v)
+	}
+	if _, err := entry.Current(); err != ErrSiblings {
+		t.Errorf("current value of siblings: %v", err)
+	}
+
+	// A replica took another write concurrently; merging keeps all three.
+	replica := NewTable(16)
+	replica.PutSibling("cart", []byte("milk jam"), context, b, time.Time{})
+	other, _ := replica.GetEntry("cart")
+	if !table.Merge(other) {
+		t.Fatal("merge refused concurrent siblings")
+	}
+	entry, _ = table.GetEntry("cart")
+	if v := values(entry); v != "milk bread,milk eggs,milk jam" {
+		t.Fatalf("merged siblings: %s", v)
+	}
+	if entry.Version <= other.Version {
+		t.Errorf("merged version %d is not newer than %d", entry.Version, other.Version)
+	}
+	// Merging again changes nothing.
+	replica.Merge(entry)
+	if replica.Merge(entry) {
+		t.Error("merged the same siblings twice")
+	}
+
+	// A write with the context of all the siblings replaces them.
+	table.PutSibling("cart", []byte("milk bread eggs jam"), Context(entry.Siblings), b, time.Time{})
+	entry, _ = table.GetEntry("cart")
+	if v := values(entry); v != "milk bread eggs jam" {
+		t.Fatalf("siblings after a merge: %s", v)
+	}
+	// A stale copy does not bring the old siblings back.
+	if table.Merge(other) {
+		t.Error("merged siblings that were replaced")
+	}
+	if size := table.Size(); size != len("milk bread eggs jam") {
+		t.Errorf("size %d", size)
+	}
+}
+
+func TestCRDTJoin(t *testing.T) {
+	add := crdt.Op{Type: crdt.PNCounter, Kind: crdt.Add, Delta: 1}
+	owner, replica := NewTable(16), NewTable(16)
+	for i := 0; i < 3; i++ {
+		owner.Apply("visits", add, "a")
+	}
+	// The replica took writes as another owner, during a partition.
+	replica.Apply("visits", add, "b")
+	entry, _ := replica.GetEntry("visits")
+	if !owner.Merge(entry) {
+		t.Fatal("merge refused the state of a replica")
+	}
+	entry, _ = owner.GetEntry("visits")
+	if v, err := crdt.Counter(entry.Value); err != nil || v != 4 {
+		t.Errorf("merged counter: %d, %v", v, err)
+	}
+	// Moving the key joins it too.
+	moved := NewTable(16)
+	moved.Apply("visits", add, "c")
+	moved.PutEntry(entry)
+	entry, _ = moved.GetEntry("visits")
+	if v, err := crdt.Counter(entry.Value); err != nil || v != 5 {
+		t.Errorf("moved counter: %d, %v", v, err)
+	}
+
+	owner.Put("plain", []byte("x"))
+	if _, _, err := owner.Apply("plain", add, "a"); err != crdt.ErrType {
+		t.Errorf("apply to a plain value: %v", err)
+	}
+	// A bad operation is a crdt.ErrType, on the side of NodeCaller too.
+	_, _, err := owner.Apply("visits", crdt.Op{Type: crdt.PNCounter, Kind: crdt.Set}, "a")
+	if err = decodeError(encodeError(err)); !errors.Is(err, crdt.ErrType) || err.Error() != "crdt: wrong type: cannot set 0 to a pn-counter" {
+		t.Errorf("apply a bad operation: %v", err)
+	}
+}
@@ -0,0 +1,358 @@
+package chord
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/anteater2/bitmesh/clock"
+	"github.com/anteater2/bitmesh/message"
+	"github.com/anteater2/bitmesh/metrics"
+	"github.com/anteater2/bitmesh/rpc"
+)
+
+// Host runs several virtual nodes of a ring in one process, at independent
+// positions of the keyspace, so that the keys spread more evenly over the
+// processes.  The virtual nodes share the caller and the callee ports of the
+// host.  Virtual node i is reached at the address of the host followed by
+// "/i", except virtual node 0, which is reached at the address itself, so a
+// host with a single virtual node looks like a plain Node to the ring.
+type Host struct {
+	config Config
+	caller *NodeCaller
+	callee *rpc.Callee
+	nodes  []*Node
+	// ids are the keyspace positions of the virtual nodes that have one.
+	ids   map[int]Key
+	mutex sync.Mutex
+}
+
+// NewHost creates a host of config.VirtualNodes virtual nodes.  It is not
+// reachable until it is started.
+func NewHost(config Config) (*Host, error) {
+	err := config.check()
+	if err != nil {
+		return nil, err
+	}
+	caller, err := NewNodeCallerWith(config.CallerPort, config.rpc())
+	if err != nil {
+		return nil, err
+	}
+	callee, err := rpc.NewCalleeWith(config.CalleePort, config.rpc())
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[int]Key)
+	for i, id := range config.IDs {
+		ids[i] = id
+	}
+	return &Host{config: config, caller: caller, callee: callee, ids: ids}, nil
+}
+
+// Start starts the host with its virtual nodes on their own ring.
+func (h *Host) Start() error {
+	if err := h.callee.Start(); err != nil {
+		return err
+	}
+	if err := h.caller.Start(); err != nil {
+		h.callee.Stop()
+		return err
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err := h.resize(h.config.VirtualNodes); err != nil {
+		h.stop()
+		return err
+	}
+	return nil
+}
+
+// Stop stops the virtual nodes and the host, without handing their keys
+// over to anyone; see Node.Stop.
+func (h *Host) Stop() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.stop()
+}
+
+func (h *Host) stop() {
+	for _, n := range h.nodes {
+		n.Stop()
+	}
+	h.nodes = nil
+	h.caller.Stop()
+	h.callee.Stop()
+}
+
+// Leave makes every virtual node leave the ring, then stops the host.
+// If a virtual node cannot leave, the host keeps running with it and the
+// ones before it.
+func (h *Host) Leave() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err := h.resize(1); err != nil {
+		return err
+	}
+	if err := h.nodes[0].Leave(); err != nil {
+		return err
+	}
+	h.nodes = nil
+	h.caller.Stop()
+	h.callee.Stop()
+	return nil
+}
+
+// Join joins the virtual nodes to a ring given a node address.
+func (h *Host) Join(ring string) error {
+	return h.join(func(n *Node) error { return n.Join(ring) })
+}
+
+// JoinAny joins the virtual nodes to a ring through the first of seeds, in
+// random order, that answers; see Node.JoinAny.
+func (h *Host) JoinAny(seeds []string) error {
+	return h.join(func(n *Node) error { return n.JoinAny(seeds) })
+}
+
+// join joins virtual node 0 to a ring with f, and the others after it.
+// The virtual nodes are on a ring of their own until then, which their
+// fingers would still point into, so they are all started again, and the
+// keys and watches they held are handed over to their owners afterwards.
+func (h *Host) join(f func(n *Node) error) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	count := len(h.nodes)
+	var entries []HashEntry
+	var watches []Watch
+	for _, n := range h.nodes {
+		entries = append(entries, n.table.GetRange(n.key, n.key)...)
+		watches = append(watches, n.Watches()...)
+		n.Stop()
+	}
+	h.nodes = nil
+	if err := h.resize(1); err != nil {
+		return err
+	}
+	err := f(h.nodes[0])
+	err = errors.Join(err, h.resize(count))
+	return errors.Join(err, h.handOver(entries, watches))
+}
+
+// handOverTries is how many rounds of stabilize handOver waits for the owner
+// of a key to settle.
+const handOverTries = 10
+
+// handOver puts the keys and watches of the virtual nodes that were started
+// again on the nodes that own them now.  Prefix watches only lived on the
+// host, so they go back to its virtual nodes.
+func (h *Host) handOver(entries []HashEntry, watches []Watch) error {
+	entry := h.nodes[0].Address()
+	// The ring is still taking in the virtual nodes, so a key only goes to a
+	// node once that node agrees it owns the key.  If another node joins in
+	// front of it later, it hands the key over like any other.
+	owner := func(key string) (string, error) {
+		hash := Hash(key, h.config.MaxKey())
+		var err error
+		for try := 0; try < handOverTries; try++ {
+			if try > 0 {
+				<-h.config.Clock.After(h.config.StabilizeInterval)
+			}
+			var node, predecessor RemoteNode
+			if node, err = h.caller.FindSuccessor(entry, hash); err != nil {
+				continue
+			}
+			if predecessor, err = h.caller.GetPredecessor(node.Address); err != nil {
+				continue
+			}
+			if hash.BetweenEndInclusive(predecessor.Key, node.Key) {
+				return node.Address, nil
+			}
+			err = fmt.Errorf("%s is not the owner of %q yet", node.Address, key)
+		}
+		return "", err
+	}
+	var errs []error
+	batches := make(map[string][]HashEntry)
+	for _, e := range entries {
+		address, err := owner(e.Key)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		batches[address] = append(batches[address], e)
+	}
+	for address, batch := range batches {
+		if err := h.caller.Repair(address, batch); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	now := h.config.Clock.Now()
+	for _, w := range watches {
+		if w.Prefix {
+			for _, n := range h.nodes {
+				n.putWatches([]Watch{w})
+			}
+			continue
+		}
+		address, err := owner(w.Key)
+		if err == nil {
+			err = h.caller.Watch(address, w, w.Expires.Sub(now))
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SetVirtualNodes adds or removes virtual nodes until there are count.
+// New virtual nodes join the ring and take their keys over from their
+// successors; removed ones leave it and hand their keys over.
+func (h *Host) SetVirtualNodes(count int) error {
+	if count < 1 {
+		return errors.New("a host needs at least one virtual node")
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.nodes) == 0 {
+		return errors.New("the host is not running")
+	}
+	return h.resize(count)
+}
+
+// resize starts or removes virtual nodes until there are count.
+// The caller must hold the mutex.
+func (h *Host) resize(count int) error {
+	for len(h.nodes) < count {
+		i := len(h.nodes)
+		n := h.newNode(i)
+		if err := n.Start(); err != nil {
+			return err
+		}
+		if i > 0 {
+			if err := n.Join(h.nodes[0].Address()); err != nil {
+				n.Stop()
+				return err
+			}
+		}
+		h.nodes = append(h.nodes, n)
+	}
+	for len(h.nodes) > count {
+		if err := h.nodes[len(h.nodes)-1].Leave(); err != nil {
+			return err
+		}
+		h.nodes = h.nodes[:len(h.nodes)-1]
+	}
+	h.config.Metrics.Set("bitmesh_chord_virtual_nodes", float64(len(h.nodes)))
+	return nil
+}
+
+// newNode creates virtual node i.
+func (h *Host) newNode(i int) *Node {
+	path := ""
+	if i > 0 {
+		path = strconv.Itoa(i)
+	}
+	config := h.config
+	config.Metrics = metrics.With(h.config.Metrics, metrics.Label{Name: "vnode", Value: strconv.Itoa(i)})
+	n := newNode(config, h.caller, h.callee, h, path)
+	if id, ok := h.ids[i]; ok {
+		n.id = &id
+	}
+	return n
+}
+
+// Move makes virtual node i leave the ring and join it again at key, at the
+// same address.  It hands its keys over to its successor on the way out and
+// takes over the ones between its new predecessor and key on the way in.
+// It fails without moving if key is taken.  If the node cannot join again,
+// it is left on a ring of its own.
+//
+// Other nodes may still point at the address of the node, so the new node
+// would answer lookups for its own join; it joins in front of the owner of
+// key, looked up before leaving, instead.
+func (h *Host) Move(i int, key Key) error {
+	if !key.Valid(h.config.MaxKey()) {
+		return fmt.Errorf("invalid ID %d; outside of the keyspace", key)
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if i < 0 || i >= len(h.nodes) {
+		return fmt.Errorf("no virtual node %d", i)
+	}
+	old := h.nodes[i]
+	if key == old.Key() {
+		return nil
+	}
+	owner, err := h.caller.FindSuccessor(old.Address(), key)
+	if err != nil {
+		return err
+	}
+	if owner.Key == key {
+		return fmt.Errorf("keyspace position %d is already taken by %s", key, owner.Address)
+	}
+	if owner.Address == old.Address() {
+		// Its keys go to its successor.
+		owner = old.Successor()
+	}
+	// Join again through the neighbours of the node.
+	var seeds []string
+	status := old.Status()
+	if status.Predecessor != nil {
+		status.Successors = append(status.Successors, *status.Predecessor)
+	}
+	for _, peer := range status.Successors {
+		if peer.Address != old.Address() {
+			seeds = append(seeds, peer.Address)
+		}
+	}
+	h.config.Logger.Info("moving virtual node", "vnode", i, "from", old.Key(), "to", key)
+	if err := old.Leave(); err != nil {
+		return err
+	}
+	h.ids[i] = key
+	n := h.newNode(i)
+	if err := n.Start(); err != nil {
+		// The host cannot go on without it.
+		h.stop()
+		return err
+	}
+	h.nodes[i] = n
+	if owner.Address == old.Address() {
+		// The node was alone.
+		return nil
+	}
+	if err := n.joinBefore(owner); err != nil {
+		h.config.Logger.Warn("could not join in front of the owner", "vnode", i, "peer", owner.Address, "error", err)
+		return n.JoinAny(seeds)
+	}
+	return nil
+}
+
+// Address returns the address of virtual node 0, which is the address of the host.
+func (h *Host) Address() string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.nodes) == 0 {
+		return ""
+	}
+	return h.nodes[0].Address()
+}
+
+// Clock returns the clock of the host, for the services that run on it.
+func (h *Host) Clock() clock.Clock {
+	return h.config.Clock
+}
+
+// Transport returns the transport of the host, nil for message.TCP, for the
+// services that run on it.
+func (h *Host) Transport() message.Transport {
+	return h.config.Transport
+}
+
+// Nodes returns the virtual nodes.
+func (h *Host) Nodes() []*Node {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]*Node(nil), h.nodes...)
+}
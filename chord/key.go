@@ -14,9 +14,6 @@ type Key uint64
 func (key Key) BetweenExclusive(start Key, end Key) bool {
 	s, e := uint64(start), uint64(end)
 	k := uint64(key)
-	if s > config.maxKey || e > config.maxKey || k > config.maxKey {
-		panic("MaxKey constraint has been violated!")
-	}
 	if s == e {
 		return k != s && k != e // Full sweep - all keys are in range, unless it is s or e.
 	} else if s > e { // Interval wraps - if key is lt end or gt start, it is in interval
@@ -32,9 +29,6 @@ func (key Key) BetweenExclusive(start Key, end Key) bool {
 func (key Key) BetweenEndInclusive(start Key, end Key) bool {
 	s, e := uint64(start), uint64(end)
 	k := uint64(key)
-	if s > config.maxKey || e > config.maxKey || k > config.maxKey {
-		panic("MaxKey constraint has been violated!")
-	}
 	if s == e {
 		return true // Full sweep - all keys are in range.
 	}
@@ -51,14 +45,25 @@ func NewKey(value uint64) Key {
 }
 
 // Valid returns true if the key is within the keyspace, false otherwise
-func (key Key) Valid() bool {
-	k := uint64(key)
-	return 0 <= k && k < config.maxKey // Check for 0 <= not necessary
+func (key Key) Valid(maxKey uint64) bool {
+	return uint64(key) < maxKey
 }
 
 // Hash a string, returning a key bounded by maxKey.
 func Hash(s string, maxKey uint64) Key {
 	h := fnv.New64a()
 	h.Write([]byte(s))
-	return NewKey(h.Sum64() % maxKey)
+	return NewKey(mix(h.Sum64()) % maxKey)
+}
+
+// mix is the finalizer of MurmurHash3.  The low bits of FNV-1a barely change
+// between strings that differ only in their last bytes, such as the addresses
+// of the virtual nodes of a host, so they are mixed with the high bits.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
 }
@@ -0,0 +1,37 @@
+package chord
+
+// Load is what a node holds, for load balancers to compare nodes.
+type Load struct {
+	// Keys is the number of keys in the range of the node and KeyBytes the
+	// size of their values.
+	Keys     int
+	KeyBytes int
+	// Split is the position at which a joining node would take half of the
+	// keys, and SplitBytes half of their bytes.  Both are the key of the node
+	// when it holds fewer than two keys.
+	Split      Key
+	SplitBytes Key
+}
+
+// Load returns the load of the node.
+func (n *Node) Load() Load {
+	entries := n.Entries()
+	load := Load{Keys: len(entries), Split: n.key, SplitBytes: n.key}
+	for _, entry := range entries {
+		load.KeyBytes += entry.size()
+	}
+	if len(entries) < 2 {
+		return load
+	}
+	// The entries are in the order of the keyspace, from the predecessor on.
+	load.Split = Hash(entries[len(entries)/2-1].Key, n.config.MaxKey())
+	bytes := 0
+	for _, entry := range entries[:len(entries)-1] {
+		bytes += entry.size()
+		load.SplitBytes = Hash(entry.Key, n.config.MaxKey())
+		if 2*bytes >= load.KeyBytes {
+			break
+		}
+	}
+	return load
+}
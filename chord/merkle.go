@@ -0,0 +1,87 @@
+package chord
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+)
+
+// merkleDepth is the depth of the Merkle trees, which have 2^merkleDepth leaves.
+const merkleDepth = 8
+
+const merkleLeaves = 1 << merkleDepth
+
+// EntryDigest identifies the content of an entry without its value.
+type EntryDigest struct {
+	Key     string
+	Version uint64
+	Digest  uint64
+}
+
+// digest returns the digest of an entry.
+func digest(entry HashEntry) EntryDigest {
+	h := fnv.New64a()
+	h.Write([]byte(entry.Key))
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], entry.Version)
+	h.Write(b[:])
+	binary.BigEndian.PutUint64(b[:], uint64(entry.Expires.UnixNano()))
+	h.Write(b[:])
+	h.Write(entry.Value)
+	h.Write([]byte(entry.Type))
+	var siblings uint64
+	for _, s := range entry.Siblings {
+		// Siblings come in any order.
+		siblings ^= s.hash()
+	}
+	binary.BigEndian.PutUint64(b[:], siblings)
+	h.Write(b[:])
+	return EntryDigest{Key: entry.Key, Version: entry.Version, Digest: mix(h.Sum64())}
+}
+
+// merkleTree is a Merkle tree over the entries of a range (start, end],
+// whose leaves split the range evenly, so that two nodes build the same tree
+// from the same entries.  Node i of the tree has children 2i+1 and 2i+2,
+// and the leaves are the last merkleLeaves nodes.
+type merkleTree struct {
+	start  Key
+	width  uint64 // of the range of a leaf
+	maxKey uint64
+	hashes []uint64
+	leaves [][]HashEntry
+}
+
+func newMerkleTree(start Key, end Key, maxKey uint64, entries []HashEntry) *merkleTree {
+	length := (uint64(end) + maxKey - uint64(start)) % maxKey
+	if length == 0 {
+		length = maxKey
+	}
+	t := &merkleTree{
+		start:  start,
+		width:  (length + merkleLeaves - 1) / merkleLeaves,
+		maxKey: maxKey,
+		hashes: make([]uint64, 2*merkleLeaves-1),
+		leaves: make([][]HashEntry, merkleLeaves),
+	}
+	first := merkleLeaves - 1
+	for _, entry := range entries {
+		leaf := t.leaf(entry.Key)
+		t.leaves[leaf] = append(t.leaves[leaf], entry)
+		// XOR does not depend on the order of the entries within a leaf.
+		t.hashes[first+leaf] ^= digest(entry).Digest
+	}
+	for i := first - 1; i >= 0; i-- {
+		t.hashes[i] = mix(t.hashes[2*i+1]*31 + t.hashes[2*i+2])
+	}
+	return t
+}
+
+// leaf returns the leaf a key falls in.
+func (t *merkleTree) leaf(key string) int {
+	offset := (uint64(Hash(key, t.maxKey)) + t.maxKey - uint64(t.start) - 1) % t.maxKey
+	return int(offset / t.width)
+}
+
+// isLeaf returns true if node i of the tree is a leaf.
+func isLeaf(i int) bool {
+	return i >= merkleLeaves-1
+}
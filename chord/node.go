@@ -1,25 +1,21 @@
 package chord
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"math"
-	"strconv"
+	"math/rand"
+	"net"
+	"sync"
 	"time"
-)
-
-var internalTable *HashTable
-
-var my struct {
-	key     Key
-	address string
-}
 
-var fingers []*RemoteNode
-var predecessor *RemoteNode
-var successor *RemoteNode
-var caller *NodeCaller
-var doubleSuccessor *RemoteNode
+	"github.com/anteater2/bitmesh/clock"
+	"github.com/anteater2/bitmesh/crdt"
+	"github.com/anteater2/bitmesh/logging"
+	"github.com/anteater2/bitmesh/message"
+	"github.com/anteater2/bitmesh/metrics"
+	"github.com/anteater2/bitmesh/rpc"
+)
 
 // RemoteNode holds information for connecting to a remote node
 type RemoteNode struct {
@@ -27,95 +23,496 @@ type RemoteNode struct {
 	Key     Key
 }
 
-// CreateLocalNode creates a local node on its own ring.  It can be inserted into another ring later.
-func createLocalNode() {
-	// Initialize the internal table
-	internalTable = NewTable(config.maxKey)
+// Node is a chord node.
+// Every node binds its own pair of ports, so several of them can live in one process.
+type Node struct {
+	config  Config
+	key     Key
+	address string
+	table   *HashTable
+	caller  *NodeCaller
+	callee  *rpc.Callee
+	log     logging.Logger
+	// host runs the node as a virtual node, which shares the caller and the
+	// callee of the host and is reached at its path; nil for a plain node.
+	host *Host
+	path string
+	// id is the keyspace position set in the config, if any.
+	id *Key
 
-	// Set the variables of this node.
-	var err error
-	caller, err = NewNodeCaller(config.callerPort)
+	watches    map[string]Watch
+	queues     map[string]*watchQueue // by watch ID
+	watchMutex sync.Mutex
+	events     *message.Sender
+
+	// merkle caches the Merkle trees of ranges until the table changes.
+	merkle           map[[2]Key]*merkleTree
+	merkleGeneration uint64
+	merkleMutex      sync.Mutex
+
+	predecessor     *RemoteNode
+	successor       *RemoteNode
+	doubleSuccessor *RemoteNode
+	fingers         []*RemoteNode
+	onFailure       []func(RemoteNode)
+	onHandoff       []func(RemoteNode, Key, Key)
+	rw              sync.RWMutex
+
+	// leaving stops stabilize from notifying the successor, which would make
+	// it take the node back as its predecessor after Leave.
+	leaving        bool
+	stabilizeMutex sync.Mutex
+
+	started  time.Time
+	quit     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewNode creates a local node.  It is not reachable until it is started.
+func NewNode(config Config) (*Node, error) {
+	err := config.check()
+	if err != nil {
+		return nil, err
+	}
+	caller, err := NewNodeCallerWith(config.CallerPort, config.rpc())
 	if err != nil {
-		panic("rpcCaller failed to initialize")
+		return nil, err
 	}
-	err = initNodeCallee(config.calleePort)
+	callee, err := rpc.NewCalleeWith(config.CalleePort, config.rpc())
 	if err != nil {
-		panic("rpcCallee failed to initialize")
+		return nil, err
 	}
+	n := newNode(config, caller, callee, nil, "")
+	if len(config.IDs) > 0 {
+		n.id = &config.IDs[0]
+	}
+	return n, nil
+}
 
-	my.address = fmt.Sprintf("%s:%d", config.addr, config.calleePort)
+// newNode creates a node that uses caller and callee, implementing its
+// functions at path.
+func newNode(config Config, caller *NodeCaller, callee *rpc.Callee, host *Host, path string) *Node {
+	n := &Node{config: config, log: config.Logger, caller: caller, callee: callee, host: host, path: path}
+	// Initialize the internal table
+	n.table = NewTable(config.MaxKey())
+	n.table.clock = config.Clock
+	n.table.changed = n.changed
+	if config.Replicas > 1 {
+		n.table.tombstones = config.TombstoneTTL
+	}
+	n.watches = make(map[string]Watch)
+	n.queues = make(map[string]*watchQueue)
+	n.events = message.NewSenderWith(config.message())
+	n.events.Register(Event{})
+	n.implement()
+	return n
+}
 
-	my.key = Hash(my.address, config.maxKey)
-	log.Printf("[NODE %d] Keyspace position %d was derived from address %s\n", my.key, my.key, my.address)
+// Start starts the node on its own ring.  It can be inserted into another ring later.
+func (n *Node) Start() error {
+	n.log.Info("creating local node on its own ring", "ip", n.config.Addr, "size", n.config.MaxKey())
+	if n.host == nil {
+		err := n.callee.Start()
+		if err != nil {
+			return err
+		}
+		err = n.caller.Start()
+		if err != nil {
+			n.callee.Stop()
+			return err
+		}
+	}
 
-	predecessor = nil
-	successor = &RemoteNode{
-		Address: my.address,
-		Key:     my.key,
+	// The callee port may have been picked by the system.
+	_, port, err := net.SplitHostPort(n.callee.Addr())
+	if err != nil {
+		if n.host == nil {
+			n.caller.Stop()
+			n.callee.Stop()
+		}
+		return err
+	}
+	n.address = rpc.JoinPath(net.JoinHostPort(n.config.Addr, port), n.path)
+
+	if n.id != nil {
+		n.key = *n.id
+		n.log = logging.With(n.config.Logger, "node", n.key, "addr", n.address)
+		n.log.Info("keyspace position was set")
+	} else {
+		n.key = Hash(n.address, n.config.MaxKey())
+		n.log = logging.With(n.config.Logger, "node", n.key, "addr", n.address)
+		n.log.Info("keyspace position was derived from address")
+	}
+
+	n.predecessor = nil
+	n.successor = &RemoteNode{
+		Address: n.address,
+		Key:     n.key,
 	}
 	// Initialize the finger table for the solo ring configuration
-	fingers = make([]*RemoteNode, config.numFingers)
-	log.Printf("[NODE %d] Finger table size %d was derived from the keyspace size\n", my.key, config.numFingers)
-	for i := uint64(0); i < config.numFingers; i++ {
-		fingers[i] = successor
+	n.fingers = make([]*RemoteNode, n.config.NumFingers())
+	n.log.Debug("finger table size was derived from the keyspace size", "fingers", n.config.NumFingers())
+	for i := range n.fingers {
+		n.fingers[i] = n.successor
 	}
+
+	n.started = n.config.Clock.Now()
+	n.quit = make(chan struct{})
+	// The loops wait for their first round on timers set here, one after
+	// the other, so that they take turns in the same order on a simulated
+	// clock rather than race each other and Join.
+	n.wg.Add(5)
+	go n.stabilize(n.config.Clock.After(0))
+	go n.fixFingers(n.config.Clock.After(0))
+	go n.checkPredecessor(n.config.Clock.After(0))
+	go n.expireKeys(n.config.Clock.After(n.config.ExpireInterval))
+	go n.antiEntropy(n.config.Clock.After(n.config.AntiEntropyInterval))
+	return nil
 }
 
-// Start ...
-func Start(addr string, calleePort uint16, callerPort uint16, bits uint64) error {
-	err := Init(addr, calleePort, callerPort, bits)
-	if err != nil {
-		return err
-	}
-	log.Printf("[ANON] Creating local node @IP %s on its own ring of size %d...\n", config.addr, config.maxKey)
-	createLocalNode()
-	startNodeCallee()
-	caller.Start()
-	go stabilize()
-	log.Printf("[NODE %d] Beginning stabilizer...\n", my.key)
+// Stop stops the node.  It does not hand its keys over to anyone,
+// so to the rest of the ring this looks like a crash; see Leave.
+// Stopping a stopped node does nothing.
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.quit)
+		n.wg.Wait()
+		if n.host == nil {
+			n.caller.Stop()
+			n.callee.Stop()
+		} else {
+			n.callee.Remove(n.path)
+		}
+		n.log.Info("stopped")
+	})
+}
 
-	//go checkSuccessor()
+// Leave hands the keys of the node over to its successor, links its
+// predecessor and successor to each other, then stops the node.
+// If the successor cannot take the keys, the node keeps running.
+func (n *Node) Leave() error {
+	// Wait for a round of stabilize in progress.
+	n.stabilizeMutex.Lock()
+	n.leaving = true
+	n.stabilizeMutex.Unlock()
+	me := RemoteNode{Address: n.address, Key: n.key}
+	predecessor := n.Predecessor()
+	if predecessor != nil && predecessor.Address == n.address {
+		// The node has not been notified since it joined.
+		predecessor = nil
+	}
+	successor := n.Successor()
+	if successor.Address != n.address {
+		entries := n.Entries()
+		n.log.Info("leaving", "successor", successor.Key, "keys", len(entries))
+		err := n.caller.Leave(successor.Address, me, predecessor, successor, entries, n.Watches())
+		n.rw.RLock()
+		doubleSuccessor := n.doubleSuccessor
+		n.rw.RUnlock()
+		if err != nil && doubleSuccessor != nil && doubleSuccessor.Address != n.address && doubleSuccessor.Address != successor.Address {
+			// The successor may have left just before it became ours.
+			n.log.Warn("successor did not take the keys, trying the double successor", "peer", successor.Address, "error", err)
+			successor = *doubleSuccessor
+			err = n.caller.Leave(successor.Address, me, predecessor, successor, entries, n.Watches())
+		}
+		if err != nil {
+			n.stabilizeMutex.Lock()
+			n.leaving = false
+			n.stabilizeMutex.Unlock()
+			return err
+		}
+		n.countTransfer("out", entries)
+		n.handoff(successor, n.key, n.key)
+		if predecessor != nil && predecessor.Address != successor.Address {
+			// The predecessor would find out by itself eventually.
+			err = n.caller.Leave(predecessor.Address, me, predecessor, successor, nil, nil)
+			if err != nil {
+				n.log.Warn("could not tell the predecessor about leaving", "peer", predecessor.Address, "error", err)
+			}
+		}
+	}
+	n.Stop()
 	return nil
 }
 
 // Join a ring given a node IP address.
-func Join(ring string) error {
-	log.Printf("[NODE %d] Connecting node to network at %s\n", my.key, config.introducer)
-	ringSuccessor, err := caller.FindSuccessor(ring, my.key)
+func (n *Node) Join(ring string) error {
+	n.log.Info("joining ring", "peer", ring)
+	ringSuccessor, err := n.caller.FindSuccessor(ring, n.key)
 	if err != nil {
 		return err
 	}
-	successor = &ringSuccessor
-	fingers[0] = &ringSuccessor
-	log.Printf("[NODE %d] New successor %d!\n", my.key, successor.Key)
-	log.Printf("[NODE %d] My keyspace is (%d, %d, %d)\n", my.key, predecessor.Key, my.key, successor.Key)
-	findDoubleSuccessor()
-	go fixFingers()
-	go checkPredecessor()
+	return n.joinBefore(ringSuccessor)
+}
+
+// joinBefore joins a ring as the predecessor of ringSuccessor.
+func (n *Node) joinBefore(ringSuccessor RemoteNode) error {
+	if ringSuccessor.Key == n.key {
+		return fmt.Errorf("keyspace position %d is already taken by %s", n.key, ringSuccessor.Address)
+	}
+	// Take over the keys between the predecessor of our successor and us.
+	ringPredecessor, err := n.caller.GetPredecessor(ringSuccessor.Address)
+	if err != nil {
+		return err
+	}
+	entries, err := n.caller.GetKeyRange(ringSuccessor.Address, ringPredecessor.Key, n.key)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		n.table.PutEntry(entry)
+	}
+	n.countTransfer("in", entries)
+	n.updateTableMetrics()
+	if watches, err := n.caller.TakeWatches(ringSuccessor.Address, ringPredecessor.Key, n.key); err == nil {
+		n.putWatches(watches)
+	} else {
+		// The watchers put them back when they renew them.
+		n.log.Warn("could not take over the watches", "peer", ringSuccessor.Address, "error", err)
+	}
+	n.rw.Lock()
+	n.successor = &ringSuccessor
+	n.fingers[0] = &ringSuccessor
+	n.rw.Unlock()
+	n.config.Metrics.Add("bitmesh_chord_successor_changes_total", 1)
+	n.log.Info("new successor", "successor", ringSuccessor.Key, "peer", ringSuccessor.Address)
+	n.logKeyspace()
+	n.findDoubleSuccessor()
 	return nil
 }
 
+// JoinAny joins a ring through the first of seeds, in random order, that is
+// alive and lets the node in.  It returns the errors of every seed if none does.
+func (n *Node) JoinAny(seeds []string) error {
+	if len(seeds) == 0 {
+		return errors.New("no seed to join the ring through")
+	}
+	var errs []error
+	for _, i := range rand.Perm(len(seeds)) {
+		seed := seeds[i]
+		if !n.caller.IsAlive(seed) {
+			n.log.Warn("seed is down", "peer", seed)
+			errs = append(errs, fmt.Errorf("%s: not alive", seed))
+			continue
+		}
+		err := n.Join(seed)
+		if err == nil {
+			return nil
+		}
+		n.log.Warn("could not join through seed", "peer", seed, "error", err)
+		errs = append(errs, fmt.Errorf("%s: %w", seed, err))
+	}
+	return errors.Join(errs...)
+}
+
+// Key returns the position of the node on the ring.
+func (n *Node) Key() Key {
+	return n.key
+}
+
+// Address returns the address other nodes use to reach this node.
+func (n *Node) Address() string {
+	return n.address
+}
+
+// Predecessor returns the predecessor of the node, or nil if it is unknown.
+func (n *Node) Predecessor() *RemoteNode {
+	n.rw.RLock()
+	defer n.rw.RUnlock()
+	if n.predecessor == nil {
+		return nil
+	}
+	predecessor := *n.predecessor
+	return &predecessor
+}
+
+// Successor returns the successor of the node.
+func (n *Node) Successor() RemoteNode {
+	n.rw.RLock()
+	defer n.rw.RUnlock()
+	return *n.successor
+}
+
+// Status is a snapshot of the state of a node.
+type Status struct {
+	Key         Key
+	Address     string
+	Predecessor *RemoteNode
+	// Successors lists the successor, then the double successor if it is known.
+	Successors []RemoteNode
+	Fingers    []RemoteNode
+	Uptime     time.Duration
+	// Keys is the number of keys stored on the node and KeyBytes the size of their values.
+	Keys     int
+	KeyBytes int
+}
+
+// Status returns the state of the node.
+func (n *Node) Status() Status {
+	status := Status{
+		Key:         n.key,
+		Address:     n.address,
+		Predecessor: n.Predecessor(),
+		Successors:  []RemoteNode{n.Successor()},
+		Fingers:     n.Fingers(),
+		Uptime:      n.config.Clock.Now().Sub(n.started),
+		Keys:        n.table.Len(),
+		KeyBytes:    n.table.Size(),
+	}
+	n.rw.RLock()
+	if n.doubleSuccessor != nil {
+		status.Successors = append(status.Successors, *n.doubleSuccessor)
+	}
+	n.rw.RUnlock()
+	return status
+}
+
+// Entries returns the stored entries the node is responsible for,
+// or all of them if it does not know its predecessor.
+func (n *Node) Entries() []HashEntry {
+	if predecessor := n.Predecessor(); predecessor != nil {
+		return n.table.GetRange(predecessor.Key, n.key)
+	}
+	return n.table.GetRange(n.key, n.key)
+}
+
+// Fingers returns a copy of the finger table.
+func (n *Node) Fingers() []RemoteNode {
+	n.rw.RLock()
+	defer n.rw.RUnlock()
+	fingers := make([]RemoteNode, len(n.fingers))
+	for i, e := range n.fingers {
+		fingers[i] = *e
+	}
+	return fingers
+}
+
+// MaxKey returns the size of the key space of the node.
+func (n *Node) MaxKey() uint64 {
+	return n.config.MaxKey()
+}
+
+// Clock returns the clock of the node, for the services that run on it.
+func (n *Node) Clock() clock.Clock {
+	return n.config.Clock
+}
+
+// Transport returns the transport of the node, nil for message.TCP, for the
+// services that run on it.
+func (n *Node) Transport() message.Transport {
+	return n.config.Transport
+}
+
+// NextHop returns the next node on the way to the owner of key: the node
+// itself if it owns key, its successor if that one does, or else the closest
+// preceding finger.  It is one step of a lookup, for overlays that route hop
+// by hop.
+func (n *Node) NextHop(key Key) RemoteNode {
+	if n.isLocalResponsible(key) {
+		return RemoteNode{Address: n.address, Key: n.key}
+	}
+	successor := n.Successor()
+	if key.BetweenEndInclusive(n.key, successor.Key) {
+		return successor
+	}
+	if target := n.closestPrecedingNode(key); target.Address != n.address {
+		return target
+	}
+	return successor
+}
+
+// Implement adds a remote function to the node, like rpc.Callee.Implement,
+// so that services built on the ring are reached at the address of the node.
+func (n *Node) Implement(f interface{}) {
+	n.callee.ImplementAt(n.path, f)
+}
+
+// OnFailure registers f to be called with every neighbour that stabilize or
+// checkPredecessor find dead.
+func (n *Node) OnFailure(f func(failed RemoteNode)) {
+	n.rw.Lock()
+	n.onFailure = append(n.onFailure, f)
+	n.rw.Unlock()
+}
+
+// OnHandoff registers f to be called when the node hands the keys in
+// (start, end] over to another node: a new predecessor that notified it, or
+// its successor when it leaves, then start == end and the range is the whole
+// ring.  Services that keep state by key move it along with the keys.
+func (n *Node) OnHandoff(f func(to RemoteNode, start Key, end Key)) {
+	n.rw.Lock()
+	n.onHandoff = append(n.onHandoff, f)
+	n.rw.Unlock()
+}
+
+// handoff calls the OnHandoff functions.  The caller must not hold the lock.
+func (n *Node) handoff(to RemoteNode, start Key, end Key) {
+	n.rw.RLock()
+	onHandoff := n.onHandoff
+	n.rw.RUnlock()
+	for _, f := range onHandoff {
+		f(to, start, end)
+	}
+}
+
+// failed calls the OnFailure functions.  The caller must not hold the lock.
+func (n *Node) failed(node RemoteNode) {
+	n.rw.RLock()
+	onFailure := n.onFailure
+	n.rw.RUnlock()
+	for _, f := range onFailure {
+		f(node)
+	}
+}
+
+func (n *Node) logKeyspace() {
+	n.rw.RLock()
+	defer n.rw.RUnlock()
+	if n.predecessor == nil {
+		n.log.Debug("keyspace", "predecessor", "?", "successor", n.successor.Key)
+		return
+	}
+	n.log.Debug("keyspace", "predecessor", n.predecessor.Key, "successor", n.successor.Key)
+}
+
+// sleep pauses for d and reports whether the node is still running.
+func (n *Node) sleep(d time.Duration) bool {
+	return n.wait(n.config.Clock.After(d))
+}
+
+// wait waits for timer and reports whether the node is still running.
+func (n *Node) wait(timer <-chan time.Time) bool {
+	select {
+	case <-n.quit:
+		return false
+	case <-timer:
+		return true
+	}
+}
+
 // closestPrecedingNode finds the closest preceding node to the key in this node's finger table.
 // This doesn't need any RPC.
-func closestPrecedingNode(key Key) RemoteNode {
-	for i := config.numFingers - 1; i > 0; i-- { // WARNING: GO DOES THIS i>0 CHECK AT THE END OF THE LOOP!
-		//log.Printf("Checking finger %d\n", i)
-		if fingers[i] == nil {
-			panic("You attempted to find ClosestPrecedingNode without an initialized finger table!")
-		}
-		if fingers[i].Key.BetweenExclusive(my.key, key) {
-			return *fingers[i]
+func (n *Node) closestPrecedingNode(key Key) RemoteNode {
+	n.rw.RLock()
+	defer n.rw.RUnlock()
+	for i := len(n.fingers) - 1; i > 0; i-- {
+		if n.fingers[i].Key.BetweenExclusive(n.key, key) {
+			return *n.fingers[i]
 		}
 	}
-	return RemoteNode{Address: my.address, Key: my.key}
+	return RemoteNode{Address: n.address, Key: n.key}
 }
 
 // Check if this node is responsible for a key.
-func isLocalResponsible(k Key) bool {
-	if predecessor == nil {
-		return false
+func (n *Node) isLocalResponsible(k Key) bool {
+	n.rw.RLock()
+	defer n.rw.RUnlock()
+	if n.predecessor == nil {
+		// Alone on the ring, every key is ours.
+		return n.successor.Address == n.address
 	}
-	return k.BetweenEndInclusive(predecessor.Key, my.key)
+	return k.BetweenEndInclusive(n.predecessor.Key, n.key)
 }
 
 /*****************************************************************************
@@ -123,118 +520,326 @@ func isLocalResponsible(k Key) bool {
  *****************************************************************************/
 
 // findSuccessor finds the successor node to the key.  This may require RPC calls.
-func findSuccessor(key Key) RemoteNode {
-	if key.BetweenEndInclusive(my.key, successor.Key) {
+func (n *Node) findSuccessor(key Key) (RemoteNode, error) {
+	successor := n.Successor()
+	if key.BetweenEndInclusive(n.key, successor.Key) {
 		// key is between this node and its successor
-		return *successor
+		n.config.Metrics.Observe("bitmesh_chord_lookup_hops", 0)
+		return successor, nil
 	}
-	target := closestPrecedingNode(key)
-	if target.Address == my.address {
-		log.Printf("[NODE %d][DIAGNOSTIC] Infinite loop detected!\n", my.key)
-		log.Printf("[NODE %d][DIAGNOSTIC] This is likely because of a bad finger table. Skip forward 1.\n", my.key)
-		target = *successor
+	target := n.closestPrecedingNode(key)
+	if target.Address == n.address {
+		// This is likely because of a bad finger table.  Skip forward 1.
+		n.log.Warn("no finger precedes the key, asking the successor", "key", key)
+		target = successor
 	}
 	// Now, we have to do an RPC on target to find the successor.
-	rv, err := caller.FindSuccessor(target.Address, key)
+	rv, hops, err := n.caller.lookup(target.Address, key)
 	if err != nil {
-		log.Printf("[NODE %d][DIAGNOSTIC] Remote target is "+target.Address+"\n", my.key)
-		log.Printf("[NODE %d][DIAGNOSTIC] Target did not respond (bad finger?) setting to successor %s(%d)\n", my.key, successor.Address, successor.Key)
-		rv, err = caller.FindSuccessor(successor.Address, key)
+		n.log.Warn("lookup target did not respond (bad finger?), asking the successor",
+			"peer", target.Address, "successor", successor.Key, "error", err)
+		rv, hops, err = n.caller.lookup(successor.Address, key)
 		if err != nil {
-			panic("Ring integrity too low to recover from missing successor!")
+			n.config.Metrics.Add("bitmesh_chord_lookup_failures_total", 1)
+			return RemoteNode{}, errors.New("ring integrity too low to recover from missing successor")
 		}
 	}
-	return rv
+	n.config.Metrics.Observe("bitmesh_chord_lookup_hops", float64(hops))
+	return rv, nil
 }
 
 // get notified
-func notify(node RemoteNode) {
-	if predecessor == nil || node.Key.BetweenExclusive(predecessor.Key, my.key) {
-		log.Printf("[NODE %d] Got notify from %s!  New predecessor: %d\n", my.key, node.Address, node.Key)
-		predecessor = &node
-		log.Printf("[NODE %d] My keyspace is (%d, %d, %d)\n", my.key, predecessor.Key, my.key, successor.Key)
-		if predecessor.Address != my.address {
-			rv, err := caller.GetKeyRange(predecessor.Address, my.key, predecessor.Key)
-			if err != nil {
-				log.Fatal(err)
-			}
-			for _, entry := range rv {
-				internalTable.Put(entry.Key, entry.Value)
-			}
-		}
-		findDoubleSuccessor()
+func (n *Node) notify(node RemoteNode) {
+	n.rw.Lock()
+	if n.predecessor != nil && !node.Key.BetweenExclusive(n.predecessor.Key, n.key) {
+		n.rw.Unlock()
+		return
+	}
+	n.log.Info("new predecessor", "predecessor", node.Key, "peer", node.Address)
+	// The keys up to the new predecessor are its now; without a previous
+	// one, that is every key but ours.
+	start := n.key
+	if n.predecessor != nil {
+		start = n.predecessor.Key
 	}
+	n.predecessor = &node
+	n.rw.Unlock()
+	n.config.Metrics.Add("bitmesh_chord_predecessor_changes_total", 1)
+	n.logKeyspace()
+	if node.Address != n.address {
+		n.handoff(node, start, node.Key)
+	}
+	n.findDoubleSuccessor()
 }
 
 // GetPredecessor is a getter for the predecessor, implemented for the sake of RPC calls.
-func getPredecessor() RemoteNode {
-	//log.Printf("RPC Call to GetPredecessor!\n")
-	if predecessor == nil {
-		//log.Printf("Returned self node, no predecessor set.\n")
-		return RemoteNode{
-			Address: my.address,
-			Key:     my.key,
-		}
+func (n *Node) getPredecessor() RemoteNode {
+	if predecessor := n.Predecessor(); predecessor != nil {
+		return *predecessor
+	}
+	return RemoteNode{
+		Address: n.address,
+		Key:     n.key,
 	}
-	//log.Printf("Returned predecessor.\n")
-	return *predecessor
 }
 
-/*func putKeyBackup(pkr putCall) int {
- 	keyString := pkr.KeyString
-	data := pkr.Data
- 	internalTable.Put(keyString, data)
- 	return 1
- }*/
+func (n *Node) getKey(keyString string) (HashEntry, error) {
+	hash := Hash(keyString, n.config.MaxKey())
+	if !n.isLocalResponsible(hash) {
+		n.log.Debug("get: not responsible", "key", keyString, "hash", hash)
+		return HashEntry{}, ErrWrongNode
+	}
+	entry, err := n.table.GetEntry(keyString)
+	if err != nil {
+		n.log.Debug("get: no such key", "key", keyString, "hash", hash)
+		return HashEntry{}, ErrNotFound
+	}
+	if entry.Value, err = entry.Current(); err != nil {
+		n.log.Debug("get: siblings", "key", keyString, "hash", hash, "siblings", len(entry.Siblings))
+		return HashEntry{}, err
+	}
+	n.log.Debug("get", "key", keyString, "hash", hash, "version", entry.Version)
+	return entry, nil
+}
 
-func getKey(keyString string) ([]byte, error) {
-	if !isLocalResponsible(Hash(keyString, config.maxKey)) {
-		log.Printf("[NODE %d] GetKey %s (HASH %d): sorry, it's none of my business\n", my.key, keyString, Hash(keyString, config.maxKey))
-		return []byte{0}, fmt.Errorf("wrong node to get the key")
+// getSiblings returns the values of a key with their vector clocks.  A key
+// put without a vector clock has one sibling with an empty clock.
+func (n *Node) getSiblings(key string) ([]Sibling, error) {
+	hash := Hash(key, n.config.MaxKey())
+	if !n.isLocalResponsible(hash) {
+		n.log.Debug("get siblings: not responsible", "key", key, "hash", hash)
+		return nil, ErrWrongNode
 	}
-	rv, err := internalTable.Get(keyString)
+	entry, err := n.table.GetEntry(key)
 	if err != nil {
-		log.Printf("[NODE %d] GetKey %s (HASH %d): no such key\n", my.key, keyString, Hash(keyString, config.maxKey))
-		return []byte{0}, fmt.Errorf("no such key")
+		return nil, ErrNotFound
 	}
-	log.Printf("[NODE %d] GetKey %s (HASH %d): success\n", my.key, keyString, Hash(keyString, config.maxKey))
-	return rv, nil
+	if len(entry.Siblings) == 0 {
+		return []Sibling{{Value: entry.Value}}, nil
+	}
+	return entry.Siblings, nil
 }
 
-func putKey(key string, value []byte) error {
-	if !isLocalResponsible(Hash(key, config.maxKey)) {
-		log.Printf("[NODE %d] PutKey %s (HASH %d): sorry, it's none of my business\n", my.key, key, Hash(key, config.maxKey))
-		return fmt.Errorf("wrong node to get the key")
+// putSibling puts a value with the vector clock it was read with, as a
+// write of the node; see HashTable.PutSibling.  It returns the new version
+// of the key.
+func (n *Node) putSibling(key string, value []byte, context VectorClock, ttl time.Duration) (uint64, error) {
+	hash := Hash(key, n.config.MaxKey())
+	if !n.isLocalResponsible(hash) {
+		n.log.Debug("put sibling: not responsible", "key", key, "hash", hash)
+		return 0, ErrWrongNode
 	}
-	internalTable.Put(key, value)
-	log.Printf("[NODE %d] PutKey %s (HASH %d): success\n", my.key, key, Hash(key, config.maxKey))
+	version := n.table.PutSibling(key, value, context, n.key, n.expiry(ttl))
+	n.updateTableMetrics()
+	n.log.Debug("put sibling", "key", key, "hash", hash, "ttl", ttl, "version", version)
+	return version, nil
+}
 
+// putKey puts a key that expires after ttl, or never if ttl is not positive.
+// It returns the new version of the key.
+func (n *Node) putKey(key string, value []byte, ttl time.Duration) (uint64, error) {
+	hash := Hash(key, n.config.MaxKey())
+	if !n.isLocalResponsible(hash) {
+		n.log.Debug("put: not responsible", "key", key, "hash", hash)
+		return 0, ErrWrongNode
+	}
+	version := n.table.PutWithExpiry(key, value, n.expiry(ttl))
+	n.updateTableMetrics()
+	n.log.Debug("put", "key", key, "hash", hash, "ttl", ttl, "version", version)
+
+	return version, nil
+}
+
+// applyKey does an operation on the CRDT stored at a key, as a write of the
+// node, and returns its new state and version.
+func (n *Node) applyKey(key string, op crdt.Op) ([]byte, uint64, error) {
+	hash := Hash(key, n.config.MaxKey())
+	if !n.isLocalResponsible(hash) {
+		n.log.Debug("apply: not responsible", "key", key, "hash", hash)
+		return nil, 0, ErrWrongNode
+	}
+	state, version, err := n.table.Apply(key, op, n.address)
+	if err != nil {
+		n.log.Debug("apply: failed", "key", key, "hash", hash, "type", op.Type, "error", err)
+		return nil, 0, err
+	}
+	n.updateTableMetrics()
+	n.log.Debug("apply", "key", key, "hash", hash, "type", op.Type, "op", op.Kind, "version", version)
+	return state, version, nil
+}
+
+// compareAndSwapKey puts a key if its version is still version, 0 standing
+// for a missing key.  It returns the new version of the key.
+func (n *Node) compareAndSwapKey(key string, version uint64, value []byte, ttl time.Duration) (uint64, error) {
+	hash := Hash(key, n.config.MaxKey())
+	if !n.isLocalResponsible(hash) {
+		n.log.Debug("compare and swap: not responsible", "key", key, "hash", hash)
+		return 0, ErrWrongNode
+	}
+	newVersion, err := n.table.CompareAndSwap(key, version, value, n.expiry(ttl))
+	if err != nil {
+		n.log.Debug("compare and swap: version mismatch", "key", key, "hash", hash, "version", version)
+		return 0, err
+	}
+	n.updateTableMetrics()
+	n.log.Debug("compare and swap", "key", key, "hash", hash, "ttl", ttl, "version", newVersion)
+	return newVersion, nil
+}
+
+// expireKey sets a key to expire after ttl, or never if ttl is not
+// positive.  It returns the new version of the key.
+func (n *Node) expireKey(key string, ttl time.Duration) (uint64, error) {
+	hash := Hash(key, n.config.MaxKey())
+	if !n.isLocalResponsible(hash) {
+		n.log.Debug("expire: not responsible", "key", key, "hash", hash)
+		return 0, ErrWrongNode
+	}
+	version, err := n.table.SetExpiry(key, n.expiry(ttl))
+	if err != nil {
+		n.log.Debug("expire: no such key", "key", key, "hash", hash)
+		return 0, err
+	}
+	n.log.Debug("expire", "key", key, "hash", hash, "ttl", ttl, "version", version)
+	return version, nil
+}
+
+// ttlKey returns the time left before a key expires, or 0 if it never does.
+func (n *Node) ttlKey(key string) (time.Duration, error) {
+	hash := Hash(key, n.config.MaxKey())
+	if !n.isLocalResponsible(hash) {
+		n.log.Debug("ttl: not responsible", "key", key, "hash", hash)
+		return 0, ErrWrongNode
+	}
+	entry, err := n.table.GetEntry(key)
+	if err != nil {
+		return 0, ErrNotFound
+	}
+	if entry.Expires.IsZero() {
+		return 0, nil
+	}
+	return entry.Expires.Sub(n.config.Clock.Now()), nil
+}
+
+// expiry returns the deadline of a key put now with ttl.
+func (n *Node) expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return n.config.Clock.Now().Add(ttl)
+}
+
+func (n *Node) deleteKey(key string) error {
+	hash := Hash(key, n.config.MaxKey())
+	if !n.isLocalResponsible(hash) {
+		n.log.Debug("delete: not responsible", "key", key, "hash", hash)
+		return ErrWrongNode
+	}
+	if !n.table.Delete(key) {
+		n.log.Debug("delete: no such key", "key", key, "hash", hash)
+		return ErrNotFound
+	}
+	n.updateTableMetrics()
+	n.log.Debug("delete", "key", key, "hash", hash)
 	return nil
 }
 
-func getKeyRange(start Key, end Key) []HashEntry {
-	return internalTable.GetRange(start, end)
+func (n *Node) getKeyRange(start Key, end Key) []HashEntry {
+	return n.table.GetRange(start, end)
+}
+
+// leave takes over the keys of a node that is leaving the ring,
+// and replaces it as predecessor or successor.
+func (n *Node) leave(node RemoteNode, predecessor *RemoteNode, successor RemoteNode, entries []HashEntry, watches []Watch) {
+	// A round of stabilize in progress could still adopt the leaving node.
+	n.stabilizeMutex.Lock()
+	defer n.stabilizeMutex.Unlock()
+	for _, entry := range entries {
+		n.table.PutEntry(entry)
+	}
+	n.putWatches(watches)
+	n.countTransfer("in", entries)
+	n.updateTableMetrics()
+	n.rw.Lock()
+	predecessorChanged := n.predecessor != nil && n.predecessor.Address == node.Address
+	if predecessorChanged {
+		if predecessor == nil || predecessor.Address == n.address || predecessor.Address == node.Address {
+			n.predecessor = nil
+		} else {
+			n.predecessor = predecessor
+		}
+	}
+	successorChanged := n.successor.Address == node.Address
+	if successorChanged {
+		n.successor = &successor
+		n.fingers[0] = &successor
+	}
+	n.purifyFingerTables(node)
+	n.rw.Unlock()
+	n.log.Info("node left", "left", node.Key, "peer", node.Address, "keys", len(entries))
+	if predecessorChanged {
+		n.config.Metrics.Add("bitmesh_chord_predecessor_changes_total", 1)
+	}
+	if successorChanged {
+		n.config.Metrics.Add("bitmesh_chord_successor_changes_total", 1)
+	}
+	n.logKeyspace()
+	n.findDoubleSuccessor()
 }
 
-func findDoubleSuccessor() {
-	log.Printf("[NODE %d] Trying to find double successor (i.e. the node after %s(%d))", my.key, successor.Address, successor.Key)
-	nextSuccessor, err := caller.FindSuccessor(successor.Address, successor.Key+1)
+func (n *Node) findDoubleSuccessor() {
+	successor := n.Successor()
+	n.log.Debug("looking for the double successor", "successor", successor.Key, "peer", successor.Address)
+	next := Key((uint64(successor.Key) + 1) % n.config.MaxKey())
+	nextSuccessor, err := n.caller.FindSuccessor(successor.Address, next)
 	if err != nil {
-		log.Print(err)
-		panic("Not enough ring integrity left to recover!")
+		n.log.Warn("could not find the double successor", "error", err)
+		return
+	}
+	n.rw.Lock()
+	if n.doubleSuccessor == nil || nextSuccessor.Key != n.doubleSuccessor.Key {
+		n.log.Info("new double successor", "double_successor", nextSuccessor.Key, "peer", nextSuccessor.Address)
+		n.doubleSuccessor = &nextSuccessor
+	}
+	n.rw.Unlock()
+}
+
+// fallBack returns a live node to replace the successor dead with: the
+// double successor, else the nearest live finger, else the predecessor.
+// Stabilize then walks back from it to the node right after this one.
+func (n *Node) fallBack(dead RemoteNode) (RemoteNode, bool) {
+	n.rw.RLock()
+	var candidates []RemoteNode
+	if n.doubleSuccessor != nil {
+		candidates = append(candidates, *n.doubleSuccessor)
 	}
-	//nextSuccessor := nextSuccessorInterf.(RemoteNode)
-	if doubleSuccessor == nil || nextSuccessor.Key != doubleSuccessor.Key {
-		log.Printf("[NODE %d] New doubleSuccessor %d\n", my.key, nextSuccessor.Key)
-		doubleSuccessor = &nextSuccessor
+	for _, finger := range n.fingers {
+		candidates = append(candidates, *finger)
 	}
+	if n.predecessor != nil {
+		candidates = append(candidates, *n.predecessor)
+	}
+	n.rw.RUnlock()
+	tried := map[string]bool{n.address: true, dead.Address: true}
+	for _, candidate := range candidates {
+		if tried[candidate.Address] {
+			continue
+		}
+		tried[candidate.Address] = true
+		if n.caller.IsAlive(candidate.Address) {
+			return candidate, true
+		}
+	}
+	return RemoteNode{}, false
 }
 
-func purifyFingerTables(node *RemoteNode) {
-	for i := uint64(0); i < config.numFingers; i-- {
-		if fingers[i].Key == node.Key {
-			log.Printf("[NODE %d] Purifying finger %d to no longer point to %d", my.key, i, node.Key)
-			fingers[i] = successor
+// purifyFingerTables points the fingers at node to the successor instead.
+// The caller must hold the write lock.
+func (n *Node) purifyFingerTables(node RemoteNode) {
+	for i := range n.fingers {
+		if n.fingers[i].Key == node.Key {
+			n.log.Info("purifying finger", "finger", i, "dead", node.Key)
+			n.fingers[i] = n.successor
+			n.config.Metrics.Add("bitmesh_chord_finger_changes_total", 1)
 		}
 	}
 }
@@ -243,79 +848,185 @@ func purifyFingerTables(node *RemoteNode) {
  * Periodically run                                                          *
  *****************************************************************************/
 
-// CheckPredecessor is a goroutine that keeps tabs on the predecessor and updates itself if the predecessor leaves the network.
-func checkPredecessor() {
-	for true {
-		if predecessor != nil {
-			if !caller.IsAlive(predecessor.Address) {
-				log.Printf("[NODE %d] Predecessor "+predecessor.Address+" failed a health check!  Attempting to adjust...", my.key)
-				predecessor = nil
-				findDoubleSuccessor()
-			}
+// checkPredecessor is a goroutine that keeps tabs on the predecessor and updates itself if the predecessor leaves the network.
+func (n *Node) checkPredecessor(start <-chan time.Time) {
+	defer n.wg.Done()
+	for ok := n.wait(start); ok; ok = n.sleep(n.config.StabilizeInterval) {
+		n.checkPredecessorOnce()
+	}
+}
+
+// expireKeys removes the expired keys and watches every ExpireInterval.  Gets do not
+// wait for it: they never return an expired key.
+func (n *Node) expireKeys(start <-chan time.Time) {
+	defer n.wg.Done()
+	for ok := n.wait(start); ok; ok = n.sleep(n.config.ExpireInterval) {
+		n.expireWatches()
+		if expired := n.table.Expire(); expired > 0 {
+			n.config.Metrics.Add("bitmesh_chord_expired_keys_total", float64(expired))
+			n.updateTableMetrics()
+			n.log.Debug("removed expired keys", "keys", expired)
 		}
-		time.Sleep(time.Second * 1)
+	}
+}
+
+func (n *Node) checkPredecessorOnce() {
+	n.rw.RLock()
+	predecessor := n.predecessor
+	n.rw.RUnlock()
+	if predecessor != nil && !n.caller.IsAlive(predecessor.Address) {
+		n.log.Warn("predecessor failed a health check", "predecessor", predecessor.Key, "peer", predecessor.Address)
+		n.rw.Lock()
+		cleared := n.predecessor == predecessor
+		if cleared {
+			n.predecessor = nil
+		}
+		n.rw.Unlock()
+		if cleared {
+			n.config.Metrics.Add("bitmesh_chord_predecessor_changes_total", 1)
+			n.failed(*predecessor)
+		}
+		n.findDoubleSuccessor()
 	}
 }
 
 // stabilize the Successor and Predecessor fields of this node.
-// This is a goroutine and never terminates.
-func stabilize() {
-	for true { // This is how while loops work.  Not even joking.
-		var remote RemoteNode
-		var err error
-		if predecessor == nil {
-			log.Printf("[NODE %d] Null predecessor!  New predecessor: %d\n", my.key, successor.Key)
-			predecessor = successor
+// This is a goroutine and runs until the node stops.
+func (n *Node) stabilize(start <-chan time.Time) {
+	defer n.wg.Done()
+	for ok := n.wait(start); ok; {
+		interval := n.config.StabilizeInterval
+		if !n.stabilizeOnce() {
+			interval *= 10
 		}
-		if successor.Address == my.address {
-			// Avoid making an RPC call to ourselves
-			remote = *predecessor
-		} else {
-			remote, err = caller.GetPredecessor(successor.Address)
-			if err != nil { // This is caused by the successor failing to respond (CHKSUC)
-				log.Printf("[NODE %d][DIAGNOSTIC] Stabilization call failed!", my.key)
-				log.Printf("[NODE %d][DIAGNOSTIC] Error: "+strconv.Itoa(int(remote.Key)), my.key)
-				log.Print(err)
-				log.Printf("[NODE %d][DIAGNOSTIC] Assuming that the error is the result of a successor node disconnection. Replacing with double successor: "+doubleSuccessor.Address, my.key)
-				purifyFingerTables(successor)
-				*successor = *doubleSuccessor
-				log.Printf("[NODE %d] My keyspace is (%d, %d, %d)\n", my.key, predecessor.Key, my.key, successor.Key)
-				findDoubleSuccessor()
-				time.Sleep(time.Second * 10)
-				continue
+		ok = n.sleep(interval)
+	}
+}
+
+// stabilizeOnce runs one round of stabilize.
+// It returns false if the successor did not answer.
+func (n *Node) stabilizeOnce() bool {
+	n.stabilizeMutex.Lock()
+	defer n.stabilizeMutex.Unlock()
+	if n.leaving {
+		return true
+	}
+	var remote RemoteNode
+	var err error
+	successor := n.Successor()
+	if successor.Address == n.address {
+		// Avoid making an RPC call to ourselves
+		remote = n.getPredecessor()
+	} else {
+		remote, err = n.caller.GetPredecessor(successor.Address)
+		if err != nil { // This is caused by the successor failing to respond (CHKSUC)
+			n.log.Warn("stabilization call failed", "peer", successor.Address, "error", err)
+			next, ok := n.fallBack(successor)
+			n.rw.Lock()
+			if !ok {
+				n.rw.Unlock()
+				n.config.Metrics.Add("bitmesh_chord_stabilize_total", 1, outcome("failed"))
+				n.log.Error("no live node to fall back to")
+			} else {
+				// Assume that the successor has left.
+				n.log.Warn("replacing successor", "successor", next.Key, "peer", next.Address)
+				n.successor = &next
+				n.purifyFingerTables(successor)
+				n.rw.Unlock()
+				n.config.Metrics.Add("bitmesh_chord_stabilize_total", 1, outcome("fell_back"))
+				n.config.Metrics.Add("bitmesh_chord_successor_changes_total", 1)
+				n.logKeyspace()
+				n.findDoubleSuccessor()
+				n.failed(successor)
 			}
+			return false
 		}
-		if remote.Key.BetweenExclusive(my.key, successor.Key) && caller.IsAlive(remote.Address) {
-			log.Printf("[NODE %d] New successor %d\n", my.key, remote.Key)
-			successor = &remote
-			fingers[0] = &remote
-			log.Printf("[NODE %d] My keyspace is (%d, %d, %d)\n", my.key, predecessor.Key, my.key, successor.Key)
-			findDoubleSuccessor()
-		}
-		caller.Notify(successor.Address, RemoteNode{
-			Address: my.address,
-			Key:     my.key,
-		})
-		time.Sleep(time.Second * 1)
 	}
+	if remote.Key.BetweenExclusive(n.key, successor.Key) && n.caller.IsAlive(remote.Address) {
+		n.log.Info("new successor", "successor", remote.Key, "peer", remote.Address)
+		n.rw.Lock()
+		n.successor = &remote
+		n.fingers[0] = &remote
+		n.rw.Unlock()
+		n.config.Metrics.Add("bitmesh_chord_stabilize_total", 1, outcome("new_successor"))
+		n.config.Metrics.Add("bitmesh_chord_successor_changes_total", 1)
+		n.logKeyspace()
+		n.findDoubleSuccessor()
+	} else {
+		n.config.Metrics.Add("bitmesh_chord_stabilize_total", 1, outcome("ok"))
+	}
+	me := RemoteNode{
+		Address: n.address,
+		Key:     n.key,
+	}
+	if successor = n.Successor(); successor.Address == n.address {
+		n.notify(me)
+	} else {
+		n.caller.Notify(successor.Address, me)
+	}
+	return true
 }
 
 // fixFingers is the finger-table updater.
-// Again, this is a goroutine and never terminates.
-func fixFingers() {
-	log.Printf("[NODE %d] Starting to finger nodes...\n", my.key) //hehehe
+// Again, this is a goroutine and runs until the node stops.
+func (n *Node) fixFingers(start <-chan time.Time) {
+	defer n.wg.Done()
 	currentFingerIndex := uint64(0)
-	for true {
+	for ok := n.wait(start); ok; ok = n.sleep(n.config.StabilizeInterval) {
 		currentFingerIndex++
-		currentFingerIndex %= config.numFingers
-		offset := uint64(math.Pow(2, float64(currentFingerIndex)))
-		val := (uint64(my.key) + offset) % config.maxKey
-		newFinger := findSuccessor(Key(val))
-		//log.Printf("Updating finger %d (pointing to key %d) of %d to point to node %s\n", currentFingerIndex, val, len(Fingers), newFinger.Address)
-		if newFinger.Address != fingers[currentFingerIndex].Address {
-			log.Printf("[NODE %d] Updating finger %d (key %d) of %d to point to node %s (key %d)\n", my.key, currentFingerIndex, val, len(fingers)-1, newFinger.Address, newFinger.Key)
-		}
-		fingers[currentFingerIndex] = &newFinger
-		time.Sleep(time.Second * 1)
+		currentFingerIndex %= n.config.NumFingers()
+		n.fixFinger(currentFingerIndex)
+	}
+}
+
+func (n *Node) fixFinger(i uint64) {
+	offset := uint64(math.Pow(2, float64(i)))
+	val := (uint64(n.key) + offset) % n.config.MaxKey()
+	newFinger, err := n.findSuccessor(Key(val))
+	if err != nil {
+		n.log.Warn("could not update finger", "finger", i, "error", err)
+		return
 	}
+	n.rw.Lock()
+	if newFinger.Address != n.fingers[i].Address {
+		n.config.Metrics.Add("bitmesh_chord_finger_changes_total", 1)
+		n.log.Debug("updating finger", "finger", i, "target", val,
+			"successor", newFinger.Key, "peer", newFinger.Address)
+	}
+	n.fingers[i] = &newFinger
+	n.rw.Unlock()
+}
+
+// Stabilize runs a round of stabilize and checkPredecessor right away,
+// then refreshes every finger, instead of waiting for the background rounds.
+func (n *Node) Stabilize() {
+	n.stabilizeOnce()
+	n.checkPredecessorOnce()
+	for i := uint64(0); i < n.config.NumFingers(); i++ {
+		n.fixFinger(i)
+	}
+}
+
+/*****************************************************************************
+ * Metrics                                                                   *
+ *****************************************************************************/
+
+func outcome(o string) metrics.Label {
+	return metrics.Label{Name: "outcome", Value: o}
+}
+
+// countTransfer records keys handed over to ("out") or taken from ("in") another node.
+func (n *Node) countTransfer(direction string, entries []HashEntry) {
+	size := 0
+	for _, entry := range entries {
+		size += entry.size()
+	}
+	label := metrics.Label{Name: "direction", Value: direction}
+	n.config.Metrics.Add("bitmesh_chord_transferred_keys_total", float64(len(entries)), label)
+	n.config.Metrics.Add("bitmesh_chord_transferred_bytes_total", float64(size), label)
+}
+
+func (n *Node) updateTableMetrics() {
+	n.config.Metrics.Set("bitmesh_chord_keys", float64(n.table.Len()))
+	n.config.Metrics.Set("bitmesh_chord_key_bytes", float64(n.table.Size()))
 }
@@ -1,35 +1,42 @@
 package chord
 
 import (
-	"log"
+	"time"
 
+	"github.com/anteater2/bitmesh/crdt"
 	"github.com/anteater2/bitmesh/rpc"
 )
 
-var callee *rpc.Callee
-
-func initNodeCallee(port uint16) error {
-	var err error
-	callee, err = rpc.NewCallee(port)
-	if err != nil {
-		return err
-	}
-
-	callee.Implement(handleIsAliveCall)
-	callee.Implement(handleNotifyCall)
-	callee.Implement(handleFindSuccessor)
-	callee.Implement(handleGetFingers)
-	callee.Implement(handleGet)
-	callee.Implement(handlePut)
-	callee.Implement(handleGetPredecessor)
-	callee.Implement(handleGetSuccessor)
-	callee.Implement(handleGetKeyRange)
-
-	return nil
-}
-
-func startNodeCallee() {
-	callee.Start()
+// implement implements the remote functions of the node on its callee.
+func (n *Node) implement() {
+	n.Implement(n.handleIsAliveCall)
+	n.Implement(n.handleNotifyCall)
+	n.Implement(n.handleFindSuccessor)
+	n.Implement(n.handleGetFingers)
+	n.Implement(n.handleGetLoad)
+	n.Implement(n.handleGetMerkle)
+	n.Implement(n.handleGetDigests)
+	n.Implement(n.handleGetEntries)
+	n.Implement(n.handleRepair)
+	n.Implement(n.handleGet)
+	n.Implement(n.handlePut)
+	n.Implement(n.handleGetSiblings)
+	n.Implement(n.handlePutSibling)
+	n.Implement(n.handleApply)
+	n.Implement(n.handleCompareAndSwap)
+	n.Implement(n.handleExpire)
+	n.Implement(n.handleGetTTL)
+	n.Implement(n.handleDelete)
+	n.Implement(n.handleMultiGet)
+	n.Implement(n.handleMultiPut)
+	n.Implement(n.handleGetNode)
+	n.Implement(n.handleGetPredecessor)
+	n.Implement(n.handleGetSuccessor)
+	n.Implement(n.handleGetKeyRange)
+	n.Implement(n.handleLeave)
+	n.Implement(n.handleWatch)
+	n.Implement(n.handleUnwatch)
+	n.Implement(n.handleTakeWatches)
 }
 
 // ----------------------------------------------------------------------------
@@ -38,7 +45,7 @@ type isAliveCall struct{}
 
 type isAliveReply struct{}
 
-func handleIsAliveCall(call isAliveCall) isAliveReply {
+func (n *Node) handleIsAliveCall(call isAliveCall) isAliveReply {
 	return isAliveReply{}
 }
 
@@ -50,33 +57,40 @@ type notifyCall struct {
 
 type notifyReply struct{}
 
-func handleNotifyCall(call notifyCall) notifyReply {
-	notify(call.RemoteNode)
+func (n *Node) handleNotifyCall(call notifyCall) notifyReply {
+	n.notify(call.RemoteNode)
 	return notifyReply{}
 }
 
 // ----------------------------------------------------------------------------
 
 type findSuccessorCall struct {
-	Key Key
+	Key  Key
+	Hops int // number of times the call has been passed
 }
 
 type findSuccessorReply struct {
 	Node RemoteNode
+	Hops int
 }
 
-func handleFindSuccessor(call findSuccessorCall, pass rpc.PassFunc) (findSuccessorReply, bool) {
+func (n *Node) handleFindSuccessor(call findSuccessorCall, pass rpc.PassFunc) (findSuccessorReply, bool) {
 	key := call.Key
-	if key.BetweenEndInclusive(my.key, successor.Key) {
-		return findSuccessorReply{*successor}, true
+	successor := n.Successor()
+	if key.BetweenEndInclusive(n.key, successor.Key) {
+		return findSuccessorReply{successor, call.Hops}, true
 	}
-	target := closestPrecedingNode(key)
-	if target.Address == my.address {
-		log.Printf("[DIAGNOSTIC] Infinite loop detected!\n")
-		log.Printf("[DIAGNOSTIC] This is likely because of a bad finger table.\n")
-		target = *successor
+	target := n.closestPrecedingNode(key)
+	if target.Address == n.address {
+		// This is likely because of a bad finger table.
+		n.log.Warn("no finger precedes the key, passing to the successor", "key", key)
+		target = successor
+	}
+	call.Hops++
+	if err := pass(target.Address, call); err != nil && target.Address != successor.Address {
+		n.log.Warn("could not pass the lookup, falling back to the successor", "peer", target.Address, "error", err)
+		pass(successor.Address, call)
 	}
-	pass(target.Address, call)
 	return findSuccessorReply{}, false
 }
 
@@ -87,13 +101,14 @@ type getCall struct {
 }
 
 type getReply struct {
-	Value []byte
-	Error error
+	Value   []byte
+	Version uint64
+	Error   string
 }
 
-func handleGet(call getCall) getReply {
-	rv, err := getKey(call.Key)
-	return getReply{rv, err}
+func (n *Node) handleGet(call getCall) getReply {
+	entry, err := n.getKey(call.Key)
+	return getReply{entry.Value, entry.Version, encodeError(err)}
 }
 
 // ----------------------------------------------------------------------------
@@ -101,15 +116,199 @@ func handleGet(call getCall) getReply {
 type putCall struct {
 	Key   string
 	Value []byte
+	TTL   time.Duration // the key never expires if it is not positive
 }
 
+// The replies of the writes carry the entry as stored, for the replicas.
 type putReply struct {
-	Error error
+	Version uint64
+	Entry   HashEntry
+	Error   string
+}
+
+func (n *Node) handlePut(call putCall) putReply {
+	version, err := n.putKey(call.Key, call.Value, call.TTL)
+	return putReply{version, n.written(call.Key, version, err), encodeError(err)}
+}
+
+// ----------------------------------------------------------------------------
+
+type getSiblingsCall struct {
+	Key string
+}
+
+type getSiblingsReply struct {
+	Siblings []Sibling
+	Error    string
+}
+
+func (n *Node) handleGetSiblings(call getSiblingsCall) getSiblingsReply {
+	siblings, err := n.getSiblings(call.Key)
+	return getSiblingsReply{siblings, encodeError(err)}
+}
+
+// ----------------------------------------------------------------------------
+
+type putSiblingCall struct {
+	Key     string
+	Value   []byte
+	Context VectorClock
+	TTL     time.Duration
+}
+
+type putSiblingReply struct {
+	Version uint64
+	Entry   HashEntry
+	Error   string
+}
+
+func (n *Node) handlePutSibling(call putSiblingCall) putSiblingReply {
+	version, err := n.putSibling(call.Key, call.Value, call.Context, call.TTL)
+	return putSiblingReply{version, n.written(call.Key, version, err), encodeError(err)}
+}
+
+// ----------------------------------------------------------------------------
+
+type applyCall struct {
+	Key string
+	Op  crdt.Op
+}
+
+type applyReply struct {
+	State   []byte
+	Version uint64
+	Entry   HashEntry
+	Error   string
+}
+
+func (n *Node) handleApply(call applyCall) applyReply {
+	state, version, err := n.applyKey(call.Key, call.Op)
+	return applyReply{state, version, n.written(call.Key, version, err), encodeError(err)}
+}
+
+// ----------------------------------------------------------------------------
+
+type compareAndSwapCall struct {
+	Key     string
+	Version uint64 // 0 for a missing key
+	Value   []byte
+	TTL     time.Duration
+}
+
+type compareAndSwapReply struct {
+	Version uint64
+	Entry   HashEntry
+	Error   string
+}
+
+func (n *Node) handleCompareAndSwap(call compareAndSwapCall) compareAndSwapReply {
+	version, err := n.compareAndSwapKey(call.Key, call.Version, call.Value, call.TTL)
+	return compareAndSwapReply{version, n.written(call.Key, version, err), encodeError(err)}
+}
+
+// ----------------------------------------------------------------------------
+
+type expireCall struct {
+	Key string
+	TTL time.Duration
+}
+
+type expireReply struct {
+	Version uint64
+	Entry   HashEntry
+	Error   string
+}
+
+func (n *Node) handleExpire(call expireCall) expireReply {
+	version, err := n.expireKey(call.Key, call.TTL)
+	return expireReply{version, n.written(call.Key, version, err), encodeError(err)}
+}
+
+// ----------------------------------------------------------------------------
+
+type getTTLCall struct {
+	Key string
+}
+
+type getTTLReply struct {
+	TTL   time.Duration // 0 for a key that never expires
+	Error string
 }
 
-func handlePut(call putCall) putReply {
-	err := putKey(call.Key, call.Value)
-	return putReply{err}
+func (n *Node) handleGetTTL(call getTTLCall) getTTLReply {
+	ttl, err := n.ttlKey(call.Key)
+	return getTTLReply{ttl, encodeError(err)}
+}
+
+// ----------------------------------------------------------------------------
+
+type deleteCall struct {
+	Key string
+}
+
+type deleteReply struct {
+	Entry HashEntry // the tombstone
+	Error string
+}
+
+func (n *Node) handleDelete(call deleteCall) deleteReply {
+	err := n.deleteKey(call.Key)
+	return deleteReply{n.written(call.Key, 0, err), encodeError(err)}
+}
+
+// ----------------------------------------------------------------------------
+
+type multiGetCall struct {
+	Keys []string
+}
+
+// multiGetReply is in the order of the keys of the call.
+type multiGetReply struct {
+	Values [][]byte
+	Errors []string
+}
+
+func (n *Node) handleMultiGet(call multiGetCall) multiGetReply {
+	reply := multiGetReply{make([][]byte, len(call.Keys)), make([]string, len(call.Keys))}
+	for i, k := range call.Keys {
+		entry, err := n.getKey(k)
+		reply.Values[i], reply.Errors[i] = entry.Value, encodeError(err)
+	}
+	return reply
+}
+
+// ----------------------------------------------------------------------------
+
+type multiPutCall struct {
+	Entries []HashEntry
+}
+
+// multiPutReply is in the order of the entries of the call.
+type multiPutReply struct {
+	Errors  []string
+	Entries []HashEntry
+}
+
+func (n *Node) handleMultiPut(call multiPutCall) multiPutReply {
+	reply := multiPutReply{make([]string, len(call.Entries)), make([]HashEntry, len(call.Entries))}
+	for i, e := range call.Entries {
+		version, err := n.putKey(e.Key, e.Value, e.TTL)
+		reply.Errors[i] = encodeError(err)
+		reply.Entries[i] = n.written(e.Key, version, err)
+	}
+	return reply
+}
+
+// ----------------------------------------------------------------------------
+
+type getNodeCall struct{}
+
+type getNodeReply struct {
+	Node RemoteNode
+}
+
+func (n *Node) handleGetNode(call getNodeCall) getNodeReply {
+	return getNodeReply{RemoteNode{Address: n.address, Key: n.key}}
 }
 
 // ----------------------------------------------------------------------------
@@ -120,8 +319,8 @@ type getPredecessorReply struct {
 	Node RemoteNode
 }
 
-func handleGetPredecessor(call getPredecessorCall) getPredecessorReply {
-	return getPredecessorReply{getPredecessor()}
+func (n *Node) handleGetPredecessor(call getPredecessorCall) getPredecessorReply {
+	return getPredecessorReply{n.getPredecessor()}
 }
 
 // ----------------------------------------------------------------------------
@@ -132,8 +331,8 @@ type getSuccessorReply struct {
 	Node RemoteNode
 }
 
-func handleGetSuccessor(call getSuccessorCall) getSuccessorReply {
-	return getSuccessorReply{*successor}
+func (n *Node) handleGetSuccessor(call getSuccessorCall) getSuccessorReply {
+	return getSuccessorReply{n.Successor()}
 }
 
 // ----------------------------------------------------------------------------
@@ -147,8 +346,71 @@ type getKeyRangeReply struct {
 	Data []HashEntry
 }
 
-func handleGetKeyRange(call getKeyRangeCall) getKeyRangeReply {
-	return getKeyRangeReply{getKeyRange(call.Start, call.End)}
+func (n *Node) handleGetKeyRange(call getKeyRangeCall) getKeyRangeReply {
+	entries := n.getKeyRange(call.Start, call.End)
+	n.countTransfer("out", entries)
+	return getKeyRangeReply{entries}
+}
+
+// ----------------------------------------------------------------------------
+
+type leaveCall struct {
+	Node        RemoteNode
+	Predecessor *RemoteNode
+	Successor   RemoteNode
+	Data        []HashEntry
+	Watches     []Watch
+}
+
+type leaveReply struct{}
+
+func (n *Node) handleLeave(call leaveCall) leaveReply {
+	n.leave(call.Node, call.Predecessor, call.Successor, call.Data, call.Watches)
+	return leaveReply{}
+}
+
+// ----------------------------------------------------------------------------
+
+type watchCall struct {
+	Watch Watch
+	TTL   time.Duration
+}
+
+type watchReply struct {
+	Error string
+}
+
+func (n *Node) handleWatch(call watchCall) watchReply {
+	err := n.addWatch(call.Watch, call.TTL)
+	return watchReply{encodeError(err)}
+}
+
+// ----------------------------------------------------------------------------
+
+type unwatchCall struct {
+	ID string
+}
+
+type unwatchReply struct{}
+
+func (n *Node) handleUnwatch(call unwatchCall) unwatchReply {
+	n.removeWatch(call.ID)
+	return unwatchReply{}
+}
+
+// ----------------------------------------------------------------------------
+
+type takeWatchesCall struct {
+	Start Key
+	End   Key
+}
+
+type takeWatchesReply struct {
+	Watches []Watch
+}
+
+func (n *Node) handleTakeWatches(call takeWatchesCall) takeWatchesReply {
+	return takeWatchesReply{n.takeWatches(call.Start, call.End)}
 }
 
 // ----------------------------------------------------------------------------
@@ -159,11 +421,77 @@ type getFingersReply struct {
 	Fingers []RemoteNode
 }
 
-func handleGetFingers(call getFingersCall) getFingersReply {
-	reply := getFingersReply{}
-	reply.Fingers = make([]RemoteNode, len(fingers))
-	for i, e := range fingers {
-		reply.Fingers[i] = *e
-	}
-	return reply
+func (n *Node) handleGetFingers(call getFingersCall) getFingersReply {
+	return getFingersReply{n.Fingers()}
+}
+
+// ----------------------------------------------------------------------------
+
+type getLoadCall struct{}
+
+type getLoadReply struct {
+	Load Load
+}
+
+func (n *Node) handleGetLoad(call getLoadCall) getLoadReply {
+	return getLoadReply{n.Load()}
+}
+
+// ----------------------------------------------------------------------------
+
+type getMerkleCall struct {
+	Start Key
+	End   Key
+	Nodes []int
+}
+
+type getMerkleReply struct {
+	Hashes []uint64
+}
+
+func (n *Node) handleGetMerkle(call getMerkleCall) getMerkleReply {
+	return getMerkleReply{n.merkleHashes(call.Start, call.End, call.Nodes)}
+}
+
+// ----------------------------------------------------------------------------
+
+type getDigestsCall struct {
+	Start  Key
+	End    Key
+	Leaves []int
+}
+
+type getDigestsReply struct {
+	Digests []EntryDigest
+}
+
+func (n *Node) handleGetDigests(call getDigestsCall) getDigestsReply {
+	return getDigestsReply{n.entryDigests(call.Start, call.End, call.Leaves)}
+}
+
+// ----------------------------------------------------------------------------
+
+type getEntriesCall struct {
+	Keys []string
+}
+
+type getEntriesReply struct {
+	Entries []HashEntry
+}
+
+func (n *Node) handleGetEntries(call getEntriesCall) getEntriesReply {
+	return getEntriesReply{n.storedEntries(call.Keys)}
+}
+
+// ----------------------------------------------------------------------------
+
+type repairCall struct {
+	Entries []HashEntry
+}
+
+type repairReply struct{}
+
+func (n *Node) handleRepair(call repairCall) repairReply {
+	n.repair(call.Entries)
+	return repairReply{}
 }
@@ -1,5 +1,6 @@
 package chord
 
+import "github.com/anteater2/bitmesh/crdt"
 import "github.com/anteater2/bitmesh/rpc"
 import "time"
 
@@ -9,17 +10,41 @@ type NodeCaller struct {
 	isAlive        rpc.RemoteFunc
 	notify         rpc.RemoteFunc
 	findSuccessor  rpc.RemoteFunc
+	getNode        rpc.RemoteFunc
 	getPredecessor rpc.RemoteFunc
 	getSuccessor   rpc.RemoteFunc
 	getKeyRange    rpc.RemoteFunc
 	getFingers     rpc.RemoteFunc
+	getLoad        rpc.RemoteFunc
+	getMerkle      rpc.RemoteFunc
+	getDigests     rpc.RemoteFunc
+	getEntries     rpc.RemoteFunc
+	repair         rpc.RemoteFunc
 	get            rpc.RemoteFunc
 	put            rpc.RemoteFunc
+	getSiblings    rpc.RemoteFunc
+	putSibling     rpc.RemoteFunc
+	apply          rpc.RemoteFunc
+	compareAndSwap rpc.RemoteFunc
+	expire         rpc.RemoteFunc
+	getTTL         rpc.RemoteFunc
+	delete         rpc.RemoteFunc
+	multiGet       rpc.RemoteFunc
+	multiPut       rpc.RemoteFunc
+	leave          rpc.RemoteFunc
+	watch          rpc.RemoteFunc
+	unwatch        rpc.RemoteFunc
+	takeWatches    rpc.RemoteFunc
 }
 
 // NewNodeCaller creates a new NodeCaller
 func NewNodeCaller(port uint16) (*NodeCaller, error) {
-	caller, err := rpc.NewCaller(port)
+	return NewNodeCallerWith(port, rpc.Config{})
+}
+
+// NewNodeCallerWith creates a new NodeCaller with the given config
+func NewNodeCallerWith(port uint16, config rpc.Config) (*NodeCaller, error) {
+	caller, err := rpc.NewCallerWith(port, config)
 	if err != nil {
 		return nil, err
 	}
@@ -28,18 +53,42 @@ func NewNodeCaller(port uint16) (*NodeCaller, error) {
 		isAlive:        caller.Declare(isAliveCall{}, isAliveReply{}, 1*time.Second),
 		notify:         caller.Declare(notifyCall{}, notifyReply{}, 1*time.Second),
 		findSuccessor:  caller.Declare(findSuccessorCall{}, findSuccessorReply{}, 1*time.Second),
+		getNode:        caller.Declare(getNodeCall{}, getNodeReply{}, 1*time.Second),
 		getPredecessor: caller.Declare(getPredecessorCall{}, getPredecessorReply{}, 1*time.Second),
 		getSuccessor:   caller.Declare(getSuccessorCall{}, getSuccessorReply{}, 1*time.Second),
 		getKeyRange:    caller.Declare(getKeyRangeCall{}, getKeyRangeReply{}, 5*time.Second),
 		getFingers:     caller.Declare(getFingersCall{}, getFingersReply{}, 1*time.Second),
+		getLoad:        caller.Declare(getLoadCall{}, getLoadReply{}, 5*time.Second),
+		getMerkle:      caller.Declare(getMerkleCall{}, getMerkleReply{}, 5*time.Second),
+		getDigests:     caller.Declare(getDigestsCall{}, getDigestsReply{}, 5*time.Second),
+		getEntries:     caller.Declare(getEntriesCall{}, getEntriesReply{}, 5*time.Second),
+		repair:         caller.Declare(repairCall{}, repairReply{}, 5*time.Second),
 		get:            caller.Declare(getCall{}, getReply{}, 5*time.Second),
 		put:            caller.Declare(putCall{}, putReply{}, 5*time.Second),
+		getSiblings:    caller.Declare(getSiblingsCall{}, getSiblingsReply{}, 5*time.Second),
+		putSibling:     caller.Declare(putSiblingCall{}, putSiblingReply{}, 5*time.Second),
+		apply:          caller.Declare(applyCall{}, applyReply{}, 5*time.Second),
+		compareAndSwap: caller.Declare(compareAndSwapCall{}, compareAndSwapReply{}, 5*time.Second),
+		expire:         caller.Declare(expireCall{}, expireReply{}, 5*time.Second),
+		getTTL:         caller.Declare(getTTLCall{}, getTTLReply{}, 5*time.Second),
+		delete:         caller.Declare(deleteCall{}, deleteReply{}, 5*time.Second),
+		multiGet:       caller.Declare(multiGetCall{}, multiGetReply{}, 5*time.Second),
+		multiPut:       caller.Declare(multiPutCall{}, multiPutReply{}, 5*time.Second),
+		leave:          caller.Declare(leaveCall{}, leaveReply{}, 5*time.Second),
+		watch:          caller.Declare(watchCall{}, watchReply{}, 1*time.Second),
+		unwatch:        caller.Declare(unwatchCall{}, unwatchReply{}, 1*time.Second),
+		takeWatches:    caller.Declare(takeWatchesCall{}, takeWatchesReply{}, 5*time.Second),
 	}, nil
 }
 
 // Start starts the NodeCaller
-func (nc *NodeCaller) Start() {
-	nc.caller.Start()
+func (nc *NodeCaller) Start() error {
+	return nc.caller.Start()
+}
+
+// Stop stops the NodeCaller
+func (nc *NodeCaller) Stop() {
+	nc.caller.Stop()
 }
 
 // Notice:
@@ -66,11 +115,26 @@ func (nc *NodeCaller) Notify(node string, remoteNode RemoteNode) error {
 
 // FindSuccessor ...
 func (nc *NodeCaller) FindSuccessor(node string, key Key) (RemoteNode, error) {
-	reply, err := nc.findSuccessor(node, findSuccessorCall{key})
+	successor, _, err := nc.lookup(node, key)
+	return successor, err
+}
+
+// lookup is FindSuccessor that also returns how many nodes the call went through.
+func (nc *NodeCaller) lookup(node string, key Key) (RemoteNode, int, error) {
+	reply, err := nc.findSuccessor(node, findSuccessorCall{Key: key})
+	if err != nil {
+		return RemoteNode{}, 0, err
+	}
+	return reply.(findSuccessorReply).Node, reply.(findSuccessorReply).Hops + 1, nil
+}
+
+// GetNode returns the address and key of node itself.
+func (nc *NodeCaller) GetNode(node string) (RemoteNode, error) {
+	reply, err := nc.getNode(node, getNodeCall{})
 	if err != nil {
 		return RemoteNode{}, err
 	}
-	return reply.(findSuccessorReply).Node, nil
+	return reply.(getNodeReply).Node, nil
 }
 
 // GetPredecessor ...
@@ -102,20 +166,136 @@ func (nc *NodeCaller) GetKeyRange(node string, start Key, end Key) ([]HashEntry,
 
 // Get ...
 func (nc *NodeCaller) Get(node string, k string) ([]byte, error) {
+	v, _, err := nc.GetVersioned(node, k)
+	return v, err
+}
+
+// GetVersioned gets the value of a key and its version.
+func (nc *NodeCaller) GetVersioned(node string, k string) ([]byte, uint64, error) {
 	reply, err := nc.get(node, getCall{k})
 	if err != nil {
-		return []byte{0}, err
+		return nil, 0, err
 	}
-	return reply.(getReply).Value, reply.(getReply).Error
+	r := reply.(getReply)
+	return r.Value, r.Version, decodeError(r.Error)
 }
 
 // Put ...
 func (nc *NodeCaller) Put(node string, k string, v []byte) error {
-	reply, err := nc.put(node, putCall{k, v})
+	_, err := nc.PutWithTTL(node, k, v, 0)
+	return err
+}
+
+// PutWithTTL puts a key that node expires after ttl, or never if ttl is not
+// positive, and returns the entry stored.
+func (nc *NodeCaller) PutWithTTL(node string, k string, v []byte, ttl time.Duration) (HashEntry, error) {
+	reply, err := nc.put(node, putCall{k, v, ttl})
 	if err != nil {
-		return err
+		return HashEntry{}, err
+	}
+	r := reply.(putReply)
+	return r.Entry, decodeError(r.Error)
+}
+
+// GetSiblings gets the concurrent values of a key put with vector clocks.
+// A key put without one has a single sibling with an empty clock.
+func (nc *NodeCaller) GetSiblings(node string, k string) ([]Sibling, error) {
+	reply, err := nc.getSiblings(node, getSiblingsCall{k})
+	if err != nil {
+		return nil, err
+	}
+	r := reply.(getSiblingsReply)
+	return r.Siblings, decodeError(r.Error)
+}
+
+// PutSibling puts a value with the vector clock context it was read with,
+// which node expires after ttl, or never if ttl is not positive.  The values
+// the context has not seen are kept as siblings.  It returns the new version
+// and the entry stored.
+func (nc *NodeCaller) PutSibling(node string, k string, v []byte, context VectorClock, ttl time.Duration) (uint64, HashEntry, error) {
+	reply, err := nc.putSibling(node, putSiblingCall{k, v, context, ttl})
+	if err != nil {
+		return 0, HashEntry{}, err
+	}
+	r := reply.(putSiblingReply)
+	return r.Version, r.Entry, decodeError(r.Error)
+}
+
+// Apply does an operation on the CRDT stored at a key on its owner, and
+// returns the new state, version and entry.
+func (nc *NodeCaller) Apply(node string, k string, op crdt.Op) ([]byte, uint64, HashEntry, error) {
+	reply, err := nc.apply(node, applyCall{k, op})
+	if err != nil {
+		return nil, 0, HashEntry{}, err
+	}
+	r := reply.(applyReply)
+	return r.State, r.Version, r.Entry, decodeError(r.Error)
+}
+
+// CompareAndSwap puts a key if its version is still version, 0 standing for
+// a missing key, and returns the new version and entry.  It returns
+// ErrVersionMismatch if the key has changed.
+func (nc *NodeCaller) CompareAndSwap(node string, k string, version uint64, v []byte, ttl time.Duration) (uint64, HashEntry, error) {
+	reply, err := nc.compareAndSwap(node, compareAndSwapCall{k, version, v, ttl})
+	if err != nil {
+		return 0, HashEntry{}, err
+	}
+	r := reply.(compareAndSwapReply)
+	return r.Version, r.Entry, decodeError(r.Error)
+}
+
+// Expire sets a key to expire after ttl, or never if ttl is not positive,
+// and returns its new version and entry.  It returns ErrNotFound for a
+// missing key.
+func (nc *NodeCaller) Expire(node string, k string, ttl time.Duration) (uint64, HashEntry, error) {
+	reply, err := nc.expire(node, expireCall{k, ttl})
+	if err != nil {
+		return 0, HashEntry{}, err
+	}
+	r := reply.(expireReply)
+	return r.Version, r.Entry, decodeError(r.Error)
+}
+
+// TTL returns the time left before a key expires, or 0 if it never does.
+func (nc *NodeCaller) TTL(node string, k string) (time.Duration, error) {
+	reply, err := nc.getTTL(node, getTTLCall{k})
+	if err != nil {
+		return 0, err
+	}
+	r := reply.(getTTLReply)
+	return r.TTL, decodeError(r.Error)
+}
+
+// Delete deletes a key and returns the tombstone node keeps, if any.
+func (nc *NodeCaller) Delete(node string, k string) (HashEntry, error) {
+	reply, err := nc.delete(node, deleteCall{k})
+	if err != nil {
+		return HashEntry{}, err
 	}
-	return reply.(putReply).Error
+	r := reply.(deleteReply)
+	return r.Entry, decodeError(r.Error)
+}
+
+// MultiGet gets several keys from node in one call.
+// The values and the errors of the keys are in the order of keys.
+func (nc *NodeCaller) MultiGet(node string, keys []string) ([][]byte, []error, error) {
+	reply, err := nc.multiGet(node, multiGetCall{keys})
+	if err != nil {
+		return nil, nil, err
+	}
+	r := reply.(multiGetReply)
+	return r.Values, decodeErrors(r.Errors), nil
+}
+
+// MultiPut puts several entries into node in one call.
+// The entries stored and the errors are in the order of entries.
+func (nc *NodeCaller) MultiPut(node string, entries []HashEntry) ([]HashEntry, []error, error) {
+	reply, err := nc.multiPut(node, multiPutCall{entries})
+	if err != nil {
+		return nil, nil, err
+	}
+	r := reply.(multiPutReply)
+	return r.Entries, decodeErrors(r.Errors), nil
 }
 
 // GetFingers ...
@@ -126,3 +306,82 @@ func (nc *NodeCaller) GetFingers(node string) ([]RemoteNode, error) {
 	}
 	return reply.(getFingersReply).Fingers, nil
 }
+
+// GetLoad returns the load of node.
+func (nc *NodeCaller) GetLoad(node string) (Load, error) {
+	reply, err := nc.getLoad(node, getLoadCall{})
+	if err != nil {
+		return Load{}, err
+	}
+	return reply.(getLoadReply).Load, nil
+}
+
+// GetMerkle returns the hashes of nodes of the Merkle tree node builds over
+// the entries and tombstones it stores in (start, end].  Node i of a tree has
+// children 2i+1 and 2i+2.
+func (nc *NodeCaller) GetMerkle(node string, start Key, end Key, nodes []int) ([]uint64, error) {
+	reply, err := nc.getMerkle(node, getMerkleCall{start, end, nodes})
+	if err != nil {
+		return nil, err
+	}
+	return reply.(getMerkleReply).Hashes, nil
+}
+
+// GetDigests returns the digests of the entries in leaves of the Merkle tree
+// of (start, end] on node, where leaf i is tree node i+255.
+func (nc *NodeCaller) GetDigests(node string, start Key, end Key, leaves []int) ([]EntryDigest, error) {
+	reply, err := nc.getDigests(node, getDigestsCall{start, end, leaves})
+	if err != nil {
+		return nil, err
+	}
+	return reply.(getDigestsReply).Digests, nil
+}
+
+// GetEntries returns the entries and tombstones node stores for keys,
+// whether it is responsible for them or keeps copies.
+func (nc *NodeCaller) GetEntries(node string, keys []string) ([]HashEntry, error) {
+	reply, err := nc.getEntries(node, getEntriesCall{keys})
+	if err != nil {
+		return nil, err
+	}
+	return reply.(getEntriesReply).Entries, nil
+}
+
+// Repair makes node merge entries, keeping the newer version of every key.
+func (nc *NodeCaller) Repair(node string, entries []HashEntry) error {
+	_, err := nc.repair(node, repairCall{entries})
+	return err
+}
+
+// Leave tells node that leaving is leaving the ring, giving it the
+// predecessor and the successor of leaving and the entries and watches to take over.
+func (nc *NodeCaller) Leave(node string, leaving RemoteNode, predecessor *RemoteNode, successor RemoteNode, entries []HashEntry, watches []Watch) error {
+	_, err := nc.leave(node, leaveCall{leaving, predecessor, successor, entries, watches})
+	return err
+}
+
+// Watch starts or renews a watch on node for ttl.  A key watch must go to
+// the owner of the key, or it gets ErrWrongNode; a prefix watch to every node.
+func (nc *NodeCaller) Watch(node string, w Watch, ttl time.Duration) error {
+	reply, err := nc.watch(node, watchCall{w, ttl})
+	if err != nil {
+		return err
+	}
+	return decodeError(reply.(watchReply).Error)
+}
+
+// Unwatch stops a watch on node.
+func (nc *NodeCaller) Unwatch(node string, id string) error {
+	_, err := nc.unwatch(node, unwatchCall{id})
+	return err
+}
+
+// TakeWatches takes the watches of the keys in (start, end] away from node,
+// along with copies of its prefix watches.
+func (nc *NodeCaller) TakeWatches(node string, start Key, end Key) ([]Watch, error) {
+	reply, err := nc.takeWatches(node, takeWatchesCall{start, end})
+	if err != nil {
+		return nil, err
+	}
+	return reply.(takeWatchesReply).Watches, nil
+}
@@ -0,0 +1,226 @@
+package chord
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/anteater2/bitmesh/metrics"
+)
+
+// antiEntropy repairs the copies of the keys of the node every AntiEntropyInterval.
+func (n *Node) antiEntropy(start <-chan time.Time) {
+	defer n.wg.Done()
+	for ok := n.wait(start); ok; ok = n.sleep(n.config.AntiEntropyInterval) {
+		if err := n.SyncReplicas(); err != nil {
+			n.log.Warn("could not sync replicas", "error", err)
+		}
+	}
+}
+
+// SyncReplicas runs a round of anti-entropy: the node compares the keys it
+// is responsible for with their copies on its Replicas-1 successors, and
+// the two sides swap the entries that differ, the newer version winning.
+func (n *Node) SyncReplicas() error {
+	if n.config.Replicas < 2 {
+		return nil
+	}
+	predecessor := n.Predecessor()
+	if predecessor == nil {
+		// The range of the node is unknown.
+		return nil
+	}
+	var errs []error
+	for _, replica := range n.replicas() {
+		if err := n.syncReplica(replica.Address, predecessor.Key, n.key); err != nil {
+			n.config.Metrics.Add("bitmesh_chord_anti_entropy_total", 1, outcome("failed"))
+			errs = append(errs, fmt.Errorf("%s: %w", replica.Address, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// replicas returns the Replicas-1 successors of the node, or fewer on a
+// smaller ring.
+func (n *Node) replicas() []RemoteNode {
+	var replicas []RemoteNode
+	seen := map[string]bool{n.address: true}
+	next := n.Successor()
+	for !seen[next.Address] {
+		seen[next.Address] = true
+		replicas = append(replicas, next)
+		if len(replicas) == n.config.Replicas-1 {
+			break
+		}
+		successor, err := n.caller.GetSuccessor(next.Address)
+		if err != nil {
+			n.log.Warn("could not walk the replicas", "peer", next.Address, "error", err)
+			break
+		}
+		next = successor
+	}
+	return replicas
+}
+
+// syncReplica compares the Merkle trees of (start, end] on the node and on
+// replica from the root down, then swaps the entries of the leaves that
+// differ.  The node wins when both have the same version of a key.
+func (n *Node) syncReplica(replica string, start Key, end Key) error {
+	local := n.merkleTree(start, end)
+	var leaves []int
+	for level := []int{0}; len(level) > 0; {
+		hashes, err := n.caller.GetMerkle(replica, start, end, level)
+		if err != nil {
+			return err
+		}
+		var next []int
+		for i, node := range level {
+			if i < len(hashes) && hashes[i] == local.hashes[node] {
+				continue
+			}
+			if isLeaf(node) {
+				leaves = append(leaves, node-(merkleLeaves-1))
+			} else {
+				next = append(next, 2*node+1, 2*node+2)
+			}
+		}
+		level = next
+	}
+	if len(leaves) == 0 {
+		n.config.Metrics.Add("bitmesh_chord_anti_entropy_total", 1, outcome("in_sync"))
+		return nil
+	}
+	remote, err := n.caller.GetDigests(replica, start, end, leaves)
+	if err != nil {
+		return err
+	}
+	mine := make(map[string]HashEntry)
+	for _, leaf := range leaves {
+		for _, entry := range local.leaves[leaf] {
+			mine[entry.Key] = entry
+		}
+	}
+	var push []HashEntry
+	var pull []string
+	theirs := make(map[string]bool)
+	for _, d := range remote {
+		theirs[d.Key] = true
+		entry, ok := mine[d.Key]
+		switch {
+		case !ok || d.Version > entry.Version:
+			pull = append(pull, d.Key)
+		case d.Version < entry.Version || d.Digest != digest(entry).Digest:
+			push = append(push, entry)
+		}
+	}
+	for key, entry := range mine {
+		if !theirs[key] {
+			push = append(push, entry)
+		}
+	}
+	pulled := 0
+	if len(pull) > 0 {
+		entries, err := n.caller.GetEntries(replica, pull)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if n.table.Merge(entry) {
+				pulled++
+			}
+		}
+		n.updateTableMetrics()
+	}
+	if len(push) > 0 {
+		if err := n.caller.Repair(replica, push); err != nil {
+			return err
+		}
+	}
+	n.log.Debug("repaired replica", "peer", replica, "leaves", len(leaves), "in", pulled, "out", len(push))
+	n.config.Metrics.Add("bitmesh_chord_anti_entropy_total", 1, outcome("repaired"))
+	n.config.Metrics.Add("bitmesh_chord_repaired_keys_total", float64(pulled), metrics.Label{Name: "direction", Value: "in"})
+	n.config.Metrics.Add("bitmesh_chord_repaired_keys_total", float64(len(push)), metrics.Label{Name: "direction", Value: "out"})
+	return nil
+}
+
+// merkleTree returns the Merkle tree of the entries and tombstones stored in
+// (start, end], whether the node is responsible for them or keeps copies.
+func (n *Node) merkleTree(start Key, end Key) *merkleTree {
+	n.merkleMutex.Lock()
+	defer n.merkleMutex.Unlock()
+	generation := n.table.Generation()
+	if generation != n.merkleGeneration || n.merkle == nil {
+		n.merkle = make(map[[2]Key]*merkleTree)
+		n.merkleGeneration = generation
+	}
+	t, ok := n.merkle[[2]Key{start, end}]
+	if !ok {
+		t = newMerkleTree(start, end, n.config.MaxKey(), n.table.getRange(start, end, true))
+		n.merkle[[2]Key{start, end}] = t
+	}
+	return t
+}
+
+// merkleHashes returns the hashes of nodes of the Merkle tree of (start, end].
+func (n *Node) merkleHashes(start Key, end Key, nodes []int) []uint64 {
+	t := n.merkleTree(start, end)
+	hashes := make([]uint64, len(nodes))
+	for i, node := range nodes {
+		if node >= 0 && node < len(t.hashes) {
+			hashes[i] = t.hashes[node]
+		}
+	}
+	return hashes
+}
+
+// entryDigests returns the digests of the entries in leaves of the Merkle
+// tree of (start, end].
+func (n *Node) entryDigests(start Key, end Key, leaves []int) []EntryDigest {
+	t := n.merkleTree(start, end)
+	var digests []EntryDigest
+	for _, leaf := range leaves {
+		if leaf < 0 || leaf >= merkleLeaves {
+			continue
+		}
+		for _, entry := range t.leaves[leaf] {
+			digests = append(digests, digest(entry))
+		}
+	}
+	return digests
+}
+
+// storedEntries returns the entries and tombstones stored for keys.
+func (n *Node) storedEntries(keys []string) []HashEntry {
+	var entries []HashEntry
+	for _, key := range keys {
+		position := Hash(key, n.config.MaxKey())
+		for _, entry := range n.table.getRange(position-1, position, true) {
+			if entry.Key == key {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries
+}
+
+// written returns the entry or tombstone a write left at key, for the reply
+// of the write to carry to the replicas.  It returns nothing if the write
+// failed, or if another write came in between and version, unless 0, is gone.
+func (n *Node) written(key string, version uint64, err error) HashEntry {
+	if err != nil {
+		return HashEntry{}
+	}
+	entries := n.storedEntries([]string{key})
+	if len(entries) == 0 || (version != 0 && entries[0].Version != version) {
+		return HashEntry{}
+	}
+	return entries[0]
+}
+
+// repair merges entries sent by the node responsible for them.
+func (n *Node) repair(entries []HashEntry) {
+	for _, entry := range entries {
+		n.table.Merge(entry)
+	}
+	n.updateTableMetrics()
+}
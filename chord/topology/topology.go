@@ -0,0 +1,206 @@
+// Package topology turns crawls of a ring into pictures:
+// Graphviz DOT graphs with the nodes placed on the identifier circle, and JSON documents.
+package topology
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/chord/crawl"
+)
+
+// Edge kinds
+const (
+	Successor   = "successor"
+	Predecessor = "predecessor"
+	Finger      = "finger"
+)
+
+// Graph is the topology of a ring.
+type Graph struct {
+	Bits  uint64
+	Nodes []Node // sorted by key
+	Edges []Edge
+}
+
+// Node is a node placed on the identifier circle.
+type Node struct {
+	Address string
+	Key     chord.Key
+	// Angle is the position of the node on the circle,
+	// in degrees clockwise from the top.
+	Angle float64
+	// X and Y are the position of the node on a unit circle centered on 0,0
+	// with key 0 at the top.
+	X float64
+	Y float64
+	// Owned and Share come from the crawl, see crawl.Node.
+	Owned uint64
+	Share float64
+	// Keys and Bytes are the number and size of the keys the node stores,
+	// from the load in the crawl.
+	Keys  int
+	Bytes int
+	// Crawled is false for the nodes that were only seen in the pointers of
+	// other nodes, such as dead fingers or nodes of another loop.
+	Crawled bool
+}
+
+// Edge is a pointer from one node to another.
+type Edge struct {
+	From string
+	To   string
+	Kind string
+	// Fingers lists the finger indexes of a finger edge.
+	Fingers []int `json:",omitempty"`
+}
+
+// FromReports builds the graph of one or more crawls, for instance from
+// seeds on both sides of a partition.  Finger edges are only included if
+// fingers is true.
+func FromReports(reports []*crawl.Report, fingers bool) *Graph {
+	g := &Graph{}
+	nodes := make(map[string]*Node)
+	add := func(address string, key chord.Key) *Node {
+		if node, prs := nodes[address]; prs {
+			return node
+		}
+		node := &Node{Address: address, Key: key}
+		nodes[address] = node
+		return node
+	}
+	edges := make(map[[3]string]*Edge)
+	connect := func(from string, to string, kind string) *Edge {
+		id := [3]string{from, to, kind}
+		if edge, prs := edges[id]; prs {
+			return edge
+		}
+		edge := &Edge{From: from, To: to, Kind: kind}
+		edges[id] = edge
+		return edge
+	}
+
+	for _, r := range reports {
+		g.Bits = r.Bits
+		for _, n := range r.Nodes {
+			node := add(n.Address, n.Key)
+			node.Key = n.Key
+			node.Owned = n.Owned
+			node.Share = n.Share
+			if n.Load != nil {
+				node.Keys = n.Load.Keys
+				node.Bytes = n.Load.KeyBytes
+			}
+			node.Crawled = n.Error == ""
+		}
+	}
+	for _, r := range reports {
+		for _, n := range r.Nodes {
+			if n.Successor != nil {
+				add(n.Successor.Address, n.Successor.Key)
+				connect(n.Address, n.Successor.Address, Successor)
+			}
+			if n.Predecessor != nil {
+				add(n.Predecessor.Address, n.Predecessor.Key)
+				connect(n.Address, n.Predecessor.Address, Predecessor)
+			}
+			if !fingers {
+				continue
+			}
+			for i, f := range n.Fingers {
+				add(f.Address, f.Key)
+				edge := connect(n.Address, f.Address, Finger)
+				edge.Fingers = append(edge.Fingers, i)
+			}
+		}
+	}
+
+	maxKey := float64(uint64(1) << g.Bits)
+	for _, node := range nodes {
+		angle := 2 * math.Pi * float64(node.Key) / maxKey
+		node.Angle = 360 * float64(node.Key) / maxKey
+		node.X = math.Sin(angle)
+		node.Y = math.Cos(angle)
+		g.Nodes = append(g.Nodes, *node)
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool {
+		if g.Nodes[i].Key != g.Nodes[j].Key {
+			return g.Nodes[i].Key < g.Nodes[j].Key
+		}
+		return g.Nodes[i].Address < g.Nodes[j].Address
+	})
+	for _, edge := range edges {
+		g.Edges = append(g.Edges, *edge)
+	}
+	sort.Slice(g.Edges, func(i, j int) bool {
+		a, b := g.Edges[i], g.Edges[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.Kind != b.Kind {
+			return a.Kind > b.Kind
+		}
+		return a.To < b.To
+	})
+	return g
+}
+
+// WriteJSON writes the graph as an indented JSON document.
+func (g *Graph) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g)
+}
+
+// WriteDOT writes the graph in the DOT language.
+// Node positions are pinned, so render it with neato (or fdp):
+//
+//	neato -n -Tsvg ring.dot > ring.svg
+//
+// Successors are solid black arrows, predecessors dashed blue ones and
+// fingers dotted gray ones.  Nodes that could not be crawled are red.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	// make the circle big enough for the labels
+	radius := math.Max(200, 40*float64(len(g.Nodes)))
+	lines := []string{
+		"digraph ring {",
+		"\tlayout=neato;",
+		"\tnode [shape=circle, fontsize=10];",
+		"\tedge [arrowsize=0.6];",
+	}
+	for _, node := range g.Nodes {
+		label := fmt.Sprintf("%d\\n%s\\n%.1f%%", node.Key, node.Address, 100*node.Share)
+		if node.Crawled {
+			label += fmt.Sprintf("\\n%d keys, %d B", node.Keys, node.Bytes)
+		}
+		attrs := fmt.Sprintf("label=\"%s\", pos=\"%.0f,%.0f!\"", label, radius*node.X, radius*node.Y)
+		if !node.Crawled {
+			attrs += ", color=red, fontcolor=red"
+		}
+		lines = append(lines, fmt.Sprintf("\t%q [%s];", node.Address, attrs))
+	}
+	for _, edge := range g.Edges {
+		var attrs string
+		switch edge.Kind {
+		case Successor:
+			attrs = "color=black"
+		case Predecessor:
+			attrs = "color=blue, style=dashed"
+		case Finger:
+			indexes := make([]string, len(edge.Fingers))
+			for i, f := range edge.Fingers {
+				indexes[i] = fmt.Sprint(f)
+			}
+			attrs = fmt.Sprintf("color=gray, style=dotted, fontsize=8, label=\"%s\"", strings.Join(indexes, ","))
+		}
+		lines = append(lines, fmt.Sprintf("\t%q -> %q [%s];", edge.From, edge.To, attrs))
+	}
+	lines = append(lines, "}")
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
@@ -0,0 +1,90 @@
+package topology_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/chord/crawl"
+	"github.com/anteater2/bitmesh/chord/topology"
+)
+
+// report of a ring a(0) -> b(4) -> a whose finger 1 at a still points at the dead node c(2)
+func report() *crawl.Report {
+	a := chord.RemoteNode{Address: "a", Key: 0}
+	b := chord.RemoteNode{Address: "b", Key: 4}
+	c := chord.RemoteNode{Address: "c", Key: 2}
+	return &crawl.Report{
+		Bits:   3,
+		Closed: true,
+		Nodes: []crawl.Node{
+			{Address: "a", Key: 0, Predecessor: &b, Successor: &b, Fingers: []chord.RemoteNode{b, c}, Owned: 4, Share: 0.5, Load: &chord.Load{Keys: 3, KeyBytes: 120}},
+			{Address: "b", Key: 4, Predecessor: &a, Successor: &a, Fingers: []chord.RemoteNode{a, a}, Owned: 4, Share: 0.5, Errors: map[string]string{"GetLoad": "timeout"}},
+		},
+	}
+}
+
+func TestFromReports(t *testing.T) {
+	g := topology.FromReports([]*crawl.Report{report()}, true)
+	if len(g.Nodes) != 3 {
+		t.Fatalf("%d nodes, expecting 3: %+v", len(g.Nodes), g.Nodes)
+	}
+	c := g.Nodes[1]
+	if c.Address != "c" || c.Crawled {
+		t.Errorf("dead finger c should be an uncrawled node: %+v", c)
+	}
+	if b := g.Nodes[2]; b.Angle != 180 || b.Y > -0.99 || !b.Crawled {
+		t.Errorf("b should be a crawled node at the bottom of the circle: %+v", b)
+	}
+	kinds := make(map[string]int)
+	for _, e := range g.Edges {
+		kinds[e.Kind]++
+		if e.From == "b" && e.Kind == topology.Finger && len(e.Fingers) != 2 {
+			t.Errorf("fingers 0 and 1 of b should share an edge: %+v", e)
+		}
+	}
+	if kinds[topology.Successor] != 2 || kinds[topology.Predecessor] != 2 || kinds[topology.Finger] != 3 {
+		t.Errorf("unexpected edges: %+v", g.Edges)
+	}
+
+	if g := topology.FromReports([]*crawl.Report{report()}, false); len(g.Nodes) != 2 || len(g.Edges) != 4 {
+		t.Errorf("without fingers: %+v", g)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	g := topology.FromReports([]*crawl.Report{report()}, true)
+
+	var dot bytes.Buffer
+	if err := g.WriteDOT(&dot); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`"a" -> "b" [color=black];`,
+		`"a" -> "b" [color=blue, style=dashed];`,
+		`"a" -> "c" [color=gray, style=dotted, fontsize=8, label="1"];`,
+		`color=red`,
+		`label="0\na\n50.0%\n3 keys, 120 B"`,
+	} {
+		if !strings.Contains(dot.String(), line) {
+			t.Errorf("DOT lacks %s:\n%s", line, dot.String())
+		}
+	}
+
+	var doc bytes.Buffer
+	if err := g.WriteJSON(&doc); err != nil {
+		t.Fatal(err)
+	}
+	var decoded topology.Graph
+	if err := json.Unmarshal(doc.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Nodes) != len(g.Nodes) || len(decoded.Edges) != len(g.Edges) {
+		t.Errorf("JSON round trip lost something:\n%s", doc.String())
+	}
+	if a := decoded.Nodes[0]; a.Keys != 3 || a.Bytes != 120 {
+		t.Errorf("JSON lacks the load of a: %+v", a)
+	}
+}
@@ -0,0 +1,136 @@
+package chord
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+)
+
+// VectorClock counts the writes a value has seen, by the ID of the node that
+// took them.
+type VectorClock map[Key]uint64
+
+// Descends returns true if c has seen every write other has.
+func (c VectorClock) Descends(other VectorClock) bool {
+	for id, count := range other {
+		if c[id] < count {
+			return false
+		}
+	}
+	return true
+}
+
+// Concurrent returns true if neither clock has seen every write of the other.
+func (c VectorClock) Concurrent(other VectorClock) bool {
+	return !c.Descends(other) && !other.Descends(c)
+}
+
+// Merge returns the smallest clock that descends from both c and other.
+func (c VectorClock) Merge(other VectorClock) VectorClock {
+	merged := make(VectorClock, len(c))
+	for id, count := range c {
+		merged[id] = count
+	}
+	for id, count := range other {
+		if count > merged[id] {
+			merged[id] = count
+		}
+	}
+	return merged
+}
+
+// Sibling is one of the concurrent values of a key put with a vector clock.
+// Clock is the context the value was put with, and the write itself is
+// write Count of the node that took it.  Two writes from the same context
+// have the same Clock, but not the same Node and Count.
+type Sibling struct {
+	Value []byte
+	Clock VectorClock
+	Node  Key
+	Count uint64
+}
+
+// seenBy returns true if clock has seen the write of s.
+func (s Sibling) seenBy(clock VectorClock) bool {
+	return clock[s.Node] >= s.Count
+}
+
+// sameWrite returns true if s and other stand for the same write.
+func (s Sibling) sameWrite(other Sibling) bool {
+	return s.Node == other.Node && s.Count == other.Count
+}
+
+// Context returns the clock of a set of siblings, to put a value that
+// replaces all of them.
+func Context(siblings []Sibling) VectorClock {
+	context := VectorClock{}
+	for _, s := range siblings {
+		context = context.Merge(s.Clock)
+		if s.Count > context[s.Node] {
+			context[s.Node] = s.Count
+		}
+	}
+	return context
+}
+
+// mergeSiblings returns the siblings of a and b that no other sibling has
+// seen, each write once.
+func mergeSiblings(a []Sibling, b []Sibling) []Sibling {
+	var merged []Sibling
+	all := append(append([]Sibling(nil), a...), b...)
+next:
+	for i, s := range all {
+		for j, t := range all {
+			if j != i && !s.sameWrite(t) && s.seenBy(t.Clock) {
+				continue next
+			}
+		}
+		for _, t := range merged {
+			if s.sameWrite(t) {
+				continue next
+			}
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+// sameSiblings returns true if a and b hold the same writes.
+func sameSiblings(a []Sibling, b []Sibling) bool {
+	if len(a) != len(b) {
+		return false
+	}
+next:
+	for _, s := range a {
+		for _, t := range b {
+			if s.sameWrite(t) {
+				continue next
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// hash returns a hash of the sibling.
+func (s Sibling) hash() uint64 {
+	h := fnv.New64a()
+	var b [8]byte
+	ids := make([]Key, 0, len(s.Clock))
+	for id := range s.Clock {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		binary.BigEndian.PutUint64(b[:], uint64(id))
+		h.Write(b[:])
+		binary.BigEndian.PutUint64(b[:], s.Clock[id])
+		h.Write(b[:])
+	}
+	binary.BigEndian.PutUint64(b[:], uint64(s.Node))
+	h.Write(b[:])
+	binary.BigEndian.PutUint64(b[:], s.Count)
+	h.Write(b[:])
+	h.Write(s.Value)
+	return h.Sum64()
+}
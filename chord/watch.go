@@ -0,0 +1,249 @@
+package chord
+
+import (
+	"strings"
+	"time"
+
+	"github.com/anteater2/bitmesh/metrics"
+)
+
+// EventType is the kind of change an Event reports.
+type EventType int
+
+// Event types
+const (
+	EventPut EventType = iota + 1
+	EventDelete
+	EventExpire
+	// EventOverflow stands in for the events dropped because the receiver
+	// of a watch was too slow, whether a node or a client dropped them.
+	EventOverflow
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "put"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	case EventOverflow:
+		return "overflow"
+	}
+	return "unknown"
+}
+
+// Event is a change of a watched key, pushed by the node that owns the key
+// to the address of the watch.
+type Event struct {
+	WatchID string
+	Type    EventType
+	Key     string
+	Value   []byte // for EventPut
+	Version uint64 // for EventPut
+	// Seq grows with every event a node sends for a watch.  It starts from
+	// the clock of the node, so it keeps growing when a key watch moves to
+	// another node, as long as their clocks agree.
+	Seq uint64
+}
+
+// watchQueueSize is the number of events a node keeps for a watch whose
+// receiver is slower than the changes.
+const watchQueueSize = 1000
+
+// watchQueue holds the events of a watch that are not sent yet.  A single
+// goroutine sends them, one after the other, so they leave in order.
+type watchQueue struct {
+	address string
+	events  []Event
+	seq     uint64
+	// overflowed is set once an EventOverflow is queued, until the queue
+	// has room again.
+	overflowed bool
+	sending    bool
+}
+
+// Watch is a subscription to the changes of a key, or of all the keys with a
+// prefix.  A key watch lives on the owner of the key and moves with it; a
+// prefix watch lives on every node, and joining nodes get a copy.
+// Watches are leases: they are dropped once they expire, unless renewed.
+type Watch struct {
+	// ID is picked by the watcher; a watch replaces any other with its ID.
+	ID     string
+	Key    string
+	Prefix bool
+	// Address is where events are sent, with a message.Sender.
+	Address string
+	Expires time.Time
+}
+
+func (w *Watch) matches(key string) bool {
+	if w.Prefix {
+		return strings.HasPrefix(key, w.Key)
+	}
+	return key == w.Key
+}
+
+// addWatch starts or renews a watch for ttl.
+func (n *Node) addWatch(w Watch, ttl time.Duration) error {
+	if !w.Prefix {
+		hash := Hash(w.Key, n.config.MaxKey())
+		if !n.isLocalResponsible(hash) {
+			n.log.Debug("watch: not responsible", "key", w.Key, "hash", hash)
+			return ErrWrongNode
+		}
+	}
+	w.Expires = n.config.Clock.Now().Add(ttl)
+	n.watchMutex.Lock()
+	n.watches[w.ID] = w
+	n.watchMutex.Unlock()
+	n.log.Debug("watch", "id", w.ID, "key", w.Key, "prefix", w.Prefix, "peer", w.Address)
+	n.updateWatchMetrics()
+	return nil
+}
+
+func (n *Node) removeWatch(id string) {
+	n.watchMutex.Lock()
+	delete(n.watches, id)
+	n.dropQueue(id)
+	n.watchMutex.Unlock()
+	n.updateWatchMetrics()
+}
+
+// takeWatches hands the watches of the keys in (start, end] over to a
+// joining node, and copies the prefix watches.
+func (n *Node) takeWatches(start Key, end Key) []Watch {
+	n.watchMutex.Lock()
+	watches := []Watch{}
+	for id, w := range n.watches {
+		if w.Prefix {
+			watches = append(watches, w)
+		} else if Hash(w.Key, n.config.MaxKey()).BetweenEndInclusive(start, end) {
+			watches = append(watches, w)
+			delete(n.watches, id)
+			n.dropQueue(id)
+		}
+	}
+	n.watchMutex.Unlock()
+	n.updateWatchMetrics()
+	return watches
+}
+
+// Watches returns the watches of the node.
+func (n *Node) Watches() []Watch {
+	n.watchMutex.Lock()
+	defer n.watchMutex.Unlock()
+	watches := make([]Watch, 0, len(n.watches))
+	for _, w := range n.watches {
+		watches = append(watches, w)
+	}
+	return watches
+}
+
+// putWatches adds the watches of another node, keeping their leases.
+func (n *Node) putWatches(watches []Watch) {
+	n.watchMutex.Lock()
+	for _, w := range watches {
+		if old, prs := n.watches[w.ID]; !prs || old.Expires.Before(w.Expires) {
+			n.watches[w.ID] = w
+		}
+	}
+	n.watchMutex.Unlock()
+	n.updateWatchMetrics()
+}
+
+// expireWatches drops the watches whose lease has run out.
+func (n *Node) expireWatches() {
+	now := n.config.Clock.Now()
+	n.watchMutex.Lock()
+	for id, w := range n.watches {
+		if !now.Before(w.Expires) {
+			delete(n.watches, id)
+			n.dropQueue(id)
+		}
+	}
+	n.watchMutex.Unlock()
+	n.updateWatchMetrics()
+}
+
+// changed is called by the table on every change of a key, with its lock
+// held, so it only queues the events.
+func (n *Node) changed(entry HashEntry, event EventType) {
+	now := n.config.Clock.Now()
+	value := entry.Value
+	if len(entry.Siblings) > 0 {
+		// The value just put with a vector clock is the last sibling.
+		value = entry.Siblings[len(entry.Siblings)-1].Value
+	}
+	n.watchMutex.Lock()
+	defer n.watchMutex.Unlock()
+	for _, w := range n.watches {
+		if !w.matches(entry.Key) || !now.Before(w.Expires) {
+			continue
+		}
+		q, ok := n.queues[w.ID]
+		if !ok {
+			q = &watchQueue{}
+			n.queues[w.ID] = q
+		}
+		q.address = w.Address
+		q.seq = max(q.seq+1, uint64(now.UnixNano()))
+		switch {
+		case len(q.events) < watchQueueSize:
+			q.overflowed = false
+			q.events = append(q.events, Event{WatchID: w.ID, Type: event, Key: entry.Key, Value: value, Version: entry.Version, Seq: q.seq})
+		case !q.overflowed:
+			q.overflowed = true
+			q.events = append(q.events, Event{WatchID: w.ID, Type: EventOverflow, Key: w.Key, Seq: q.seq})
+			fallthrough
+		default:
+			n.config.Metrics.Add("bitmesh_chord_watch_dropped_total", 1)
+		}
+		if !q.sending {
+			q.sending = true
+			go n.sendEvents(w.ID, q)
+		}
+	}
+}
+
+// sendEvents sends the events of a watch in order until its queue is empty.
+func (n *Node) sendEvents(id string, q *watchQueue) {
+	for {
+		n.watchMutex.Lock()
+		if len(q.events) == 0 {
+			q.sending = false
+			if _, ok := n.watches[id]; !ok {
+				n.dropQueue(id)
+			}
+			n.watchMutex.Unlock()
+			return
+		}
+		e := q.events[0]
+		q.events = q.events[1:]
+		address := q.address
+		n.watchMutex.Unlock()
+		label := metrics.Label{Name: "type", Value: e.Type.String()}
+		if err := n.events.Send(address, e); err != nil {
+			n.config.Metrics.Add("bitmesh_chord_watch_send_errors_total", 1, label)
+			n.log.Debug("could not send an event", "id", e.WatchID, "key", e.Key, "peer", address, "error", err)
+			continue
+		}
+		n.config.Metrics.Add("bitmesh_chord_watch_events_total", 1, label)
+	}
+}
+
+// dropQueue forgets the queue of a watch that is gone, unless it is still
+// being sent.  The caller must hold watchMutex.
+func (n *Node) dropQueue(id string) {
+	if q, ok := n.queues[id]; ok && !q.sending {
+		delete(n.queues, id)
+	}
+}
+
+func (n *Node) updateWatchMetrics() {
+	n.watchMutex.Lock()
+	count := len(n.watches)
+	n.watchMutex.Unlock()
+	n.config.Metrics.Set("bitmesh_chord_watches", float64(count))
+}
@@ -0,0 +1,27 @@
+// Package clock abstracts the passing of time,
+// so that code which waits can also run on simulated time.
+package clock
+
+import "time"
+
+// Clock tells the time and wakes up waiters.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After waits for the duration to elapse and then sends the current time
+	// on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+// Real is the wall clock of package time.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,393 @@
+// Package crdt implements state-based conflict-free replicated data types.
+// States are encoded as bytes, so that they can be stored in the DHT; two
+// states of the same type can always be merged, in any order and any number
+// of times, into one that has seen the updates of both.
+package crdt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Type is the type of a CRDT.
+type Type string
+
+const (
+	// GCounter is a counter that only grows.
+	GCounter Type = "g-counter"
+	// PNCounter is a counter that is added to and subtracted from.
+	PNCounter Type = "pn-counter"
+	// LWWRegister is a value whose last write wins.
+	LWWRegister Type = "lww-register"
+	// ORSet is a set of strings where an add wins over a concurrent remove.
+	ORSet Type = "or-set"
+	// LWWMap is a map of strings to values whose last write wins, key by key.
+	LWWMap Type = "lww-map"
+)
+
+// Kind is the kind of an operation.
+type Kind int
+
+const (
+	// Add adds Delta to a counter, or Key to a set.
+	Add Kind = iota + 1
+	// Remove removes Key from a set or a map.
+	Remove
+	// Set sets a register to Value, or Key to Value in a map.
+	Set
+)
+
+// Op is an operation on a CRDT.
+type Op struct {
+	Type  Type
+	Kind  Kind
+	Delta int64
+	Key   string
+	Value []byte
+}
+
+// ErrType is returned for a state or an operation of another type.
+var ErrType = errors.New("crdt: wrong type")
+
+// Apply returns the state after op, done by replica at time now.  A nil
+// state is the initial state of the type.  Operations on one state must all
+// be done by a replica that has seen it, and every replica must have its
+// own ID.
+func Apply(state []byte, op Op, replica string, now time.Time) ([]byte, error) {
+	switch op.Type {
+	case GCounter, PNCounter:
+		var c counter
+		if err := decode(state, &c); err != nil {
+			return nil, err
+		}
+		if op.Kind != Add || (op.Type == GCounter && op.Delta < 0) {
+			return nil, fmt.Errorf("%w: cannot %s %d to a %s", ErrType, op.Kind, op.Delta, op.Type)
+		}
+		c.add(replica, op.Delta)
+		return json.Marshal(c)
+	case LWWRegister:
+		var r register
+		if err := decode(state, &r); err != nil {
+			return nil, err
+		}
+		if op.Kind != Set {
+			return nil, fmt.Errorf("%w: cannot %s a %s", ErrType, op.Kind, op.Type)
+		}
+		r = r.merge(register{Value: op.Value, Time: timestamp(r, now), Replica: replica})
+		return json.Marshal(r)
+	case ORSet:
+		var s orSet
+		if err := decode(state, &s); err != nil {
+			return nil, err
+		}
+		switch op.Kind {
+		case Add:
+			s.add(op.Key, replica)
+		case Remove:
+			s.remove(op.Key)
+		default:
+			return nil, fmt.Errorf("%w: cannot %s in a %s", ErrType, op.Kind, op.Type)
+		}
+		return json.Marshal(s)
+	case LWWMap:
+		var m lwwMap
+		if err := decode(state, &m); err != nil {
+			return nil, err
+		}
+		r := register{Value: op.Value, Time: timestamp(m[op.Key], now), Replica: replica}
+		switch op.Kind {
+		case Set:
+		case Remove:
+			r.Value, r.Deleted = nil, true
+		default:
+			return nil, fmt.Errorf("%w: cannot %s in a %s", ErrType, op.Kind, op.Type)
+		}
+		if m == nil {
+			m = make(lwwMap)
+		}
+		m[op.Key] = m[op.Key].merge(r)
+		return json.Marshal(m)
+	}
+	return nil, fmt.Errorf("%w: unknown type %q", ErrType, op.Type)
+}
+
+// Merge returns the join of two states of type t.
+func Merge(t Type, a []byte, b []byte) ([]byte, error) {
+	switch t {
+	case GCounter, PNCounter:
+		var x, y counter
+		if err := decodeBoth(a, b, &x, &y); err != nil {
+			return nil, err
+		}
+		return json.Marshal(x.merge(y))
+	case LWWRegister:
+		var x, y register
+		if err := decodeBoth(a, b, &x, &y); err != nil {
+			return nil, err
+		}
+		return json.Marshal(x.merge(y))
+	case ORSet:
+		var x, y orSet
+		if err := decodeBoth(a, b, &x, &y); err != nil {
+			return nil, err
+		}
+		return json.Marshal(x.merge(y))
+	case LWWMap:
+		var x, y lwwMap
+		if err := decodeBoth(a, b, &x, &y); err != nil {
+			return nil, err
+		}
+		merged := make(lwwMap)
+		for k, r := range x {
+			merged[k] = r
+		}
+		for k, r := range y {
+			merged[k] = merged[k].merge(r)
+		}
+		return json.Marshal(merged)
+	}
+	return nil, fmt.Errorf("crdt: unknown type %q", t)
+}
+
+// Counter returns the value of a G-Counter or a PN-Counter.
+func Counter(state []byte) (int64, error) {
+	var c counter
+	if err := decode(state, &c); err != nil {
+		return 0, err
+	}
+	return c.value(), nil
+}
+
+// Register returns the value of an LWW-Register, nil if it was never set.
+func Register(state []byte) ([]byte, error) {
+	var r register
+	if err := decode(state, &r); err != nil {
+		return nil, err
+	}
+	return r.Value, nil
+}
+
+// Elements returns the elements of an OR-Set, sorted.
+func Elements(state []byte) ([]string, error) {
+	var s orSet
+	if err := decode(state, &s); err != nil {
+		return nil, err
+	}
+	return s.elements(), nil
+}
+
+// Entries returns the entries of an LWW-Map.
+func Entries(state []byte) (map[string][]byte, error) {
+	var m lwwMap
+	if err := decode(state, &m); err != nil {
+		return nil, err
+	}
+	entries := make(map[string][]byte)
+	for k, r := range m {
+		if !r.Deleted {
+			entries[k] = r.Value
+		}
+	}
+	return entries, nil
+}
+
+func (k Kind) String() string {
+	switch k {
+	case Add:
+		return "add"
+	case Remove:
+		return "remove"
+	case Set:
+		return "set"
+	}
+	return "Kind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// decode decodes a state, leaving v alone for a nil one.
+func decode(state []byte, v interface{}) error {
+	if len(state) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(state, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrType, err)
+	}
+	return nil
+}
+
+func decodeBoth(a []byte, b []byte, x interface{}, y interface{}) error {
+	if err := decode(a, x); err != nil {
+		return err
+	}
+	return decode(b, y)
+}
+
+// counter is a PN-Counter: the sums of the increments and of the decrements
+// of every replica.  A G-Counter is one without decrements.
+type counter struct {
+	P map[string]int64 `json:"p"`
+	N map[string]int64 `json:"n,omitempty"`
+}
+
+func (c *counter) add(replica string, delta int64) {
+	if c.P == nil {
+		c.P = make(map[string]int64)
+	}
+	if delta >= 0 {
+		c.P[replica] += delta
+		return
+	}
+	if c.N == nil {
+		c.N = make(map[string]int64)
+	}
+	c.N[replica] -= delta
+}
+
+func (c counter) merge(other counter) counter {
+	return counter{P: maxEach(c.P, other.P), N: maxEach(c.N, other.N)}
+}
+
+func (c counter) value() int64 {
+	var v int64
+	for _, p := range c.P {
+		v += p
+	}
+	for _, n := range c.N {
+		v -= n
+	}
+	return v
+}
+
+// maxEach returns the maximum of a and b for every replica.
+func maxEach(a map[string]int64, b map[string]int64) map[string]int64 {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	merged := make(map[string]int64, len(a))
+	for r, v := range a {
+		merged[r] = v
+	}
+	for r, v := range b {
+		if v > merged[r] {
+			merged[r] = v
+		}
+	}
+	return merged
+}
+
+// register is a value with the time and the replica of its write.  The
+// later write wins, and the greater replica between two at the same time.
+type register struct {
+	Value   []byte `json:"v,omitempty"`
+	Time    int64  `json:"t"` // in nanoseconds since the epoch
+	Replica string `json:"r"`
+	Deleted bool   `json:"d,omitempty"`
+}
+
+func (r register) merge(other register) register {
+	if other.Time > r.Time || (other.Time == r.Time && other.Replica > r.Replica) {
+		return other
+	}
+	return r
+}
+
+// timestamp returns the time of a write at now that follows the write of r,
+// even if the clock of the replica is behind.
+func timestamp(r register, now time.Time) int64 {
+	t := now.UnixNano()
+	if t <= r.Time {
+		t = r.Time + 1
+	}
+	return t
+}
+
+// orSet is an observed-remove set.  Every add of an element gets a unique
+// tag, and a remove drops the tags of the element it has seen, so that a
+// concurrent add, with a tag it has not seen, wins.
+type orSet struct {
+	// Adds maps the elements to their tags.
+	Adds map[string][]string `json:"a,omitempty"`
+	// Removed are the tags that were removed.
+	Removed []string `json:"r,omitempty"`
+	// Clock counts the adds of every replica, to make tags.
+	Clock map[string]int64 `json:"c,omitempty"`
+}
+
+func (s *orSet) add(element string, replica string) {
+	if s.Clock == nil {
+		s.Clock = make(map[string]int64)
+	}
+	if s.Adds == nil {
+		s.Adds = make(map[string][]string)
+	}
+	s.Clock[replica]++
+	tag := replica + "#" + strconv.FormatInt(s.Clock[replica], 10)
+	s.Adds[element] = append(s.Adds[element], tag)
+	sort.Strings(s.Adds[element])
+}
+
+func (s *orSet) remove(element string) {
+	s.Removed = union(s.Removed, s.Adds[element])
+	delete(s.Adds, element)
+}
+
+func (s orSet) merge(other orSet) orSet {
+	merged := orSet{
+		Adds:    make(map[string][]string),
+		Removed: union(s.Removed, other.Removed),
+		Clock:   maxEach(s.Clock, other.Clock),
+	}
+	removed := make(map[string]bool, len(merged.Removed))
+	for _, tag := range merged.Removed {
+		removed[tag] = true
+	}
+	for _, adds := range []map[string][]string{s.Adds, other.Adds} {
+		for element, tags := range adds {
+			var live []string
+			for _, tag := range tags {
+				if !removed[tag] {
+					live = append(live, tag)
+				}
+			}
+			if len(live) > 0 {
+				merged.Adds[element] = union(merged.Adds[element], live)
+			}
+		}
+	}
+	if len(merged.Adds) == 0 {
+		merged.Adds = nil
+	}
+	return merged
+}
+
+func (s orSet) elements() []string {
+	elements := make([]string, 0, len(s.Adds))
+	for element := range s.Adds {
+		elements = append(elements, element)
+	}
+	sort.Strings(elements)
+	return elements
+}
+
+// union returns the sorted union of two sets of tags.
+func union(a []string, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	var u []string
+	for _, tags := range [][]string{a, b} {
+		for _, tag := range tags {
+			if !seen[tag] {
+				seen[tag] = true
+				u = append(u, tag)
+			}
+		}
+	}
+	sort.Strings(u)
+	return u
+}
+
+// lwwMap is a map of registers; removed keys are registers marked deleted,
+// so that they win over older writes.
+type lwwMap map[string]register
@@ -0,0 +1,124 @@
+package crdt_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/anteater2/bitmesh/crdt"
+)
+
+// replicas applies ops on two replicas, a and b, from the same state, and
+// returns their states.
+func replicas(t *testing.T, state []byte, a []crdt.Op, b []crdt.Op) ([]byte, []byte) {
+	t.Helper()
+	now := time.Unix(1000, 0)
+	apply := func(state []byte, ops []crdt.Op, replica string) []byte {
+		for _, op := range ops {
+			var err error
+			now = now.Add(time.Second)
+			if state, err = crdt.Apply(state, op, replica, now); err != nil {
+				t.Fatalf("%s: %v: %v", replica, op, err)
+			}
+		}
+		return state
+	}
+	return apply(state, a, "a"), apply(state, b, "b")
+}
+
+// join merges x and y both ways, checks that the results are the same and
+// that merging again changes nothing, and returns the result.
+func join(t *testing.T, typ crdt.Type, x []byte, y []byte) []byte {
+	t.Helper()
+	xy, err := crdt.Merge(typ, x, y)
+	if err != nil {
+		t.Fatal(err)
+	}
+	yx, err := crdt.Merge(typ, y, x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(xy, yx) {
+		t.Errorf("merge is not commutative: %s and %s", xy, yx)
+	}
+	again, err := crdt.Merge(typ, xy, x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, xy) {
+		t.Errorf("merge is not idempotent: %s and %s", again, xy)
+	}
+	return xy
+}
+
+func TestCounters(t *testing.T) {
+	add := func(typ crdt.Type, n int64) crdt.Op { return crdt.Op{Type: typ, Kind: crdt.Add, Delta: n} }
+	x, y := replicas(t, nil,
+		[]crdt.Op{add(crdt.PNCounter, 5), add(crdt.PNCounter, -2)},
+		[]crdt.Op{add(crdt.PNCounter, 10)})
+	if v, err := crdt.Counter(join(t, crdt.PNCounter, x, y)); err != nil || v != 13 {
+		t.Errorf("PN-Counter: %d, %v", v, err)
+	}
+
+	x, y = replicas(t, nil, []crdt.Op{add(crdt.GCounter, 1)}, []crdt.Op{add(crdt.GCounter, 2), add(crdt.GCounter, 3)})
+	if v, err := crdt.Counter(join(t, crdt.GCounter, x, y)); err != nil || v != 6 {
+		t.Errorf("G-Counter: %d, %v", v, err)
+	}
+	if _, err := crdt.Apply(nil, add(crdt.GCounter, -1), "a", time.Now()); err == nil {
+		t.Error("decremented a G-Counter")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	set := func(v string) crdt.Op { return crdt.Op{Type: crdt.LWWRegister, Kind: crdt.Set, Value: []byte(v)} }
+	// b writes last.
+	x, y := replicas(t, nil, []crdt.Op{set("a")}, []crdt.Op{set("b1"), set("b2")})
+	if v, err := crdt.Register(join(t, crdt.LWWRegister, x, y)); err != nil || string(v) != "b2" {
+		t.Errorf("register: %q, %v", v, err)
+	}
+}
+
+func TestORSet(t *testing.T) {
+	op := func(kind crdt.Kind, e string) crdt.Op { return crdt.Op{Type: crdt.ORSet, Kind: kind, Key: e} }
+	state, _ := replicas(t, nil, []crdt.Op{op(crdt.Add, "milk"), op(crdt.Add, "eggs")}, nil)
+	// a removes milk while b adds it again: the add wins.  b removes eggs.
+	x, y := replicas(t, state,
+		[]crdt.Op{op(crdt.Remove, "milk"), op(crdt.Add, "jam")},
+		[]crdt.Op{op(crdt.Add, "milk"), op(crdt.Remove, "eggs")})
+	elements, err := crdt.Elements(join(t, crdt.ORSet, x, y))
+	if err != nil || fmt.Sprint(elements) != "[jam milk]" {
+		t.Errorf("elements: %v, %v", elements, err)
+	}
+}
+
+func TestLWWMap(t *testing.T) {
+	op := func(kind crdt.Kind, k string, v string) crdt.Op {
+		return crdt.Op{Type: crdt.LWWMap, Kind: kind, Key: k, Value: []byte(v)}
+	}
+	state, _ := replicas(t, nil, []crdt.Op{op(crdt.Set, "name", "ann"), op(crdt.Set, "city", "paris")}, nil)
+	x, y := replicas(t, state,
+		[]crdt.Op{op(crdt.Set, "name", "bob"), op(crdt.Remove, "city", "")},
+		[]crdt.Op{op(crdt.Set, "city", "rome"), op(crdt.Set, "age", "30")})
+	// Writes of b come after those of a in time.
+	entries, err := crdt.Entries(join(t, crdt.LWWMap, x, y))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprintf("%s %s %s", entries["name"], entries["city"], entries["age"]); got != "bob rome 30" || len(entries) != 3 {
+		t.Errorf("entries: %q", entries)
+	}
+}
+
+func TestWrongType(t *testing.T) {
+	state, err := crdt.Apply(nil, crdt.Op{Type: crdt.ORSet, Kind: crdt.Add, Key: "x"}, "a", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := crdt.Apply(state, crdt.Op{Type: crdt.ORSet, Kind: crdt.Set}, "a", time.Now()); err == nil {
+		t.Error("set an element of a set")
+	}
+	if _, err := crdt.Merge("bag", state, state); err == nil {
+		t.Error("merged an unknown type")
+	}
+}
@@ -0,0 +1,198 @@
+package dht
+
+import (
+	"errors"
+
+	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/crdt"
+)
+
+// Counter is a counter stored at a key, a PN-Counter or a G-Counter.
+type Counter struct {
+	dht *DHT
+	key string
+	t   crdt.Type
+}
+
+// Counter returns the PN-Counter stored at k.
+func (dht *DHT) Counter(k string) *Counter {
+	return &Counter{dht, k, crdt.PNCounter}
+}
+
+// GCounter returns the G-Counter, which only grows, stored at k.
+func (dht *DHT) GCounter(k string) *Counter {
+	return &Counter{dht, k, crdt.GCounter}
+}
+
+// Add adds n to the counter and returns its new value.
+func (c *Counter) Add(n int64) (int64, error) {
+	if c.t == crdt.GCounter && n < 0 {
+		return 0, errors.New("dht: a G-Counter only grows")
+	}
+	state, err := c.dht.apply(c.key, crdt.Op{Type: c.t, Kind: crdt.Add, Delta: n})
+	if err != nil {
+		return 0, err
+	}
+	return crdt.Counter(state)
+}
+
+// Value returns the value of the counter, 0 if it was never added to.
+func (c *Counter) Value() (int64, error) {
+	state, err := c.dht.state(c.key)
+	if err != nil {
+		return 0, err
+	}
+	return crdt.Counter(state)
+}
+
+// Register is an LWW-Register stored at a key.
+type Register struct {
+	dht *DHT
+	key string
+}
+
+// Register returns the LWW-Register stored at k.
+func (dht *DHT) Register(k string) *Register {
+	return &Register{dht, k}
+}
+
+// Set sets the value of the register.
+func (r *Register) Set(v []byte) error {
+	_, err := r.dht.apply(r.key, crdt.Op{Type: crdt.LWWRegister, Kind: crdt.Set, Value: v})
+	return err
+}
+
+// Get returns the value of the register, or ErrNotFound if it was never set.
+func (r *Register) Get() ([]byte, error) {
+	state, err := r.dht.state(r.key)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, ErrNotFound
+	}
+	v, err := crdt.Register(state)
+	if v == nil && err == nil {
+		v = []byte{}
+	}
+	return v, err
+}
+
+// Set is an OR-Set of strings stored at a key.
+type Set struct {
+	dht *DHT
+	key string
+}
+
+// Set returns the OR-Set stored at k.
+func (dht *DHT) Set(k string) *Set {
+	return &Set{dht, k}
+}
+
+// Add adds an element to the set.
+func (s *Set) Add(element string) error {
+	_, err := s.dht.apply(s.key, crdt.Op{Type: crdt.ORSet, Kind: crdt.Add, Key: element})
+	return err
+}
+
+// Remove removes an element from the set.  An add of the element that the
+// owner of the key has not seen yet wins.
+func (s *Set) Remove(element string) error {
+	_, err := s.dht.apply(s.key, crdt.Op{Type: crdt.ORSet, Kind: crdt.Remove, Key: element})
+	return err
+}
+
+// Elements returns the elements of the set, sorted.
+func (s *Set) Elements() ([]string, error) {
+	state, err := s.dht.state(s.key)
+	if err != nil {
+		return nil, err
+	}
+	return crdt.Elements(state)
+}
+
+// Map is an LWW-Map stored at a key.
+type Map struct {
+	dht *DHT
+	key string
+}
+
+// Map returns the LWW-Map stored at k.
+func (dht *DHT) Map(k string) *Map {
+	return &Map{dht, k}
+}
+
+// Set sets a field of the map.
+func (m *Map) Set(field string, v []byte) error {
+	_, err := m.dht.apply(m.key, crdt.Op{Type: crdt.LWWMap, Kind: crdt.Set, Key: field, Value: v})
+	return err
+}
+
+// Delete removes a field from the map.
+func (m *Map) Delete(field string) error {
+	_, err := m.dht.apply(m.key, crdt.Op{Type: crdt.LWWMap, Kind: crdt.Remove, Key: field})
+	return err
+}
+
+// Get returns a field of the map, or ErrNotFound if it is not set.
+func (m *Map) Get(field string) ([]byte, error) {
+	entries, err := m.Entries()
+	if err != nil {
+		return nil, err
+	}
+	v, ok := entries[field]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if v == nil {
+		v = []byte{}
+	}
+	return v, nil
+}
+
+// Entries returns the fields of the map.
+func (m *Map) Entries() (map[string][]byte, error) {
+	state, err := m.dht.state(m.key)
+	if err != nil {
+		return nil, err
+	}
+	return crdt.Entries(state)
+}
+
+// apply does an operation on the CRDT at k on its owner, and returns the new
+// state.  Operations such as adds are not idempotent, so one is only sent
+// again when a node answered that it does not own k, never after a timeout,
+// which may hide an operation that was done.
+func (dht *DHT) apply(k string, op crdt.Op) ([]byte, error) {
+	hashk := chord.Hash(k, 1<<dht.bits)
+	owner, ok := dht.routes.owner(hashk)
+	for attempt := 0; attempt < 2; attempt++ {
+		if !ok || attempt > 0 {
+			var err error
+			if owner, err = dht.lookup(hashk); err != nil {
+				return nil, err
+			}
+		}
+		state, _, entry, err := dht.caller.Apply(owner.Address, k, op)
+		if err == nil {
+			return state, dht.replicate(owner.Address, []chord.HashEntry{entry}, k)
+		}
+		if !answered(err) {
+			dht.log.Debug("dropping a stale route", "key", k, "hash", hashk, "peer", owner.Address, "error", err)
+			dht.routes.remove(owner.Address)
+		}
+		if err != chord.ErrWrongNode {
+			return nil, err
+		}
+	}
+	return nil, chord.ErrWrongNode
+}
+
+// state returns the state of the CRDT at k, nil if there is none.
+func (dht *DHT) state(k string) ([]byte, error) {
+	state, err := dht.GetBytes(k)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	return state, err
+}
@@ -1,58 +1,659 @@
 package dht
 
 import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
 	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/clock"
+	"github.com/anteater2/bitmesh/crdt"
+	"github.com/anteater2/bitmesh/logging"
+	"github.com/anteater2/bitmesh/message"
+	"github.com/anteater2/bitmesh/metrics"
+	"github.com/anteater2/bitmesh/rpc"
 )
 
 // DHT represents a client for a distributed hash table.
 type DHT struct {
-	node   string
+	seeds  []string
 	bits   uint64
 	caller *chord.NodeCaller
+	config Config
+	log    logging.Logger
+	routes routes
+
+	entry         string
+	entryMutex    sync.Mutex
+	failoverMutex sync.Mutex
+
+	watchers   map[string]*watcher
+	watchMutex sync.Mutex
+	// receiver gets the events of the watches.  It starts with the first watch.
+	receiver   *message.Receiver
+	eventAddr  string
+	eventMutex sync.Mutex
+
+	quit     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
 }
 
-// New creates a client to access DHT
+// Config holds the optional settings of a client.
+type Config struct {
+	// Seeds are more nodes to enter the ring through, besides the one given to NewWith.
+	Seeds []string
+	// RefreshInterval is the pause between two snapshots of the ring, which
+	// fill the routing cache.  Defaults to 30 seconds; negative disables them.
+	RefreshInterval time.Duration
+	// Addr is the IP address nodes use to send the events of watches to the
+	// client.  Defaults to the address the transport listens on, if it is a
+	// single one, or else to the local address of the route to the entry node.
+	Addr string
+	// EventPort is the port to receive the events of watches on; 0 picks a free port.
+	EventPort uint16
+	// WatchLease is how long nodes keep a watch that is not renewed.  Watches
+	// are renewed every third of it.  Defaults to 30 seconds.
+	WatchLease time.Duration
+	// Replicas is the number of nodes, the owner of a key and its successors,
+	// that reads and writes of single keys go to (N).  Defaults to 1, the
+	// owner alone.  The nodes should keep as many copies, with tombstones;
+	// see chord.Config.Replicas.
+	Replicas int
+	// ReadQuorum is the number of replicas a read waits for (R).  Defaults to
+	// a majority of Replicas.
+	ReadQuorum int
+	// WriteQuorum is the number of replicas, the owner included, a write
+	// waits for (W).  Defaults to a majority of Replicas.
+	WriteQuorum int
+	// Transport defaults to message.TCP.  It carries the calls and the
+	// events of watches.
+	Transport message.Transport
+	// Clock defaults to clock.Real.  It times calls, renewals and refreshes.
+	Clock clock.Clock
+	// Metrics defaults to metrics.Discard.  It is shared with the rpc and message layers.
+	Metrics metrics.Metrics
+	// Logger defaults to slog.Default().  It is shared with the rpc and message layers.
+	Logger logging.Logger
+}
+
+func (c Config) message() message.Config {
+	return message.Config{Transport: c.Transport, Metrics: c.Metrics, Logger: c.Logger}
+}
+
+func (c Config) rpc() rpc.Config {
+	return rpc.Config{Transport: c.Transport, Clock: c.Clock, Metrics: c.Metrics, Logger: c.Logger}
+}
+
+// maxSnapshot bounds the number of nodes a snapshot of the ring walks through.
+const maxSnapshot = 4096
+
+// New creates a client to access DHT through node
 func New(node string, receivePort uint16, bits uint64) (*DHT, error) { // configuration
-	caller, err := chord.NewNodeCaller(receivePort)
+	return NewWith(node, receivePort, bits, Config{})
+}
+
+// NewWith creates a client to access DHT with the given config.
+// The client enters the ring through node or any of config.Seeds.
+func NewWith(node string, receivePort uint16, bits uint64, config Config) (*DHT, error) {
+	if config.RefreshInterval == 0 {
+		config.RefreshInterval = 30 * time.Second
+	}
+	if config.WatchLease == 0 {
+		config.WatchLease = 30 * time.Second
+	}
+	if config.Replicas == 0 {
+		config.Replicas = 1
+	}
+	if config.ReadQuorum == 0 {
+		config.ReadQuorum = config.Replicas/2 + 1
+	}
+	if config.WriteQuorum == 0 {
+		config.WriteQuorum = config.Replicas/2 + 1
+	}
+	if config.Replicas < 0 || config.ReadQuorum < 0 || config.WriteQuorum < 0 ||
+		config.ReadQuorum > config.Replicas || config.WriteQuorum > config.Replicas {
+		return nil, fmt.Errorf("dht: invalid quorums N=%d R=%d W=%d", config.Replicas, config.ReadQuorum, config.WriteQuorum)
+	}
+	if config.Clock == nil {
+		config.Clock = clock.Real
+	}
+	config.Metrics = metrics.Or(config.Metrics)
+	config.Logger = logging.Or(config.Logger)
+	caller, err := chord.NewNodeCallerWith(receivePort, config.rpc())
 	if err != nil {
 		return nil, err
 	}
 	return &DHT{
-		node:   node,
+		seeds:  append([]string{node}, config.Seeds...),
 		bits:   bits,
 		caller: caller,
+		config: config,
+		log:    config.Logger,
+		quit:   make(chan struct{}),
+
+		watchers: make(map[string]*watcher),
 	}, nil
 }
 
-// Start ...
-func (dht *DHT) Start() {
-	dht.caller.Start()
+// Start starts the client and picks a live seed to enter the ring through.
+func (dht *DHT) Start() error {
+	if err := dht.caller.Start(); err != nil {
+		return err
+	}
+	if err := dht.failover(""); err != nil {
+		dht.caller.Stop()
+		return err
+	}
+	if dht.config.RefreshInterval > 0 {
+		dht.wg.Add(1)
+		go dht.refreshLoop()
+	}
+	return nil
+}
+
+// Stop stops the client
+func (dht *DHT) Stop() {
+	dht.stopOnce.Do(func() {
+		close(dht.quit)
+		dht.wg.Wait()
+		dht.caller.Stop()
+		dht.eventMutex.Lock()
+		if dht.receiver != nil {
+			dht.receiver.Stop()
+		}
+		dht.eventMutex.Unlock()
+	})
 }
 
-// Put puts a key-value pair into dht.
-func (dht *DHT) Put(k string, v string) error {
-	hashk := chord.Hash(k, 1<<dht.bits)
-	remote, err := dht.caller.FindSuccessor(dht.node, hashk)
-	if err != nil {
+func (dht *DHT) refreshLoop() {
+	defer dht.wg.Done()
+	for {
+		if err := dht.Refresh(); err != nil {
+			dht.log.Warn("cannot take a snapshot of the ring", "error", err)
+		}
+		select {
+		case <-dht.quit:
+			return
+		case <-dht.config.Clock.After(dht.config.RefreshInterval):
+		}
+	}
+}
+
+// Entry returns the address of the node the client enters the ring through.
+func (dht *DHT) Entry() string {
+	dht.entryMutex.Lock()
+	defer dht.entryMutex.Unlock()
+	return dht.entry
+}
+
+// failover picks a new entry node among the seeds, then among the nodes in the
+// routing cache, in random order.  It skips failed, and does nothing if the
+// entry node is no longer failed, that is if another call already moved on.
+func (dht *DHT) failover(failed string) error {
+	dht.failoverMutex.Lock()
+	defer dht.failoverMutex.Unlock()
+	if dht.Entry() != failed {
+		return nil
+	}
+	var candidates []string
+	for _, i := range rand.Perm(len(dht.seeds)) {
+		candidates = append(candidates, dht.seeds[i])
+	}
+	routes := dht.routes.list()
+	for _, i := range rand.Perm(len(routes)) {
+		candidates = append(candidates, routes[i].Address)
+	}
+	tried := map[string]bool{failed: true}
+	for _, candidate := range candidates {
+		if tried[candidate] {
+			continue
+		}
+		tried[candidate] = true
+		if !dht.caller.IsAlive(candidate) {
+			dht.log.Debug("candidate entry node is down", "peer", candidate)
+			continue
+		}
+		dht.entryMutex.Lock()
+		dht.entry = candidate
+		dht.entryMutex.Unlock()
+		if failed != "" {
+			dht.config.Metrics.Add("bitmesh_dht_failovers_total", 1)
+			dht.log.Info("new entry node", "peer", candidate, "failed", failed)
+		}
+		return nil
+	}
+	return errors.New("dht: no live node to enter the ring through")
+}
+
+// withEntry calls f with the entry node.  If f fails because the entry node
+// is down, it fails over to another node and calls f again.
+func (dht *DHT) withEntry(f func(entry string) error) error {
+	entry := dht.Entry()
+	err := f(entry)
+	if err == nil || dht.caller.IsAlive(entry) {
+		return err
+	}
+	dht.log.Warn("entry node is down", "peer", entry, "error", err)
+	dht.routes.remove(entry)
+	if err := dht.failover(entry); err != nil {
 		return err
 	}
-	err = dht.caller.Put(remote.Address, k, []byte(v))
+	return f(dht.Entry())
+}
+
+// Refresh walks the ring from the entry node and replaces the routing cache
+// with the nodes it met.  If the walk breaks, the nodes met so far are added
+// to the cache.
+func (dht *DHT) Refresh() error {
+	var first chord.RemoteNode
+	err := dht.withEntry(func(entry string) error {
+		var err error
+		first, err = dht.caller.GetSuccessor(entry)
+		return err
+	})
 	if err != nil {
 		return err
 	}
+	nodes := []chord.RemoteNode{first}
+	for len(nodes) < maxSnapshot {
+		next, err := dht.caller.GetSuccessor(nodes[len(nodes)-1].Address)
+		if err != nil {
+			for _, node := range nodes {
+				dht.routes.add(node)
+			}
+			return err
+		}
+		if next.Address == first.Address {
+			break
+		}
+		nodes = append(nodes, next)
+	}
+	dht.routes.set(nodes)
+	dht.log.Debug("refreshed the routing cache", "nodes", len(nodes))
 	return nil
 }
 
-// Get gets the value corresponding to the key from dht
-func (dht *DHT) Get(k string) (string, error) {
+// Routes returns the nodes in the routing cache, sorted by key.
+func (dht *DHT) Routes() []chord.RemoteNode {
+	return dht.routes.list()
+}
+
+// route calls f with the address of the node responsible for k.
+// The node is taken from the routing cache if possible.  If it is not
+// responsible or does not answer, it is dropped from the cache and f is
+// called again on the node found by a lookup.
+func (dht *DHT) route(k string, f func(address string) error) error {
 	hashk := chord.Hash(k, 1<<dht.bits)
-	remote, err := dht.caller.FindSuccessor(dht.node, hashk)
+	if owner, ok := dht.routes.owner(hashk); ok {
+		err := f(owner.Address)
+		if answered(err) {
+			dht.config.Metrics.Add("bitmesh_dht_route_cache_total", 1, metrics.Label{Name: "result", Value: "hit"})
+			return err
+		}
+		dht.config.Metrics.Add("bitmesh_dht_route_cache_total", 1, metrics.Label{Name: "result", Value: "stale"})
+		dht.log.Debug("dropping a stale route", "key", k, "hash", hashk, "peer", owner.Address, "error", err)
+		dht.routes.remove(owner.Address)
+	} else {
+		dht.config.Metrics.Add("bitmesh_dht_route_cache_total", 1, metrics.Label{Name: "result", Value: "miss"})
+	}
+	owner, err := dht.lookup(hashk)
 	if err != nil {
-		return "", err
+		return err
 	}
-	v, err := dht.caller.Get(remote.Address, k)
+	return f(owner.Address)
+}
+
+// lookup finds the node responsible for key through the entry node and
+// caches it.
+func (dht *DHT) lookup(key chord.Key) (chord.RemoteNode, error) {
+	var owner chord.RemoteNode
+	err := dht.withEntry(func(entry string) error {
+		var err error
+		owner, err = dht.caller.FindSuccessor(entry, key)
+		return err
+	})
+	if err != nil {
+		return owner, err
+	}
+	dht.routes.add(owner)
+	return owner, nil
+}
+
+// batch sends keys to their owners, with one call per owner, in parallel.
+// f calls address with the keys at indexes and returns their errors, or the
+// error of the call.  The keys whose owner was wrong or did not answer are
+// looked up again and sent once more.  The errors are in the order of keys.
+func (dht *DHT) batch(keys []string, f func(address string, indexes []int) ([]error, error)) []error {
+	errs := make([]error, len(keys))
+	pending := make([]int, len(keys))
+	for i := range pending {
+		pending[i] = i
+	}
+	for attempt := 0; attempt < 2 && len(pending) > 0; attempt++ {
+		groups := make(map[string][]int)
+		for _, i := range pending {
+			hashk := chord.Hash(keys[i], 1<<dht.bits)
+			owner, ok := dht.routes.owner(hashk)
+			if !ok || attempt > 0 {
+				var err error
+				owner, err = dht.lookup(hashk)
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+			}
+			groups[owner.Address] = append(groups[owner.Address], i)
+		}
+		var retry []int
+		var mutex sync.Mutex
+		var wg sync.WaitGroup
+		for address, indexes := range groups {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results, err := f(address, indexes)
+				mutex.Lock()
+				defer mutex.Unlock()
+				stale := false
+				for j, i := range indexes {
+					if err == nil {
+						errs[i] = results[j]
+					} else {
+						errs[i] = err
+					}
+					if !answered(errs[i]) {
+						retry = append(retry, i)
+						stale = true
+					}
+				}
+				if stale {
+					dht.log.Debug("dropping a stale route", "peer", address, "error", err)
+					dht.routes.remove(address)
+				}
+			}()
+		}
+		wg.Wait()
+		pending = retry
+	}
+	return errs
+}
+
+// answered returns true if err is an answer of the owner of the key, rather
+// than a sign that the route is stale.
+func answered(err error) bool {
+	return err == nil || err == ErrNotFound || err == ErrVersionMismatch || err == ErrSiblings || errors.Is(err, crdt.ErrType)
+}
+
+// ErrNotFound is returned for missing keys.  It is the same value as chord.ErrNotFound.
+var ErrNotFound = chord.ErrNotFound
+
+// ErrVersionMismatch is returned by CompareAndSwap when the key has changed.
+// It is the same value as chord.ErrVersionMismatch.
+var ErrVersionMismatch = chord.ErrVersionMismatch
+
+// maxUpdateAttempts bounds the number of compare-and-swaps of Update.
+const maxUpdateAttempts = 100
+
+// Put puts a key-value pair into dht.
+func (dht *DHT) Put(k string, v string) error {
+	return dht.PutBytes(k, []byte(v))
+}
+
+// Get gets the value corresponding to the key from dht
+func (dht *DHT) Get(k string) (string, error) {
+	v, err := dht.GetBytes(k)
 	if err != nil {
 		return "", err
 	}
 	return string(v), nil
 }
+
+// PutBytes puts a key-value pair into dht.
+func (dht *DHT) PutBytes(k string, v []byte) error {
+	return dht.PutWithTTL(k, v, 0)
+}
+
+// PutWithTTL puts a key-value pair that expires after ttl into dht.
+// The key never expires if ttl is not positive.
+func (dht *DHT) PutWithTTL(k string, v []byte, ttl time.Duration) error {
+	var owner string
+	var entry chord.HashEntry
+	err := dht.route(k, func(address string) error {
+		var err error
+		owner = address
+		entry, err = dht.caller.PutWithTTL(address, k, v, ttl)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return dht.replicate(owner, []chord.HashEntry{entry}, k)
+}
+
+// Expire sets an existing key to expire after ttl, or never if ttl is not
+// positive.  It returns ErrNotFound if there is no such key.
+func (dht *DHT) Expire(k string, ttl time.Duration) error {
+	var owner string
+	var entry chord.HashEntry
+	err := dht.route(k, func(address string) error {
+		var err error
+		owner = address
+		_, entry, err = dht.caller.Expire(address, k, ttl)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return dht.replicate(owner, []chord.HashEntry{entry}, k)
+}
+
+// TTL returns the time left before a key expires, on the clock of its
+// owner, or 0 if it never does.  It returns ErrNotFound if there is no such key.
+func (dht *DHT) TTL(k string) (time.Duration, error) {
+	var ttl time.Duration
+	err := dht.route(k, func(address string) error {
+		var err error
+		ttl, err = dht.caller.TTL(address, k)
+		return err
+	})
+	return ttl, err
+}
+
+// GetBytes gets the value corresponding to the key from dht.
+// It returns ErrNotFound if there is no such key.
+func (dht *DHT) GetBytes(k string) ([]byte, error) {
+	v, _, err := dht.GetVersioned(k)
+	return v, err
+}
+
+// GetVersioned gets the value corresponding to the key from dht, and its version.
+// It returns ErrNotFound if there is no such key, and ErrSiblings if it has
+// concurrent values.
+func (dht *DHT) GetVersioned(k string) ([]byte, uint64, error) {
+	var v []byte
+	var version uint64
+	var err error
+	if dht.config.Replicas > 1 {
+		var entry chord.HashEntry
+		entry, err = dht.quorumGet(k)
+		if err == nil {
+			v, err = entry.Current()
+		}
+		version = entry.Version
+	} else {
+		err = dht.route(k, func(address string) error {
+			var err error
+			v, version, err = dht.caller.GetVersioned(address, k)
+			return err
+		})
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if v == nil {
+		// gob turns empty values into nil
+		v = []byte{}
+	}
+	return v, version, nil
+}
+
+// CompareAndSwap puts a key-value pair into dht if the version of the key is
+// still version, 0 standing for a missing key, and returns the new version.
+// It returns ErrVersionMismatch if the key has changed.  The key never expires.
+func (dht *DHT) CompareAndSwap(k string, version uint64, v []byte) (uint64, error) {
+	var newVersion uint64
+	var owner string
+	var entry chord.HashEntry
+	err := dht.route(k, func(address string) error {
+		var err error
+		owner = address
+		newVersion, entry, err = dht.caller.CompareAndSwap(address, k, version, v, 0)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return newVersion, dht.replicate(owner, []chord.HashEntry{entry}, k)
+}
+
+// Update replaces the value of a key with f of it, with a compare-and-swap
+// that is tried again, on a fresh value, as long as someone else changes the
+// key in between.  f gets nil for a missing key and may be called several
+// times; if it fails, Update stops and returns its error.
+// Update returns the value it put.
+func (dht *DHT) Update(k string, f func(old []byte) ([]byte, error)) ([]byte, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		old, version, err := dht.GetVersioned(k)
+		if err == ErrNotFound {
+			old, version = nil, 0
+		} else if err != nil {
+			return nil, err
+		}
+		v, err := f(old)
+		if err != nil {
+			return nil, err
+		}
+		_, err = dht.CompareAndSwap(k, version, v)
+		if err != ErrVersionMismatch {
+			return v, err
+		}
+		// Back off a little so that contending writers spread out.
+		<-dht.config.Clock.After(time.Duration(rand.Intn(attempt+1)) * time.Millisecond)
+	}
+	return nil, ErrVersionMismatch
+}
+
+// Delete removes the key from dht.
+func (dht *DHT) Delete(k string) error {
+	var owner string
+	var tombstone chord.HashEntry
+	err := dht.route(k, func(address string) error {
+		var err error
+		owner = address
+		tombstone, err = dht.caller.Delete(address, k)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return dht.replicate(owner, []chord.HashEntry{tombstone}, k)
+}
+
+// Entry is a key-value pair for MultiPut.
+type Entry struct {
+	Key   string
+	Value []byte
+	// TTL is how long the key lives, like in PutWithTTL; 0 means forever.
+	TTL time.Duration
+}
+
+// MultiPut puts several key-value pairs into dht, with one call per node.
+// The errors are in the order of entries.  With Replicas > 1, the keys of an
+// owner are replicated together, and fail with ErrQuorum together.
+func (dht *DHT) MultiPut(entries []Entry) []error {
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	owners := make([]string, len(entries))
+	written := make([]chord.HashEntry, len(entries))
+	errs := dht.batch(keys, func(address string, indexes []int) ([]error, error) {
+		batch := make([]chord.HashEntry, len(indexes))
+		for j, i := range indexes {
+			batch[j] = chord.HashEntry{Key: entries[i].Key, Value: entries[i].Value, TTL: entries[i].TTL}
+			owners[i] = address
+		}
+		stored, errs, err := dht.caller.MultiPut(address, batch)
+		for j, i := range indexes {
+			if j < len(stored) {
+				written[i] = stored[j]
+			}
+		}
+		return errs, err
+	})
+	if dht.config.Replicas < 2 {
+		return errs
+	}
+	// The owners that took a key are the ones to replicate it from.
+	groups := make(map[string][]int)
+	for i, err := range errs {
+		if err == nil {
+			groups[owners[i]] = append(groups[owners[i]], i)
+		}
+	}
+	var wg sync.WaitGroup
+	for owner, indexes := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			batch := make([]string, len(indexes))
+			stored := make([]chord.HashEntry, len(indexes))
+			for j, i := range indexes {
+				batch[j] = keys[i]
+				stored[j] = written[i]
+			}
+			if err := dht.replicate(owner, stored, batch...); err != nil {
+				for _, i := range indexes {
+					errs[i] = err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// MultiGet gets the values of several keys from dht, with one call per node.
+// The values and the errors are in the order of keys; missing keys get ErrNotFound.
+// With Replicas > 1, every key is read from ReadQuorum replicas like Get does,
+// with one call per replica for all of its keys.
+func (dht *DHT) MultiGet(keys []string) ([][]byte, []error) {
+	values := make([][]byte, len(keys))
+	if dht.config.Replicas > 1 {
+		return values, dht.quorumMultiGet(keys, values)
+	}
+	errs := dht.batch(keys, func(address string, indexes []int) ([]error, error) {
+		batch := make([]string, len(indexes))
+		for j, i := range indexes {
+			batch[j] = keys[i]
+		}
+		vs, errs, err := dht.caller.MultiGet(address, batch)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range indexes {
+			if errs[j] == nil {
+				values[i] = vs[j]
+				if values[i] == nil {
+					// gob turns empty values into nil
+					values[i] = []byte{}
+				}
+			}
+		}
+		return errs, nil
+	})
+	return values, errs
+}
@@ -0,0 +1,906 @@
+package dht_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/chord/chordtest"
+	"github.com/anteater2/bitmesh/crdt"
+	"github.com/anteater2/bitmesh/dht"
+	"github.com/anteater2/bitmesh/metrics"
+	"github.com/anteater2/bitmesh/sim"
+)
+
+// newRing starts a ring of size nodes, which stops when the test ends.
+func newRing(t *testing.T, size int, bits uint64, config chord.Config) *chordtest.Ring {
+	t.Helper()
+	ring, err := chordtest.NewRingWith(size, bits, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ring.Stop)
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	return ring
+}
+
+// newClient starts a client that enters the ring through entry, which stops
+// when the test ends.
+func newClient(t *testing.T, entry string, bits uint64, config dht.Config) *dht.DHT {
+	t.Helper()
+	d, err := dht.NewWith(entry, 0, bits, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Stop)
+	return d
+}
+
+// newDHT starts a ring of size nodes and a client of it.
+func newDHT(t *testing.T, size int, bits uint64, config dht.Config) (*chordtest.Ring, *dht.DHT) {
+	t.Helper()
+	ring := newRing(t, size, bits, chord.Config{})
+	return ring, newClient(t, ring.Entry(), bits, config)
+}
+
+// TestPutGet puts 1000 key value pairs and randomly gets 100 out of them.
+func TestPutGet(t *testing.T) {
+	_, d := newDHT(t, 5, 16, dht.Config{})
+
+	max := 1000
+	for i := 0; i < max; i++ {
+		k := fmt.Sprintf("Test Key %d", i)
+		if err := d.Put(k, k); err != nil {
+			t.Fatalf("put %q: %v", k, err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("Test Key %d", rand.Int()%max)
+		v, err := d.Get(k)
+		if err != nil {
+			t.Fatalf("get %q: %v", k, err)
+		}
+		if v != k {
+			t.Fatalf("get %q: got %q", k, v)
+		}
+	}
+}
+
+type point struct {
+	X, Y int
+}
+
+// TestBytesAndTyped checks binary values, missing keys and the typed wrapper.
+func TestBytesAndTyped(t *testing.T) {
+	_, d := newDHT(t, 3, 10, dht.Config{})
+
+	for _, v := range [][]byte{{0}, {}, {0, 1, 255}} {
+		if err := d.PutBytes("bytes", v); err != nil {
+			t.Fatal(err)
+		}
+		got, err := d.GetBytes("bytes")
+		if err != nil || got == nil || string(got) != string(v) {
+			t.Errorf("get %v: %v, %v", v, got, err)
+		}
+	}
+	if v, err := d.GetBytes("missing"); err != dht.ErrNotFound || v != nil {
+		t.Errorf("get missing key: %v, %v", v, err)
+	}
+
+	for _, codec := range []dht.Codec[point]{dht.JSON[point]{}, dht.Gob[point]{}} {
+		points := dht.NewTyped(d, codec)
+		if err := points.Put("point", point{1, 2}); err != nil {
+			t.Fatal(err)
+		}
+		if p, err := points.Get("point"); err != nil || p != (point{1, 2}) {
+			t.Errorf("%T: get: %v, %v", codec, p, err)
+		}
+		if err := points.Delete("point"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := points.Get("point"); err != dht.ErrNotFound {
+			t.Errorf("%T: get deleted key: %v", codec, err)
+		}
+	}
+	d.Put("point", "not json")
+	if _, err := dht.NewTyped(d, dht.JSON[point]{}).Get("point"); err == nil {
+		t.Error("decoding garbage succeeded")
+	}
+}
+
+// TestRoutes checks that the client goes straight to the owners it knows,
+// and recovers from stale routes after nodes join and leave.
+func TestRoutes(t *testing.T) {
+	registry := metrics.NewRegistry()
+	ring, d := newDHT(t, 4, 10, dht.Config{RefreshInterval: -1, Metrics: registry})
+	entry := d.Entry()
+	if err := d.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if routes := d.Routes(); len(routes) != 4 {
+		t.Fatalf("%d routes after refresh, expecting 4: %v", len(routes), routes)
+	}
+
+	const keys = 100
+	for i := 0; i < keys; i++ {
+		k := fmt.Sprint("key ", i)
+		if err := d.Put(k, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hit := metrics.Label{Name: "result", Value: "hit"}
+	if hits := registry.Get("bitmesh_dht_route_cache_total", hit); hits != keys {
+		t.Errorf("%v cache hits, expecting %d", hits, keys)
+	}
+
+	if _, err := ring.Add(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < keys; i++ {
+		k := fmt.Sprint("key ", i)
+		if v, err := d.Get(k); err != nil || v != k {
+			t.Errorf("get %q after join: %q, %v", k, v, err)
+		}
+	}
+	leaving := 0
+	if ring.Node(leaving).Address() == entry {
+		leaving = 1
+	}
+	left := ring.Node(leaving).Address()
+	if err := ring.Leave(leaving); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < keys; i++ {
+		k := fmt.Sprint("key ", i)
+		if v, err := d.Get(k); err != nil || v != k {
+			t.Errorf("get %q after leave: %q, %v", k, v, err)
+		}
+	}
+	stale := metrics.Label{Name: "result", Value: "stale"}
+	if registry.Get("bitmesh_dht_route_cache_total", stale) == 0 {
+		t.Error("no stale route after a join and a leave")
+	}
+	for _, route := range d.Routes() {
+		if route.Address == left {
+			t.Errorf("route to %s is still cached after it left", route.Address)
+		}
+	}
+}
+
+// TestFailover checks that the client skips dead seeds and moves to another
+// node when its entry node leaves.
+func TestFailover(t *testing.T) {
+	ring := newRing(t, 4, 10, chord.Config{})
+	registry := metrics.NewRegistry()
+	config := dht.Config{
+		Seeds:           []string{ring.Node(0).Address(), "127.0.0.1:2"},
+		RefreshInterval: -1,
+		Metrics:         registry,
+	}
+	d := newClient(t, "127.0.0.1:1", 10, config)
+	if entry := d.Entry(); entry != ring.Node(0).Address() {
+		t.Fatalf("entry node is %q, expecting the only live seed %q", entry, ring.Node(0).Address())
+	}
+	if err := d.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	const keys = 100
+	for i := 0; i < keys; i++ {
+		k := fmt.Sprint("key ", i)
+		if err := d.Put(k, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The other nodes are only known from the snapshot.
+	if err := ring.Leave(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < keys; i++ {
+		k := fmt.Sprint("key ", i)
+		if v, err := d.Get(k); err != nil || v != k {
+			t.Errorf("get %q after the entry node left: %q, %v", k, v, err)
+		}
+	}
+	if registry.Get("bitmesh_dht_failovers_total") != 1 {
+		t.Errorf("%v failovers, expecting 1", registry.Get("bitmesh_dht_failovers_total"))
+	}
+
+	dead, err := dht.New("127.0.0.1:1", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dead.Start(); err == nil {
+		dead.Stop()
+		t.Error("started without a live seed")
+	}
+}
+
+// TestMulti checks that MultiPut and MultiGet make one call per node.
+func TestMulti(t *testing.T) {
+	registry := metrics.NewRegistry()
+	_, d := newDHT(t, 5, 16, dht.Config{RefreshInterval: -1, Metrics: registry})
+	if err := d.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	const max = 1000
+	entries := make([]dht.Entry, max)
+	keys := make([]string, max+1)
+	for i := range entries {
+		k := fmt.Sprintf("Test Key %d", i)
+		entries[i] = dht.Entry{Key: k, Value: []byte(k)}
+		keys[i] = k
+	}
+	keys[max] = "missing"
+	for i, err := range d.MultiPut(entries) {
+		if err != nil {
+			t.Fatalf("put %q: %v", entries[i].Key, err)
+		}
+	}
+	values, errs := d.MultiGet(keys)
+	for i, k := range keys[:max] {
+		if errs[i] != nil || string(values[i]) != k {
+			t.Fatalf("get %q: %q, %v", k, values[i], errs[i])
+		}
+	}
+	if errs[max] != dht.ErrNotFound {
+		t.Errorf("get missing key: %v", errs[max])
+	}
+	for _, method := range []string{"chord.multiPutCall", "chord.multiGetCall"} {
+		calls := registry.Get("bitmesh_rpc_calls_total", metrics.Label{Name: "method", Value: method})
+		if calls == 0 || calls > 5 {
+			t.Errorf("%v calls of %s for 5 nodes", calls, method)
+		}
+	}
+	if calls := registry.Get("bitmesh_rpc_calls_total", metrics.Label{Name: "method", Value: "chord.findSuccessorCall"}); calls != 0 {
+		t.Errorf("%v lookups with a full routing cache", calls)
+	}
+
+	// A TTL goes with the batch, and a batch without one clears it.
+	k := entries[0].Key
+	if errs := d.MultiPut([]dht.Entry{{Key: k, Value: []byte(k), TTL: time.Hour}}); errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+	if ttl, err := d.TTL(k); err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("TTL after a batch with one: %v, %v", ttl, err)
+	}
+	if errs := d.MultiPut([]dht.Entry{{Key: k, Value: []byte(k)}}); errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+	if ttl, err := d.TTL(k); err != nil || ttl != 0 {
+		t.Errorf("TTL after a batch without one: %v, %v", ttl, err)
+	}
+}
+
+// TestTTL checks that keys keep their deadline when they move to another node.
+func TestTTL(t *testing.T) {
+	ring, d := newDHT(t, 3, 10, dht.Config{})
+	entry := d.Entry()
+
+	const ttl = 2 * time.Second
+	const keys = 50
+	start := time.Now()
+	for i := 0; i < keys; i++ {
+		k := fmt.Sprint("key ", i)
+		if err := d.PutWithTTL(k, []byte(k), ttl); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Put("forever "+k, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every key expires between these two.
+	first, last := start.Add(ttl), time.Now().Add(ttl)
+
+	// Move keys around with a join and a leave.
+	if _, err := ring.Add(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	leaving := 0
+	if ring.Node(leaving).Address() == entry {
+		leaving = 1
+	}
+	if err := ring.Leave(leaving); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(first) > 0 {
+		for i := 0; i < keys; i++ {
+			k := fmt.Sprint("key ", i)
+			if v, err := d.Get(k); err != nil || v != k {
+				t.Errorf("get %q before its deadline: %q, %v", k, v, err)
+			}
+		}
+	}
+
+	time.Sleep(time.Until(last))
+	for i := 0; i < keys; i++ {
+		k := fmt.Sprint("key ", i)
+		if v, err := d.Get(k); err != dht.ErrNotFound {
+			t.Errorf("get %q after its deadline: %q, %v", k, v, err)
+		}
+		if v, err := d.Get("forever " + k); err != nil || v != k {
+			t.Errorf("get %q: %q, %v", "forever "+k, v, err)
+		}
+	}
+}
+
+// TestUpdate checks compare-and-swap and concurrent updates of a counter.
+func TestUpdate(t *testing.T) {
+	ring, d := newDHT(t, 3, 10, dht.Config{})
+
+	if _, err := d.CompareAndSwap("cas", 1, []byte("a")); err != dht.ErrVersionMismatch {
+		t.Errorf("swap a missing key at version 1: %v", err)
+	}
+	version, err := d.CompareAndSwap("cas", 0, []byte("a"))
+	if err != nil || version != 1 {
+		t.Fatalf("create: %d, %v", version, err)
+	}
+	if err := d.Put("cas", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CompareAndSwap("cas", version, []byte("c")); err != dht.ErrVersionMismatch {
+		t.Errorf("swap after a put: %v", err)
+	}
+	if v, version, err := d.GetVersioned("cas"); err != nil || string(v) != "b" || version != 2 {
+		t.Errorf("get: %q, %d, %v", v, version, err)
+	}
+
+	counter := dht.NewTyped(d, dht.JSON[int]{})
+	const writers, increments = 8, 20
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		go func() {
+			for i := 0; i < increments; i++ {
+				_, err := counter.Update("counter", func(old int, found bool) (int, error) {
+					return old + 1, nil
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for w := 0; w < writers; w++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := counter.Get("counter"); err != nil || n != writers*increments {
+		t.Errorf("counter is %d, %v, expecting %d", n, err, writers*increments)
+	}
+
+	// Versions move with the keys.
+	_, before, _ := d.GetVersioned("counter")
+	if _, err := ring.Add(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, after, err := d.GetVersioned("counter"); err != nil || after != before {
+		t.Errorf("version %d after a join, %v, expecting %d", after, err, before)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	// The lease outlasts the test, so watches only move with the keys.
+	ring, d := newDHT(t, 3, 10, dht.Config{Addr: "127.0.0.1", WatchLease: time.Hour})
+	entry := d.Entry()
+	next := func(events <-chan dht.Event) dht.Event {
+		t.Helper()
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatal("events closed")
+			}
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+		return dht.Event{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const keys = 20
+	watches := make([]<-chan dht.Event, keys)
+	for i := range watches {
+		watches[i] = d.Watch(ctx, fmt.Sprint("key ", i))
+	}
+	prefix := d.WatchPrefix(ctx, "prefix/")
+
+	// Move the watches around with a join and a leave.
+	if _, err := ring.Add(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	leaving := 0
+	if ring.Node(leaving).Address() == entry {
+		leaving = 1
+	}
+	if err := ring.Leave(leaving); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, events := range watches {
+		k := fmt.Sprint("key ", i)
+		if err := d.Put(k, "v"); err != nil {
+			t.Fatal(err)
+		}
+		if e := next(events); e.Type != dht.EventPut || e.Key != k || string(e.Value) != "v" || e.Version != 1 {
+			t.Errorf("put %q: got %v %q %q version %d", k, e.Type, e.Key, e.Value, e.Version)
+		}
+	}
+	if err := d.Delete("key 0"); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(watches[0]); e.Type != dht.EventDelete || e.Key != "key 0" {
+		t.Errorf("delete: got %v %q", e.Type, e.Key)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < keys; i++ {
+		if err := d.Put(fmt.Sprint("prefix/", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Put("other", "v"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < keys; i++ {
+		seen[next(prefix).Key] = true
+	}
+	for i := 0; i < keys; i++ {
+		if k := fmt.Sprint("prefix/", i); !seen[k] {
+			t.Errorf("no event for %q", k)
+		}
+	}
+
+	cancel()
+	for _, events := range append(watches, prefix) {
+		for range events {
+		}
+	}
+}
+
+// TestWatchOverflow fills the channel of a watch that nobody reads.
+func TestWatchOverflow(t *testing.T) {
+	_, d := newDHT(t, 3, 16, dht.Config{Addr: "127.0.0.1"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const k = "busy"
+	events := d.Watch(ctx, k)
+	for i := 0; i < 300; i++ {
+		if err := d.Put(k, fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for len(events) < cap(events) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d events of %d", len(events), cap(events))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Let the last events in, to be dropped.
+	time.Sleep(100 * time.Millisecond)
+	puts := 0
+	for len(events) > 1 {
+		if e := <-events; e.Type == dht.EventPut {
+			puts++
+		}
+	}
+	if e := <-events; e.Type != dht.EventOverflow || e.Key != k || puts != cap(events)-1 {
+		t.Errorf("%d puts, then %v %q", puts, e.Type, e.Key)
+	}
+	// The events after a gap come through again.
+	if err := d.Put(k, "last"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-events:
+		if e.Type != dht.EventPut || string(e.Value) != "last" {
+			t.Errorf("after the gap: %v %q", e.Type, e.Value)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("no event after the gap")
+	}
+}
+
+// TestWatchOrder changes a key quickly; its events come in the order of the changes.
+func TestWatchOrder(t *testing.T) {
+	_, d := newDHT(t, 3, 16, dht.Config{Addr: "127.0.0.1"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const k = "flapping"
+	events := d.Watch(ctx, k)
+	for i := 0; i < 50; i++ {
+		if err := d.Put(k, fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Delete(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var last dht.Event
+	put := -1
+	for {
+		select {
+		case e := <-events:
+			if e.Seq <= last.Seq {
+				t.Fatalf("event %d after %d", e.Seq, last.Seq)
+			}
+			if e.Type == dht.EventPut {
+				i, _ := strconv.Atoi(string(e.Value))
+				if i <= put {
+					t.Fatalf("put %d after %d", i, put)
+				}
+				put = i
+			}
+			last = e
+			continue
+		case <-time.After(time.Second):
+		}
+		break
+	}
+	if last.Type != dht.EventDelete || put != 49 {
+		t.Errorf("last put %d, then %v", put, last.Type)
+	}
+}
+
+// TestSimWatch runs a client with a watch on a simulated ring.
+func TestSimWatch(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		network := sim.New(sim.Config{Seed: 1, MinLatency: time.Millisecond, MaxLatency: 10 * time.Millisecond})
+		defer network.Close()
+		ring, err := chordtest.NewSimRing(3, 16, network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ring.Stop()
+		if err := ring.WaitConverged(time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		d, err := dht.NewWith(ring.Entry(), 0, 16, dht.Config{Transport: network.Host("10.1.0.1"), Clock: network})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer d.Stop()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		events := d.Watch(ctx, "key")
+		if err := d.Put("key", "v"); err != nil {
+			t.Fatal(err)
+		}
+		if e := <-events; e.Type != dht.EventPut || e.Key != "key" || string(e.Value) != "v" {
+			t.Errorf("got %v %q %q", e.Type, e.Key, e.Value)
+		}
+		cancel()
+		for range events {
+		}
+	})
+}
+
+// TestQuorum checks quorum reads and writes, and read repair.
+func TestQuorum(t *testing.T) {
+	const bits = 16
+	if _, err := dht.NewWith("127.0.0.1:1", 0, bits, dht.Config{Replicas: 3, ReadQuorum: 4}); err == nil {
+		t.Error("accepted a read quorum bigger than the replicas")
+	}
+	// Anti-entropy would repair the replicas before the reads do.
+	ring := newRing(t, 5, bits, chord.Config{Replicas: 3, AntiEntropyInterval: time.Hour})
+	d := newClient(t, ring.Entry(), bits, dht.Config{Replicas: 3, ReadQuorum: 2, WriteQuorum: 3})
+	caller, err := chord.NewNodeCaller(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := caller.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Stop()
+
+	const k = "quorum"
+	owner, err := caller.FindSuccessor(ring.Entry(), chord.Hash(k, 1<<bits))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replicas := []string{owner.Address}
+	for len(replicas) < 3 {
+		next, err := caller.GetSuccessor(replicas[len(replicas)-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		replicas = append(replicas, next.Address)
+	}
+	// versions returns the version of k on every replica, negative for a
+	// tombstone and 0 if it is missing.
+	versions := func() []int {
+		var vs []int
+		for _, r := range replicas {
+			entries, err := caller.GetEntries(r, []string{k})
+			switch {
+			case err != nil:
+				t.Fatal(err)
+			case len(entries) == 0:
+				vs = append(vs, 0)
+			case entries[0].Deleted:
+				vs = append(vs, -int(entries[0].Version))
+			default:
+				vs = append(vs, int(entries[0].Version))
+			}
+		}
+		return vs
+	}
+
+	if err := d.Put(k, "one"); err != nil {
+		t.Fatal(err)
+	}
+	if vs := versions(); fmt.Sprint(vs) != "[1 1 1]" {
+		t.Fatalf("versions after a put: %v", vs)
+	}
+
+	// The last replica misses a write; a read returns it anyway and repairs it.
+	entries, err := caller.GetEntries(owner.Address, []string{k})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries[0].Value = []byte("two")
+	entries[0].Version++
+	for _, r := range replicas[:2] {
+		if err := caller.Repair(r, entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := d.Get(k); err != nil || v != "two" {
+		t.Fatalf("get %q: %q, %v", k, v, err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for fmt.Sprint(versions()) != "[2 2 2]" {
+		if time.Now().After(deadline) {
+			t.Fatalf("the stale replica was not repaired: %v", versions())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Only the last replica has the last write; the answers disagree and the
+	// newest one wins.
+	entries[0].Value = []byte("three")
+	entries[0].Version++
+	if err := caller.Repair(replicas[2], entries); err != nil {
+		t.Fatal(err)
+	}
+	all := newClient(t, ring.Entry(), bits, dht.Config{Replicas: 3, ReadQuorum: 3, WriteQuorum: 3})
+	if v, err := all.Get(k); err != nil || v != "three" {
+		t.Fatalf("get %q: %q, %v", k, v, err)
+	}
+	deadline = time.Now().Add(10 * time.Second)
+	for fmt.Sprint(versions()) != "[3 3 3]" {
+		if time.Now().After(deadline) {
+			t.Fatalf("the stale replicas were not repaired: %v", versions())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := d.Delete(k); err != nil {
+		t.Fatal(err)
+	}
+	if vs := versions(); fmt.Sprint(vs) != "[-4 -4 -4]" {
+		t.Fatalf("versions after a delete: %v", vs)
+	}
+	if _, err := d.Get(k); err != dht.ErrNotFound {
+		t.Errorf("get a deleted key: %v", err)
+	}
+
+	// Batches are replicated and read from a quorum too.
+	if errs := d.MultiPut([]dht.Entry{{Key: k, Value: []byte("five")}, {Key: "other", Value: []byte("six")}}); errs[0] != nil || errs[1] != nil {
+		t.Fatalf("multi put: %v", errs)
+	}
+	if vs := versions(); fmt.Sprint(vs) != "[5 5 5]" {
+		t.Fatalf("versions after a multi put: %v", vs)
+	}
+
+	// The writes carry their entries to the replicas, and a batch is read
+	// with one call per node.
+	registry := metrics.NewRegistry()
+	counted := newClient(t, ring.Entry(), bits, dht.Config{Replicas: 3, ReadQuorum: 2, WriteQuorum: 3, Metrics: registry})
+	batch := make([]dht.Entry, 100)
+	keys := make([]string, len(batch))
+	for i := range batch {
+		keys[i] = fmt.Sprintf("batch %d", i)
+		batch[i] = dht.Entry{Key: keys[i], Value: []byte(keys[i])}
+	}
+	for i, err := range counted.MultiPut(batch) {
+		if err != nil {
+			t.Fatalf("put %q: %v", keys[i], err)
+		}
+	}
+	getEntries := metrics.Label{Name: "method", Value: "chord.getEntriesCall"}
+	if calls := registry.Get("bitmesh_rpc_calls_total", getEntries); calls != 0 {
+		t.Errorf("%v reads of the owners to replicate writes", calls)
+	}
+	values, errs := counted.MultiGet(keys)
+	for i, k := range keys {
+		if errs[i] != nil || string(values[i]) != k {
+			t.Fatalf("get %q: %q, %v", k, values[i], errs[i])
+		}
+	}
+	if calls := registry.Get("bitmesh_rpc_calls_total", getEntries); calls == 0 || calls > 5 {
+		t.Errorf("%v calls of chord.getEntriesCall for 5 nodes", calls)
+	}
+
+	for i := 0; i < ring.Size(); i++ {
+		if ring.Node(i).Address() == replicas[2] {
+			ring.Kill(i)
+		}
+	}
+	values, errs = d.MultiGet([]string{k, "other"})
+	if errs[0] != nil || string(values[0]) != "five" || errs[1] != nil || string(values[1]) != "six" {
+		t.Errorf("multi get with a replica down: %q, %v", values, errs)
+	}
+}
+
+// TestSiblings checks that concurrent writes with vector clocks are kept and
+// merged by the next update.
+func TestSiblings(t *testing.T) {
+	_, d := newDHT(t, 3, 10, dht.Config{})
+
+	if err := d.PutSibling("cart", []byte("milk"), nil); err != nil {
+		t.Fatal(err)
+	}
+	_, context, err := d.GetSiblings("cart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two clients add to the cart they both read.
+	for _, v := range []string{"milk,eggs", "milk,bread"} {
+		if err := d.PutSibling("cart", []byte(v), context); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.Get("cart"); err != dht.ErrSiblings {
+		t.Errorf("get a key with siblings: %v", err)
+	}
+	union := func(siblings [][]byte) ([]byte, error) {
+		items := map[string]bool{}
+		for _, s := range siblings {
+			for _, item := range strings.Split(string(s), ",") {
+				items[item] = true
+			}
+		}
+		var cart []string
+		for item := range items {
+			cart = append(cart, item)
+		}
+		sort.Strings(cart)
+		return []byte(strings.Join(cart, ",")), nil
+	}
+	if _, err := d.UpdateSiblings("cart", union); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Get("cart"); err != nil || v != "bread,eggs,milk" {
+		t.Errorf("get the merged cart: %q, %v", v, err)
+	}
+	siblings, _, err := d.GetSiblings("cart")
+	if err != nil || len(siblings) != 1 {
+		t.Errorf("siblings after a merge: %q, %v", siblings, err)
+	}
+}
+
+// TestCRDT updates the CRDTs of the DHT from two clients.
+func TestCRDT(t *testing.T) {
+	ring, a := newDHT(t, 3, 10, dht.Config{})
+	b := newClient(t, ring.Entry(), 10, dht.Config{})
+	clients := []*dht.DHT{a, b}
+
+	done := make(chan error)
+	for _, d := range clients {
+		go func() {
+			for i := 0; i < 50; i++ {
+				if _, err := d.Counter("visits").Add(1); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}()
+	}
+	for range clients {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := b.Counter("visits").Value(); err != nil || v != 100 {
+		t.Errorf("counter: %d, %v", v, err)
+	}
+	if v, err := a.Counter("visits").Add(-10); err != nil || v != 90 {
+		t.Errorf("decrement: %d, %v", v, err)
+	}
+	if _, err := a.GCounter("likes").Add(-1); err == nil {
+		t.Error("decremented a G-Counter")
+	}
+	if err := a.Set("visits").Add("x"); err != crdt.ErrType {
+		t.Errorf("add to a set at a counter: %v", err)
+	}
+
+	if err := a.Set("cart").Add("milk"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Set("cart").Add("eggs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Set("cart").Remove("milk"); err != nil {
+		t.Fatal(err)
+	}
+	if elements, err := b.Set("cart").Elements(); err != nil || fmt.Sprint(elements) != "[eggs]" {
+		t.Errorf("elements: %v, %v", elements, err)
+	}
+
+	if _, err := a.Register("motd").Get(); err != dht.ErrNotFound {
+		t.Errorf("get a register never set: %v", err)
+	}
+	if err := a.Register("motd").Set([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Register("motd").Set([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := a.Register("motd").Get(); err != nil || string(v) != "bye" {
+		t.Errorf("register: %q, %v", v, err)
+	}
+
+	if err := a.Map("user").Set("name", []byte("ann")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Map("user").Set("city", []byte("paris")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Map("user").Delete("city"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := b.Map("user").Entries()
+	if err != nil || len(entries) != 1 || string(entries["name"]) != "ann" {
+		t.Errorf("map entries: %q, %v", entries, err)
+	}
+	if _, err := b.Map("user").Get("city"); err != dht.ErrNotFound {
+		t.Errorf("get a deleted field: %v", err)
+	}
+}
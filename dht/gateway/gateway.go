@@ -0,0 +1,229 @@
+// Package gateway serves a DHT over HTTP, for clients that do not speak gob.
+//
+//	GET    /keys/{key}     the value, as is
+//	PUT    /keys/{key}     stores the request body; ?ttl=30s makes it expire
+//	DELETE /keys/{key}     removes the key
+//	POST   /batch/get      [{"Key": k}, ...]             -> [{"Key": k, "Value": v, "Status": 200}, ...]
+//	POST   /batch/put      [{"Key": k, "Value": v}, ...] -> [{"Key": k, "Status": 204}, ...]
+//	POST   /batch/delete   [{"Key": k}, ...]             -> [{"Key": k, "Status": 204}, ...]
+//
+// Keys in paths are URL-escaped; values in JSON are base64.
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/dht"
+	"github.com/anteater2/bitmesh/rpc"
+)
+
+// MaxBodySize is the largest request body accepted.
+var MaxBodySize int64 = 32 << 20
+
+// Item is a key of a batch request or response.
+type Item struct {
+	Key   string
+	Value []byte `json:",omitempty"`
+	// Status is the HTTP status code the single-key request would have got.
+	Status int    `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+// Handler returns the HTTP API of d.
+func Handler(d *dht.DHT) http.Handler {
+	g := &gateway{dht: d}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/keys/", g.handleKey)
+	mux.HandleFunc("/batch/get", g.batch(g.multiGet))
+	mux.HandleFunc("/batch/put", g.batch(g.multiPut))
+	mux.HandleFunc("/batch/delete", g.batch(each(g.delete)))
+	return mux
+}
+
+type gateway struct {
+	dht *dht.DHT
+}
+
+// Status returns the HTTP status code for an error of the DHT.
+func Status(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, dht.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, dht.ErrSiblings):
+		// The key has concurrent values, which only the DHT client merges.
+		return http.StatusConflict
+	case errors.Is(err, chord.ErrWrongNode):
+		// The ring is still stabilizing; trying again later should work.
+		return http.StatusServiceUnavailable
+	case errors.Is(err, rpc.ErrTimeout):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func (g *gateway) handleKey(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/keys/")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing key"))
+		return
+	}
+	var item Item
+	switch r.Method {
+	case "GET":
+		item = g.get(Item{Key: key})
+		if item.Status == http.StatusOK {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(item.Value)
+			return
+		}
+	case "PUT":
+		var ttl time.Duration
+		if s := r.URL.Query().Get("ttl"); s != "" {
+			var err error
+			ttl, err = time.ParseDuration(s)
+			if err != nil || ttl <= 0 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid ttl %q", s))
+				return
+			}
+		}
+		value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxBodySize))
+		if err != nil {
+			writeError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		item = g.putWithTTL(Item{Key: key, Value: value}, ttl)
+	case "DELETE":
+		item = g.delete(Item{Key: key})
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	if item.Error != "" {
+		writeError(w, item.Status, errors.New(item.Error))
+		return
+	}
+	w.WriteHeader(item.Status)
+}
+
+func (g *gateway) get(item Item) Item {
+	v, err := g.dht.GetBytes(item.Key)
+	if err != nil {
+		return failed(item.Key, err)
+	}
+	return Item{Key: item.Key, Value: v, Status: http.StatusOK}
+}
+
+func (g *gateway) putWithTTL(item Item, ttl time.Duration) Item {
+	if err := g.dht.PutWithTTL(item.Key, item.Value, ttl); err != nil {
+		return failed(item.Key, err)
+	}
+	return Item{Key: item.Key, Status: http.StatusNoContent}
+}
+
+func (g *gateway) delete(item Item) Item {
+	if err := g.dht.Delete(item.Key); err != nil {
+		return failed(item.Key, err)
+	}
+	return Item{Key: item.Key, Status: http.StatusNoContent}
+}
+
+// multiGet gets the items with one call per node.
+func (g *gateway) multiGet(items []Item) []Item {
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+	values, errs := g.dht.MultiGet(keys)
+	results := make([]Item, len(items))
+	for i, k := range keys {
+		if errs[i] != nil {
+			results[i] = failed(k, errs[i])
+		} else {
+			results[i] = Item{Key: k, Value: values[i], Status: http.StatusOK}
+		}
+	}
+	return results
+}
+
+// multiPut puts the items with one call per node.
+func (g *gateway) multiPut(items []Item) []Item {
+	entries := make([]dht.Entry, len(items))
+	for i, item := range items {
+		entries[i] = dht.Entry{Key: item.Key, Value: item.Value}
+	}
+	errs := g.dht.MultiPut(entries)
+	results := make([]Item, len(items))
+	for i, item := range items {
+		if errs[i] != nil {
+			results[i] = failed(item.Key, errs[i])
+		} else {
+			results[i] = Item{Key: item.Key, Status: http.StatusNoContent}
+		}
+	}
+	return results
+}
+
+// each runs f on the items one by one.
+func each(f func(Item) Item) func([]Item) []Item {
+	return func(items []Item) []Item {
+		results := make([]Item, len(items))
+		for i, item := range items {
+			results[i] = f(item)
+		}
+		return results
+	}
+}
+
+func failed(key string, err error) Item {
+	return Item{Key: key, Status: Status(err), Error: err.Error()}
+}
+
+// batch runs f on the items of a JSON list that have a key.  The response is
+// 200 as long as the request is well formed; every item has its own status.
+func (g *gateway) batch(f func([]Item) []Item) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		var items []Item
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxBodySize)).Decode(&items)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		results := make([]Item, len(items))
+		var valid []Item
+		var indexes []int
+		for i, item := range items {
+			if item.Key == "" {
+				results[i] = Item{Status: http.StatusBadRequest, Error: "missing key"}
+				continue
+			}
+			valid = append(valid, item)
+			indexes = append(indexes, i)
+		}
+		for j, result := range f(valid) {
+			results[indexes[j]] = result
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"Error": err.Error()})
+}
@@ -0,0 +1,128 @@
+package gateway_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/chord/chordtest"
+	"github.com/anteater2/bitmesh/dht"
+	"github.com/anteater2/bitmesh/dht/gateway"
+	"github.com/anteater2/bitmesh/rpc"
+)
+
+func TestGateway(t *testing.T) {
+	ring, err := chordtest.NewRing(3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.Stop()
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	d, err := dht.New(ring.Entry(), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+	server := httptest.NewServer(gateway.Handler(d))
+	defer server.Close()
+
+	do := func(method string, path string, body []byte) (int, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, data
+	}
+
+	value := []byte{0, 1, 2, 255}
+	if code, _ := do("PUT", "/keys/a%2Fb", value); code != http.StatusNoContent {
+		t.Fatalf("PUT: %d", code)
+	}
+	if code, body := do("GET", "/keys/a%2Fb", nil); code != http.StatusOK || !bytes.Equal(body, value) {
+		t.Fatalf("GET: %d %v", code, body)
+	}
+	if v, err := d.Get("a/b"); err != nil || v != string(value) {
+		t.Fatalf("the key is not escaped: %q, %v", v, err)
+	}
+	if code, _ := do("DELETE", "/keys/a%2Fb", nil); code != http.StatusNoContent {
+		t.Fatalf("DELETE: %d", code)
+	}
+	if code, _ := do("GET", "/keys/a%2Fb", nil); code != http.StatusNotFound {
+		t.Fatalf("GET after DELETE: %d", code)
+	}
+	if code, _ := do("DELETE", "/keys/a%2Fb", nil); code != http.StatusNotFound {
+		t.Fatalf("DELETE after DELETE: %d", code)
+	}
+	if code, _ := do("POST", "/keys/x", nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST /keys/x: %d", code)
+	}
+	if code, _ := do("GET", "/keys/", nil); code != http.StatusBadRequest {
+		t.Fatalf("GET /keys/: %d", code)
+	}
+
+	batch := func(op string, items []gateway.Item) []gateway.Item {
+		t.Helper()
+		body, _ := json.Marshal(items)
+		code, data := do("POST", "/batch/"+op, body)
+		if code != http.StatusOK {
+			t.Fatalf("batch %s: %d %s", op, code, data)
+		}
+		var results []gateway.Item
+		if err := json.Unmarshal(data, &results); err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+	results := batch("put", []gateway.Item{{Key: "x", Value: []byte("1")}, {Key: "y", Value: []byte("2")}})
+	for _, r := range results {
+		if r.Status != http.StatusNoContent {
+			t.Errorf("batch put %q: %+v", r.Key, r)
+		}
+	}
+	results = batch("get", []gateway.Item{{Key: "x"}, {Key: "z"}, {Key: "y"}})
+	if string(results[0].Value) != "1" || results[1].Status != http.StatusNotFound || string(results[2].Value) != "2" {
+		t.Errorf("batch get: %+v", results)
+	}
+	results = batch("delete", []gateway.Item{{Key: "x"}, {Key: "x"}})
+	if results[0].Status != http.StatusNoContent || results[1].Status != http.StatusNotFound {
+		t.Errorf("batch delete: %+v", results)
+	}
+	if code, _ := do("POST", "/batch/get", []byte("not json")); code != http.StatusBadRequest {
+		t.Errorf("batch get with a bad body: %d", code)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	for err, want := range map[error]int{
+		nil:                http.StatusOK,
+		chord.ErrNotFound:  http.StatusNotFound,
+		chord.ErrWrongNode: http.StatusServiceUnavailable,
+		chord.ErrSiblings:  http.StatusConflict,
+		rpc.ErrTimeout:     http.StatusGatewayTimeout,
+		io.EOF:             http.StatusBadGateway,
+		fmt.Errorf("blob: get chunk: %w", dht.ErrNotFound): http.StatusNotFound,
+		fmt.Errorf("typed: %w", chord.ErrSiblings):         http.StatusConflict,
+	} {
+		if got := gateway.Status(err); got != want {
+			t.Errorf("Status(%v) = %d, want %d", err, got, want)
+		}
+	}
+}
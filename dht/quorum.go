@@ -0,0 +1,322 @@
+package dht
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/metrics"
+)
+
+// ErrQuorum is returned when fewer nodes than ReadQuorum answer a read, or
+// fewer than WriteQuorum take a write.  A write that fails with it is not
+// undone on the nodes that took it.
+var ErrQuorum = errors.New("dht: quorum not reached")
+
+// replicas returns the node at owner and its successors, Replicas nodes at
+// most.  They come from the routing cache if it has that many nodes, else
+// from a walk of the ring, which is fewer nodes on a smaller ring.
+func (dht *DHT) replicas(owner string) ([]chord.RemoteNode, error) {
+	n := dht.config.Replicas
+	if nodes := dht.routes.successors(owner, n); len(nodes) == n {
+		return nodes, nil
+	}
+	first, err := dht.caller.GetSuccessor(owner)
+	if err != nil {
+		return nil, err
+	}
+	// The successor of a node knows its address and key, not the node itself.
+	nodes := []chord.RemoteNode{{Address: owner}}
+	for next := first; len(nodes) < n && next.Address != owner; {
+		nodes = append(nodes, next)
+		dht.routes.add(next)
+		if next, err = dht.caller.GetSuccessor(next.Address); err != nil {
+			break
+		}
+	}
+	return nodes, nil
+}
+
+// replicate copies the entries of keys, or their tombstones, as written on
+// owner, to the other replicas in parallel, with one call per node.  It
+// returns once WriteQuorum nodes, the owner included, have them; the other
+// copies go on in the background.
+//
+// Writes go to the owner first, rather than to all the replicas at once,
+// because the owner orders them: it picks the versions that CompareAndSwap,
+// the siblings and the CRDTs depend on.  The reply of the owner carries the
+// entries, so a write takes two round trips.  While the owner is down, its
+// writes fail until the ring has stabilized and a lookup finds the new one.
+func (dht *DHT) replicate(owner string, written []chord.HashEntry, keys ...string) error {
+	if dht.config.Replicas < 2 {
+		return nil
+	}
+	// The owner sends no entry back for a key written again in between, or
+	// deleted without a tombstone; those are read from it.
+	var entries []chord.HashEntry
+	var missing []string
+	for i, k := range keys {
+		if i < len(written) && written[i].Key == k {
+			entries = append(entries, written[i])
+		} else {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) > 0 {
+		stored, err := dht.caller.GetEntries(owner, missing)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, stored...)
+	}
+	if len(entries) == 0 {
+		// The owner keeps no tombstones, or other deletes came first.
+		return nil
+	}
+	nodes, err := dht.replicas(owner)
+	if err != nil {
+		return err
+	}
+	acks := make(chan error, len(nodes)-1)
+	for _, node := range nodes[1:] {
+		go func() {
+			acks <- dht.caller.Repair(node.Address, entries)
+		}()
+	}
+	ok, failed := 1, 0
+	for ok < dht.config.WriteQuorum && ok+failed < len(nodes) {
+		if err := <-acks; err != nil {
+			failed++
+			dht.log.Debug("replica did not take a write", "keys", keys, "error", err)
+		} else {
+			ok++
+		}
+	}
+	if ok < dht.config.WriteQuorum {
+		dht.config.Metrics.Add("bitmesh_dht_quorum_failures_total", 1, metrics.Label{Name: "op", Value: "write"})
+		return ErrQuorum
+	}
+	return nil
+}
+
+// answer is the reply of a replica to a read: its entry or tombstone of the
+// key, if it has one.
+type answer struct {
+	node  string
+	entry *chord.HashEntry
+	err   error
+}
+
+// quorumGet reads k from its replicas in parallel and returns the newest
+// entry of ReadQuorum answers, or ErrNotFound.  The answers may disagree; only
+// when ReadQuorum + WriteQuorum > Replicas is one of them sure to have the
+// last write.  The replicas that answer
+// with an older version, even after it returns, are repaired in the
+// background.  If the quorum is not reached, the routes of the nodes that
+// did not answer are dropped and the read is tried once more.
+func (dht *DHT) quorumGet(k string) (chord.HashEntry, error) {
+	hashk := chord.Hash(k, 1<<dht.bits)
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		owner, ok := dht.routes.owner(hashk)
+		if !ok || attempt > 0 {
+			if owner, err = dht.lookup(hashk); err != nil {
+				return chord.HashEntry{}, err
+			}
+		}
+		var nodes []chord.RemoteNode
+		if nodes, err = dht.replicas(owner.Address); err != nil {
+			dht.routes.remove(owner.Address)
+			continue
+		}
+		var entry chord.HashEntry
+		if entry, err = dht.read(k, nodes); err != ErrQuorum {
+			return entry, err
+		}
+	}
+	dht.config.Metrics.Add("bitmesh_dht_quorum_failures_total", 1, metrics.Label{Name: "op", Value: "read"})
+	return chord.HashEntry{}, err
+}
+
+// quorumMultiGet is quorumGet for several keys, which sets the values of
+// keys and returns their errors.  The keys are grouped by the replicas they
+// live on, and each replica is asked for all of its keys in one call.  The
+// keys whose quorum is not reached are read again one by one, after lookups.
+func (dht *DHT) quorumMultiGet(keys []string, values [][]byte) []error {
+	errs := make([]error, len(keys))
+	sets := make(map[string][]chord.RemoteNode)
+	var indexes []int
+	var nodes [][]chord.RemoteNode
+	for i, k := range keys {
+		hashk := chord.Hash(k, 1<<dht.bits)
+		owner, ok := dht.routes.owner(hashk)
+		if !ok {
+			var err error
+			if owner, err = dht.lookup(hashk); err != nil {
+				errs[i] = err
+				continue
+			}
+		}
+		set, ok := sets[owner.Address]
+		if !ok {
+			var err error
+			if set, err = dht.replicas(owner.Address); err != nil {
+				dht.routes.remove(owner.Address)
+				errs[i] = err
+				continue
+			}
+			sets[owner.Address] = set
+		}
+		indexes = append(indexes, i)
+		nodes = append(nodes, set)
+	}
+	batch := make([]string, len(indexes))
+	for j, i := range indexes {
+		batch[j] = keys[i]
+	}
+	entries, batchErrs := dht.readAll(batch, nodes)
+	for j, i := range indexes {
+		if errs[i] = batchErrs[j]; errs[i] == nil {
+			values[i], errs[i] = entries[j].Current()
+		}
+	}
+	var wg sync.WaitGroup
+	for i, k := range keys {
+		if answered(errs[i]) {
+			if errs[i] == nil && values[i] == nil {
+				// gob turns empty values into nil
+				values[i] = []byte{}
+			}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			values[i], errs[i] = dht.GetBytes(k)
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// read asks nodes for k, waits for ReadQuorum answers and returns the newest
+// of them, whether or not they agree.
+func (dht *DHT) read(k string, nodes []chord.RemoteNode) (chord.HashEntry, error) {
+	entries, errs := dht.readAll([]string{k}, [][]chord.RemoteNode{nodes})
+	return entries[0], errs[0]
+}
+
+// readAll is read for several keys, each with its own nodes, with one call
+// per node for all of its keys.  The entries and errors are in the order of
+// keys.
+func (dht *DHT) readAll(keys []string, nodes [][]chord.RemoteNode) ([]chord.HashEntry, []error) {
+	calls := make(map[string][]int)
+	for i := range keys {
+		for _, node := range nodes[i] {
+			calls[node.Address] = append(calls[node.Address], i)
+		}
+	}
+	type reply struct {
+		node    string
+		indexes []int
+		entries []chord.HashEntry
+		err     error
+	}
+	answerOf := func(r reply, i int) answer {
+		a := answer{node: r.node, err: r.err}
+		for j := range r.entries {
+			if r.entries[j].Key == keys[i] {
+				a.entry = &r.entries[j]
+			}
+		}
+		return a
+	}
+	replies := make(chan reply, len(calls))
+	for address, indexes := range calls {
+		go func() {
+			batch := make([]string, len(indexes))
+			for j, i := range indexes {
+				batch[j] = keys[i]
+			}
+			entries, err := dht.caller.GetEntries(address, batch)
+			replies <- reply{address, indexes, entries, err}
+		}()
+	}
+	entries := make([]chord.HashEntry, len(keys))
+	errs := make([]error, len(keys))
+	got := make([][]answer, len(keys))
+	ok := make([]int, len(keys))
+	done := make([]bool, len(keys))
+	waiting, received := len(keys), 0
+	for waiting > 0 {
+		r := <-replies
+		received++
+		if r.err != nil {
+			dht.routes.remove(r.node)
+		}
+		for _, i := range r.indexes {
+			got[i] = append(got[i], answerOf(r, i))
+			if r.err == nil {
+				ok[i]++
+			}
+			if done[i] || (ok[i] < dht.config.ReadQuorum && len(got[i]) < len(nodes[i])) {
+				continue
+			}
+			done[i] = true
+			waiting--
+			entry := newest(got[i])
+			switch {
+			case ok[i] < dht.config.ReadQuorum:
+				errs[i] = ErrQuorum
+			case entry == nil || entry.Deleted:
+				errs[i] = ErrNotFound
+			default:
+				entries[i] = *entry
+			}
+		}
+	}
+	dht.wg.Add(1)
+	go func() {
+		defer dht.wg.Done()
+		for ; received < len(calls); received++ {
+			r := <-replies
+			for _, i := range r.indexes {
+				got[i] = append(got[i], answerOf(r, i))
+			}
+		}
+		for i := range keys {
+			dht.readRepair(got[i])
+		}
+	}()
+	return entries, errs
+}
+
+// newest returns the entry with the highest version among answers, if any.
+func newest(answers []answer) *chord.HashEntry {
+	var entry *chord.HashEntry
+	for _, a := range answers {
+		if a.entry != nil && (entry == nil || a.entry.Version > entry.Version) {
+			entry = a.entry
+		}
+	}
+	return entry
+}
+
+// readRepair sends the newest entry of answers to the nodes that answered
+// with an older one, or with none.
+func (dht *DHT) readRepair(answers []answer) {
+	entry := newest(answers)
+	if entry == nil {
+		return
+	}
+	for _, a := range answers {
+		if a.err != nil || (a.entry != nil && a.entry.Version >= entry.Version) {
+			continue
+		}
+		if err := dht.caller.Repair(a.node, []chord.HashEntry{*entry}); err != nil {
+			dht.log.Debug("could not repair a replica", "key", entry.Key, "peer", a.node, "error", err)
+			continue
+		}
+		dht.config.Metrics.Add("bitmesh_dht_read_repairs_total", 1)
+	}
+}
@@ -0,0 +1,431 @@
+// Package resp serves a DHT over the Redis protocol (RESP), so that redis-cli,
+// benchmarks and Redis client libraries can use a ring.
+//
+// Supported commands: PING, ECHO, QUIT, GET, SET, DEL, EXISTS, EXPIRE, TTL,
+// MGET and MSET.
+// Anything else gets an error reply.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/dht"
+	"github.com/anteater2/bitmesh/rpc"
+)
+
+// Server serves a DHT over RESP.
+type Server struct {
+	dht *dht.DHT
+
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	mutex     sync.Mutex
+	wg        sync.WaitGroup
+}
+
+// NewServer creates a server for d.
+func NewServer(d *dht.DHT) *Server {
+	return &Server{
+		dht:       d,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and serves the connections.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves the connections of l until the server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		l.Close()
+		return errors.New("resp: server closed")
+	}
+	s.listeners[l] = struct{}{}
+	s.mutex.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			delete(s.listeners, l)
+			s.mutex.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mutex.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the listeners, closes the connections and waits for them.
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		s.wg.Done()
+	}()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if perr, ok := err.(protocolError); ok {
+				writeError(w, "ERR Protocol error: "+string(perr))
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := s.execute(w, args)
+		// Pipelined commands are answered together.
+		if r.Buffered() == 0 || quit {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// arities holds the minimum and maximum numbers of arguments of the commands.
+// A maximum of -1 means any number and -2 any number of pairs.
+var arities = map[string][2]int{
+	"PING": {0, 1}, "ECHO": {1, 1}, "QUIT": {0, 0},
+	"GET": {1, 1}, "SET": {2, -1}, "DEL": {1, -1}, "EXISTS": {1, -1},
+	"EXPIRE": {2, 2}, "TTL": {1, 1},
+	"MGET": {1, -1}, "MSET": {2, -2},
+}
+
+// execute runs a command and writes its reply.  It returns true on QUIT.
+func (s *Server) execute(w *bufio.Writer, args []string) bool {
+	args0 := args[0]
+	name := strings.ToUpper(args0)
+	args = args[1:]
+	if a, prs := arities[name]; prs {
+		if len(args) < a[0] || (a[1] >= 0 && len(args) > a[1]) || (a[1] == -2 && len(args)%2 != 0) {
+			writeError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+			return false
+		}
+	}
+	switch name {
+	case "PING":
+		if len(args) == 0 {
+			writeSimple(w, "PONG")
+		} else {
+			writeBulk(w, &args[0])
+		}
+	case "ECHO":
+		writeBulk(w, &args[0])
+	case "QUIT":
+		writeSimple(w, "OK")
+		return true
+	case "GET":
+		v, err := s.get(args[0])
+		if err != nil {
+			writeDHTError(w, err)
+			break
+		}
+		writeBulk(w, v)
+	case "SET":
+		ttl, err := parseExpiry(args[2:])
+		if err != nil {
+			writeError(w, err.Error())
+			break
+		}
+		if err := s.dht.PutWithTTL(args[0], []byte(args[1]), ttl); err != nil {
+			writeDHTError(w, err)
+			break
+		}
+		writeSimple(w, "OK")
+	case "DEL":
+		count := 0
+		for _, k := range args {
+			err := s.dht.Delete(k)
+			if err == dht.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				writeDHTError(w, err)
+				return false
+			}
+			count++
+		}
+		writeInteger(w, count)
+	case "EXISTS":
+		count := 0
+		for _, k := range args {
+			v, err := s.get(k)
+			if err != nil {
+				writeDHTError(w, err)
+				return false
+			}
+			if v != nil {
+				count++
+			}
+		}
+		writeInteger(w, count)
+	case "EXPIRE":
+		seconds, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			writeError(w, "ERR value is not an integer or out of range")
+			break
+		}
+		if seconds > int64(math.MaxInt64/time.Second) {
+			writeError(w, "ERR invalid expire time in 'expire' command")
+			break
+		}
+		if seconds <= 0 {
+			// Like Redis, a deadline in the past deletes the key.
+			err = s.dht.Delete(args[0])
+		} else {
+			err = s.dht.Expire(args[0], time.Duration(seconds)*time.Second)
+		}
+		if errors.Is(err, dht.ErrNotFound) {
+			writeInteger(w, 0)
+			break
+		}
+		if err != nil {
+			writeDHTError(w, err)
+			break
+		}
+		writeInteger(w, 1)
+	case "TTL":
+		ttl, err := s.dht.TTL(args[0])
+		switch {
+		case errors.Is(err, dht.ErrNotFound):
+			writeInteger(w, -2)
+		case err != nil:
+			writeDHTError(w, err)
+		case ttl == 0:
+			writeInteger(w, -1)
+		default:
+			// Rounded to the nearest second, like Redis.
+			writeInteger(w, int((ttl+time.Second/2)/time.Second))
+		}
+	case "MGET":
+		values, errs := s.dht.MultiGet(args)
+		for _, err := range errs {
+			if err != nil && err != dht.ErrNotFound {
+				writeDHTError(w, err)
+				return false
+			}
+		}
+		fmt.Fprintf(w, "*%d\r\n", len(values))
+		for i, v := range values {
+			if errs[i] != nil {
+				writeBulk(w, nil)
+				continue
+			}
+			str := string(v)
+			writeBulk(w, &str)
+		}
+	case "MSET":
+		// Like SET, MSET drops the TTLs of the keys it overwrites.
+		entries := make([]dht.Entry, 0, len(args)/2)
+		for i := 0; i < len(args); i += 2 {
+			entries = append(entries, dht.Entry{Key: args[i], Value: []byte(args[i+1])})
+		}
+		for _, err := range s.dht.MultiPut(entries) {
+			if err != nil {
+				writeDHTError(w, err)
+				return false
+			}
+		}
+		writeSimple(w, "OK")
+	default:
+		writeError(w, fmt.Sprintf("ERR unknown command '%s'", truncate(args0)))
+	}
+	return false
+}
+
+// parseExpiry parses the options of SET.  Only EX and PX are supported.
+func parseExpiry(options []string) (time.Duration, error) {
+	if len(options) == 0 {
+		return 0, nil
+	}
+	if len(options) != 2 {
+		return 0, errors.New("ERR syntax error")
+	}
+	var unit time.Duration
+	switch strings.ToUpper(options[0]) {
+	case "EX":
+		unit = time.Second
+	case "PX":
+		unit = time.Millisecond
+	default:
+		return 0, errors.New("ERR syntax error")
+	}
+	n, err := strconv.ParseInt(options[1], 10, 64)
+	if err != nil {
+		return 0, errors.New("ERR value is not an integer or out of range")
+	}
+	if n <= 0 || n > int64(math.MaxInt64/unit) {
+		return 0, errors.New("ERR invalid expire time in 'set' command")
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// get returns nil for missing keys.
+func (s *Server) get(k string) (*string, error) {
+	v, err := s.dht.Get(k)
+	if err == dht.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func truncate(s string) string {
+	if len(s) > 64 {
+		return s[:64] + "..."
+	}
+	return s
+}
+
+/*****************************************************************************
+ * Protocol                                                                  *
+ *****************************************************************************/
+
+// protocolError is a malformed request.  The connection is closed after it.
+type protocolError string
+
+func (e protocolError) Error() string {
+	return string(e)
+}
+
+// maxBulk is the largest bulk string accepted, as in Redis.
+const maxBulk = 512 << 20
+
+// readCommand reads an array of bulk strings, or an inline command.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > 1024*1024 {
+		return nil, protocolError("invalid multibulk length")
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, protocolError(fmt.Sprintf("expected '$', got '%.1s'", line))
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulk {
+			return nil, protocolError("invalid bulk length")
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, protocolError("bulk string is not terminated by CRLF")
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func writeSimple(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "+%s\r\n", s)
+}
+
+func writeError(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "-%s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(s))
+}
+
+func writeInteger(w *bufio.Writer, i int) {
+	fmt.Fprintf(w, ":%d\r\n", i)
+}
+
+// writeBulk writes a null bulk string if s is nil.
+func writeBulk(w *bufio.Writer, s *string) {
+	if s == nil {
+		w.WriteString("$-1\r\n")
+		return
+	}
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(*s), *s)
+}
+
+func writeDHTError(w *bufio.Writer, err error) {
+	switch {
+	case err == chord.ErrWrongNode:
+		// As Redis Cluster does while slots are moving
+		writeError(w, "TRYAGAIN "+err.Error())
+	case errors.Is(err, rpc.ErrTimeout):
+		writeError(w, "TIMEOUT "+err.Error())
+	default:
+		writeError(w, "ERR "+err.Error())
+	}
+}
@@ -0,0 +1,160 @@
+package resp_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anteater2/bitmesh/chord/chordtest"
+	"github.com/anteater2/bitmesh/dht"
+	"github.com/anteater2/bitmesh/dht/resp"
+)
+
+// client speaks just enough RESP for the tests.  Replies are rendered as
+// the lines of redis-cli, with arrays flattened.
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *client) do(t *testing.T, args ...string) string {
+	t.Helper()
+	fmt.Fprintf(c.conn, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(c.conn, "$%d\r\n%s\r\n", len(a), a)
+	}
+	return c.read(t)
+}
+
+func (c *client) read(t *testing.T) string {
+	t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+', '-', ':':
+		return line
+	case '$':
+		var n int
+		fmt.Sscan(line[1:], &n)
+		if n < 0 {
+			return "(nil)"
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	case '*':
+		var n int
+		fmt.Sscan(line[1:], &n)
+		items := make([]string, n)
+		for i := range items {
+			items[i] = c.read(t)
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	}
+	t.Fatalf("bad reply %q", line)
+	return ""
+}
+
+func TestServer(t *testing.T) {
+	ring, err := chordtest.NewRing(3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.Stop()
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	d, err := dht.New(ring.Entry(), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := resp.NewServer(d)
+	done := make(chan error)
+	go func() { done <- server.Serve(l) }()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &client{conn: conn, r: bufio.NewReader(conn)}
+
+	for _, step := range [][2]string{
+		{"PING", "+PONG"},
+		{"ping hello", "hello"},
+		{"ECHO a", "a"},
+		{"GET k", "(nil)"},
+		{"SET k v", "+OK"},
+		{"GET k", "v"},
+		{"SET k v NX", "-ERR syntax error"},
+		{"SET e v EX 0", "-ERR invalid expire time in 'set' command"},
+		{"SET e v PX 100", "+OK"},
+		{"GET e", "v"},
+		{"TTL k", ":-1"},
+		{"TTL x", ":-2"},
+		{"EXPIRE x 10", ":0"},
+		{"EXPIRE k 100", ":1"},
+		{"TTL k", ":100"},
+		{"GET k", "v"},
+		{"EXPIRE k ten", "-ERR value is not an integer or out of range"},
+		{"EXPIRE k", "-ERR wrong number of arguments for 'expire' command"},
+		{"SET gone v", "+OK"},
+		{"EXPIRE gone 0", ":1"},
+		{"TTL gone", ":-2"},
+		{"MSET a 1 b 2", "+OK"},
+		{"EXPIRE a 100", ":1"},
+		{"MSET a 1", "+OK"},
+		{"TTL a", ":-1"},
+		{"MSET a", "-ERR wrong number of arguments for 'mset' command"},
+		{"MGET a x b", "[1 (nil) 2]"},
+		{"EXISTS a x b k", ":3"},
+		{"DEL a x b", ":2"},
+		{"EXISTS a b", ":0"},
+		{"GET", "-ERR wrong number of arguments for 'get' command"},
+		{"FLUSHALL", "-ERR unknown command 'FLUSHALL'"},
+	} {
+		if got := c.do(t, strings.Fields(step[0])...); got != step[1] {
+			t.Errorf("%s: got %q, want %q", step[0], got, step[1])
+		}
+	}
+	time.Sleep(150 * time.Millisecond)
+	if got := c.do(t, "GET", "e"); got != "(nil)" {
+		t.Errorf("GET e after expiry: %q", got)
+	}
+	// binary safe values
+	if got := c.do(t, "SET", "bin", "a\r\nb\x00"); got != "+OK" {
+		t.Errorf("SET bin: %q", got)
+	}
+	if got := c.do(t, "GET", "bin"); got != "a\r\nb\x00" {
+		t.Errorf("GET bin: %q", got)
+	}
+	// inline commands and pipelining
+	fmt.Fprint(conn, "PING\r\nGET k\r\n")
+	if got := c.read(t) + " " + c.read(t); got != "+PONG v" {
+		t.Errorf("inline pipeline: %q", got)
+	}
+	if got := c.do(t, "QUIT"); got != "+OK" {
+		t.Errorf("QUIT: %q", got)
+	}
+
+	server.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Serve: %v", err)
+	}
+}
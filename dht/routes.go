@@ -0,0 +1,96 @@
+package dht
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/anteater2/bitmesh/chord"
+)
+
+// routes caches the nodes of the ring, sorted by key.  The owner of a key is
+// taken to be the first cached node at or after it; that is wrong when the
+// real owner is missing from the cache, in which case the node answers
+// ErrWrongNode and the entry is dropped.
+type routes struct {
+	nodes []chord.RemoteNode
+	mutex sync.Mutex
+}
+
+// owner returns the cached owner of key, if any.
+func (r *routes) owner(key chord.Key) (chord.RemoteNode, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.nodes) == 0 {
+		return chord.RemoteNode{}, false
+	}
+	i := sort.Search(len(r.nodes), func(i int) bool { return r.nodes[i].Key >= key })
+	if i == len(r.nodes) {
+		i = 0 // wrap around
+	}
+	return r.nodes[i], true
+}
+
+// add caches node, replacing any node with the same key or address.
+func (r *routes) add(node chord.RemoteNode) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.removeLocked(node.Address)
+	i := sort.Search(len(r.nodes), func(i int) bool { return r.nodes[i].Key >= node.Key })
+	if i < len(r.nodes) && r.nodes[i].Key == node.Key {
+		r.nodes[i] = node
+		return
+	}
+	r.nodes = append(r.nodes, chord.RemoteNode{})
+	copy(r.nodes[i+1:], r.nodes[i:])
+	r.nodes[i] = node
+}
+
+// remove drops the node at address from the cache.
+func (r *routes) remove(address string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.removeLocked(address)
+}
+
+func (r *routes) removeLocked(address string) {
+	for i, n := range r.nodes {
+		if n.Address == address {
+			r.nodes = append(r.nodes[:i], r.nodes[i+1:]...)
+			return
+		}
+	}
+}
+
+// set replaces the whole cache.
+func (r *routes) set(nodes []chord.RemoteNode) {
+	sorted := append([]chord.RemoteNode(nil), nodes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.nodes = sorted
+}
+
+// list returns a copy of the cached nodes.
+func (r *routes) list() []chord.RemoteNode {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]chord.RemoteNode(nil), r.nodes...)
+}
+
+// successors returns the node at address and the cached nodes after it, n
+// nodes at most, or nil if the node is not cached.
+func (r *routes) successors(address string, n int) []chord.RemoteNode {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, node := range r.nodes {
+		if node.Address != address {
+			continue
+		}
+		nodes := []chord.RemoteNode{node}
+		for j := 1; j < n && j < len(r.nodes); j++ {
+			nodes = append(nodes, r.nodes[(i+j)%len(r.nodes)])
+		}
+		return nodes
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package dht
+
+import (
+	"time"
+
+	"github.com/anteater2/bitmesh/chord"
+)
+
+// ErrSiblings is returned by Get for a key with concurrent values, which
+// GetSiblings returns.  It is the same value as chord.ErrSiblings.
+var ErrSiblings = chord.ErrSiblings
+
+// GetSiblings gets the concurrent values of a key put with PutSibling, and
+// the context to put a value that replaces them all.  A key put otherwise
+// has one value.  It returns ErrNotFound if there is no such key.
+func (dht *DHT) GetSiblings(k string) ([][]byte, chord.VectorClock, error) {
+	var siblings []chord.Sibling
+	var err error
+	if dht.config.Replicas > 1 {
+		var entry chord.HashEntry
+		entry, err = dht.quorumGet(k)
+		siblings = entry.Siblings
+		if err == nil && len(siblings) == 0 {
+			siblings = []chord.Sibling{{Value: entry.Value}}
+		}
+	} else {
+		err = dht.route(k, func(address string) error {
+			var err error
+			siblings, err = dht.caller.GetSiblings(address, k)
+			return err
+		})
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	values := make([][]byte, len(siblings))
+	for i, s := range siblings {
+		values[i] = s.Value
+		if values[i] == nil {
+			// gob turns empty values into nil
+			values[i] = []byte{}
+		}
+	}
+	return values, chord.Context(siblings), nil
+}
+
+// PutSibling puts a value with a vector clock, the context returned by
+// GetSiblings, or nil for a new key.  The value replaces the values the
+// context has seen; the ones put concurrently are kept as its siblings.
+func (dht *DHT) PutSibling(k string, v []byte, context chord.VectorClock) error {
+	return dht.PutSiblingWithTTL(k, v, context, 0)
+}
+
+// PutSiblingWithTTL is PutSibling for a key that expires after ttl, or never
+// if ttl is not positive.
+func (dht *DHT) PutSiblingWithTTL(k string, v []byte, context chord.VectorClock, ttl time.Duration) error {
+	var owner string
+	var entry chord.HashEntry
+	err := dht.route(k, func(address string) error {
+		var err error
+		owner = address
+		_, entry, err = dht.caller.PutSibling(address, k, v, context, ttl)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return dht.replicate(owner, []chord.HashEntry{entry}, k)
+}
+
+// UpdateSiblings merges the concurrent values of a key into one with f, and
+// puts it in their place.  f gets no values for a missing key; if it fails,
+// UpdateSiblings stops and returns its error.  The values put concurrently
+// in between are kept as siblings, for the next update to merge.
+// UpdateSiblings returns the value it put.
+func (dht *DHT) UpdateSiblings(k string, f func(siblings [][]byte) ([]byte, error)) ([]byte, error) {
+	siblings, context, err := dht.GetSiblings(k)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	v, err := f(siblings)
+	if err != nil {
+		return nil, err
+	}
+	return v, dht.PutSibling(k, v, context)
+}
@@ -0,0 +1,131 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// Codec turns values of type T into bytes and back.
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// JSON is a Codec that uses encoding/json.
+type JSON[T any] struct{}
+
+// Encode implements Codec.
+func (JSON[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Decode implements Codec.
+func (JSON[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// Gob is a Codec that uses encoding/gob.
+type Gob[T any] struct{}
+
+// Encode implements Codec.
+func (Gob[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+// Decode implements Codec.
+func (Gob[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+// CodecFuncs makes a Codec out of a pair of functions, such as proto.Marshal
+// and a function that calls proto.Unmarshal on a new message.
+type CodecFuncs[T any] struct {
+	EncodeFunc func(v T) ([]byte, error)
+	DecodeFunc func(data []byte) (T, error)
+}
+
+// Encode implements Codec.
+func (c CodecFuncs[T]) Encode(v T) ([]byte, error) {
+	return c.EncodeFunc(v)
+}
+
+// Decode implements Codec.
+func (c CodecFuncs[T]) Decode(data []byte) (T, error) {
+	return c.DecodeFunc(data)
+}
+
+// Typed stores values of type T in a DHT, encoded with a Codec.
+type Typed[T any] struct {
+	dht   *DHT
+	codec Codec[T]
+}
+
+// NewTyped creates a typed view of d.
+func NewTyped[T any](d *DHT, codec Codec[T]) *Typed[T] {
+	return &Typed[T]{dht: d, codec: codec}
+}
+
+// Put encodes v and puts it into the DHT.
+func (t *Typed[T]) Put(k string, v T) error {
+	data, err := t.codec.Encode(v)
+	if err != nil {
+		return fmt.Errorf("dht: encode %q: %w", k, err)
+	}
+	return t.dht.PutBytes(k, data)
+}
+
+// Get gets the value of k and decodes it.
+// It returns ErrNotFound if there is no such key.
+func (t *Typed[T]) Get(k string) (T, error) {
+	data, err := t.dht.GetBytes(k)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	v, err := t.codec.Decode(data)
+	if err != nil {
+		return v, fmt.Errorf("dht: decode %q: %w", k, err)
+	}
+	return v, nil
+}
+
+// Update replaces the value of k with f of it, as DHT.Update does.
+// f gets found == false for a missing key.
+func (t *Typed[T]) Update(k string, f func(old T, found bool) (T, error)) (T, error) {
+	var v T
+	_, err := t.dht.Update(k, func(data []byte) ([]byte, error) {
+		var old T
+		found := data != nil
+		if found {
+			var err error
+			old, err = t.codec.Decode(data)
+			if err != nil {
+				return nil, fmt.Errorf("dht: decode %q: %w", k, err)
+			}
+		}
+		var err error
+		v, err = f(old, found)
+		if err != nil {
+			return nil, err
+		}
+		data, err = t.codec.Encode(v)
+		if err != nil {
+			return nil, fmt.Errorf("dht: encode %q: %w", k, err)
+		}
+		return data, nil
+	})
+	return v, err
+}
+
+// Delete removes k from the DHT.
+func (t *Typed[T]) Delete(k string) error {
+	return t.dht.Delete(k)
+}
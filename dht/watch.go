@@ -0,0 +1,233 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+
+	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/message"
+)
+
+// Event is a change of a watched key.  It is the same type as chord.Event.
+type Event = chord.Event
+
+// EventType is the kind of change an Event reports.
+type EventType = chord.EventType
+
+// Event types
+const (
+	EventPut    = chord.EventPut
+	EventDelete = chord.EventDelete
+	EventExpire = chord.EventExpire
+	// EventOverflow stands for the events dropped while the channel of a
+	// watch, or the queue of a node, was full.
+	EventOverflow = chord.EventOverflow
+)
+
+// watchBuffer is the number of events a watch holds for a slow reader.
+const watchBuffer = 256
+
+// watcher is a watch of the client and the channel of its events.
+type watcher struct {
+	watch  chord.Watch
+	events chan Event
+	// overflowed is set once an EventOverflow is in the channel, until the
+	// reader makes room again.
+	overflowed bool
+	// seqs holds the Seq of the last event passed on, by key.
+	seqs map[string]uint64
+}
+
+// Watch returns the changes of key, pushed by the node that owns it, until
+// ctx is done or the client stops; then the channel is closed.  Events that
+// come in while the channel is full are dropped, and the reader finds an
+// EventOverflow where they would have been.
+// If the watch cannot be set up, it is tried again with every renewal.
+func (dht *DHT) Watch(ctx context.Context, key string) <-chan Event {
+	return dht.watch(ctx, key, false)
+}
+
+// WatchPrefix returns the changes of all the keys starting with prefix, pushed
+// by every node, like Watch.
+func (dht *DHT) WatchPrefix(ctx context.Context, prefix string) <-chan Event {
+	return dht.watch(ctx, prefix, true)
+}
+
+func (dht *DHT) watch(ctx context.Context, key string, prefix bool) <-chan Event {
+	address, err := dht.eventAddress()
+	if err != nil {
+		dht.log.Error("cannot receive events", "error", err)
+		events := make(chan Event)
+		close(events)
+		return events
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	w := &watcher{
+		watch: chord.Watch{ID: hex.EncodeToString(id), Key: key, Prefix: prefix, Address: address},
+		// One more slot for an EventOverflow.
+		events: make(chan Event, watchBuffer+1),
+		seqs:   make(map[string]uint64),
+	}
+	dht.watchMutex.Lock()
+	dht.watchers[w.watch.ID] = w
+	dht.watchMutex.Unlock()
+	if err := dht.subscribe(w.watch); err != nil {
+		dht.log.Warn("cannot set up a watch", "id", w.watch.ID, "key", key, "error", err)
+	}
+	dht.config.Metrics.Add("bitmesh_dht_watches_total", 1)
+	dht.wg.Add(1)
+	go dht.renew(ctx, w)
+	return w.events
+}
+
+// renew renews the lease of a watch until ctx is done or the client stops.
+func (dht *DHT) renew(ctx context.Context, w *watcher) {
+	defer dht.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			dht.unsubscribe(w.watch)
+			dht.dropWatcher(w.watch.ID)
+			return
+		case <-dht.quit:
+			dht.dropWatcher(w.watch.ID)
+			return
+		case <-dht.config.Clock.After(dht.config.WatchLease / 3):
+		}
+		if err := dht.subscribe(w.watch); err != nil {
+			dht.log.Warn("cannot renew a watch", "id", w.watch.ID, "key", w.watch.Key, "error", err)
+		}
+	}
+}
+
+// subscribe starts or renews a watch on the owner of its key, or on every
+// node of the ring for a prefix watch.
+func (dht *DHT) subscribe(w chord.Watch) error {
+	if !w.Prefix {
+		return dht.route(w.Key, func(address string) error {
+			return dht.caller.Watch(address, w, dht.config.WatchLease)
+		})
+	}
+	// The cache may miss nodes, so walk the ring first.
+	var errs []error
+	if err := dht.Refresh(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, node := range dht.routes.list() {
+		if err := dht.caller.Watch(node.Address, w, dht.config.WatchLease); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// unsubscribe stops a watch.  The nodes that miss it drop it when its lease runs out.
+func (dht *DHT) unsubscribe(w chord.Watch) {
+	if !w.Prefix {
+		owner, err := dht.lookup(chord.Hash(w.Key, 1<<dht.bits))
+		if err == nil {
+			dht.caller.Unwatch(owner.Address, w.ID)
+		}
+		return
+	}
+	for _, node := range dht.routes.list() {
+		dht.caller.Unwatch(node.Address, w.ID)
+	}
+}
+
+func (dht *DHT) dropWatcher(id string) {
+	dht.watchMutex.Lock()
+	defer dht.watchMutex.Unlock()
+	if w, ok := dht.watchers[id]; ok {
+		delete(dht.watchers, id)
+		close(w.events)
+	}
+}
+
+// handleEvent passes an event on to its watch.
+func (dht *DHT) handleEvent(from string, v interface{}) {
+	e, ok := v.(Event)
+	if !ok {
+		return
+	}
+	dht.watchMutex.Lock()
+	defer dht.watchMutex.Unlock()
+	w, ok := dht.watchers[e.WatchID]
+	if !ok {
+		dht.log.Debug("event of an unknown watch", "id", e.WatchID, "peer", from)
+		return
+	}
+	if e.Type != EventOverflow && e.Seq != 0 {
+		// Messages may overtake each other on the way; a newer event of the
+		// key already told the reader more.  Older nodes send no Seq.
+		if e.Seq <= w.seqs[e.Key] {
+			dht.config.Metrics.Add("bitmesh_dht_watch_stale_total", 1)
+			return
+		}
+		w.seqs[e.Key] = e.Seq
+	}
+	// Only handleEvent sends on the channel, under the mutex, so it never
+	// blocks.
+	switch {
+	case len(w.events) < watchBuffer:
+		w.overflowed = false
+		w.events <- e
+		return
+	case !w.overflowed:
+		w.overflowed = true
+		w.events <- Event{WatchID: e.WatchID, Type: EventOverflow, Key: w.watch.Key}
+	}
+	dht.config.Metrics.Add("bitmesh_dht_watch_dropped_total", 1)
+}
+
+// eventAddress returns the address the nodes send events to.
+func (dht *DHT) eventAddress() (string, error) {
+	dht.eventMutex.Lock()
+	defer dht.eventMutex.Unlock()
+	if dht.eventAddr != "" {
+		return dht.eventAddr, nil
+	}
+	receiver, err := message.NewReceiverWith(dht.config.EventPort, dht.handleEvent, dht.config.message())
+	if err != nil {
+		return "", err
+	}
+	receiver.Register(Event{})
+	if err := receiver.Start(); err != nil {
+		return "", err
+	}
+	host, port, err := net.SplitHostPort(receiver.Addr())
+	if err != nil {
+		receiver.Stop()
+		return "", err
+	}
+	ip := dht.config.Addr
+	if ip == "" && !net.ParseIP(host).IsUnspecified() {
+		// The transport listens on one address, as a simulated host does.
+		ip = host
+	}
+	if ip == "" {
+		// Take the local address of the route to the entry node.
+		ip, err = localIP(dht.Entry())
+		if err != nil {
+			receiver.Stop()
+			return "", err
+		}
+	}
+	dht.receiver = receiver
+	dht.eventAddr = net.JoinHostPort(ip, port)
+	return dht.eventAddr, nil
+}
+
+// localIP returns the local address of the route to address.
+func localIP(address string) (string, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
@@ -0,0 +1,3 @@
+module github.com/anteater2/bitmesh
+
+go 1.25
@@ -0,0 +1,595 @@
+// Package lock grants locks with leases and fencing tokens on top of a chord
+// ring.
+//
+// A lock hashes to its owner, the node that owns the key of its name, which
+// grants it.  Calls are routed to the owner hop by hop with
+// chord.Node.NextHop.  A lease lasts until its TTL runs out unless it is
+// renewed, and every grant of a lock gets a greater token than the last one,
+// so that the resources the lock guards can turn away the writes of a holder
+// whose lease ran out.  When the owner hands its keys over to another node
+// (see chord.Node.OnHandoff), it sends the locks along; when it crashes, the
+// next owner starts the tokens from its clock.
+package lock
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/logging"
+	"github.com/anteater2/bitmesh/metrics"
+	"github.com/anteater2/bitmesh/rpc"
+)
+
+var (
+	// ErrHeld is returned by TryAcquire for a lock that another holder has.
+	ErrHeld = errors.New("lock: held by another holder")
+	// ErrNotHeld is returned by Renew and Release for a lease that ran out,
+	// was released, or was lost to another holder.
+	ErrNotHeld = errors.New("lock: not held")
+	// ErrStopped is returned by Acquire when the service stops.
+	ErrStopped = errors.New("lock: stopped")
+)
+
+// Lease is the hold of a lock.  Token is the fencing token of the grant, and
+// Expires is the end of the lease on the clock of the owner.
+type Lease struct {
+	Name    string
+	Holder  string
+	Token   uint64
+	Expires time.Time
+}
+
+// Config holds the optional settings of a node.
+type Config struct {
+	// CheckInterval is the pause between two checks of the node for leases
+	// that ran out, and for locks it no longer owns.  Defaults to one second.
+	CheckInterval time.Duration
+	// RetryInterval is the longest Acquire waits for a lock before it tries
+	// again, in case it is not told about a release.  Defaults to one second.
+	RetryInterval time.Duration
+	// Metrics defaults to metrics.Discard.  It is shared with the rpc and message layers.
+	Metrics metrics.Metrics
+	// Logger defaults to slog.Default().  It is shared with the rpc and message layers.
+	Logger logging.Logger
+}
+
+// Node is the lock service of a chord node.
+type Node struct {
+	node   *chord.Node
+	config Config
+	log    logging.Logger
+	caller *rpc.Caller
+
+	acquire  rpc.RemoteFunc
+	renew    rpc.RemoteFunc
+	release  rpc.RemoteFunc
+	transfer rpc.RemoteFunc
+	wake     rpc.RemoteFunc
+
+	// locks are the locks the node owns, or owned and could not hand over yet.
+	locks map[string]*lock
+	// left is set once the node has handed everything over to leave the ring.
+	left bool
+	// waiting holds the channels of the calls to Acquire waiting for a lock.
+	waiting map[string]map[chan struct{}]struct{}
+	holders uint64
+	mutex   sync.Mutex
+
+	quit     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// lock is the state of a lock on its owner.  A released lock is kept, so
+// that the next grant gets a greater token.
+type lock struct {
+	Name string
+	// Holder is "" for a free lock.
+	Holder  string
+	Token   uint64
+	Expires time.Time
+	// Waiters are the addresses of the nodes to tell when the lock is free.
+	Waiters []string
+}
+
+func (k *lock) held(now time.Time) bool {
+	return k.Holder != "" && now.Before(k.Expires)
+}
+
+func (k *lock) lease() Lease {
+	return Lease{Name: k.Name, Holder: k.Holder, Token: k.Token, Expires: k.Expires}
+}
+
+func (k *lock) addWaiter(address string) {
+	for _, waiter := range k.Waiters {
+		if waiter == address {
+			return
+		}
+	}
+	k.Waiters = append(k.Waiters, address)
+}
+
+// New creates the lock service of node, which receives its replies on port.
+func New(node *chord.Node, port uint16) (*Node, error) {
+	return NewWith(node, port, Config{})
+}
+
+// NewWith creates the lock service of node with the given config.
+func NewWith(node *chord.Node, port uint16, config Config) (*Node, error) {
+	if config.CheckInterval == 0 {
+		config.CheckInterval = time.Second
+	}
+	if config.RetryInterval == 0 {
+		config.RetryInterval = time.Second
+	}
+	config.Metrics = metrics.Or(config.Metrics)
+	config.Logger = logging.Or(config.Logger)
+	caller, err := rpc.NewCallerWith(port, rpc.Config{
+		Transport: node.Transport(),
+		Clock:     node.Clock(),
+		Metrics:   config.Metrics,
+		Logger:    config.Logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	l := &Node{
+		node:     node,
+		config:   config,
+		log:      logging.With(config.Logger, "node", node.Key(), "addr", node.Address()),
+		caller:   caller,
+		acquire:  caller.Declare(acquireCall{}, acquireReply{}, 5*time.Second),
+		renew:    caller.Declare(renewCall{}, renewReply{}, 5*time.Second),
+		release:  caller.Declare(releaseCall{}, releaseReply{}, 5*time.Second),
+		transfer: caller.Declare(transferCall{}, transferReply{}, 5*time.Second),
+		wake:     caller.Declare(wakeCall{}, wakeReply{}, time.Second),
+		locks:    make(map[string]*lock),
+		waiting:  make(map[string]map[chan struct{}]struct{}),
+		quit:     make(chan struct{}),
+	}
+	node.Implement(l.handleAcquire)
+	node.Implement(l.handleRenew)
+	node.Implement(l.handleRelease)
+	node.Implement(l.handleTransfer)
+	node.Implement(l.handleWake)
+	node.OnHandoff(l.handoff)
+	return l, nil
+}
+
+// Start starts the service.
+func (l *Node) Start() error {
+	if err := l.caller.Start(); err != nil {
+		return err
+	}
+	l.wg.Add(1)
+	go l.checkLoop()
+	return nil
+}
+
+// Stop stops the service.  The locks it owns are lost, unless the chord
+// node left the ring before.
+func (l *Node) Stop() {
+	l.stopOnce.Do(func() {
+		close(l.quit)
+		l.wg.Wait()
+		l.caller.Stop()
+	})
+}
+
+// TryAcquire acquires the lock called name for ttl, or returns ErrHeld if
+// another holder has it.
+func (l *Node) TryAcquire(name string, ttl time.Duration) (Lease, error) {
+	return l.tryAcquire(name, l.newHolder(), ttl, "")
+}
+
+// Acquire acquires the lock called name for ttl, waiting for it to be free
+// until ctx is done.
+func (l *Node) Acquire(ctx context.Context, name string, ttl time.Duration) (Lease, error) {
+	holder := l.newHolder()
+	for {
+		woken := l.wait(name)
+		lease, err := l.tryAcquire(name, holder, ttl, l.node.Address())
+		if err != ErrHeld {
+			l.stopWaiting(name, woken)
+			return lease, err
+		}
+		select {
+		case <-woken:
+		case <-l.node.Clock().After(l.config.RetryInterval):
+			l.stopWaiting(name, woken)
+		case <-ctx.Done():
+			l.stopWaiting(name, woken)
+			return Lease{}, ctx.Err()
+		case <-l.quit:
+			return Lease{}, ErrStopped
+		}
+	}
+}
+
+// Renew extends a lease to ttl from now, and returns the new lease.  It
+// returns ErrNotHeld if the lease already ran out.
+func (l *Node) Renew(lease Lease, ttl time.Duration) (Lease, error) {
+	reply := l.handleRenew(renewCall{lease.Name, lease.Holder, lease.Token, ttl})
+	return reply.Lease, decodeError(reply.Error)
+}
+
+// Release frees the lock of a lease, and tells the nodes waiting for it.
+func (l *Node) Release(lease Lease) error {
+	return decodeError(l.handleRelease(releaseCall{lease.Name, lease.Holder, lease.Token}).Error)
+}
+
+// Leases returns the leases held on the locks the node owns.
+func (l *Node) Leases() []Lease {
+	now := l.node.Clock().Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var leases []Lease
+	for _, k := range l.locks {
+		if k.held(now) {
+			leases = append(leases, k.lease())
+		}
+	}
+	return leases
+}
+
+func (l *Node) tryAcquire(name string, holder string, ttl time.Duration, waiter string) (Lease, error) {
+	reply := l.handleAcquire(acquireCall{name, holder, ttl, waiter})
+	return reply.Lease, decodeError(reply.Error)
+}
+
+// newHolder returns a holder ID that no other call to Acquire uses.
+func (l *Node) newHolder() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.holders++
+	return l.node.Address() + "#" + strconv.FormatUint(l.holders, 10)
+}
+
+// wait returns a channel that is closed when the node is told that the lock
+// called name is free.
+func (l *Node) wait(name string) chan struct{} {
+	woken := make(chan struct{})
+	l.mutex.Lock()
+	if l.waiting[name] == nil {
+		l.waiting[name] = make(map[chan struct{}]struct{})
+	}
+	l.waiting[name][woken] = struct{}{}
+	l.mutex.Unlock()
+	return woken
+}
+
+func (l *Node) stopWaiting(name string, woken chan struct{}) {
+	l.mutex.Lock()
+	delete(l.waiting[name], woken)
+	if len(l.waiting[name]) == 0 {
+		delete(l.waiting, name)
+	}
+	l.mutex.Unlock()
+}
+
+// route returns the next hop towards the owner of the lock called name, and
+// whether it is the node itself.  The caller must hold the lock, so that the
+// locks the node grants are not handed over in between.
+func (l *Node) route(name string) (chord.RemoteNode, bool) {
+	if l.left {
+		return l.node.Successor(), false
+	}
+	next := l.node.NextHop(chord.Hash(name, l.node.MaxKey()))
+	return next, next.Address == l.node.Address()
+}
+
+// lock returns the lock called name, creating it if needed.  A new lock
+// starts from the clock of the node in nanoseconds rather than from 0, so
+// that when an owner crashes with its locks, the grants of the next one still
+// get greater tokens, as long as the clocks of the nodes are closer than the
+// time it takes.  The caller must hold the lock.
+func (l *Node) lock(name string, now time.Time) *lock {
+	k, ok := l.locks[name]
+	if !ok {
+		k = &lock{Name: name, Token: uint64(now.UnixNano())}
+		l.locks[name] = k
+	}
+	return k
+}
+
+// free releases k and returns the nodes waiting for it.  The caller must
+// hold the lock.
+func (l *Node) free(k *lock) []string {
+	waiters := k.Waiters
+	k.Holder, k.Expires, k.Waiters = "", time.Time{}, nil
+	return waiters
+}
+
+// notify tells the waiters that the lock called name is free.
+func (l *Node) notify(name string, waiters []string) {
+	for _, waiter := range waiters {
+		if waiter == l.node.Address() {
+			l.handleWake(wakeCall{name})
+			continue
+		}
+		go func() {
+			if _, err := l.wake(waiter, wakeCall{name}); err != nil {
+				l.log.Debug("could not wake a waiter", "lock", name, "peer", waiter, "error", err)
+			}
+		}()
+	}
+}
+
+// handoff sends the locks in (start, end] to the node that now owns them.
+func (l *Node) handoff(to chord.RemoteNode, start chord.Key, end chord.Key) {
+	l.mutex.Lock()
+	if start == end {
+		// The node leaves the ring.
+		l.left = true
+	}
+	var moved []lock
+	for name, k := range l.locks {
+		if chord.Hash(name, l.node.MaxKey()).BetweenEndInclusive(start, end) {
+			moved = append(moved, *k)
+			delete(l.locks, name)
+		}
+	}
+	l.mutex.Unlock()
+	l.send(to.Address, moved)
+}
+
+// send hands locks over to address.  If it fails, the node keeps them until
+// the next check.
+func (l *Node) send(address string, locks []lock) {
+	if len(locks) == 0 {
+		return
+	}
+	if _, err := l.transfer(address, transferCall{locks}); err != nil {
+		l.log.Warn("could not hand the locks over", "peer", address, "locks", len(locks), "error", err)
+		l.mutex.Lock()
+		l.merge(locks)
+		l.mutex.Unlock()
+		return
+	}
+	l.log.Debug("handed the locks over", "peer", address, "locks", len(locks))
+	l.config.Metrics.Add("bitmesh_lock_handoffs_total", float64(len(locks)))
+	l.updateMetrics()
+}
+
+// merge adds locks handed over by another node.  If both granted a lock
+// while it changed hands, the grant with the greater token wins; the other
+// holder finds out when it renews.  The caller must hold the lock.
+func (l *Node) merge(locks []lock) {
+	for _, k := range locks {
+		mine, ok := l.locks[k.Name]
+		if !ok {
+			l.locks[k.Name] = &k
+			continue
+		}
+		waiters := mine.Waiters
+		if k.Token > mine.Token || (k.Token == mine.Token && k.Holder > mine.Holder) {
+			*mine = k
+		}
+		for _, waiter := range waiters {
+			mine.addWaiter(waiter)
+		}
+		for _, waiter := range k.Waiters {
+			mine.addWaiter(waiter)
+		}
+	}
+}
+
+// checkLoop expires leases and hands over the locks the node no longer owns
+// every CheckInterval.
+func (l *Node) checkLoop() {
+	defer l.wg.Done()
+	for {
+		select {
+		case <-l.quit:
+			return
+		case <-l.node.Clock().After(l.config.CheckInterval):
+		}
+		l.check()
+	}
+}
+
+func (l *Node) check() {
+	now := l.node.Clock().Now()
+	freed := make(map[string][]string)
+	moved := make(map[string][]lock)
+	l.mutex.Lock()
+	// Without a predecessor, the node does not know which keys it owns.
+	stable := !l.left && l.node.Predecessor() != nil
+	for name, k := range l.locks {
+		if k.Holder != "" && !k.held(now) {
+			l.log.Debug("lease ran out", "lock", name, "holder", k.Holder, "token", k.Token)
+			l.config.Metrics.Add("bitmesh_lock_expired_total", 1)
+			freed[name] = l.free(k)
+		}
+		if next, local := l.route(name); stable && !local {
+			moved[next.Address] = append(moved[next.Address], *k)
+			delete(l.locks, name)
+		}
+	}
+	l.mutex.Unlock()
+	for name, waiters := range freed {
+		l.notify(name, waiters)
+	}
+	for address, locks := range moved {
+		l.send(address, locks)
+	}
+	l.updateMetrics()
+}
+
+func (l *Node) updateMetrics() {
+	l.config.Metrics.Set("bitmesh_lock_leases", float64(len(l.Leases())))
+}
+
+// ----------------------------------------------------------------------------
+
+type acquireCall struct {
+	Name   string
+	Holder string
+	TTL    time.Duration
+	// Waiter is the address to tell when the lock is free, or "" for none.
+	Waiter string
+}
+
+type acquireReply struct {
+	Lease Lease
+	Error string
+}
+
+// handleAcquire grants a lock if the node owns it, or else sends the call
+// one hop closer to the owner.
+func (l *Node) handleAcquire(call acquireCall) acquireReply {
+	l.mutex.Lock()
+	next, local := l.route(call.Name)
+	if !local {
+		l.mutex.Unlock()
+		reply, err := l.acquire(next.Address, call)
+		if err != nil {
+			return acquireReply{Error: err.Error()}
+		}
+		return reply.(acquireReply)
+	}
+	now := l.node.Clock().Now()
+	k := l.lock(call.Name, now)
+	if k.held(now) && k.Holder != call.Holder {
+		if call.Waiter != "" {
+			k.addWaiter(call.Waiter)
+		}
+		l.mutex.Unlock()
+		return acquireReply{Error: ErrHeld.Error()}
+	}
+	if k.Holder != call.Holder || !k.held(now) {
+		k.Holder = call.Holder
+		k.Token++
+	}
+	k.Expires = now.Add(call.TTL)
+	lease := k.lease()
+	l.mutex.Unlock()
+	l.log.Debug("granted", "lock", call.Name, "holder", call.Holder, "token", lease.Token)
+	l.config.Metrics.Add("bitmesh_lock_grants_total", 1)
+	l.updateMetrics()
+	return acquireReply{Lease: lease}
+}
+
+// ----------------------------------------------------------------------------
+
+type renewCall struct {
+	Name   string
+	Holder string
+	Token  uint64
+	TTL    time.Duration
+}
+
+type renewReply struct {
+	Lease Lease
+	Error string
+}
+
+func (l *Node) handleRenew(call renewCall) renewReply {
+	l.mutex.Lock()
+	next, local := l.route(call.Name)
+	if !local {
+		l.mutex.Unlock()
+		reply, err := l.renew(next.Address, call)
+		if err != nil {
+			return renewReply{Error: err.Error()}
+		}
+		return reply.(renewReply)
+	}
+	defer l.mutex.Unlock()
+	now := l.node.Clock().Now()
+	k, ok := l.locks[call.Name]
+	if !ok || !k.held(now) || k.Holder != call.Holder || k.Token != call.Token {
+		return renewReply{Error: ErrNotHeld.Error()}
+	}
+	k.Expires = now.Add(call.TTL)
+	return renewReply{Lease: k.lease()}
+}
+
+// ----------------------------------------------------------------------------
+
+type releaseCall struct {
+	Name   string
+	Holder string
+	Token  uint64
+}
+
+type releaseReply struct {
+	Error string
+}
+
+func (l *Node) handleRelease(call releaseCall) releaseReply {
+	l.mutex.Lock()
+	next, local := l.route(call.Name)
+	if !local {
+		l.mutex.Unlock()
+		reply, err := l.release(next.Address, call)
+		if err != nil {
+			return releaseReply{Error: err.Error()}
+		}
+		return reply.(releaseReply)
+	}
+	k, ok := l.locks[call.Name]
+	if !ok || k.Holder != call.Holder || k.Token != call.Token {
+		l.mutex.Unlock()
+		return releaseReply{Error: ErrNotHeld.Error()}
+	}
+	waiters := l.free(k)
+	l.mutex.Unlock()
+	l.log.Debug("released", "lock", call.Name, "holder", call.Holder, "token", call.Token)
+	l.updateMetrics()
+	l.notify(call.Name, waiters)
+	return releaseReply{}
+}
+
+// ----------------------------------------------------------------------------
+
+type transferCall struct {
+	Locks []lock
+}
+
+type transferReply struct{}
+
+// handleTransfer takes the locks handed over by another node.  If the node
+// does not own them either, it hands them on at its next check.
+func (l *Node) handleTransfer(call transferCall) transferReply {
+	l.mutex.Lock()
+	l.merge(call.Locks)
+	l.mutex.Unlock()
+	l.updateMetrics()
+	return transferReply{}
+}
+
+// ----------------------------------------------------------------------------
+
+type wakeCall struct {
+	Name string
+}
+
+type wakeReply struct{}
+
+// handleWake wakes the calls to Acquire waiting for a lock.
+func (l *Node) handleWake(call wakeCall) wakeReply {
+	l.mutex.Lock()
+	for woken := range l.waiting[call.Name] {
+		close(woken)
+	}
+	delete(l.waiting, call.Name)
+	l.mutex.Unlock()
+	return wakeReply{}
+}
+
+func decodeError(s string) error {
+	switch s {
+	case "":
+		return nil
+	case ErrHeld.Error():
+		return ErrHeld
+	case ErrNotHeld.Error():
+		return ErrNotHeld
+	}
+	return errors.New(s)
+}
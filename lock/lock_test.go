@@ -0,0 +1,275 @@
+package lock_test
+
+import (
+	"context"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/chord/chordtest"
+	"github.com/anteater2/bitmesh/lock"
+	"github.com/anteater2/bitmesh/sim"
+)
+
+func newService(t *testing.T, node *chord.Node) *lock.Node {
+	t.Helper()
+	l, err := lock.NewWith(node, 0, lock.Config{CheckInterval: 50 * time.Millisecond, RetryInterval: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(l.Stop)
+	return l
+}
+
+func newRing(t *testing.T, size int) (*chordtest.Ring, []*lock.Node) {
+	t.Helper()
+	ring, err := chordtest.NewRing(size, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ring.Stop)
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	nodes := make([]*lock.Node, size)
+	for i := range nodes {
+		nodes[i] = newService(t, ring.Node(i))
+	}
+	return ring, nodes
+}
+
+// eventually calls f until it succeeds, for calls made while the ring changes.
+func eventually(t *testing.T, f func() error) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		err := f()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestLock(t *testing.T) {
+	_, nodes := newRing(t, 4)
+	const name = "shard-7"
+	first, err := nodes[0].TryAcquire(name, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes[1].TryAcquire(name, time.Minute); err != lock.ErrHeld {
+		t.Fatalf("acquired a held lock: %v", err)
+	}
+	renewed, err := nodes[0].Renew(first, time.Minute)
+	if err != nil || renewed.Token != first.Token || !renewed.Expires.After(first.Expires) {
+		t.Fatalf("renew: %+v, %v", renewed, err)
+	}
+
+	// A waiter gets the lock as soon as it is released, long before it would
+	// try again by itself.
+	acquired := make(chan lock.Lease)
+	go func() {
+		lease, err := nodes[2].Acquire(context.Background(), name, time.Minute)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- lease
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if err := nodes[0].Release(first); err != nil {
+		t.Fatal(err)
+	}
+	var second lock.Lease
+	select {
+	case second = <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the waiter was not woken")
+	}
+	if second.Token <= first.Token {
+		t.Errorf("token %d after %d", second.Token, first.Token)
+	}
+	if err := nodes[0].Release(first); err != lock.ErrNotHeld {
+		t.Errorf("released a lease twice: %v", err)
+	}
+
+	// An expired lease is lost to the next holder.
+	if err := nodes[2].Release(second); err != nil {
+		t.Fatal(err)
+	}
+	short, err := nodes[1].TryAcquire(name, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	third, err := nodes[3].Acquire(ctx, name, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Token <= short.Token {
+		t.Errorf("token %d after %d", third.Token, short.Token)
+	}
+	if _, err := nodes[1].Renew(short, time.Minute); err != lock.ErrNotHeld {
+		t.Errorf("renewed an expired lease: %v", err)
+	}
+}
+
+// owner returns the number of the node of ring that owns the lock called name.
+func owner(t *testing.T, ring *chordtest.Ring, name string) int {
+	t.Helper()
+	key := chord.Hash(name, ring.Node(0).MaxKey())
+	for i := 0; i < ring.Size(); i++ {
+		if n := ring.Node(i); n != nil && n.NextHop(key).Address == n.Address() {
+			return i
+		}
+	}
+	t.Fatal("no owner")
+	return -1
+}
+
+func TestCrash(t *testing.T) {
+	const size = 4
+	ring, nodes := newRing(t, size)
+	const name = "shard-1"
+	crashed := owner(t, ring, name)
+	client := nodes[(crashed+1)%size]
+	lease, err := client.TryAcquire(name, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock dies with its owner, but the next grant still gets a greater
+	// token.
+	ring.Kill(crashed)
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	var next lock.Lease
+	eventually(t, func() error {
+		next, err = nodes[(crashed+2)%size].TryAcquire(name, time.Minute)
+		return err
+	})
+	if next.Token <= lease.Token {
+		t.Errorf("token %d after %d", next.Token, lease.Token)
+	}
+}
+
+// TestSim runs the service on a simulated ring, where leases run out in
+// virtual time.
+func TestSim(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		network := sim.New(sim.Config{Seed: 1, MinLatency: time.Millisecond, MaxLatency: 10 * time.Millisecond})
+		defer network.Close()
+		ring, err := chordtest.NewSimRing(3, 16, network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ring.Stop()
+		if err := ring.WaitConverged(time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		nodes := make([]*lock.Node, 3)
+		for i := range nodes {
+			nodes[i] = newService(t, ring.Node(i))
+			defer nodes[i].Stop()
+		}
+
+		const name = "shard-9"
+		first, err := nodes[0].TryAcquire(name, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := nodes[1].TryAcquire(name, time.Minute); err != lock.ErrHeld {
+			t.Fatalf("acquired a held lock: %v", err)
+		}
+		if want := network.Now().Add(time.Second); first.Expires.After(want) {
+			t.Errorf("lease until %v, expecting %v at the latest", first.Expires, want)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		second, err := nodes[2].Acquire(ctx, name, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if second.Token <= first.Token || network.Now().Before(first.Expires) {
+			t.Errorf("token %d after %d, at %v", second.Token, first.Token, network.Now())
+		}
+	})
+}
+
+func TestHandoff(t *testing.T) {
+	const size = 5
+	ring, nodes := newRing(t, size)
+	const name = "shard-3"
+	owner := owner(t, ring, name)
+	client := nodes[(owner+1)%size]
+	lease, err := client.TryAcquire(name, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes[owner].Leases()) != 1 {
+		t.Fatalf("the owner has %d leases", len(nodes[owner].Leases()))
+	}
+
+	// The lock follows the keys to the successor of the owner.
+	if err := ring.Leave(owner); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() error {
+		lease, err = client.Renew(lease, time.Minute)
+		return err
+	})
+	holders := func() int {
+		count := 0
+		for i, l := range nodes {
+			if i != owner && len(l.Leases()) == 1 {
+				count++
+			}
+		}
+		return count
+	}
+	if count := holders(); count != 1 {
+		t.Errorf("%d nodes have the lease", count)
+	}
+	other := nodes[(owner+2)%size]
+	if _, err := other.TryAcquire(name, time.Minute); err != lock.ErrHeld {
+		t.Errorf("acquired a lock that was handed over: %v", err)
+	}
+
+	// New nodes take the locks in their range when they are notified.
+	for i := 0; i < 3; i++ {
+		j, err := ring.Add()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, newService(t, ring.Node(j)))
+	}
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() error {
+		lease, err = client.Renew(lease, time.Minute)
+		return err
+	})
+	if count := holders(); count != 1 {
+		t.Errorf("%d nodes have the lease", count)
+	}
+	if err := client.Release(lease); err != nil {
+		t.Fatal(err)
+	}
+	next, err := other.TryAcquire(name, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Token <= lease.Token {
+		t.Errorf("token %d after %d", next.Token, lease.Token)
+	}
+}
@@ -0,0 +1,49 @@
+// Package logging is the leveled, structured logging of message, rpc and chord.
+//
+// A *slog.Logger is a Logger, so any slog handler can be plugged into their
+// configs.  Fields are passed the slog way, as alternating keys and values.
+package logging
+
+import "log/slog"
+
+// Logger is the subset of *slog.Logger that bitmesh uses.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// Discard drops every record.
+var Discard Logger = slog.New(slog.DiscardHandler)
+
+// Or returns l, or slog.Default() if l is nil.
+// Without any setup, that logs at level Info and above through package log.
+func Or(l Logger) Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
+
+// With returns a Logger that adds the fields args to every record.
+func With(l Logger, args ...any) Logger {
+	if s, ok := l.(*slog.Logger); ok {
+		return s.With(args...)
+	}
+	return &with{l: l, args: args}
+}
+
+type with struct {
+	l    Logger
+	args []any
+}
+
+func (w *with) merge(args []any) []any {
+	return append(append([]any{}, w.args...), args...)
+}
+
+func (w *with) Debug(msg string, args ...any) { w.l.Debug(msg, w.merge(args)...) }
+func (w *with) Info(msg string, args ...any)  { w.l.Info(msg, w.merge(args)...) }
+func (w *with) Warn(msg string, args ...any)  { w.l.Warn(msg, w.merge(args)...) }
+func (w *with) Error(msg string, args ...any) { w.l.Error(msg, w.merge(args)...) }
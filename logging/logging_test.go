@@ -0,0 +1,64 @@
+package logging_test
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/anteater2/bitmesh/logging"
+)
+
+// recorder is a Logger that is not a *slog.Logger.
+type recorder struct {
+	lines []string
+}
+
+func (r *recorder) log(level string, msg string, args []any) {
+	r.lines = append(r.lines, fmt.Sprint(level, " ", msg, " ", args))
+}
+
+func (r *recorder) Debug(msg string, args ...any) { r.log("DEBUG", msg, args) }
+func (r *recorder) Info(msg string, args ...any)  { r.log("INFO", msg, args) }
+func (r *recorder) Warn(msg string, args ...any)  { r.log("WARN", msg, args) }
+func (r *recorder) Error(msg string, args ...any) { r.log("ERROR", msg, args) }
+
+func TestWith(t *testing.T) {
+	r := &recorder{}
+	l := logging.With(logging.With(r, "node", 1), "addr", "a")
+	l.Info("hello", "peer", "b")
+	l.Debug("bye")
+	want := []string{
+		"INFO hello [node 1 addr a peer b]",
+		"DEBUG bye [node 1 addr a]",
+	}
+	if strings.Join(r.lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", r.lines, want)
+	}
+}
+
+func TestWithSlog(t *testing.T) {
+	var buf bytes.Buffer
+	s := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	l := logging.With(s, "node", 1)
+	l.Info("hello", "peer", "b")
+	l.Debug("hidden")
+	if got, want := buf.String(), "level=INFO msg=hello node=1 peer=b\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestOr(t *testing.T) {
+	if logging.Or(nil) != slog.Default() {
+		t.Error("Or(nil) is not slog.Default()")
+	}
+	logging.Discard.Error("nobody hears this")
+}
@@ -3,21 +3,25 @@
 package message
 
 import (
+	"bytes"
 	"encoding/gob"
 	"fmt"
-	"net"
 	"reflect"
 	"sync"
+
+	"github.com/anteater2/bitmesh/logging"
+	"github.com/anteater2/bitmesh/metrics"
 )
 
 // Receiver is bound to a local address (or more precisely, port number)
 // and contains handlers for a set of types.
 type Receiver struct {
-	localAddr *net.TCPAddr
-	addr      string
+	port      uint16
+	transport Transport
+	listener  Listener
 	handler   func(string, interface{})
-	quit      chan struct{}
-	wg        *sync.WaitGroup
+	metrics   metrics.Metrics
+	log       logging.Logger
 
 	types map[reflect.Type]struct{}
 	rw    sync.RWMutex
@@ -25,13 +29,17 @@ type Receiver struct {
 
 // NewReceiver creates a new instance of Receiver
 func NewReceiver(port uint16, handler func(string, interface{})) (*Receiver, error) {
-	laddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		return nil, err
-	}
+	return NewReceiverWith(port, handler, Config{})
+}
+
+// NewReceiverWith creates a new instance of Receiver with the given config
+func NewReceiverWith(port uint16, handler func(string, interface{}), config Config) (*Receiver, error) {
 	return &Receiver{
-		localAddr: laddr,
+		port:      port,
+		transport: config.transport(),
 		handler:   handler,
+		metrics:   metrics.Or(config.Metrics),
+		log:       logging.Or(config.Logger),
 		types:     make(map[reflect.Type]struct{}),
 	}, nil
 }
@@ -46,72 +54,51 @@ func (r *Receiver) Register(v interface{}) {
 
 // Addr returns addresss of the receiver
 func (r *Receiver) Addr() string {
-	return r.addr
+	if r.listener == nil {
+		return ""
+	}
+	return r.listener.Addr()
 }
 
-// Start starts a go routine that listens to incoming messages
+// Start starts listening to incoming messages
 // and dispatches them to their registered handlers.
 func (r *Receiver) Start() error {
-	listener, err := net.ListenTCP("tcp", r.localAddr)
+	listener, err := r.transport.Listen(r.port, r.handleMessage)
 	if err != nil {
 		return err
 	}
-	r.addr = listener.Addr().String()
-	r.quit = make(chan struct{}, 1)
-	r.wg = new(sync.WaitGroup)
-	r.wg.Add(1)
-	// start a go routine to listen to connections
-	go func() {
-		defer listener.Close()
-		defer r.wg.Done()
-		newConn := make(chan (net.Conn))
-		// start a go routine to put new connections into channel newConn
-		go func() {
-			for {
-				conn, err := listener.Accept()
-				if err != nil {
-					return
-				}
-				newConn <- conn
-			}
-		}()
-		for {
-			select {
-			case conn := <-newConn:
-				go r.handleConnection(conn)
-			case <-r.quit:
-				return
-			}
-		}
-	}()
+	r.listener = listener
 	return nil
 }
 
 // Stop signals the Receiver to stop and waits until it actually stops
 func (r *Receiver) Stop() {
-	if r.quit != nil {
-		r.quit <- struct{}{}
-		r.quit = nil
-		r.wg.Wait()
-		r.wg = nil
-		r.addr = ""
+	if r.listener != nil {
+		r.listener.Close()
+		r.listener = nil
 	}
 }
 
-func (r *Receiver) handleConnection(conn net.Conn) {
-	defer conn.Close()
-	for {
-		dec := gob.NewDecoder(conn)
-		var msg interface{}
-		err := dec.Decode(&msg)
-		if err != nil {
-			return
-		}
-		// handle when the type is registered
-		r.rw.RLock()
-		if _, prs := r.types[reflect.TypeOf(msg)]; prs {
-			go r.handler(conn.RemoteAddr().String(), msg)
-		}
-		r.rw.RUnlock()
+func (r *Receiver) handleMessage(from string, data []byte) {
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	var msg interface{}
+	err := dec.Decode(&msg)
+	if err != nil {
+		r.log.Debug("message: dropping undecodable message", "peer", from, "error", err)
+		r.metrics.Add("bitmesh_message_dropped_total", 1, metrics.Label{Name: "type", Value: "undecodable"})
+		return
+	}
+	label := metrics.Label{Name: "type", Value: fmt.Sprintf("%T", msg)}
+	// handle when the type is registered
+	r.rw.RLock()
+	_, prs := r.types[reflect.TypeOf(msg)]
+	r.rw.RUnlock()
+	if !prs {
+		r.log.Debug("message: dropping message of unregistered type", "peer", from, "type", label.Value)
+		r.metrics.Add("bitmesh_message_dropped_total", 1, label)
+		return
 	}
+	r.metrics.Add("bitmesh_message_received_total", 1, label)
+	r.metrics.Add("bitmesh_message_received_bytes_total", float64(len(data)), label)
+	go r.handler(from, msg)
 }
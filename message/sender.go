@@ -1,22 +1,35 @@
 package message
 
 import (
+	"bytes"
 	"encoding/gob"
 	"fmt"
-	"net"
 	"reflect"
 	"sync"
+
+	"github.com/anteater2/bitmesh/metrics"
 )
 
 // Sender sends data of a particular set of types
 type Sender struct {
-	types map[reflect.Type]struct{}
-	mutex sync.Mutex
+	transport Transport
+	metrics   metrics.Metrics
+	types     map[reflect.Type]struct{}
+	mutex     sync.Mutex
 }
 
 // NewSender creates a new instance of Sender
 func NewSender() *Sender {
-	return &Sender{types: make(map[reflect.Type]struct{})}
+	return NewSenderWith(Config{})
+}
+
+// NewSenderWith creates a new instance of Sender with the given config
+func NewSenderWith(config Config) *Sender {
+	return &Sender{
+		transport: config.transport(),
+		metrics:   metrics.Or(config.Metrics),
+		types:     make(map[reflect.Type]struct{}),
+	}
 }
 
 // Register records a type so that Sender can send it
@@ -29,22 +42,25 @@ func (s *Sender) Register(v interface{}) {
 
 // Send encodes the message using gob and sends it to the addr
 func (s *Sender) Send(addr string, message interface{}) error {
-	if _, prs := s.types[reflect.TypeOf(message)]; !prs {
+	s.mutex.Lock()
+	_, prs := s.types[reflect.TypeOf(message)]
+	s.mutex.Unlock()
+	if !prs {
 		return fmt.Errorf("message: unregistered type %T", message)
 	}
-	remoteAddr, err := net.ResolveTCPAddr("tcp", addr)
-	if err != nil {
-		return err
-	}
-	conn, err := net.DialTCP("tcp", nil, remoteAddr)
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(&message)
 	if err != nil {
 		return err
 	}
-	enc := gob.NewEncoder(conn)
-	err = enc.Encode(&message)
+	label := metrics.Label{Name: "type", Value: fmt.Sprintf("%T", message)}
+	err = s.transport.Send(addr, buf.Bytes())
 	if err != nil {
+		s.metrics.Add("bitmesh_message_send_errors_total", 1, label)
 		return err
 	}
-	conn.Close()
+	s.metrics.Add("bitmesh_message_sent_total", 1, label)
+	s.metrics.Add("bitmesh_message_sent_bytes_total", float64(buf.Len()), label)
 	return nil
 }
@@ -0,0 +1,113 @@
+package message
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/anteater2/bitmesh/logging"
+	"github.com/anteater2/bitmesh/metrics"
+)
+
+// Transport carries encoded messages to addresses of form "<IP>:<port>".
+type Transport interface {
+	// Listen binds port and calls handle with the address of the sender and
+	// the content of every message sent to it, until the Listener is closed.
+	// If port is 0, a free port is picked.
+	Listen(port uint16, handle func(from string, data []byte)) (Listener, error)
+	// Send delivers data to the listener at addr.
+	Send(addr string, data []byte) error
+}
+
+// Listener is a port bound by a Transport.
+type Listener interface {
+	// Addr returns the address of the listener.
+	Addr() string
+	// Close unbinds the port and waits until no more messages are handled.
+	Close() error
+}
+
+// Config holds the optional settings of a Sender or a Receiver.
+type Config struct {
+	// Transport defaults to TCP.
+	Transport Transport
+	// Metrics defaults to metrics.Discard.
+	Metrics metrics.Metrics
+	// Logger defaults to slog.Default().
+	Logger logging.Logger
+}
+
+func (c Config) transport() Transport {
+	if c.Transport == nil {
+		return TCP
+	}
+	return c.Transport
+}
+
+// TCP is the default transport.  Every message is sent over its own connection.
+var TCP Transport = tcpTransport{}
+
+type tcpTransport struct{}
+
+type tcpListener struct {
+	listener *net.TCPListener
+	wg       sync.WaitGroup
+}
+
+func (tcpTransport) Listen(port uint16, handle func(string, []byte)) (Listener, error) {
+	laddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	l := &tcpListener{listener: listener}
+	l.wg.Add(1)
+	// start a go routine to accept connections
+	go func() {
+		defer l.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// the sender closes the connection after one message
+				data, err := ioutil.ReadAll(conn)
+				if err != nil {
+					return
+				}
+				handle(conn.RemoteAddr().String(), data)
+			}()
+		}
+	}()
+	return l, nil
+}
+
+func (tcpTransport) Send(addr string, data []byte) error {
+	remoteAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTCP("tcp", nil, remoteAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(data)
+	return err
+}
+
+func (l *tcpListener) Addr() string {
+	return l.listener.Addr().String()
+}
+
+func (l *tcpListener) Close() error {
+	err := l.listener.Close()
+	l.wg.Wait()
+	return err
+}
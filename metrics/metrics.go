@@ -0,0 +1,86 @@
+// Package metrics lets message, rpc and chord report what they are doing.
+//
+// Packages report to a Metrics, which is Discard unless one is set in their
+// config.  A Registry keeps the measurements in memory and serves them in the
+// Prometheus text format.
+package metrics
+
+import (
+	"sort"
+	"strings"
+)
+
+// Label is a dimension of a measurement, such as the method of an RPC.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Metrics receives measurements.  Implementations must be safe for concurrent use.
+type Metrics interface {
+	// Add adds delta to a counter.
+	Add(name string, delta float64, labels ...Label)
+	// Set sets a gauge.
+	Set(name string, value float64, labels ...Label)
+	// Observe records a sample, such as a latency, in a histogram.
+	Observe(name string, value float64, labels ...Label)
+}
+
+// Discard drops every measurement.
+var Discard Metrics = discard{}
+
+type discard struct{}
+
+func (discard) Add(string, float64, ...Label)     {}
+func (discard) Set(string, float64, ...Label)     {}
+func (discard) Observe(string, float64, ...Label) {}
+
+// Or returns m, or Discard if m is nil.
+func Or(m Metrics) Metrics {
+	if m == nil {
+		return Discard
+	}
+	return m
+}
+
+// With returns a Metrics that adds labels to every measurement before passing
+// it on to m.  It is handy to tell apart several nodes of the same process.
+func With(m Metrics, labels ...Label) Metrics {
+	return &with{m: m, labels: labels}
+}
+
+type with struct {
+	m      Metrics
+	labels []Label
+}
+
+func (w *with) merge(labels []Label) []Label {
+	return append(append([]Label{}, w.labels...), labels...)
+}
+
+func (w *with) Add(name string, delta float64, labels ...Label) {
+	w.m.Add(name, delta, w.merge(labels)...)
+}
+
+func (w *with) Set(name string, value float64, labels ...Label) {
+	w.m.Set(name, value, w.merge(labels)...)
+}
+
+func (w *with) Observe(name string, value float64, labels ...Label) {
+	w.m.Observe(name, value, w.merge(labels)...)
+}
+
+// key identifies a series: a name and its labels sorted by label name.
+func key(name string, labels []Label) (string, []Label) {
+	sorted := append([]Label{}, labels...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	var b strings.Builder
+	b.WriteString(name)
+	for _, l := range sorted {
+		b.WriteString("\x00")
+		b.WriteString(l.Name)
+		b.WriteString("\x00")
+		b.WriteString(l.Value)
+	}
+	return b.String(), sorted
+}
@@ -0,0 +1,193 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of histogram buckets, fit for latencies in seconds.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// kinds of series, named after the Prometheus types
+const (
+	counter   = "counter"
+	gauge     = "gauge"
+	histogram = "histogram"
+)
+
+type series struct {
+	name   string
+	labels []Label
+	value  float64 // counters and gauges
+
+	// histograms
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// Registry is a Metrics that keeps the latest measurements in memory.
+type Registry struct {
+	series  map[string]*series
+	kinds   map[string]string
+	buckets map[string][]float64
+	mutex   sync.Mutex
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		series:  make(map[string]*series),
+		kinds:   make(map[string]string),
+		buckets: make(map[string][]float64),
+	}
+}
+
+// SetBuckets sets the bucket upper bounds of the histogram name,
+// which otherwise uses DefaultBuckets.  It only affects new series.
+func (r *Registry) SetBuckets(name string, buckets []float64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.buckets[name] = append([]float64{}, buckets...)
+}
+
+// get returns the series, creating it if needed.  The caller must hold the mutex.
+func (r *Registry) get(kind string, name string, labels []Label) *series {
+	k, sorted := key(name, labels)
+	s, prs := r.series[k]
+	if !prs {
+		s = &series{name: name, labels: sorted}
+		if kind == histogram {
+			s.buckets = r.buckets[name]
+			if s.buckets == nil {
+				s.buckets = DefaultBuckets
+			}
+			s.counts = make([]uint64, len(s.buckets))
+		}
+		r.series[k] = s
+	}
+	if _, prs := r.kinds[name]; !prs {
+		r.kinds[name] = kind
+	}
+	return s
+}
+
+// Add implements Metrics.
+func (r *Registry) Add(name string, delta float64, labels ...Label) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.get(counter, name, labels).value += delta
+}
+
+// Set implements Metrics.
+func (r *Registry) Set(name string, value float64, labels ...Label) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.get(gauge, name, labels).value = value
+}
+
+// Observe implements Metrics.
+func (r *Registry) Observe(name string, value float64, labels ...Label) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s := r.get(histogram, name, labels)
+	for i, bound := range s.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// Get returns the value of a counter or a gauge, or the number of samples of
+// a histogram.  It returns 0 for series that have never been measured.
+func (r *Registry) Get(name string, labels ...Label) float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	k, _ := key(name, labels)
+	s, prs := r.series[k]
+	if !prs {
+		return 0
+	}
+	if s.counts != nil {
+		return float64(s.count)
+	}
+	return s.value
+}
+
+// WriteText writes all the series in the Prometheus text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	byName := make(map[string][]*series)
+	names := []string{}
+	for _, s := range r.series {
+		if _, prs := byName[s.name]; !prs {
+			names = append(names, s.name)
+		}
+		byName[s.name] = append(byName[s.name], s)
+	}
+	sort.Strings(names)
+	out := bufio.NewWriter(w)
+	for _, name := range names {
+		all := byName[name]
+		sort.Slice(all, func(i, j int) bool {
+			return formatLabels(all[i].labels) < formatLabels(all[j].labels)
+		})
+		fmt.Fprintf(out, "# TYPE %s %s\n", name, r.kinds[name])
+		for _, s := range all {
+			if s.counts == nil {
+				fmt.Fprintf(out, "%s%s %s\n", name, formatLabels(s.labels), formatFloat(s.value))
+				continue
+			}
+			for i, bound := range s.buckets {
+				le := append(append([]Label{}, s.labels...), Label{"le", formatFloat(bound)})
+				fmt.Fprintf(out, "%s_bucket%s %d\n", name, formatLabels(le), s.counts[i])
+			}
+			le := append(append([]Label{}, s.labels...), Label{"le", "+Inf"})
+			fmt.Fprintf(out, "%s_bucket%s %d\n", name, formatLabels(le), s.count)
+			fmt.Fprintf(out, "%s_sum%s %s\n", name, formatLabels(s.labels), formatFloat(s.sum))
+			fmt.Fprintf(out, "%s_count%s %d\n", name, formatLabels(s.labels), s.count)
+		}
+	}
+	return out.Flush()
+}
+
+// ServeHTTP serves the series in the Prometheus text exposition format,
+// so that a Registry can be mounted as a /metrics endpoint.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteText(w)
+}
+
+func formatLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = fmt.Sprintf("%s=\"%s\"", l.Name, escaper.Replace(l.Value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
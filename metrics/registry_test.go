@@ -0,0 +1,112 @@
+package metrics_test
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anteater2/bitmesh/metrics"
+	"github.com/anteater2/bitmesh/rpc"
+)
+
+func TestWriteText(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.SetBuckets("hops", []float64{1, 2})
+	node := metrics.With(r, metrics.Label{Name: "node", Value: "a"})
+	node.Add("calls_total", 1, metrics.Label{Name: "method", Value: `say "hi"`})
+	node.Add("calls_total", 2, metrics.Label{Name: "method", Value: `say "hi"`})
+	r.Set("keys", 7)
+	r.Observe("hops", 1)
+	r.Observe("hops", 3)
+
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# TYPE calls_total counter
+calls_total{method="say \"hi\"",node="a"} 3
+# TYPE hops histogram
+hops_bucket{le="1"} 1
+hops_bucket{le="2"} 1
+hops_bucket{le="+Inf"} 2
+hops_sum 4
+hops_count 2
+# TYPE keys gauge
+keys 7
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+	if v := r.Get("calls_total", metrics.Label{Name: "node", Value: "a"}, metrics.Label{Name: "method", Value: `say "hi"`}); v != 3 {
+		t.Errorf("Get(calls_total) = %v, want 3", v)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") || w.Body.String() != want {
+		t.Errorf("ServeHTTP served %q: %q", w.Header().Get("Content-Type"), w.Body.String())
+	}
+}
+
+type echoArg struct{ S string }
+
+type silentArg struct{}
+
+func TestRPC(t *testing.T) {
+	r := metrics.NewRegistry()
+	config := rpc.Config{Metrics: r}
+	caller, err := rpc.NewCallerWith(0, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callee, err := rpc.NewCalleeWith(0, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := caller.Declare(echoArg{}, "", time.Second)
+	silent := caller.Declare(silentArg{}, 0, 50*time.Millisecond)
+	callee.Implement(func(arg echoArg) string { return arg.S })
+	callee.Implement(func(arg silentArg, pass rpc.PassFunc) (int, bool) { return 0, false })
+	if err := caller.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Stop()
+	if err := callee.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer callee.Stop()
+
+	for i := 0; i < 3; i++ {
+		if _, err := echo(callee.Addr(), echoArg{"hello"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := silent(callee.Addr(), silentArg{}); err == nil {
+		t.Fatal("silent call did not time out")
+	}
+
+	echoMethod := metrics.Label{Name: "method", Value: "metrics_test.echoArg"}
+	silentMethod := metrics.Label{Name: "method", Value: "metrics_test.silentArg"}
+	for _, c := range []struct {
+		name   string
+		labels []metrics.Label
+		want   float64
+	}{
+		{"bitmesh_rpc_calls_total", []metrics.Label{echoMethod}, 3},
+		{"bitmesh_rpc_call_seconds", []metrics.Label{echoMethod}, 3},
+		{"bitmesh_rpc_handled_total", []metrics.Label{echoMethod}, 3},
+		{"bitmesh_rpc_calls_total", []metrics.Label{silentMethod}, 1},
+		{"bitmesh_rpc_timeouts_total", []metrics.Label{silentMethod}, 1},
+		{"bitmesh_message_sent_total", []metrics.Label{{Name: "type", Value: "rpc.call"}}, 4},
+		{"bitmesh_message_received_total", []metrics.Label{{Name: "type", Value: "rpc.reply"}}, 3},
+	} {
+		if got := r.Get(c.name, c.labels...); got != c.want {
+			t.Errorf("%s%v = %v, want %v", c.name, c.labels, got, c.want)
+		}
+	}
+	if r.Get("bitmesh_message_sent_bytes_total", metrics.Label{Name: "type", Value: "rpc.call"}) == 0 {
+		t.Error("no bytes sent")
+	}
+}
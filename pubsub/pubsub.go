@@ -0,0 +1,475 @@
+// Package pubsub multicasts messages to the subscribers of topics with
+// trees built on top of chord routing, like Scribe.
+//
+// A topic hashes to its root, the node that owns the key of the topic.
+// A node that subscribes routes a join towards the root, hop by hop with
+// chord.Node.NextHop, and every node on the way records the previous one as
+// its child and joins in turn, until the path meets the tree.  Publishes are
+// routed to the root, which sends them down the tree.
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/logging"
+	"github.com/anteater2/bitmesh/metrics"
+	"github.com/anteater2/bitmesh/rpc"
+)
+
+// Message is a message published on a topic.
+type Message struct {
+	Topic string
+	Data  []byte
+}
+
+// Config holds the optional settings of a node.
+type Config struct {
+	// RefreshInterval is the pause between two joins of a node to its parents,
+	// which repair the trees.  Children that have not joined again within three
+	// intervals are dropped.  Defaults to five seconds.
+	RefreshInterval time.Duration
+	// Metrics defaults to metrics.Discard.  It is shared with the rpc and message layers.
+	Metrics metrics.Metrics
+	// Logger defaults to slog.Default().  It is shared with the rpc and message layers.
+	Logger logging.Logger
+}
+
+// Node is the publish/subscribe service of a chord node.
+type Node struct {
+	node   *chord.Node
+	config Config
+	log    logging.Logger
+	caller *rpc.Caller
+
+	join    rpc.RemoteFunc
+	leave   rpc.RemoteFunc
+	publish rpc.RemoteFunc
+	deliver rpc.RemoteFunc
+
+	topics map[string]*topic
+	mutex  sync.Mutex
+
+	quit     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// topic is the part of the tree of a topic on a node.
+type topic struct {
+	// parent is the address of the parent, or "" for the root or a node that
+	// has not joined yet.
+	parent string
+	// children maps the addresses of the children to the time they last joined.
+	children    map[string]time.Time
+	subscribers map[chan Message]struct{}
+}
+
+func (t *topic) empty() bool {
+	return len(t.children) == 0 && len(t.subscribers) == 0
+}
+
+// New creates the publish/subscribe service of node, which receives its
+// replies on port.
+func New(node *chord.Node, port uint16) (*Node, error) {
+	return NewWith(node, port, Config{})
+}
+
+// NewWith creates the publish/subscribe service of node with the given config.
+func NewWith(node *chord.Node, port uint16, config Config) (*Node, error) {
+	if config.RefreshInterval == 0 {
+		config.RefreshInterval = 5 * time.Second
+	}
+	config.Metrics = metrics.Or(config.Metrics)
+	config.Logger = logging.Or(config.Logger)
+	caller, err := rpc.NewCallerWith(port, rpc.Config{
+		Transport: node.Transport(),
+		Clock:     node.Clock(),
+		Metrics:   config.Metrics,
+		Logger:    config.Logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	p := &Node{
+		node:    node,
+		config:  config,
+		log:     logging.With(config.Logger, "node", node.Key(), "addr", node.Address()),
+		caller:  caller,
+		join:    caller.Declare(joinCall{}, joinReply{}, time.Second),
+		leave:   caller.Declare(leaveCall{}, leaveReply{}, time.Second),
+		publish: caller.Declare(publishCall{}, publishReply{}, 5*time.Second),
+		deliver: caller.Declare(deliverCall{}, deliverReply{}, time.Second),
+		topics:  make(map[string]*topic),
+		quit:    make(chan struct{}),
+	}
+	node.Implement(p.handleJoin)
+	node.Implement(p.handleLeave)
+	node.Implement(p.handlePublish)
+	node.Implement(p.handleDeliver)
+	node.OnFailure(p.repair)
+	return p, nil
+}
+
+// Start starts the service.
+func (p *Node) Start() error {
+	if err := p.caller.Start(); err != nil {
+		return err
+	}
+	p.wg.Add(1)
+	go p.refreshLoop()
+	return nil
+}
+
+// Stop stops the service and closes the channels of the subscriptions.
+// The chord node keeps running.
+func (p *Node) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.quit)
+		p.wg.Wait()
+		p.mutex.Lock()
+		for _, t := range p.topics {
+			for subscriber := range t.subscribers {
+				close(subscriber)
+			}
+		}
+		p.topics = make(map[string]*topic)
+		p.mutex.Unlock()
+		p.caller.Stop()
+	})
+}
+
+// Subscribe returns the messages published on name until ctx is done or the
+// service stops; then the channel is closed.  Messages that come in while
+// the channel is full are dropped.
+func (p *Node) Subscribe(ctx context.Context, name string) <-chan Message {
+	subscriber := make(chan Message, 256)
+	p.mutex.Lock()
+	t := p.topic(name)
+	t.subscribers[subscriber] = struct{}{}
+	joined := t.parent != ""
+	p.mutex.Unlock()
+	p.updateMetrics()
+	if !joined {
+		p.joinParent(name)
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		select {
+		case <-ctx.Done():
+		case <-p.quit:
+			return
+		}
+		p.mutex.Lock()
+		if t, ok := p.topics[name]; ok {
+			delete(t.subscribers, subscriber)
+			close(subscriber)
+		}
+		p.mutex.Unlock()
+		p.prune(name)
+	}()
+	return subscriber
+}
+
+// Publish sends data to the subscribers of name, through the root of the topic.
+func (p *Node) Publish(name string, data []byte) error {
+	return decodeError(p.handlePublish(publishCall{Message{name, data}}).Error)
+}
+
+// Topics returns the names of the topics the node is part of the tree of.
+func (p *Node) Topics() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	names := make([]string, 0, len(p.topics))
+	for name := range p.topics {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Children returns the addresses of the children of the node in the tree of name.
+func (p *Node) Children(name string) []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var children []string
+	if t, ok := p.topics[name]; ok {
+		for child := range t.children {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+// topic returns the topic called name, creating it if needed.
+// The caller must hold the lock.
+func (p *Node) topic(name string) *topic {
+	t, ok := p.topics[name]
+	if !ok {
+		t = &topic{children: make(map[string]time.Time), subscribers: make(map[chan Message]struct{})}
+		p.topics[name] = t
+	}
+	return t
+}
+
+// joinParent joins the tree of name through the next hop towards its root,
+// and leaves the previous parent if it is another node.
+func (p *Node) joinParent(name string) {
+	next := p.node.NextHop(chord.Hash(name, p.node.MaxKey()))
+	parent := ""
+	if next.Address != p.node.Address() {
+		parent = next.Address
+		p.mutex.Lock()
+		t, ok := p.topics[name]
+		loop := ok && !t.children[parent].IsZero()
+		p.mutex.Unlock()
+		if loop {
+			// The ring is not stable yet; try again on the next refresh.
+			p.log.Debug("next hop is a child", "topic", name, "peer", parent)
+			return
+		}
+		if _, err := p.join(parent, joinCall{name, p.node.Address()}); err != nil {
+			p.log.Warn("could not join a parent", "topic", name, "peer", parent, "error", err)
+			return
+		}
+	}
+	p.mutex.Lock()
+	t, ok := p.topics[name]
+	if !ok {
+		p.mutex.Unlock()
+		return
+	}
+	old := t.parent
+	t.parent = parent
+	p.mutex.Unlock()
+	if old != parent {
+		p.log.Debug("new parent", "topic", name, "parent", parent, "old", old)
+		if old != "" {
+			p.leave(old, leaveCall{name, p.node.Address()})
+		}
+	}
+}
+
+// prune leaves the tree of name if the node has neither children nor
+// subscribers left in it.
+func (p *Node) prune(name string) {
+	p.mutex.Lock()
+	t, ok := p.topics[name]
+	if !ok || !t.empty() {
+		p.mutex.Unlock()
+		return
+	}
+	delete(p.topics, name)
+	parent := t.parent
+	p.mutex.Unlock()
+	p.updateMetrics()
+	if parent != "" {
+		p.log.Debug("leaving a tree", "topic", name, "parent", parent)
+		p.leave(parent, leaveCall{name, p.node.Address()})
+	}
+}
+
+// multicast hands m to the local subscribers and sends it down to the children.
+func (p *Node) multicast(m Message) {
+	p.mutex.Lock()
+	t, ok := p.topics[m.Topic]
+	if !ok {
+		p.mutex.Unlock()
+		return
+	}
+	for subscriber := range t.subscribers {
+		select {
+		case subscriber <- m:
+			p.config.Metrics.Add("bitmesh_pubsub_delivered_total", 1)
+		default:
+			p.config.Metrics.Add("bitmesh_pubsub_dropped_total", 1)
+		}
+	}
+	var children []string
+	for child := range t.children {
+		children = append(children, child)
+	}
+	p.mutex.Unlock()
+	for _, child := range children {
+		go func() {
+			if _, err := p.deliver(child, deliverCall{m}); err != nil {
+				p.log.Warn("dropping a child that did not answer", "topic", m.Topic, "peer", child, "error", err)
+				p.dropChild(m.Topic, child)
+			}
+		}()
+	}
+}
+
+func (p *Node) dropChild(name string, child string) {
+	p.mutex.Lock()
+	if t, ok := p.topics[name]; ok {
+		delete(t.children, child)
+	}
+	p.mutex.Unlock()
+	p.prune(name)
+}
+
+// repair rebuilds the trees around a failed neighbour: it is dropped as a
+// child, and the topics it was the parent of are joined again.
+func (p *Node) repair(failed chord.RemoteNode) {
+	var orphans []string
+	p.mutex.Lock()
+	for name, t := range p.topics {
+		delete(t.children, failed.Address)
+		if t.parent == failed.Address {
+			t.parent = ""
+			orphans = append(orphans, name)
+		}
+	}
+	names := make([]string, 0, len(p.topics))
+	for name := range p.topics {
+		names = append(names, name)
+	}
+	p.mutex.Unlock()
+	for _, name := range orphans {
+		p.log.Info("parent failed, joining again", "topic", name, "peer", failed.Address)
+		p.config.Metrics.Add("bitmesh_pubsub_repairs_total", 1)
+		p.joinParent(name)
+	}
+	for _, name := range names {
+		p.prune(name)
+	}
+}
+
+// refreshLoop joins the parents again every RefreshInterval, which follows
+// the changes of the ring, and drops the children that stopped doing so.
+func (p *Node) refreshLoop() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-p.node.Clock().After(p.config.RefreshInterval):
+		}
+		p.refresh()
+	}
+}
+
+func (p *Node) refresh() {
+	deadline := p.node.Clock().Now().Add(-3 * p.config.RefreshInterval)
+	p.mutex.Lock()
+	names := make([]string, 0, len(p.topics))
+	for name, t := range p.topics {
+		for child, joined := range t.children {
+			if joined.Before(deadline) {
+				p.log.Debug("dropping a child that did not join again", "topic", name, "peer", child)
+				delete(t.children, child)
+			}
+		}
+		names = append(names, name)
+	}
+	p.mutex.Unlock()
+	for _, name := range names {
+		p.prune(name)
+		p.mutex.Lock()
+		_, ok := p.topics[name]
+		p.mutex.Unlock()
+		if ok {
+			p.joinParent(name)
+		}
+	}
+}
+
+func (p *Node) updateMetrics() {
+	p.mutex.Lock()
+	count := len(p.topics)
+	p.mutex.Unlock()
+	p.config.Metrics.Set("bitmesh_pubsub_topics", float64(count))
+}
+
+// ----------------------------------------------------------------------------
+
+type joinCall struct {
+	Topic string
+	Child string
+}
+
+type joinReply struct{}
+
+func (p *Node) handleJoin(call joinCall) joinReply {
+	p.mutex.Lock()
+	t := p.topic(call.Topic)
+	if _, ok := t.children[call.Child]; !ok {
+		p.log.Debug("new child", "topic", call.Topic, "peer", call.Child)
+	}
+	t.children[call.Child] = p.node.Clock().Now()
+	if t.parent == call.Child {
+		// Our parent now routes through us, so we find another one.
+		t.parent = ""
+	}
+	joined := t.parent != ""
+	p.mutex.Unlock()
+	p.updateMetrics()
+	if !joined {
+		go p.joinParent(call.Topic)
+	}
+	return joinReply{}
+}
+
+// ----------------------------------------------------------------------------
+
+type leaveCall struct {
+	Topic string
+	Child string
+}
+
+type leaveReply struct{}
+
+func (p *Node) handleLeave(call leaveCall) leaveReply {
+	p.dropChild(call.Topic, call.Child)
+	return leaveReply{}
+}
+
+// ----------------------------------------------------------------------------
+
+type publishCall struct {
+	Message Message
+}
+
+type publishReply struct {
+	Error string
+}
+
+// handlePublish sends a message down the tree if the node is the root of
+// the topic, or else one hop closer to the root.
+func (p *Node) handlePublish(call publishCall) publishReply {
+	next := p.node.NextHop(chord.Hash(call.Message.Topic, p.node.MaxKey()))
+	if next.Address == p.node.Address() {
+		p.config.Metrics.Add("bitmesh_pubsub_published_total", 1)
+		p.multicast(call.Message)
+		return publishReply{}
+	}
+	reply, err := p.publish(next.Address, call)
+	if err != nil {
+		return publishReply{err.Error()}
+	}
+	return reply.(publishReply)
+}
+
+// ----------------------------------------------------------------------------
+
+type deliverCall struct {
+	Message Message
+}
+
+type deliverReply struct{}
+
+func (p *Node) handleDeliver(call deliverCall) deliverReply {
+	p.multicast(call.Message)
+	return deliverReply{}
+}
+
+func decodeError(s string) error {
+	if s == "" {
+		return nil
+	}
+	return errors.New(s)
+}
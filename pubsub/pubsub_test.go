@@ -0,0 +1,159 @@
+package pubsub_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/chord/chordtest"
+	"github.com/anteater2/bitmesh/pubsub"
+	"github.com/anteater2/bitmesh/sim"
+)
+
+func TestPubSub(t *testing.T) {
+	const size = 8
+	ring, err := chordtest.NewRing(size, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.Stop()
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	nodes := make([]*pubsub.Node, size)
+	for i := range nodes {
+		nodes[i], err = pubsub.NewWith(ring.Node(i), 0, pubsub.Config{RefreshInterval: 100 * time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := nodes[i].Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer nodes[i].Stop()
+	}
+
+	const topic = "news"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscriptions := make(map[int]<-chan pubsub.Message)
+	for i := 1; i < size; i++ {
+		subscriptions[i] = nodes[i].Subscribe(ctx, topic)
+	}
+	// Every subscriber gets at least one of the messages published until then.
+	published := 0
+	waitAll := func() {
+		t.Helper()
+		got := make(map[int]bool)
+		deadline := time.Now().Add(30 * time.Second)
+		for len(got) < len(subscriptions) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d of %d subscribers got a message", len(got), len(subscriptions))
+			}
+			published++
+			if err := nodes[0].Publish(topic, []byte(fmt.Sprint(published))); err != nil {
+				t.Log(err)
+			}
+			time.Sleep(100 * time.Millisecond)
+			for i, messages := range subscriptions {
+				select {
+				case m := <-messages:
+					if m.Topic != topic {
+						t.Errorf("message on %q", m.Topic)
+					}
+					got[i] = true
+				default:
+				}
+			}
+		}
+	}
+	waitAll()
+
+	// Kill a node inside the tree, or the root if the tree is flat.
+	key := chord.Hash(topic, ring.Node(0).MaxKey())
+	isRoot := func(i int) bool { return ring.Node(i).NextHop(key).Address == ring.Node(i).Address() }
+	victim := -1
+	for i := 1; i < size; i++ {
+		if len(nodes[i].Children(topic)) > 0 && (victim == -1 || isRoot(victim)) {
+			victim = i
+		}
+	}
+	if victim == -1 {
+		t.Fatal("no node has children")
+	}
+	t.Log("killing", ring.Node(victim).Address(), "root", isRoot(victim))
+	nodes[victim].Stop()
+	ring.Kill(victim)
+	delete(subscriptions, victim)
+	if err := ring.WaitConverged(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, messages := range subscriptions {
+		for len(messages) > 0 {
+			<-messages
+		}
+	}
+	waitAll()
+
+	// Unsubscribing prunes the tree.
+	cancel()
+	deadline := time.Now().Add(10 * time.Second)
+	for i := range nodes {
+		if i == victim {
+			continue
+		}
+		for len(nodes[i].Topics()) > 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("node %d still in %v", i, nodes[i].Topics())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestSim(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		network := sim.New(sim.Config{Seed: 1, MinLatency: time.Millisecond, MaxLatency: 10 * time.Millisecond})
+		defer network.Close()
+		const size = 4
+		ring, err := chordtest.NewSimRing(size, 16, network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ring.Stop()
+		if err := ring.WaitConverged(time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		nodes := make([]*pubsub.Node, size)
+		for i := range nodes {
+			nodes[i], err = pubsub.NewWith(ring.Node(i), 0, pubsub.Config{RefreshInterval: time.Second})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := nodes[i].Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer nodes[i].Stop()
+		}
+
+		const topic = "news"
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		messages := nodes[size-1].Subscribe(ctx, topic)
+		// The tree is built on the simulated network and refreshed on its clock.
+		<-network.After(5 * time.Second)
+		if err := nodes[0].Publish(topic, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case m := <-messages:
+			if string(m.Data) != "hello" {
+				t.Errorf("got %q", m.Data)
+			}
+		case <-network.After(time.Minute):
+			t.Fatal("no message")
+		}
+	})
+}
@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"net"
 	"reflect"
+	"strconv"
 	"sync"
 
+	"github.com/anteater2/bitmesh/logging"
 	"github.com/anteater2/bitmesh/message"
+	"github.com/anteater2/bitmesh/metrics"
 )
 
 type remoteFuncType int
@@ -20,26 +23,41 @@ const (
 type Callee struct {
 	sender   *message.Sender
 	receiver *message.Receiver
+	metrics  metrics.Metrics
+	log      logging.Logger
 
-	functions     map[reflect.Type]interface{}
-	functionTypes map[reflect.Type]remoteFuncType
+	functions     map[route]interface{}
+	functionTypes map[route]remoteFuncType
 	rw            sync.RWMutex
 }
 
+// route picks a remote function.
+type route struct {
+	path string
+	arg  reflect.Type
+}
+
 // NewCallee creates a new instance of Callee
 func NewCallee(port uint16) (*Callee, error) {
+	return NewCalleeWith(port, Config{})
+}
+
+// NewCalleeWith creates a new instance of Callee with the given config
+func NewCalleeWith(port uint16, config Config) (*Callee, error) {
 	var c Callee
 	var err error
-	c.sender = message.NewSender()
-	c.receiver, err = message.NewReceiver(port, func(addr string, v interface{}) {
+	c.metrics = metrics.Or(config.Metrics)
+	c.log = logging.Or(config.Logger)
+	c.sender = message.NewSenderWith(config.message())
+	c.receiver, err = message.NewReceiverWith(port, func(addr string, v interface{}) {
 		c.handleCall(addr, v.(call))
-	})
+	}, config.message())
 	if err != nil {
 		return nil, err
 	}
 	c.receiver.Register(call{})
-	c.functions = make(map[reflect.Type]interface{})
-	c.functionTypes = make(map[reflect.Type]remoteFuncType)
+	c.functions = make(map[route]interface{})
+	c.functionTypes = make(map[route]remoteFuncType)
 	c.sender.Register(call{})
 	c.sender.Register(reply{})
 	return &c, nil
@@ -65,13 +83,20 @@ type PassFunc func(addr string, arg interface{}) error
 // On the other hand, if the second return value of f is true, the return value of f
 // will be sent back.
 func (c *Callee) Implement(f interface{}) {
+	c.ImplementAt("", f)
+}
+
+// ImplementAt is like Implement, for the calls sent to the address of the
+// callee followed by a slash and path, such as "10.0.0.1:2001/3".
+// Several services can thus share a callee, each with its own functions.
+func (c *Callee) ImplementAt(path string, f interface{}) {
 	if t, v, ok := checkImplTypeAlwaysReturn(f); ok {
 		c.receiver.Register(reflect.Zero(t).Interface())
 		c.sender.Register(reflect.Zero(t).Interface())
 		c.sender.Register(reflect.Zero(v).Interface())
 		c.rw.Lock()
-		c.functions[t] = f
-		c.functionTypes[t] = alwaysRetrun
+		c.functions[route{path, t}] = f
+		c.functionTypes[route{path, t}] = alwaysRetrun
 		c.rw.Unlock()
 		return
 	}
@@ -80,14 +105,26 @@ func (c *Callee) Implement(f interface{}) {
 		c.sender.Register(reflect.Zero(t).Interface())
 		c.sender.Register(reflect.Zero(v).Interface())
 		c.rw.Lock()
-		c.functions[t] = f
-		c.functionTypes[t] = mayReturn
+		c.functions[route{path, t}] = f
+		c.functionTypes[route{path, t}] = mayReturn
 		c.rw.Unlock()
 		return
 	}
 	panic(fmt.Sprintf("rpc.Callee.Implement: invalid function type %T", f))
 }
 
+// Remove removes the functions implemented at path.
+func (c *Callee) Remove(path string) {
+	c.rw.Lock()
+	for r := range c.functions {
+		if r.path == path {
+			delete(c.functions, r)
+			delete(c.functionTypes, r)
+		}
+	}
+	c.rw.Unlock()
+}
+
 // Start starts the Callee
 func (c *Callee) Start() error {
 	return c.receiver.Start()
@@ -98,6 +135,11 @@ func (c *Callee) Stop() {
 	c.receiver.Stop()
 }
 
+// Addr returns the address where the callee receives calls
+func (c *Callee) Addr() string {
+	return c.receiver.Addr()
+}
+
 func (c *Callee) handleCall(addr string, call call) error {
 	argValue := reflect.ValueOf(call.Arg)
 	argType := argValue.Type()
@@ -107,11 +149,15 @@ func (c *Callee) handleCall(addr string, call call) error {
 	} else {
 		callerAddr = changePort(addr, call.CallerPort)
 	}
+	r := route{call.Path, argType}
 	c.rw.RLock()
-	if f, prs := c.functions[argType]; prs {
+	if f, prs := c.functions[r]; prs {
 		fValue := reflect.ValueOf(f)
-		remoteFuncType := c.functionTypes[argType]
+		remoteFuncType := c.functionTypes[r]
 		c.rw.RUnlock()
+		label := method(call.Arg)
+		c.metrics.Add("bitmesh_rpc_handled_total", 1, label)
+		c.log.Debug("rpc: handling call", "method", label.Value, "id", call.ID, "peer", callerAddr)
 		switch remoteFuncType {
 		case alwaysRetrun:
 			out := fValue.Call([]reflect.Value{argValue})
@@ -127,6 +173,9 @@ func (c *Callee) handleCall(addr string, call call) error {
 				call.Arg = arg
 				call.CallerAddr = callerAddr
 				call.IsPassedCall = true
+				c.metrics.Add("bitmesh_rpc_passes_total", 1, label)
+				c.log.Debug("rpc: passing call", "method", label.Value, "id", call.ID, "peer", addr)
+				addr, call.Path = SplitPath(addr)
 				return c.sender.Send(addr, call)
 			}
 			out := fValue.Call([]reflect.Value{argValue, reflect.ValueOf(pass)})
@@ -140,6 +189,7 @@ func (c *Callee) handleCall(addr string, call call) error {
 		}
 	} else {
 		c.rw.RUnlock()
+		c.log.Debug("rpc: no implementation for call", "method", method(call.Arg).Value, "path", call.Path, "id", call.ID, "peer", callerAddr)
 		return nil
 	}
 }
@@ -179,3 +229,15 @@ func changePort(addr string, port uint16) string {
 	}
 	return net.JoinHostPort(host, fmt.Sprintf("%d", port))
 }
+
+func portOf(addr string) uint16 {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		panic(err)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		panic(err)
+	}
+	return uint16(p)
+}
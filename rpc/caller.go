@@ -7,7 +7,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/anteater2/bitmesh/clock"
+	"github.com/anteater2/bitmesh/logging"
 	"github.com/anteater2/bitmesh/message"
+	"github.com/anteater2/bitmesh/metrics"
 )
 
 // Caller represents a caller service where remote functions are declared.
@@ -17,6 +20,9 @@ type Caller struct {
 	port     uint16
 	sender   *message.Sender
 	receiver *message.Receiver
+	clock    clock.Clock
+	metrics  metrics.Metrics
+	log      logging.Logger
 
 	nextID func() uint64
 
@@ -26,21 +32,33 @@ type Caller struct {
 
 // NewCaller creates a new Caller
 func NewCaller(port uint16) (*Caller, error) {
+	return NewCallerWith(port, Config{})
+}
+
+// NewCallerWith creates a new Caller with the given config
+func NewCallerWith(port uint16, config Config) (*Caller, error) {
 	var c Caller
 	var err error
 	c.port = port
+	c.clock = config.clock()
+	c.metrics = metrics.Or(config.Metrics)
+	c.log = logging.Or(config.Logger)
 	c.retChan = make(map[uint64]chan interface{})
 	c.nextID = makeIDGenerator()
-	c.sender = message.NewSender()
-	c.receiver, err = message.NewReceiver(port, func(addr string, v interface{}) {
+	c.sender = message.NewSenderWith(config.message())
+	c.receiver, err = message.NewReceiverWith(port, func(addr string, v interface{}) {
 		reply := v.(reply)
 		c.rw.RLock()
 		ret, prs := c.retChan[reply.ID]
 		c.rw.RUnlock()
 		if prs {
-			ret <- reply.Ret
+			// drop duplicated replies
+			select {
+			case ret <- reply.Ret:
+			default:
+			}
 		}
-	})
+	}, config.message())
 	if err != nil {
 		return nil, err
 	}
@@ -49,11 +67,15 @@ func NewCaller(port uint16) (*Caller, error) {
 	return &c, nil
 }
 
+// ErrTimeout is returned by a RemoteFunc when no return value arrived in time.
+var ErrTimeout = errors.New("rpc: time out")
+
 // RemoteFunc is the type returned by Declare
 type RemoteFunc func(addr string, arg interface{}) (interface{}, error)
 
 // Declare registers a return type and makes a RemoteFunc
 // which sends a call to the specified address and block until return or timeout.
+// The address may end with a path, see Callee.ImplementAt.
 // This RemoteFunc will check the type of arg and the type of retuen value.
 // If the type of arg does not match, it will panic; if the type of return value
 // does not match, it will return an error.
@@ -63,6 +85,7 @@ func (c *Caller) Declare(arg interface{}, ret interface{}, timeout time.Duration
 	c.receiver.Register(ret)
 	argType := reflect.TypeOf(arg)
 	retType := reflect.TypeOf(ret)
+	label := method(arg)
 	return func(addr string, arg interface{}) (interface{}, error) {
 		if reflect.TypeOf(arg) != argType {
 			panic(fmt.Sprintf("rpc.Caller.RemoteFunc: bad argument type: %T (expecting %v)",
@@ -83,9 +106,14 @@ func (c *Caller) Declare(arg interface{}, ret interface{}, timeout time.Duration
 		}()
 
 		// send the call
-		call := call{ID: id, Arg: arg, CallerPort: c.port, IsPassedCall: false}
-		err := c.sender.Send(addr, call)
+		c.metrics.Add("bitmesh_rpc_calls_total", 1, label)
+		start := c.clock.Now()
+		host, path := SplitPath(addr)
+		call := call{ID: id, Arg: arg, CallerPort: c.port, IsPassedCall: false, Path: path}
+		err := c.sender.Send(host, call)
 		if err != nil {
+			c.log.Debug("rpc: could not send call", "method", label.Value, "id", id, "peer", addr, "error", err)
+			c.metrics.Add("bitmesh_rpc_errors_total", 1, label)
 			return nil, err
 		}
 
@@ -93,18 +121,34 @@ func (c *Caller) Declare(arg interface{}, ret interface{}, timeout time.Duration
 		select {
 		case val := <-ret:
 			if reflect.TypeOf(val) != retType {
+				c.log.Warn("rpc: bad return type", "method", label.Value, "id", id, "peer", addr, "type", fmt.Sprintf("%T", val))
+				c.metrics.Add("bitmesh_rpc_errors_total", 1, label)
 				return nil, fmt.Errorf("bad return type: %T (expecting %v)", val, retType)
 			}
+			c.metrics.Observe("bitmesh_rpc_call_seconds", c.clock.Now().Sub(start).Seconds(), label)
 			return val, nil
-		case <-time.After(timeout):
-			return nil, errors.New("time out")
+		case <-c.clock.After(timeout):
+			c.log.Debug("rpc: call timed out", "method", label.Value, "id", id, "peer", addr, "timeout", timeout)
+			c.metrics.Add("bitmesh_rpc_timeouts_total", 1, label)
+			return nil, ErrTimeout
 		}
 	}
 }
 
 // Start starts the caller
 func (c *Caller) Start() error {
-	return c.receiver.Start()
+	err := c.receiver.Start()
+	if err != nil {
+		return err
+	}
+	// the port may have been picked by the system
+	c.port = portOf(c.receiver.Addr())
+	return nil
+}
+
+// Addr returns the address where the caller receives return values
+func (c *Caller) Addr() string {
+	return c.receiver.Addr()
 }
 
 // Stop stops the caller
@@ -1,12 +1,51 @@
 package rpc
 
+import (
+	"fmt"
+	"strings"
+
+	"github.com/anteater2/bitmesh/clock"
+	"github.com/anteater2/bitmesh/logging"
+	"github.com/anteater2/bitmesh/message"
+	"github.com/anteater2/bitmesh/metrics"
+)
+
+// Config holds the optional settings of a Caller or a Callee.
+type Config struct {
+	// Transport defaults to message.TCP.
+	Transport message.Transport
+	// Clock is used for timeouts and defaults to clock.Real.
+	Clock clock.Clock
+	// Metrics defaults to metrics.Discard.  It is shared with the message layer.
+	Metrics metrics.Metrics
+	// Logger defaults to slog.Default().  It is shared with the message layer.
+	Logger logging.Logger
+}
+
+func (c Config) clock() clock.Clock {
+	if c.Clock == nil {
+		return clock.Real
+	}
+	return c.Clock
+}
+
+func (c Config) message() message.Config {
+	return message.Config{Transport: c.Transport, Metrics: c.Metrics, Logger: c.Logger}
+}
+
+// method labels the metrics of a remote function with the type of its argument.
+func method(arg interface{}) metrics.Label {
+	return metrics.Label{Name: "method", Value: fmt.Sprintf("%T", arg)}
+}
+
 // Call represents a remote call
 type call struct {
 	ID           uint64
 	Arg          interface{}
 	CallerPort   uint16
 	CallerAddr   string
-	IsPassedCall bool // indicates whether CallerAddr or sender's address should be used
+	IsPassedCall bool   // indicates whether CallerAddr or sender's address should be used
+	Path         string // picks the functions implemented at a path
 }
 
 // Reply represents a reply to a remote call
@@ -14,3 +53,20 @@ type reply struct {
 	ID  uint64
 	Ret interface{}
 }
+
+// SplitPath splits an address like "10.0.0.1:2001/3" into the network
+// address and the path, which is empty if there is no slash.
+func SplitPath(addr string) (string, string) {
+	if i := strings.IndexByte(addr, '/'); i >= 0 {
+		return addr[:i], addr[i+1:]
+	}
+	return addr, ""
+}
+
+// JoinPath adds a path to a network address, if path is not empty.
+func JoinPath(addr string, path string) string {
+	if path == "" {
+		return addr
+	}
+	return addr + "/" + path
+}
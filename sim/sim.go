@@ -0,0 +1,372 @@
+// Package sim simulates a network and a clock for message, rpc and chord.
+//
+// A Network delivers messages after a random latency and may lose, duplicate
+// or reorder them, or cut hosts off from each other.  All of the randomness
+// comes from the seed and the messages themselves, and time only moves when
+// the Network says so, so a scenario that runs on nothing but the Network's
+// transports and clock can be replayed from its seed.
+//
+// A Network runs inside a bubble of package testing/synctest.  Its driver
+// goroutine waits until every other goroutine of the bubble is durably
+// blocked, then fires the next pending event, one at a time.  Code that
+// waits on something other than the Network, or that wakes several
+// goroutines at once from one event, can still make a replay diverge.
+package sim
+
+import (
+	"container/heap"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+	"testing/synctest"
+	"time"
+
+	"github.com/anteater2/bitmesh/message"
+)
+
+// Config describes how badly a simulated network behaves.
+type Config struct {
+	// Seed drives every random decision of the network.
+	Seed int64
+	// Every message takes between MinLatency and MaxLatency to arrive.
+	MinLatency time.Duration
+	MaxLatency time.Duration
+	// LossRate is the probability that a message is dropped.
+	LossRate float64
+	// DuplicateRate is the probability that a message is delivered twice.
+	DuplicateRate float64
+	// ReorderRate is the probability that a message is held back for an extra
+	// MaxLatency, so that the messages sent after it overtake it.
+	ReorderRate float64
+	// Trace, if set, is called with every message delivered, in order.
+	Trace func(at time.Time, from string, to string, data []byte)
+}
+
+// Epoch is the virtual time at which every Network starts.
+var Epoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// firstPort is the first port handed out to listeners that ask for port 0.
+const firstPort = 40000
+
+// Network is a simulated network with a virtual clock.
+// It implements clock.Clock; Host returns its message.Transport.
+type Network struct {
+	config Config
+
+	now       time.Time
+	events    eventQueue
+	seq       uint64
+	listeners map[string]*listener
+	sent      map[uint64]uint64 // copies of every message sent so far, by hash
+	groups    map[string]int    // host -> partition group; missing hosts are in group 0
+	ports     map[string]uint16
+	closed    bool
+	mutex     sync.Mutex
+	cond      *sync.Cond
+
+	done chan struct{}
+}
+
+// New creates a network and starts driving its clock.  It must be called
+// inside a bubble of package testing/synctest, see synctest.Test.
+func New(config Config) *Network {
+	if config.MaxLatency < config.MinLatency {
+		config.MaxLatency = config.MinLatency
+	}
+	n := &Network{
+		config:    config,
+		now:       Epoch,
+		listeners: make(map[string]*listener),
+		sent:      make(map[uint64]uint64),
+		groups:    make(map[string]int),
+		ports:     make(map[string]uint16),
+		done:      make(chan struct{}),
+	}
+	n.cond = sync.NewCond(&n.mutex)
+	go n.drive()
+	return n
+}
+
+// Close stops the clock.  Pending messages are dropped, and pending timers
+// fire at once, so that nothing waits on the clock forever; so do the timers
+// set after Close.
+func (n *Network) Close() {
+	n.mutex.Lock()
+	n.closed = true
+	n.cond.Broadcast()
+	n.mutex.Unlock()
+	<-n.done
+}
+
+// Now returns the virtual time.
+func (n *Network) Now() time.Time {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.now
+}
+
+// After sends the virtual time on the returned channel once d has passed.
+func (n *Network) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.closed {
+		ch <- n.now
+		return ch
+	}
+	n.push(&event{
+		at:    n.now.Add(d),
+		timer: true,
+		fire: func(now time.Time) {
+			ch <- now
+		},
+	})
+	return ch
+}
+
+// Host returns the transport of the host with the given IP.
+// Messages sent through it come from that IP.
+func (n *Network) Host(ip string) message.Transport {
+	return &host{network: n, ip: ip}
+}
+
+// Partition splits the hosts into groups that cannot reach each other.
+// Hosts that are not listed form one more group.  Messages already on their
+// way across the new borders are lost.
+func (n *Network) Partition(groups ...[]string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, ip := range group {
+			n.groups[ip] = i + 1
+		}
+	}
+}
+
+// Heal removes all partitions.
+func (n *Network) Heal() {
+	n.Partition()
+}
+
+// push schedules an event.  The caller must hold the mutex.
+func (n *Network) push(e *event) {
+	e.seq = n.seq
+	n.seq++
+	heap.Push(&n.events, e)
+	n.cond.Broadcast()
+}
+
+func (n *Network) reachable(from string, to string) bool {
+	return n.groups[from] == n.groups[to]
+}
+
+// drive moves the clock forward one event at a time.  Before each, it lets
+// everything that the last one woke up run until it waits again, so that the
+// order of the events does not depend on the scheduler.
+func (n *Network) drive() {
+	defer close(n.done)
+	for {
+		synctest.Wait()
+		n.mutex.Lock()
+		if n.closed {
+			events := n.events
+			n.events = nil
+			n.mutex.Unlock()
+			for _, e := range events {
+				if e.timer {
+					e.fire(n.now)
+				}
+			}
+			return
+		}
+		if len(n.events) == 0 {
+			n.cond.Wait()
+			n.mutex.Unlock()
+			continue
+		}
+		e := heap.Pop(&n.events).(*event)
+		n.now = e.at
+		n.mutex.Unlock()
+		e.fire(e.at)
+	}
+}
+
+/*****************************************************************************
+ * Transport                                                                 *
+ *****************************************************************************/
+
+type host struct {
+	network *Network
+	ip      string
+}
+
+type listener struct {
+	network *Network
+	addr    string
+	handle  func(string, []byte)
+}
+
+// splitmix is a small source of random numbers, seeded for every message.
+type splitmix uint64
+
+func (s *splitmix) Uint64() uint64 {
+	*s += 0x9e3779b97f4a7c15
+	z := uint64(*s)
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return z ^ z>>31
+}
+
+func (s *splitmix) Int63() int64 { return int64(s.Uint64() >> 1) }
+
+func (s *splitmix) Seed(seed int64) { *s = splitmix(seed) }
+
+func (h *host) Listen(port uint16, handle func(string, []byte)) (message.Listener, error) {
+	n := h.network
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if port == 0 {
+		if n.ports[h.ip] == 0 {
+			n.ports[h.ip] = firstPort
+		}
+		for n.listeners[net.JoinHostPort(h.ip, fmt.Sprint(n.ports[h.ip]))] != nil {
+			n.ports[h.ip]++
+		}
+		port = n.ports[h.ip]
+	}
+	addr := net.JoinHostPort(h.ip, fmt.Sprint(port))
+	if n.listeners[addr] != nil {
+		return nil, fmt.Errorf("sim: listen %s: address already in use", addr)
+	}
+	l := &listener{network: n, addr: addr, handle: handle}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+func (h *host) Send(addr string, data []byte) error {
+	n := h.network
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	to, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if !n.reachable(h.ip, to) {
+		return nil
+	}
+	if n.listeners[addr] == nil {
+		return fmt.Errorf("sim: dial %s: connection refused", addr)
+	}
+	// The fate of a message depends on the seed, its link, its content and
+	// how many times it was sent before, not on the order in which goroutines
+	// send, so that concurrent sends replay the same.
+	name := h.ip + ">" + addr
+	hash := fnv.New64a()
+	hash.Write([]byte(name))
+	hash.Write([]byte{0})
+	hash.Write(data)
+	sum := hash.Sum64()
+	n.sent[sum]++
+	source := splitmix(uint64(n.config.Seed) ^ sum ^ n.sent[sum]<<32)
+	r := rand.New(&source)
+	if r.Float64() < n.config.LossRate {
+		return nil
+	}
+	copies := 1
+	if r.Float64() < n.config.DuplicateRate {
+		copies = 2
+	}
+	data = append([]byte(nil), data...)
+	from := net.JoinHostPort(h.ip, "0")
+	for i := 0; i < copies; i++ {
+		latency := n.config.MinLatency
+		if spread := n.config.MaxLatency - n.config.MinLatency; spread > 0 {
+			latency += time.Duration(r.Int63n(int64(spread)))
+		}
+		if r.Float64() < n.config.ReorderRate {
+			latency += n.config.MaxLatency
+		}
+		n.push(&event{
+			at:  n.now.Add(latency),
+			key: fmt.Sprintf("%s#%x.%d.%d", name, sum, n.sent[sum], i),
+			fire: func(time.Time) {
+				n.deliver(from, to, addr, data)
+			},
+		})
+	}
+	return nil
+}
+
+func (n *Network) deliver(from string, to string, addr string, data []byte) {
+	n.mutex.Lock()
+	l := n.listeners[addr]
+	fromIP, _, _ := net.SplitHostPort(from)
+	ok := l != nil && n.reachable(fromIP, to)
+	now := n.now
+	n.mutex.Unlock()
+	if ok {
+		if n.config.Trace != nil {
+			n.config.Trace(now, from, addr, data)
+		}
+		l.handle(from, data)
+	}
+}
+
+func (l *listener) Addr() string {
+	return l.addr
+}
+
+func (l *listener) Close() error {
+	n := l.network
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.listeners[l.addr] == l {
+		delete(n.listeners, l.addr)
+	}
+	return nil
+}
+
+/*****************************************************************************
+ * Event queue                                                               *
+ *****************************************************************************/
+
+type event struct {
+	at    time.Time
+	timer bool
+	key   string // orders messages that arrive at the same time
+	seq   uint64
+	fire  func(now time.Time)
+}
+
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+
+func (q eventQueue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	// Timers first, then messages in an order that does not depend on which
+	// goroutine happened to send first.
+	if q[i].timer != q[j].timer {
+		return q[i].timer
+	}
+	if q[i].key != q[j].key {
+		return q[i].key < q[j].key
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(*event)) }
+
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,141 @@
+package sim_test
+
+import (
+	"fmt"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/anteater2/bitmesh/sim"
+)
+
+type delivery struct {
+	at   time.Duration
+	data string
+}
+
+// exchange sends count messages from one host to another and records what arrives.
+func exchange(t *testing.T, config sim.Config, count int) []delivery {
+	network := sim.New(config)
+	defer network.Close()
+	received := make(chan delivery, 2*count)
+	l, err := network.Host("10.0.0.2").Listen(0, func(from string, data []byte) {
+		if from != "10.0.0.1:0" {
+			t.Errorf("message from %s", from)
+		}
+		received <- delivery{network.Now().Sub(sim.Epoch), string(data)}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	sender := network.Host("10.0.0.1")
+	for i := 0; i < count; i++ {
+		if err := sender.Send(l.Addr(), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// everything has arrived once the virtual clock passes the maximum delay
+	<-network.After(3 * config.MaxLatency)
+	close(received)
+	deliveries := []delivery{}
+	for d := range received {
+		deliveries = append(deliveries, d)
+	}
+	return deliveries
+}
+
+func TestLatency(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		config := sim.Config{Seed: 1, MinLatency: 10 * time.Millisecond, MaxLatency: 20 * time.Millisecond}
+		deliveries := exchange(t, config, 100)
+		if len(deliveries) != 100 {
+			t.Fatalf("%d messages delivered, expecting 100", len(deliveries))
+		}
+		for _, d := range deliveries {
+			if d.at < config.MinLatency || d.at >= config.MaxLatency {
+				t.Errorf("message %s took %v", d.data, d.at)
+			}
+		}
+	})
+}
+
+func TestLossAndDuplication(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		config := sim.Config{Seed: 1, MaxLatency: time.Millisecond, LossRate: 0.2, DuplicateRate: 0.2}
+		deliveries := exchange(t, config, 1000)
+		seen := make(map[string]int)
+		for _, d := range deliveries {
+			seen[d.data]++
+		}
+		duplicated := 0
+		for _, n := range seen {
+			if n > 1 {
+				duplicated++
+			}
+		}
+		if lost := 1000 - len(seen); lost < 100 || lost > 300 {
+			t.Errorf("%d messages lost, expecting about 200", lost)
+		}
+		if duplicated < 100 || duplicated > 250 {
+			t.Errorf("%d messages duplicated, expecting about 160", duplicated)
+		}
+	})
+}
+
+func TestReplay(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		config := sim.Config{
+			Seed:          42,
+			MinLatency:    time.Millisecond,
+			MaxLatency:    50 * time.Millisecond,
+			LossRate:      0.1,
+			DuplicateRate: 0.1,
+			ReorderRate:   0.1,
+		}
+		first := exchange(t, config, 200)
+		second := exchange(t, config, 200)
+		if fmt.Sprint(first) != fmt.Sprint(second) {
+			t.Fatalf("same seed, different runs:\n%v\n%v", first, second)
+		}
+		config.Seed = 43
+		if third := exchange(t, config, 200); fmt.Sprint(first) == fmt.Sprint(third) {
+			t.Fatal("different seeds, same run")
+		}
+	})
+}
+
+func TestPartition(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		network := sim.New(sim.Config{MaxLatency: time.Millisecond})
+		defer network.Close()
+		received := make(chan string, 10)
+		l, err := network.Host("10.0.0.2").Listen(2001, func(from string, data []byte) {
+			received <- string(data)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		sender := network.Host("10.0.0.1")
+
+		network.Partition([]string{"10.0.0.1"})
+		sender.Send("10.0.0.2:2001", []byte("lost"))
+		<-network.After(time.Second)
+		network.Heal()
+		sender.Send("10.0.0.2:2001", []byte("delivered"))
+		<-network.After(time.Second)
+		close(received)
+		got := []string{}
+		for data := range received {
+			got = append(got, data)
+		}
+		if fmt.Sprint(got) != "[delivered]" {
+			t.Fatalf("received %v, expecting [delivered]", got)
+		}
+
+		if err := sender.Send("10.0.0.2:2002", nil); err == nil {
+			t.Fatal("sending to a closed port should fail")
+		}
+	})
+}
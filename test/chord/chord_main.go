@@ -3,14 +3,32 @@ package main
 import (
 	"flag"
 	"log"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/chord/admin"
+	"github.com/anteater2/bitmesh/chord/balance"
+	"github.com/anteater2/bitmesh/dht"
+	"github.com/anteater2/bitmesh/dht/gateway"
+	"github.com/anteater2/bitmesh/metrics"
 )
 
 func main() {
 	var bits uint64
 	var introducer string
+	var verbose bool
+	var adminAddr string
+	var gatewayAddr string
+	var vnodes int
+	var replicas int
+	var ids string
+	var balanceInterval time.Duration
 	flag.Uint64Var(
 		&bits,
 		"n",
@@ -22,19 +40,149 @@ func main() {
 		&introducer,
 		"c",
 		"",
-		"Create a new node and connect to the specified ring address",
+		"Create a new node and connect to the ring through any of the comma-separated addresses",
+	)
+
+	flag.BoolVar(
+		&verbose,
+		"v",
+		false,
+		"Log every call and every key, not only changes to the ring",
+	)
+
+	flag.StringVar(
+		&adminAddr,
+		"admin",
+		"",
+		"Serve the admin HTTP API on the specified address, such as :8080",
+	)
+
+	flag.StringVar(
+		&gatewayAddr,
+		"gateway",
+		"",
+		"Serve the DHT over HTTP on the specified address, such as :8000",
+	)
+
+	flag.IntVar(
+		&vnodes,
+		"vnodes",
+		1,
+		"Run this many virtual nodes on the same ports; the admin API can change it with POST /vnodes?count=N",
+	)
+
+	flag.IntVar(
+		&replicas,
+		"replicas",
+		1,
+		"Store every key on this many nodes, the owner and its successors",
+	)
+
+	flag.StringVar(
+		&ids,
+		"ids",
+		"",
+		"Place the node, or its virtual nodes in order, at the comma-separated keyspace positions instead of the hash of its address",
+	)
+
+	flag.DurationVar(
+		&balanceInterval,
+		"balance",
+		0,
+		"Move the virtual nodes into the arcs of loaded nodes, probing every interval, such as 30s",
 	)
 
 	flag.Parse()
-	err := chord.Start(getOutboundIP(), 2001, 2000, bits)
-	if err != nil {
-		panic(err)
+	level := slog.LevelInfo
+	if verbose {
+		level = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	registry := metrics.NewRegistry()
+	config := chord.Config{
+		Addr:         getOutboundIP(),
+		CalleePort:   2001,
+		CallerPort:   2000,
+		Bits:         bits,
+		VirtualNodes: vnodes,
+		Replicas:     replicas,
+		Logger:       logger,
+		Metrics:      registry,
 	}
-	if introducer != "" {
-		err = chord.Join(introducer)
+	if ids != "" {
+		for _, id := range strings.Split(ids, ",") {
+			key, err := strconv.ParseUint(id, 10, 64)
+			if err != nil {
+				panic(err)
+			}
+			config.IDs = append(config.IDs, chord.NewKey(key))
+		}
+	}
+	var address string
+	var handler http.Handler
+	if vnodes > 1 || balanceInterval > 0 {
+		host, err := chord.NewHost(config)
+		if err != nil {
+			panic(err)
+		}
+		err = host.Start()
+		if err != nil {
+			panic(err)
+		}
+		if introducer != "" {
+			err = host.JoinAny(strings.Split(introducer, ","))
+			if err != nil {
+				panic(err)
+			}
+		}
+		if balanceInterval > 0 {
+			b, err := balance.NewWith(host, 0, balance.Config{Interval: balanceInterval, Logger: logger, Metrics: registry})
+			if err != nil {
+				panic(err)
+			}
+			err = b.Start()
+			if err != nil {
+				panic(err)
+			}
+		}
+		address = host.Address()
+		handler = admin.HostHandler(host, registry)
+	} else {
+		node, err := chord.NewNode(config)
+		if err != nil {
+			panic(err)
+		}
+		err = node.Start()
+		if err != nil {
+			panic(err)
+		}
+		if introducer != "" {
+			err = node.JoinAny(strings.Split(introducer, ","))
+			if err != nil {
+				panic(err)
+			}
+		}
+		address = node.Address()
+		handler = admin.Handler(node, registry)
+	}
+	if adminAddr != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(adminAddr, handler))
+		}()
+	}
+	if gatewayAddr != "" {
+		// The gateway enters the ring through this node.
+		d, err := dht.New(address, 0, bits)
+		if err != nil {
+			panic(err)
+		}
+		err = d.Start()
 		if err != nil {
 			panic(err)
 		}
+		go func() {
+			log.Fatal(http.ListenAndServe(gatewayAddr, gateway.Handler(d)))
+		}()
 	}
 	select {}
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/anteater2/bitmesh/chord"
+	"github.com/anteater2/bitmesh/chord/crawl"
+	"github.com/anteater2/bitmesh/chord/topology"
+)
+
+// crawl walks the ring from one or more seed nodes and prints what it found.
+// It exits with status 1 if an invariant is broken and 2 if a seed cannot be crawled.
+func main() {
+	var bits uint64
+	var seeds string
+	var port uint
+	var format string
+	var fingers bool
+	flag.Uint64Var(&bits, "n", 10, "The keyspace of the ring has size 2^numBits")
+	flag.StringVar(&seeds, "s", "172.17.0.2:2001", "Comma separated addresses of the nodes to start crawling from")
+	flag.UintVar(&port, "p", 0, "The port to receive replies on, 0 picks a free port")
+	flag.StringVar(&format, "f", "report", "Output format: report (JSON crawl reports), json (JSON topology) or dot")
+	flag.BoolVar(&fingers, "fingers", false, "Include finger edges in the topology")
+	flag.Parse()
+
+	caller, err := chord.NewNodeCaller(uint16(port))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	err = caller.Start()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	reports := []*crawl.Report{}
+	ok := true
+	for _, seed := range strings.Split(seeds, ",") {
+		report, err := crawl.Crawl(caller, seed, bits)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		reports = append(reports, report)
+		ok = ok && report.OK()
+	}
+	caller.Stop()
+
+	switch format {
+	case "report":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if len(reports) == 1 {
+			enc.Encode(reports[0])
+		} else {
+			enc.Encode(reports)
+		}
+	case "json":
+		topology.FromReports(reports, fingers).WriteJSON(os.Stdout)
+	case "dot":
+		topology.FromReports(reports, fingers).WriteDOT(os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", format)
+		os.Exit(2)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
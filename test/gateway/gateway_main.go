@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/anteater2/bitmesh/dht"
+	"github.com/anteater2/bitmesh/dht/gateway"
+	"github.com/anteater2/bitmesh/dht/resp"
+)
+
+// gateway serves the DHT of a ring over HTTP, and optionally over the Redis protocol.
+func main() {
+	var bits uint64
+	var ring string
+	var port uint
+	var addr string
+	var respAddr string
+	var replicas, readQuorum, writeQuorum int
+	flag.Uint64Var(&bits, "n", 10, "The keyspace of the ring has size 2^numBits")
+	flag.StringVar(&ring, "c", "172.17.0.2:2001", "The addresses of nodes of the ring, comma-separated")
+	flag.UintVar(&port, "p", 0, "The port to receive replies on, 0 picks a free port")
+	flag.StringVar(&addr, "l", ":8000", "The address to serve HTTP on")
+	flag.StringVar(&respAddr, "resp", "", "The address to serve the Redis protocol on, such as :6379")
+	flag.IntVar(&replicas, "replicas", 1, "The number of nodes to read and write each key on, with -replicas on the nodes")
+	flag.IntVar(&readQuorum, "r", 0, "The number of replicas a read waits for, 0 for a majority")
+	flag.IntVar(&writeQuorum, "w", 0, "The number of replicas a write waits for, 0 for a majority")
+	flag.Parse()
+
+	seeds := strings.Split(ring, ",")
+	d, err := dht.NewWith(seeds[0], uint16(port), bits, dht.Config{
+		Seeds:       seeds[1:],
+		Replicas:    replicas,
+		ReadQuorum:  readQuorum,
+		WriteQuorum: writeQuorum,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = d.Start()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if respAddr != "" {
+		fmt.Printf("Serving the DHT of %s over RESP on %s\n", ring, respAddr)
+		go func() {
+			log.Fatal(resp.NewServer(d).ListenAndServe(respAddr))
+		}()
+	}
+	fmt.Printf("Serving the DHT of %s on %s\n", ring, addr)
+	log.Fatal(http.ListenAndServe(addr, gateway.Handler(d)))
+}